@@ -2,8 +2,10 @@ package bencoding
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 )
 
@@ -52,7 +54,15 @@ func bencodeMap(m map[string]interface{}) ([]byte, error) {
 	bencodedChunks := make([][]byte, 0, len(m)*2+2)
 	bencodedChunks = append(bencodedChunks, []byte("d"))
 
-	for k, v := range m {
+	// Keys have to be sorted as raw strings
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := m[k]
 		bencodedK := bencodeBytes([]byte(k))
 		bencodedV, err := Encode(v)
 		if err != nil {
@@ -79,7 +89,16 @@ func Decode(data []byte) (interface{}, error) {
 	return item, nil
 }
 
+// Decodes a single item from the start of data, returning whatever follows it
+func DecodePartial(data []byte) (interface{}, []byte, error) {
+	return bdecode(data)
+}
+
 func bdecode(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errors.New("Unexpected end of data")
+	}
+
 	firstByte := data[0]
 	switch {
 	case firstByte == 'i':
@@ -120,7 +139,7 @@ func decodeBytes(data []byte) ([]byte, []byte, error) {
 		return nil, nil, fmt.Errorf("Invalid string length. Left: %d. Error: %s", len(data), err)
 	}
 
-	if len(split[1]) < length {
+	if length < 0 || len(split[1]) < length {
 		return nil, nil, fmt.Errorf("String too short. Left: %d. Expected: %d", len(split[1]), length)
 	}
 
@@ -132,13 +151,16 @@ func decodeList(data []byte) ([]interface{}, []byte, error) {
 	var item interface{}
 	var err error
 
-	for data[0] != 'e' {
+	for len(data) > 0 && data[0] != 'e' {
 		item, data, err = bdecode(data)
 		if err != nil {
 			return nil, nil, err
 		}
 		items = append(items, item)
 	}
+	if len(data) == 0 {
+		return nil, nil, errors.New("Failed to find list end")
+	}
 
 	return items, data[1:], nil
 }
@@ -149,7 +171,7 @@ func decodeMap(data []byte) (map[string]interface{}, []byte, error) {
 	var value interface{}
 	var err error
 
-	for data[0] != 'e' {
+	for len(data) > 0 && data[0] != 'e' {
 		_key, data, err = decodeBytes(data)
 		if err != nil {
 			return nil, nil, err
@@ -162,6 +184,9 @@ func decodeMap(data []byte) (map[string]interface{}, []byte, error) {
 		}
 		m[string(key)] = value
 	}
+	if len(data) == 0 {
+		return nil, nil, errors.New("Failed to find map end")
+	}
 
 	return m, data[1:], nil
 }
@@ -82,8 +82,9 @@ func TestEncodeMap(t *testing.T) {
 				"bar": []interface{}{1, 2, map[string]interface{}{"spam": "eggs"}},
 			},
 		},
+		map[string]interface{}{"spam": 1, "foo": 2, "bar": 3, "eggs": 4},
 	}
-	expectedOutputs := []string{"de", "d3:food3:bardeee", "d3:food3:barli1ei2ed4:spam4:eggseeee"}
+	expectedOutputs := []string{"de", "d3:food3:bardeee", "d3:food3:barli1ei2ed4:spam4:eggseeee", "d3:bari3e4:eggsi4e3:fooi2e4:spami1ee"}
 
 	for i, input := range inputs {
 		output, err := Encode(input)
@@ -167,3 +168,30 @@ func TestDecodeMap(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeTruncated(t *testing.T) {
+	inputs := []string{"", "l", "li1e", "d3:foo", "d3:fooi3e", "5:spam", "-1:"}
+
+	for _, input := range inputs {
+		_, err := Decode([]byte(input))
+		if err == nil {
+			t.Fatalf("Expected error for input: %q", input)
+		}
+	}
+}
+
+func TestDecodePartial(t *testing.T) {
+	input := []byte("d3:fooi3eeleftover")
+
+	_output, leftover, err := DecodePartial(input)
+	if err != nil {
+		t.Fatalf("Failed to decode input. Error: %s", err)
+	}
+	output := _output.(map[string]interface{})
+	if output["foo"] != 3 {
+		t.Fatalf("Expected 3. Got: %v", output["foo"])
+	}
+	if string(leftover) != "leftover" {
+		t.Fatalf("Expected leftover. Got: %s", leftover)
+	}
+}
@@ -0,0 +1,227 @@
+package bitfield
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gobby/pwp"
+	"math/bits"
+)
+
+// Piece availability, one bit per piece with the highest bit of the first byte being piece 0
+type Bitfield struct {
+	bits   []byte
+	length int
+}
+
+func New(length int) *Bitfield {
+	return &Bitfield{
+		bits:   make([]byte, (length+7)/8),
+		length: length,
+	}
+}
+
+// Validates the encoded bitfield against the piece count, rejecting set spare bits
+func FromBytes(data []byte, length int) (*Bitfield, error) {
+	if len(data) != (length+7)/8 {
+		return nil, fmt.Errorf("Invalid bitfield length %d for %d pieces", len(data), length)
+	}
+	if spare := length % 8; spare != 0 && data[len(data)-1]&(0xff>>uint(spare)) != 0 {
+		return nil, errors.New("Spare bits set in bitfield")
+	}
+
+	b := New(length)
+	copy(b.bits, data)
+	return b, nil
+}
+
+// Converts a BitfieldMsg, HaveAllMsg or HaveNoneMsg
+func FromMessage(message pwp.Message, length int) (*Bitfield, error) {
+	switch msg := message.(type) {
+	case *pwp.BitfieldMsg:
+		return FromBytes(msg.Bitfield, length)
+	case *pwp.HaveAllMsg:
+		b := New(length)
+		b.SetAll()
+		return b, nil
+	case *pwp.HaveNoneMsg:
+		return New(length), nil
+	default:
+		return nil, fmt.Errorf("Not a bitfield message: %T", message)
+	}
+}
+
+// The most compact message announcing the bitfield. HaveAll and HaveNone require the fast extension
+func (b *Bitfield) Message(fast bool) pwp.Message {
+	if fast && b.Full() {
+		return &pwp.HaveAllMsg{}
+	}
+	if fast && b.Empty() {
+		return &pwp.HaveNoneMsg{}
+	}
+	return &pwp.BitfieldMsg{Bitfield: b.Bytes()}
+}
+
+func (b *Bitfield) Len() int {
+	return b.length
+}
+
+func (b *Bitfield) Bytes() []byte {
+	data := make([]byte, len(b.bits))
+	copy(data, b.bits)
+	return data
+}
+
+func (b *Bitfield) Copy() *Bitfield {
+	return &Bitfield{
+		bits:   b.Bytes(),
+		length: b.length,
+	}
+}
+
+func (b *Bitfield) Has(index int) bool {
+	if index < 0 || index >= b.length {
+		return false
+	}
+	return b.bits[index/8]&(0x80>>uint(index%8)) != 0
+}
+
+func (b *Bitfield) Set(index int) {
+	if index < 0 || index >= b.length {
+		return
+	}
+	b.bits[index/8] |= 0x80 >> uint(index%8)
+}
+
+func (b *Bitfield) Clear(index int) {
+	if index < 0 || index >= b.length {
+		return
+	}
+	b.bits[index/8] &^= 0x80 >> uint(index%8)
+}
+
+func (b *Bitfield) SetAll() {
+	for i := range b.bits {
+		b.bits[i] = 0xff
+	}
+	if spare := b.length % 8; spare != 0 {
+		b.bits[len(b.bits)-1] = 0xff << uint(8-spare)
+	}
+}
+
+func (b *Bitfield) Count() int {
+	count := 0
+	data := b.bits
+	for len(data) >= 8 {
+		count += bits.OnesCount64(binary.BigEndian.Uint64(data))
+		data = data[8:]
+	}
+	for _, x := range data {
+		count += bits.OnesCount8(x)
+	}
+	return count
+}
+
+func (b *Bitfield) Full() bool {
+	return b.Count() == b.length
+}
+
+func (b *Bitfield) Empty() bool {
+	for _, x := range b.bits {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Index of the first set bit at or after from, -1 if there is none
+func (b *Bitfield) Next(from int) int {
+	if from < 0 {
+		from = 0
+	}
+	if from >= b.length {
+		return -1
+	}
+
+	i := from / 8
+	// Bits before from in the first byte are masked out
+	x := b.bits[i] & (0xff >> uint(from%8))
+	for {
+		if x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+		i++
+		for i+8 <= len(b.bits) && binary.BigEndian.Uint64(b.bits[i:]) == 0 {
+			i += 8
+		}
+		if i >= len(b.bits) {
+			return -1
+		}
+		x = b.bits[i]
+	}
+}
+
+// Pieces in both bitfields
+func (b *Bitfield) And(other *Bitfield) *Bitfield {
+	result := New(b.length)
+	n := len(b.bits)
+	if len(other.bits) < n {
+		n = len(other.bits)
+	}
+
+	i := 0
+	for ; i+8 <= n; i += 8 {
+		x := binary.LittleEndian.Uint64(b.bits[i:]) & binary.LittleEndian.Uint64(other.bits[i:])
+		binary.LittleEndian.PutUint64(result.bits[i:], x)
+	}
+	for ; i < n; i++ {
+		result.bits[i] = b.bits[i] & other.bits[i]
+	}
+	return result
+}
+
+// Pieces in this bitfield but not the other, e.g. pieces a peer has that we want
+func (b *Bitfield) AndNot(other *Bitfield) *Bitfield {
+	result := b.Copy()
+	n := len(b.bits)
+	if len(other.bits) < n {
+		n = len(other.bits)
+	}
+
+	i := 0
+	for ; i+8 <= n; i += 8 {
+		x := binary.LittleEndian.Uint64(b.bits[i:]) &^ binary.LittleEndian.Uint64(other.bits[i:])
+		binary.LittleEndian.PutUint64(result.bits[i:], x)
+	}
+	for ; i < n; i++ {
+		result.bits[i] = b.bits[i] &^ other.bits[i]
+	}
+	return result
+}
+
+// Whether this bitfield has any piece the other doesn't, without allocating
+func (b *Bitfield) AnyNotIn(other *Bitfield) bool {
+	n := len(b.bits)
+	if len(other.bits) < n {
+		n = len(other.bits)
+	}
+
+	i := 0
+	for ; i+8 <= n; i += 8 {
+		if binary.LittleEndian.Uint64(b.bits[i:])&^binary.LittleEndian.Uint64(other.bits[i:]) != 0 {
+			return true
+		}
+	}
+	for ; i < n; i++ {
+		if b.bits[i]&^other.bits[i] != 0 {
+			return true
+		}
+	}
+	for ; i < len(b.bits); i++ {
+		if b.bits[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
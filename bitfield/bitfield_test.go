@@ -0,0 +1,194 @@
+package bitfield
+
+import (
+	"bytes"
+	"gobby/pwp"
+	"testing"
+)
+
+const (
+	_BENCHMARK_LENGTH = 1000000
+)
+
+func TestSetHasClear(t *testing.T) {
+	b := New(20)
+	b.Set(0)
+	b.Set(9)
+	b.Set(19)
+	b.Set(20)
+	b.Set(-1)
+
+	if !b.Has(0) || !b.Has(9) || !b.Has(19) || b.Has(1) || b.Has(20) {
+		t.Fatalf("Unexpected bits: %x", b.Bytes())
+	}
+	if !bytes.Equal(b.Bytes(), []byte{0x80, 0x40, 0x10}) {
+		t.Fatalf("Expected 804010. Got: %x", b.Bytes())
+	}
+
+	b.Clear(9)
+	if b.Has(9) || b.Count() != 2 {
+		t.Fatalf("Expected bit 9 to be cleared. Got: %x", b.Bytes())
+	}
+}
+
+func TestFromBytes(t *testing.T) {
+	b, err := FromBytes([]byte{0xff, 0xe0}, 11)
+	if err != nil {
+		t.Fatalf("Failed to decode bitfield: %s", err)
+	}
+	if !b.Full() {
+		t.Fatalf("Expected full bitfield")
+	}
+
+	if _, err := FromBytes([]byte{0xff, 0xf0}, 11); err == nil {
+		t.Fatalf("Expected error for set spare bits")
+	}
+	if _, err := FromBytes([]byte{0xff}, 11); err == nil {
+		t.Fatalf("Expected error for short bitfield")
+	}
+	if _, err := FromBytes([]byte{0xff, 0x00, 0x00}, 11); err == nil {
+		t.Fatalf("Expected error for long bitfield")
+	}
+}
+
+func TestMessages(t *testing.T) {
+	b := New(10)
+	if _, ok := b.Message(true).(*pwp.HaveNoneMsg); !ok {
+		t.Fatalf("Expected HaveNone for empty bitfield")
+	}
+	if _, ok := b.Message(false).(*pwp.BitfieldMsg); !ok {
+		t.Fatalf("Expected Bitfield without fast extension")
+	}
+
+	b.SetAll()
+	if !bytes.Equal(b.Bytes(), []byte{0xff, 0xc0}) {
+		t.Fatalf("Expected ffc0. Got: %x", b.Bytes())
+	}
+	if _, ok := b.Message(true).(*pwp.HaveAllMsg); !ok {
+		t.Fatalf("Expected HaveAll for full bitfield")
+	}
+
+	for _, message := range []pwp.Message{&pwp.HaveAllMsg{}, &pwp.BitfieldMsg{Bitfield: []byte{0xff, 0xc0}}} {
+		decoded, err := FromMessage(message, 10)
+		if err != nil {
+			t.Fatalf("Failed to convert %T: %s", message, err)
+		}
+		if !decoded.Full() {
+			t.Fatalf("Expected full bitfield from %T", message)
+		}
+	}
+	decoded, err := FromMessage(&pwp.HaveNoneMsg{}, 10)
+	if err != nil || !decoded.Empty() {
+		t.Fatalf("Expected empty bitfield. Got: %v, %v", decoded, err)
+	}
+	if _, err := FromMessage(&pwp.ChokeMsg{}, 10); err == nil {
+		t.Fatalf("Expected error for non bitfield message")
+	}
+}
+
+func TestNext(t *testing.T) {
+	b := New(200)
+	indexes := []int{3, 7, 8, 150, 199}
+	for _, index := range indexes {
+		b.Set(index)
+	}
+
+	found := make([]int, 0)
+	for i := b.Next(0); i >= 0; i = b.Next(i + 1) {
+		found = append(found, i)
+	}
+	if len(found) != len(indexes) {
+		t.Fatalf("Expected %v. Got: %v", indexes, found)
+	}
+	for i := range indexes {
+		if found[i] != indexes[i] {
+			t.Fatalf("Expected %v. Got: %v", indexes, found)
+		}
+	}
+	if b.Next(200) != -1 {
+		t.Fatalf("Expected -1 past the end")
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	theirs, _ := FromBytes([]byte{0xf0, 0x80}, 9)
+	ours, _ := FromBytes([]byte{0x30, 0x00}, 9)
+
+	wanted := theirs.AndNot(ours)
+	if !bytes.Equal(wanted.Bytes(), []byte{0xc0, 0x80}) {
+		t.Fatalf("Expected c080. Got: %x", wanted.Bytes())
+	}
+	common := theirs.And(ours)
+	if !bytes.Equal(common.Bytes(), []byte{0x30, 0x00}) {
+		t.Fatalf("Expected 3000. Got: %x", common.Bytes())
+	}
+	if !theirs.AnyNotIn(ours) || ours.AnyNotIn(theirs) {
+		t.Fatalf("Unexpected AnyNotIn results")
+	}
+	if !bytes.Equal(theirs.Bytes(), []byte{0xf0, 0x80}) {
+		t.Fatalf("Expected operands to be unchanged. Got: %x", theirs.Bytes())
+	}
+}
+
+func benchmarkBitfield() *Bitfield {
+	b := New(_BENCHMARK_LENGTH)
+	for i := 0; i < _BENCHMARK_LENGTH; i += 7 {
+		b.Set(i)
+	}
+	return b
+}
+
+func BenchmarkSetHas(b *testing.B) {
+	bf := New(_BENCHMARK_LENGTH)
+	for i := 0; i < b.N; i++ {
+		index := i % _BENCHMARK_LENGTH
+		bf.Set(index)
+		if !bf.Has(index) {
+			b.Fatalf("Expected bit %d", index)
+		}
+	}
+}
+
+func BenchmarkCount(b *testing.B) {
+	bf := benchmarkBitfield()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bf.Count()
+	}
+}
+
+func BenchmarkAndNot(b *testing.B) {
+	theirs := benchmarkBitfield()
+	ours := New(_BENCHMARK_LENGTH)
+	ours.SetAll()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		theirs.AndNot(ours)
+	}
+}
+
+func BenchmarkAnyNotIn(b *testing.B) {
+	theirs := benchmarkBitfield()
+	ours := theirs.Copy()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		theirs.AnyNotIn(ours)
+	}
+}
+
+func BenchmarkNextSparse(b *testing.B) {
+	bf := New(_BENCHMARK_LENGTH)
+	bf.Set(_BENCHMARK_LENGTH - 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bf.Next(0)
+	}
+}
+
+func BenchmarkFromBytes(b *testing.B) {
+	data := benchmarkBitfield().Bytes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FromBytes(data, _BENCHMARK_LENGTH)
+	}
+}
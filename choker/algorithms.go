@@ -0,0 +1,156 @@
+package choker
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	_OPTIMISTIC_INTERVAL = time.Second * 30
+	_NEW_PEER_AGE        = time.Minute
+	// New peers are more likely to be unchoked optimistically, so they get something to trade
+	_NEW_PEER_WEIGHT = 3
+)
+
+func interested(peers []*Peer) []*Peer {
+	result := make([]*Peer, 0, len(peers))
+	for _, peer := range peers {
+		if peer.Interested {
+			result = append(result, peer)
+		}
+	}
+	return result
+}
+
+// Fastest first. Rates of what peers give us while downloading, of what we give them while seeding
+func sortByRate(peers []*Peer, seeding bool) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		if seeding {
+			return peers[i].UploadRate > peers[j].UploadRate
+		}
+		return peers[i].DownloadRate > peers[j].DownloadRate
+	})
+}
+
+// Tit-for-tat: the best peers get the regular slots, one more is unchoked optimistically
+// and rotated every 30 seconds
+type TitForTat struct {
+	Slots int
+
+	random     *rand.Rand
+	optimistic string
+	rotatedAt  time.Time
+}
+
+func NewTitForTat(slots int) *TitForTat {
+	if slots <= 0 {
+		slots = _DEFAULT_SLOTS
+	}
+	return &TitForTat{
+		Slots:  slots,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (a *TitForTat) Select(peers []*Peer, seeding bool, now time.Time) map[string]bool {
+	candidates := interested(peers)
+	sortByRate(candidates, seeding)
+
+	unchoke := make(map[string]bool)
+	regular := a.Slots - 1
+	remaining := make([]*Peer, 0, len(candidates))
+	for i, peer := range candidates {
+		if i < regular {
+			unchoke[peer.Address] = true
+		} else {
+			remaining = append(remaining, peer)
+		}
+	}
+
+	current := false
+	for _, peer := range remaining {
+		if peer.Address == a.optimistic {
+			current = true
+		}
+	}
+	if !current || now.Sub(a.rotatedAt) >= _OPTIMISTIC_INTERVAL {
+		a.optimistic = a.pickOptimistic(remaining, now)
+		a.rotatedAt = now
+	}
+	if a.optimistic != "" {
+		unchoke[a.optimistic] = true
+	}
+	return unchoke
+}
+
+func (a *TitForTat) pickOptimistic(peers []*Peer, now time.Time) string {
+	total := 0
+	weights := make([]int, len(peers))
+	for i, peer := range peers {
+		weights[i] = 1
+		if now.Sub(peer.ConnectedAt) < _NEW_PEER_AGE {
+			weights[i] = _NEW_PEER_WEIGHT
+		}
+		total += weights[i]
+	}
+	if total == 0 {
+		return ""
+	}
+
+	choice := a.random.Intn(total)
+	for i, weight := range weights {
+		if choice < weight {
+			return peers[i].Address
+		}
+		choice -= weight
+	}
+	return ""
+}
+
+// Unchokes the longest connected interested peers, regardless of rates
+type FixedSlots struct {
+	Slots int
+}
+
+func (a *FixedSlots) Select(peers []*Peer, seeding bool, now time.Time) map[string]bool {
+	candidates := interested(peers)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].ConnectedAt.Before(candidates[j].ConnectedAt)
+	})
+
+	unchoke := make(map[string]bool)
+	for i := 0; i < len(candidates) && i < a.Slots; i++ {
+		unchoke[candidates[i].Address] = true
+	}
+	return unchoke
+}
+
+// Opens another slot for every MinSlotRate of current upload, so a fast link is
+// shared among more peers and a slow one isn't spread too thin.
+// Without a positive MinSlotRate all MaxSlots are used
+type RateBased struct {
+	MinSlotRate float64
+	MaxSlots    int
+}
+
+func (a *RateBased) Select(peers []*Peer, seeding bool, now time.Time) map[string]bool {
+	total := 0.0
+	for _, peer := range peers {
+		total += peer.UploadRate
+	}
+	slots := a.MaxSlots
+	// Compared as floats, since huge ratios overflow int
+	if a.MinSlotRate > 0 && total/a.MinSlotRate+1 < float64(a.MaxSlots) {
+		slots = int(total/a.MinSlotRate) + 1
+	}
+
+	candidates := interested(peers)
+	sortByRate(candidates, seeding)
+
+	unchoke := make(map[string]bool)
+	for i := 0; i < len(candidates) && i < slots; i++ {
+		unchoke[candidates[i].Address] = true
+	}
+	return unchoke
+}
@@ -0,0 +1,110 @@
+package choker
+
+import (
+	"gobby/logs"
+	"sync"
+	"time"
+)
+
+const (
+	_CHOKE_INTERVAL = time.Second * 10
+	_DEFAULT_SLOTS  = 4
+)
+
+type Peer struct {
+	Address string
+	// Whether the peer is interested in our pieces
+	Interested bool
+	// Whether we currently unchoke the peer
+	Unchoked bool
+	// Bytes per second from the peer to us
+	DownloadRate float64
+	// Bytes per second from us to the peer
+	UploadRate  float64
+	ConnectedAt time.Time
+}
+
+// Decides which peers get unchoked. Called every rechoke interval
+type Algorithm interface {
+	Select(peers []*Peer, seeding bool, now time.Time) map[string]bool
+}
+
+// Applies the decisions, e.g. a PeerCoordinator
+type Target interface {
+	Choke(address string) error
+	Unchoke(address string) error
+}
+
+type Choker struct {
+	target Target
+	peers  func() []*Peer
+
+	mx        sync.Mutex
+	algorithm Algorithm
+	seeding   bool
+	stopOnce  sync.Once
+	stopCh    chan struct{}
+}
+
+func NewChoker(target Target, peers func() []*Peer, algorithm Algorithm) *Choker {
+	return &Choker{
+		target:    target,
+		peers:     peers,
+		algorithm: algorithm,
+		stopCh:    make(chan struct{}),
+	}
+}
+
+func (c *Choker) SetAlgorithm(algorithm Algorithm) {
+	c.mx.Lock()
+	c.algorithm = algorithm
+	c.mx.Unlock()
+}
+
+// Once seeding, peers are ranked by how fast we upload to them
+func (c *Choker) SetSeeding(seeding bool) {
+	c.mx.Lock()
+	c.seeding = seeding
+	c.mx.Unlock()
+}
+
+func (c *Choker) Run() {
+	ticker := time.NewTicker(_CHOKE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			c.Rechoke(now)
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+func (c *Choker) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+	})
+}
+
+func (c *Choker) Rechoke(now time.Time) {
+	c.mx.Lock()
+	algorithm, seeding := c.algorithm, c.seeding
+	c.mx.Unlock()
+
+	peers := c.peers()
+	unchoke := algorithm.Select(peers, seeding, now)
+
+	for _, peer := range peers {
+		var err error
+		if unchoke[peer.Address] && !peer.Unchoked {
+			err = c.target.Unchoke(peer.Address)
+		} else if !unchoke[peer.Address] && peer.Unchoked {
+			err = c.target.Choke(peer.Address)
+		}
+		if err != nil {
+			logs.Debug("Choker", "Failed to update %s: %s", peer.Address, err)
+		}
+	}
+}
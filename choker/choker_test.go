@@ -0,0 +1,177 @@
+package choker
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type mockTarget struct {
+	choked   []string
+	unchoked []string
+}
+
+func (t *mockTarget) Choke(address string) error {
+	t.choked = append(t.choked, address)
+	return nil
+}
+
+func (t *mockTarget) Unchoke(address string) error {
+	t.unchoked = append(t.unchoked, address)
+	return nil
+}
+
+func testPeers(count int, now time.Time) []*Peer {
+	peers := make([]*Peer, count)
+	for i := range peers {
+		peers[i] = &Peer{
+			Address:      strconv.Itoa(i),
+			Interested:   true,
+			DownloadRate: float64(i * 100),
+			UploadRate:   float64((count - i) * 100),
+			ConnectedAt:  now.Add(-time.Hour),
+		}
+	}
+	return peers
+}
+
+func newTestTitForTat(slots int) *TitForTat {
+	a := NewTitForTat(slots)
+	a.random = rand.New(rand.NewSource(1))
+	return a
+}
+
+func TestTitForTatRegularSlots(t *testing.T) {
+	now := time.Now()
+	peers := testPeers(10, now)
+	peers[9].Interested = false
+
+	unchoke := newTestTitForTat(4).Select(peers, false, now)
+	if len(unchoke) != 4 {
+		t.Fatalf("Expected 4 unchoked peers. Got: %d", len(unchoke))
+	}
+	for _, address := range []string{"8", "7", "6"} {
+		if !unchoke[address] {
+			t.Fatalf("Expected fastest uploader %s to be unchoked. Got: %v", address, unchoke)
+		}
+	}
+	if unchoke["9"] {
+		t.Fatalf("Expected uninterested peer to stay choked")
+	}
+}
+
+func TestTitForTatSeeding(t *testing.T) {
+	now := time.Now()
+	peers := testPeers(10, now)
+
+	unchoke := newTestTitForTat(4).Select(peers, true, now)
+	for _, address := range []string{"0", "1", "2"} {
+		if !unchoke[address] {
+			t.Fatalf("Expected fastest downloader %s to be unchoked. Got: %v", address, unchoke)
+		}
+	}
+}
+
+func TestTitForTatOptimisticRotation(t *testing.T) {
+	now := time.Now()
+	peers := testPeers(20, now)
+	a := newTestTitForTat(2)
+
+	a.Select(peers, false, now)
+	first := a.optimistic
+	a.Select(peers, false, now.Add(_CHOKE_INTERVAL))
+	if a.optimistic != first {
+		t.Fatalf("Expected optimistic unchoke to stay for %s", _OPTIMISTIC_INTERVAL)
+	}
+
+	rotated := false
+	for i := 1; i <= 10; i++ {
+		a.Select(peers, false, now.Add(_OPTIMISTIC_INTERVAL*time.Duration(i)))
+		if a.optimistic != first {
+			rotated = true
+		}
+	}
+	if !rotated {
+		t.Fatalf("Expected optimistic unchoke to rotate")
+	}
+}
+
+func TestTitForTatFavorsNewPeers(t *testing.T) {
+	now := time.Now()
+	newPicks := 0
+	for seed := int64(0); seed < 200; seed++ {
+		peers := testPeers(3, now)
+		peers[0].ConnectedAt = now
+		a := NewTitForTat(1)
+		a.random = rand.New(rand.NewSource(seed))
+
+		if a.Select(peers, false, now)["0"] {
+			newPicks++
+		}
+	}
+
+	// Weighted 3 out of 5
+	if newPicks < 90 {
+		t.Fatalf("Expected new peer to be favored. Picked %d out of 200", newPicks)
+	}
+}
+
+func TestFixedSlots(t *testing.T) {
+	now := time.Now()
+	peers := testPeers(5, now)
+	peers[3].ConnectedAt = now.Add(-time.Hour * 2)
+	peers[4].ConnectedAt = now.Add(-time.Hour * 3)
+
+	unchoke := (&FixedSlots{Slots: 2}).Select(peers, false, now)
+	if len(unchoke) != 2 || !unchoke["3"] || !unchoke["4"] {
+		t.Fatalf("Expected longest connected peers. Got: %v", unchoke)
+	}
+}
+
+func TestRateBased(t *testing.T) {
+	now := time.Now()
+	peers := testPeers(10, now)
+
+	unchoke := (&RateBased{MinSlotRate: 2000, MaxSlots: 8}).Select(peers, false, now)
+	// 5500 total upload opens 3 slots
+	if len(unchoke) != 3 {
+		t.Fatalf("Expected 3 slots. Got: %d", len(unchoke))
+	}
+
+	unchoke = (&RateBased{MinSlotRate: 100, MaxSlots: 8}).Select(peers, false, now)
+	if len(unchoke) != 8 {
+		t.Fatalf("Expected slots capped at 8. Got: %d", len(unchoke))
+	}
+}
+
+func TestRateBasedWithoutMinSlotRate(t *testing.T) {
+	now := time.Now()
+	peers := testPeers(10, now)
+
+	for _, minSlotRate := range []float64{0, -1} {
+		unchoke := (&RateBased{MinSlotRate: minSlotRate, MaxSlots: 4}).Select(peers, false, now)
+		if len(unchoke) != 4 {
+			t.Fatalf("Expected all %d slots for minimum rate %v. Got: %d", 4, minSlotRate, len(unchoke))
+		}
+	}
+}
+
+func TestRechoke(t *testing.T) {
+	now := time.Now()
+	peers := testPeers(3, now)
+	peers[0].Unchoked = true
+	peers[2].Unchoked = true
+	target := &mockTarget{}
+
+	c := NewChoker(target, func() []*Peer { return peers }, &FixedSlots{Slots: 2})
+	peers[0].Interested = false
+	c.Rechoke(now)
+
+	if len(target.choked) != 1 || target.choked[0] != "0" {
+		t.Fatalf("Expected peer 0 to be choked. Got: %v", target.choked)
+	}
+	if len(target.unchoked) != 1 || target.unchoked[0] != "1" {
+		t.Fatalf("Expected peer 1 to be unchoked. Got: %v", target.unchoked)
+	}
+}
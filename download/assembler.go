@@ -0,0 +1,98 @@
+package download
+
+import (
+	"fmt"
+	"gobby/picker"
+	"sync"
+)
+
+type partialPiece struct {
+	data      []byte
+	received  []bool
+	remaining int
+}
+
+// Collects blocks into whole pieces
+type Assembler struct {
+	pieceCount      int
+	pieceLength     int
+	lastPieceLength int
+
+	mx     sync.Mutex
+	pieces map[int]*partialPiece
+}
+
+func NewAssembler(pieceCount, pieceLength, lastPieceLength int) *Assembler {
+	return &Assembler{
+		pieceCount:      pieceCount,
+		pieceLength:     pieceLength,
+		lastPieceLength: lastPieceLength,
+		pieces:          make(map[int]*partialPiece),
+	}
+}
+
+func (a *Assembler) pieceSize(index int) int {
+	if index == a.pieceCount-1 {
+		return a.lastPieceLength
+	}
+	return a.pieceLength
+}
+
+// Returns the piece data once its last block is added, nil before that
+func (a *Assembler) AddBlock(index, offset int, block []byte) ([]byte, error) {
+	if index < 0 || index >= a.pieceCount {
+		return nil, fmt.Errorf("Invalid piece index %d", index)
+	}
+	size := a.pieceSize(index)
+	if offset < 0 || offset%picker.BlockSize != 0 || offset >= size {
+		return nil, fmt.Errorf("Invalid block offset %d in piece %d", offset, index)
+	}
+	expected := size - offset
+	if expected > picker.BlockSize {
+		expected = picker.BlockSize
+	}
+	if len(block) != expected {
+		return nil, fmt.Errorf("Invalid block length %d at %d/%d. Expected: %d", len(block), index, offset, expected)
+	}
+
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	piece, exists := a.pieces[index]
+	if !exists {
+		blockCount := (size + picker.BlockSize - 1) / picker.BlockSize
+		piece = &partialPiece{
+			data:      make([]byte, size),
+			received:  make([]bool, blockCount),
+			remaining: blockCount,
+		}
+		a.pieces[index] = piece
+	}
+
+	i := offset / picker.BlockSize
+	if piece.received[i] {
+		return nil, nil
+	}
+	copy(piece.data[offset:], block)
+	piece.received[i] = true
+	piece.remaining--
+
+	if piece.remaining > 0 {
+		return nil, nil
+	}
+	delete(a.pieces, index)
+	return piece.data, nil
+}
+
+func (a *Assembler) Discard(index int) {
+	a.mx.Lock()
+	delete(a.pieces, index)
+	a.mx.Unlock()
+}
+
+// Number of pieces with some, but not all blocks
+func (a *Assembler) Partial() int {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return len(a.pieces)
+}
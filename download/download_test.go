@@ -0,0 +1,503 @@
+package download
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"gobby"
+	"gobby/picker"
+	"gobby/pwp"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockRequester struct {
+	mx       sync.Mutex
+	requests map[string][]*pwp.RequestMsg
+	cancels  map[string][]*pwp.CancelMsg
+}
+
+func newMockRequester() *mockRequester {
+	return &mockRequester{
+		requests: make(map[string][]*pwp.RequestMsg),
+		cancels:  make(map[string][]*pwp.CancelMsg),
+	}
+}
+
+func (r *mockRequester) Request(address string, msg *pwp.RequestMsg) error {
+	r.mx.Lock()
+	r.requests[address] = append(r.requests[address], msg)
+	r.mx.Unlock()
+	return nil
+}
+
+func (r *mockRequester) Cancel(address string, msg *pwp.CancelMsg) error {
+	r.mx.Lock()
+	r.cancels[address] = append(r.cancels[address], msg)
+	r.mx.Unlock()
+	return nil
+}
+
+// Pieces whose expected content is all zeros
+func zeroPieces(count, pieceLength, lastPieceLength int) []*gobby.Piece {
+	pieces := make([]*gobby.Piece, count)
+	for i := range pieces {
+		length := pieceLength
+		if i == count-1 {
+			length = lastPieceLength
+		}
+		hash := sha1.Sum(make([]byte, length))
+		pieces[i] = &gobby.Piece{Index: i, Length: length, Hash: hash[:]}
+	}
+	return pieces
+}
+
+func TestQueueDepthFollowsRate(t *testing.T) {
+	q := NewRequestQueue(20)
+	initial := q.Depth()
+	if initial < _MIN_PIPELINE {
+		t.Fatalf("Expected at least %d. Got: %d", _MIN_PIPELINE, initial)
+	}
+
+	now := time.Now()
+	for i := 0; i < 200; i++ {
+		q.Add(&picker.Block{Index: i, Offset: 0, Length: picker.BlockSize}, now)
+	}
+	for i := 0; i < 200; i++ {
+		now = now.Add(time.Millisecond * 10)
+		_, err := q.Received(i, 0, picker.BlockSize, now)
+		if err != nil {
+			t.Fatalf("Failed to receive block: %s", err)
+		}
+	}
+
+	if q.Depth() != 20 {
+		t.Fatalf("Expected depth capped at reqq 20. Got: %d", q.Depth())
+	}
+}
+
+func TestQueueRejectsInvalidBlocks(t *testing.T) {
+	q := NewRequestQueue(0)
+	now := time.Now()
+	q.Add(&picker.Block{Index: 1, Offset: picker.BlockSize, Length: picker.BlockSize}, now)
+
+	if _, err := q.Received(2, 0, picker.BlockSize, now); err == nil {
+		t.Fatalf("Expected error for unsolicited block")
+	}
+	if _, err := q.Received(1, picker.BlockSize, 100, now); err == nil {
+		t.Fatalf("Expected error for wrongly sized block")
+	}
+
+	q.Cancel(1, picker.BlockSize)
+	block, err := q.Received(1, picker.BlockSize, picker.BlockSize, now)
+	if block != nil || err != nil {
+		t.Fatalf("Expected cancelled block to be ignored. Got: %v, %v", block, err)
+	}
+	if _, err := q.Received(1, picker.BlockSize, picker.BlockSize, now); err == nil {
+		t.Fatalf("Expected error for block received twice")
+	}
+}
+
+func TestQueueExpired(t *testing.T) {
+	q := NewRequestQueue(0)
+	now := time.Now()
+	q.Add(&picker.Block{Index: 0, Offset: 0, Length: picker.BlockSize}, now)
+	q.Add(&picker.Block{Index: 1, Offset: 0, Length: picker.BlockSize}, now.Add(_REQUEST_TIMEOUT/2))
+
+	expired := q.Expired(now.Add(_REQUEST_TIMEOUT))
+	if len(expired) != 1 || expired[0].Index != 0 {
+		t.Fatalf("Expected request for piece 0 to expire. Got: %v", expired)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("Expected 1 pending request. Got: %d", q.Len())
+	}
+}
+
+func TestAssembler(t *testing.T) {
+	a := NewAssembler(2, picker.BlockSize*2, 10)
+
+	first := bytes.Repeat([]byte{1}, picker.BlockSize)
+	second := bytes.Repeat([]byte{2}, picker.BlockSize)
+	data, err := a.AddBlock(0, picker.BlockSize, second)
+	if data != nil || err != nil {
+		t.Fatalf("Expected incomplete piece. Got: %v, %v", data, err)
+	}
+	data, err = a.AddBlock(0, 0, first)
+	if err != nil {
+		t.Fatalf("Failed to add block: %s", err)
+	}
+	if !bytes.Equal(data, append(first, second...)) {
+		t.Fatalf("Piece data missmatch")
+	}
+
+	invalid := []struct {
+		index, offset, length int
+	}{
+		{2, 0, 10},
+		{0, 100, picker.BlockSize},
+		{0, picker.BlockSize * 2, picker.BlockSize},
+		{1, 0, picker.BlockSize},
+	}
+	for _, block := range invalid {
+		if _, err := a.AddBlock(block.index, block.offset, make([]byte, block.length)); err == nil {
+			t.Fatalf("Expected error for block %+v", block)
+		}
+	}
+
+	data, err = a.AddBlock(1, 0, make([]byte, 10))
+	if err != nil || len(data) != 10 {
+		t.Fatalf("Expected short last piece. Got: %v, %v", data, err)
+	}
+}
+
+func TestDownloader(t *testing.T) {
+	p := picker.NewPicker(1, picker.BlockSize*2, picker.BlockSize*2)
+	requester := newMockRequester()
+	pieces := make(map[int][]byte)
+	d := NewDownloader(p, NewAssembler(1, picker.BlockSize*2, picker.BlockSize*2), zeroPieces(1, picker.BlockSize*2, picker.BlockSize*2), requester, func(index int, data []byte) {
+		pieces[index] = data
+	})
+
+	d.PeerConnected("a", 0)
+	p.PeerHaveAll("a")
+	d.Fill("a")
+	if len(requester.requests["a"]) != 0 {
+		t.Fatalf("Expected no requests while choked")
+	}
+
+	d.PeerUnchoked("a")
+	requests := requester.requests["a"]
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests. Got: %d", len(requests))
+	}
+
+	d.HandleReject("a", &pwp.RejectRequestMsg{Index: requests[1].Index, Offset: requests[1].Offset, Length: requests[1].Length})
+	d.Fill("a")
+	requests = requester.requests["a"]
+	if len(requests) != 3 || requests[2].Offset != requests[1].Offset {
+		t.Fatalf("Expected rejected block to be requested again. Got: %d requests", len(requests))
+	}
+
+	for _, req := range []*pwp.RequestMsg{requests[0], requests[2]} {
+		err := d.HandlePiece("a", &pwp.PieceMsg{Index: req.Index, Offset: req.Offset, Block: make([]byte, req.Length)})
+		if err != nil {
+			t.Fatalf("Failed to handle piece: %s", err)
+		}
+	}
+	if len(pieces[0]) != picker.BlockSize*2 {
+		t.Fatalf("Expected assembled piece")
+	}
+	if !p.Have(0) {
+		t.Fatalf("Expected verified piece to be marked as had")
+	}
+
+	err := d.HandlePiece("a", &pwp.PieceMsg{Index: 0, Offset: 0, Block: make([]byte, picker.BlockSize)})
+	if err == nil {
+		t.Fatalf("Expected error for unsolicited block")
+	}
+}
+
+func TestDownloaderDelivered(t *testing.T) {
+	p := picker.NewPicker(1, picker.BlockSize*2, picker.BlockSize*2)
+	requester := newMockRequester()
+	d := NewDownloader(p, NewAssembler(1, picker.BlockSize*2, picker.BlockSize*2), zeroPieces(1, picker.BlockSize*2, picker.BlockSize*2), requester, func(int, []byte) {})
+	delivered := make(map[string]int64)
+	d.OnDelivered(func(address string, bytes int64) {
+		delivered[address] += bytes
+	})
+
+	for _, address := range []string{"a", "b"} {
+		d.PeerConnected(address, 0)
+		p.PeerHaveAll(address)
+	}
+	d.PeerUnchoked("a")
+	d.HandlePiece("a", &pwp.PieceMsg{Index: 0, Offset: 0, Block: make([]byte, picker.BlockSize)})
+	d.PeerChoked("a", false)
+	if len(delivered) != 0 {
+		t.Fatalf("Expected nothing credited before the piece is verified. Got: %v", delivered)
+	}
+
+	d.PeerUnchoked("b")
+	d.HandlePiece("b", &pwp.PieceMsg{Index: 0, Offset: picker.BlockSize, Block: make([]byte, picker.BlockSize)})
+	if delivered["a"] != picker.BlockSize || delivered["b"] != picker.BlockSize {
+		t.Fatalf("Expected each contributor to be credited a block. Got: %v", delivered)
+	}
+}
+
+func TestDownloaderTimeoutReissues(t *testing.T) {
+	p := picker.NewPicker(1, picker.BlockSize, picker.BlockSize)
+	requester := newMockRequester()
+	d := NewDownloader(p, NewAssembler(1, picker.BlockSize, picker.BlockSize), zeroPieces(1, picker.BlockSize, picker.BlockSize), requester, func(int, []byte) {})
+
+	d.PeerConnected("slow", 0)
+	p.PeerHaveAll("slow")
+	d.PeerUnchoked("slow")
+	if len(requester.requests["slow"]) != 1 {
+		t.Fatalf("Expected request to slow peer")
+	}
+
+	d.PeerConnected("fast", 0)
+	p.PeerHaveAll("fast")
+	d.Tick(time.Now().Add(_REQUEST_TIMEOUT))
+	if len(requester.cancels["slow"]) != 1 {
+		t.Fatalf("Expected timed out request to be cancelled")
+	}
+
+	d.PeerUnchoked("fast")
+	if len(requester.requests["fast"]) != 1 {
+		t.Fatalf("Expected request to be issued to another peer")
+	}
+
+	// The slow peer may still deliver
+	err := d.HandlePiece("slow", &pwp.PieceMsg{Index: 0, Offset: 0, Block: make([]byte, picker.BlockSize)})
+	if err != nil {
+		t.Fatalf("Expected late block to be tolerated. Got: %s", err)
+	}
+}
+
+// Disconnects peers whose requests fail, calling back into the downloader like a coordinator would
+type disconnectingRequester struct {
+	*mockRequester
+	d *Downloader
+}
+
+func (r *disconnectingRequester) Request(address string, msg *pwp.RequestMsg) error {
+	if address == "broken" {
+		r.d.PeerLeft(address)
+		return errors.New("Connection closed")
+	}
+	return r.mockRequester.Request(address, msg)
+}
+
+func TestDownloaderSendsWithoutLock(t *testing.T) {
+	p := picker.NewPicker(1, picker.BlockSize, picker.BlockSize)
+	requester := &disconnectingRequester{mockRequester: newMockRequester()}
+	d := NewDownloader(p, NewAssembler(1, picker.BlockSize, picker.BlockSize), zeroPieces(1, picker.BlockSize, picker.BlockSize), requester, func(int, []byte) {})
+	requester.d = d
+
+	d.PeerConnected("broken", 0)
+	p.PeerHaveAll("broken")
+	done := make(chan struct{})
+	go func() {
+		d.PeerUnchoked("broken")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Expected requester to be called without the mutex held")
+	}
+
+	d.PeerConnected("a", 0)
+	p.PeerHaveAll("a")
+	d.PeerUnchoked("a")
+	if len(requester.requests["a"]) != 1 {
+		t.Fatalf("Expected block of the failed request to be requested again. Got: %d", len(requester.requests["a"]))
+	}
+}
+
+func TestDownloaderChokeReleases(t *testing.T) {
+	p := picker.NewPicker(1, picker.BlockSize, picker.BlockSize)
+	requester := newMockRequester()
+	d := NewDownloader(p, NewAssembler(1, picker.BlockSize, picker.BlockSize), zeroPieces(1, picker.BlockSize, picker.BlockSize), requester, func(int, []byte) {})
+
+	d.PeerConnected("a", 0)
+	d.PeerConnected("b", 0)
+	p.PeerHaveAll("a")
+	p.PeerHaveAll("b")
+	d.PeerUnchoked("a")
+	d.PeerChoked("a", false)
+
+	d.PeerUnchoked("b")
+	if len(requester.requests["b"]) != 1 {
+		t.Fatalf("Expected released block to be requested from b")
+	}
+	if p.Endgame() {
+		t.Fatalf("Expected no endgame")
+	}
+}
+
+func TestDownloaderVerifiesPieces(t *testing.T) {
+	p := picker.NewPicker(1, picker.BlockSize*2, picker.BlockSize*2)
+	requester := newMockRequester()
+	stored := 0
+	d := NewDownloader(p, NewAssembler(1, picker.BlockSize*2, picker.BlockSize*2), zeroPieces(1, picker.BlockSize*2, picker.BlockSize*2), requester, func(index int, data []byte) {
+		stored++
+	})
+	banned := make([]string, 0)
+	d.OnBan(func(address string) {
+		banned = append(banned, address)
+	})
+
+	for _, address := range []string{"a", "b", "c"} {
+		d.PeerConnected(address, 0)
+		p.PeerHaveAll(address)
+	}
+
+	// The first block comes corrupt from a, the second one from b
+	d.PeerUnchoked("a")
+	if len(requester.requests["a"]) != 2 {
+		t.Fatalf("Expected both blocks to be requested from a. Got: %d", len(requester.requests["a"]))
+	}
+	d.HandlePiece("a", &pwp.PieceMsg{Index: 0, Offset: 0, Block: bytes.Repeat([]byte{1}, picker.BlockSize)})
+	d.PeerChoked("a", false)
+
+	d.PeerUnchoked("b")
+	if len(requester.requests["b"]) != 1 {
+		t.Fatalf("Expected remaining block to be requested from b. Got: %d", len(requester.requests["b"]))
+	}
+	d.HandlePiece("b", &pwp.PieceMsg{Index: 0, Offset: picker.BlockSize, Block: make([]byte, picker.BlockSize)})
+	d.PeerChoked("b", false)
+
+	if stored != 0 {
+		t.Fatalf("Expected corrupt piece not to be stored")
+	}
+	if p.Have(0) {
+		t.Fatalf("Expected corrupt piece to be downloaded again")
+	}
+	if len(banned) != 0 || d.Strikes("a") != 0 || d.Strikes("b") != 0 {
+		t.Fatalf("Expected no blame before the piece verifies. Got: %v", banned)
+	}
+
+	// a already sent corrupt data of other pieces
+	d.strikes["a"] = _MAX_STRIKES - 1
+	d.PeerUnchoked("c")
+	for _, req := range requester.requests["c"] {
+		d.HandlePiece("c", &pwp.PieceMsg{Index: req.Index, Offset: req.Offset, Block: make([]byte, req.Length)})
+	}
+	if stored != 1 {
+		t.Fatalf("Expected piece to be stored once it verifies")
+	}
+	if d.Strikes("a") != _MAX_STRIKES || d.Strikes("b") != 0 || d.Strikes("c") != 0 {
+		t.Fatalf("Expected only the sender of the corrupt block to be blamed. Got: %d, %d, %d", d.Strikes("a"), d.Strikes("b"), d.Strikes("c"))
+	}
+	if len(banned) != 1 || banned[0] != "a" {
+		t.Fatalf("Expected a to be banned after %d strikes. Got: %v", _MAX_STRIKES, banned)
+	}
+}
+
+func TestDownloaderBansSoleContributor(t *testing.T) {
+	p := picker.NewPicker(1, picker.BlockSize, picker.BlockSize)
+	requester := newMockRequester()
+	d := NewDownloader(p, NewAssembler(1, picker.BlockSize, picker.BlockSize), zeroPieces(1, picker.BlockSize, picker.BlockSize), requester, func(int, []byte) {
+		t.Fatalf("Expected corrupt piece not to be stored")
+	})
+	banned := make([]string, 0)
+	d.OnBan(func(address string) {
+		banned = append(banned, address)
+	})
+
+	d.PeerConnected("a", 0)
+	p.PeerHaveAll("a")
+	d.PeerUnchoked("a")
+	d.HandlePiece("a", &pwp.PieceMsg{Index: 0, Offset: 0, Block: bytes.Repeat([]byte{1}, picker.BlockSize)})
+
+	if len(banned) != 1 || banned[0] != "a" {
+		t.Fatalf("Expected sole contributor to be banned. Got: %v", banned)
+	}
+	if d.Strikes("a") != 1 {
+		t.Fatalf("Expected 1 strike. Got: %d", d.Strikes("a"))
+	}
+}
+
+type mockSkipper struct {
+	skipped map[int]bool
+	fail    int
+}
+
+func (m *mockSkipper) SetFileSkipped(index int, skipped bool) error {
+	if index == m.fail {
+		return errors.New("Disk full")
+	}
+	m.skipped[index] = skipped
+	return nil
+}
+
+func TestPiecePriorities(t *testing.T) {
+	// Pieces of 10 bytes: file0 covers 0-1, file1 covers 1-2, the empty file none, file2 covers 3-4
+	files := []*gobby.File{
+		&gobby.File{Length: 15, Path: "file0"},
+		&gobby.File{Length: 15, Path: "file1"},
+		&gobby.File{Length: 0, Path: "empty"},
+		&gobby.File{Length: 15, Path: "file2"},
+	}
+	priorities := []picker.Priority{picker.PriorityHigh, picker.PrioritySkip, picker.PrioritySkip, picker.PriorityLow}
+
+	pieces := PiecePriorities(files, 10, priorities)
+	expected := []picker.Priority{picker.PriorityHigh, picker.PriorityHigh, picker.PrioritySkip, picker.PriorityLow, picker.PriorityLow}
+	if len(pieces) != len(expected) {
+		t.Fatalf("Expected %d pieces. Got: %d", len(expected), len(pieces))
+	}
+	for i := range expected {
+		if pieces[i] != expected[i] {
+			t.Fatalf("Expected piece %d priority %d. Got: %d", i, expected[i], pieces[i])
+		}
+	}
+}
+
+func TestFileSelector(t *testing.T) {
+	files := []*gobby.File{
+		&gobby.File{Length: 15, Path: "file0"},
+		&gobby.File{Length: 15, Path: "file1"},
+	}
+	p := picker.NewPicker(3, 10, 10)
+	skipper := &mockSkipper{skipped: make(map[int]bool), fail: -1}
+	selector := NewFileSelector(p, skipper, files, 10)
+
+	err := selector.SetFilePriority(1, picker.PrioritySkip)
+	if err != nil {
+		t.Fatalf("Failed to set priority: %s", err)
+	}
+	if priority, _ := selector.FilePriority(1); !skipper.skipped[1] || priority != picker.PrioritySkip {
+		t.Fatalf("Expected file 1 to be skipped")
+	}
+	// Piece 1 straddles both files
+	if p.Priority(0) != picker.PriorityNormal || p.Priority(1) != picker.PriorityNormal || p.Priority(2) != picker.PrioritySkip {
+		t.Fatalf("Expected straddling piece to stay wanted. Got: %d, %d, %d", p.Priority(0), p.Priority(1), p.Priority(2))
+	}
+
+	// Changed while running
+	err = selector.SetFilePriorities([]picker.Priority{picker.PrioritySkip, picker.PriorityHigh})
+	if err != nil {
+		t.Fatalf("Failed to set priorities: %s", err)
+	}
+	if !skipper.skipped[0] || skipper.skipped[1] {
+		t.Fatalf("Expected file 0 to be skipped and file 1 wanted")
+	}
+	if p.Priority(0) != picker.PrioritySkip || p.Priority(1) != picker.PriorityHigh || p.Priority(2) != picker.PriorityHigh {
+		t.Fatalf("Expected piece priorities to follow. Got: %d, %d, %d", p.Priority(0), p.Priority(1), p.Priority(2))
+	}
+
+	if selector.SetFilePriority(0, picker.Priority(9)) == nil {
+		t.Fatalf("Expected invalid priority to fail")
+	}
+	if selector.SetFilePriority(2, picker.PriorityLow) == nil {
+		t.Fatalf("Expected invalid file to fail")
+	}
+	if _, err := selector.FilePriority(2); err == nil {
+		t.Fatalf("Expected priority of invalid file to fail")
+	}
+
+	skipper.fail = 1
+	if selector.SetFilePriorities([]picker.Priority{picker.PriorityLow, picker.PrioritySkip}) == nil {
+		t.Fatalf("Expected storage failure to be returned")
+	}
+	first, _ := selector.FilePriority(0)
+	second, _ := selector.FilePriority(1)
+	if first != picker.PriorityLow || second != picker.PriorityHigh || p.Priority(0) != picker.PriorityLow {
+		t.Fatalf("Expected files changed before the failure to be applied")
+	}
+
+	// Without a skipper, files can't be skipped
+	selector = NewFileSelector(p, nil, files, 10)
+	if selector.SetFilePriority(0, picker.PrioritySkip) == nil {
+		t.Fatalf("Expected skipping without a skipper to fail")
+	}
+	if priority, _ := selector.FilePriority(0); priority != picker.PriorityNormal {
+		t.Fatalf("Expected file 0 to keep its priority. Got: %d", priority)
+	}
+	if err := selector.SetFilePriority(0, picker.PriorityHigh); err != nil {
+		t.Fatalf("Failed to set priority without a skipper: %s", err)
+	}
+}
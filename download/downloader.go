@@ -0,0 +1,398 @@
+package download
+
+import (
+	"crypto/sha1"
+	"gobby"
+	"gobby/logs"
+	"gobby/picker"
+	"gobby/pwp"
+	"sync"
+	"time"
+)
+
+// Sends requests to connected peers, e.g. a PeerCoordinator
+type Requester interface {
+	Request(address string, msg *pwp.RequestMsg) error
+	Cancel(address string, msg *pwp.CancelMsg) error
+}
+
+const (
+	// Peers that sent corrupt blocks of this many pieces get banned
+	_MAX_STRIKES = 3
+)
+
+// The peer that sent a block, and what it sent
+type blockSource struct {
+	address string
+	length  int
+	digest  [sha1.Size]byte
+}
+
+// A request or cancel collected under the mutex, sent after it is released
+type outgoing struct {
+	address string
+	request *pwp.RequestMsg
+	cancel  *pwp.CancelMsg
+}
+
+type downloadPeer struct {
+	queue  *RequestQueue
+	choked bool
+}
+
+// Keeps the request pipelines of all peers of a torrent filled with blocks chosen by the picker.
+// Availability is fed to the picker by the caller. Only pieces matching their hash are handed to
+// onPiece, corrupt ones are downloaded again. A sole sender of a corrupt piece is banned right away.
+// With several senders, the blocks that differ from the piece once it verifies give their senders strikes
+type Downloader struct {
+	picker    *picker.Picker
+	assembler *Assembler
+	pieces    []*gobby.Piece
+	requester Requester
+	onPiece   func(index int, data []byte)
+
+	mx    sync.Mutex
+	peers map[string]*downloadPeer
+	// Senders of the blocks of incomplete pieces, by offset
+	blocks map[int]map[int]*blockSource
+	// Blocks of failed attempts at pieces with several senders, compared once the piece verifies
+	suspects    map[int][]map[int]*blockSource
+	strikes     map[string]int
+	onBan       func(address string)
+	onDelivered func(address string, bytes int64)
+}
+
+func NewDownloader(p *picker.Picker, assembler *Assembler, pieces []*gobby.Piece, requester Requester, onPiece func(index int, data []byte)) *Downloader {
+	return &Downloader{
+		picker:      p,
+		assembler:   assembler,
+		pieces:      pieces,
+		requester:   requester,
+		onPiece:     onPiece,
+		peers:       make(map[string]*downloadPeer),
+		blocks:      make(map[int]map[int]*blockSource),
+		suspects:    make(map[int][]map[int]*blockSource),
+		strikes:     make(map[string]int),
+		onBan:       func(string) {},
+		onDelivered: func(string, int64) {},
+	}
+}
+
+// Called for peers that sent too much corrupt data. Should disconnect and ban them
+func (d *Downloader) OnBan(handler func(address string)) {
+	d.mx.Lock()
+	d.onBan = handler
+	d.mx.Unlock()
+}
+
+// Called with the bytes each peer contributed to a verified piece,
+// e.g. to prefer reconnecting to it through ConnectionManager.RecordDelivered
+func (d *Downloader) OnDelivered(handler func(address string, bytes int64)) {
+	d.mx.Lock()
+	d.onDelivered = handler
+	d.mx.Unlock()
+}
+
+func (d *Downloader) PeerConnected(address string, reqq int) {
+	d.mx.Lock()
+	d.peers[address] = &downloadPeer{queue: NewRequestQueue(reqq), choked: true}
+	d.mx.Unlock()
+}
+
+func (d *Downloader) PeerLeft(address string) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	peer, exists := d.peers[address]
+	if !exists {
+		return
+	}
+	for _, block := range peer.queue.Clear() {
+		d.picker.Release(address, block)
+	}
+	delete(d.peers, address)
+}
+
+// Without the fast extension a choke discards all outstanding requests
+func (d *Downloader) PeerChoked(address string, fast bool) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	peer, exists := d.peers[address]
+	if !exists {
+		return
+	}
+	peer.choked = true
+	if !fast {
+		for _, block := range peer.queue.Clear() {
+			d.picker.Release(address, block)
+		}
+	}
+}
+
+func (d *Downloader) PeerUnchoked(address string) {
+	d.mx.Lock()
+	peer, exists := d.peers[address]
+	if !exists {
+		d.mx.Unlock()
+		return
+	}
+	peer.choked = false
+	out := d.fill(nil, address, peer, time.Now())
+	d.mx.Unlock()
+
+	d.send(out)
+}
+
+// Requests more blocks from the peer if its pipeline has room, e.g. after it announced new pieces
+func (d *Downloader) Fill(address string) {
+	d.mx.Lock()
+	var out []*outgoing
+	if peer, exists := d.peers[address]; exists {
+		out = d.fill(out, address, peer, time.Now())
+	}
+	d.mx.Unlock()
+
+	d.send(out)
+}
+
+// Queues picked blocks and appends their requests to out. Must be called with the mutex held
+func (d *Downloader) fill(out []*outgoing, address string, peer *downloadPeer, now time.Time) []*outgoing {
+	if peer.choked {
+		return out
+	}
+	free := peer.queue.Free()
+	if free == 0 {
+		return out
+	}
+
+	for _, block := range d.picker.Pick(address, free) {
+		peer.queue.Add(block, now)
+		out = append(out, &outgoing{address: address, request: &pwp.RequestMsg{
+			Index:  int32(block.Index),
+			Offset: int32(block.Offset),
+			Length: int32(block.Length),
+		}})
+	}
+	return out
+}
+
+// Must be called without the mutex held, as the requester may call back into the downloader
+func (d *Downloader) send(out []*outgoing) {
+	for _, msg := range out {
+		if msg.cancel != nil {
+			d.requester.Cancel(msg.address, msg.cancel)
+			continue
+		}
+
+		err := d.requester.Request(msg.address, msg.request)
+		if err != nil {
+			logs.Debug("Downloader", "Failed to request %d/%d from %s: %s", msg.request.Index, msg.request.Offset, msg.address, err)
+			d.requestFailed(msg.address, int(msg.request.Index), int(msg.request.Offset))
+		}
+	}
+}
+
+// Releases a block whose request couldn't be sent, unless the peer already left
+func (d *Downloader) requestFailed(address string, index, offset int) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	peer, exists := d.peers[address]
+	if !exists {
+		return
+	}
+	if block := peer.queue.Remove(index, offset); block != nil {
+		d.picker.Release(address, block)
+	}
+}
+
+// Returns an error for blocks that weren't requested or have the wrong size, after which
+// the peer should be disconnected. The block is released to the reader's pool afterwards
+func (d *Downloader) HandlePiece(address string, msg *pwp.PieceMsg) error {
+	// Blocks are copied into the assembler
+	defer pwp.ReleaseBlock(msg.Block)
+
+	d.mx.Lock()
+
+	peer, exists := d.peers[address]
+	if !exists {
+		d.mx.Unlock()
+		return nil
+	}
+	now := time.Now()
+	block, err := peer.queue.Received(int(msg.Index), int(msg.Offset), len(msg.Block), now)
+	if err != nil {
+		d.mx.Unlock()
+		return err
+	}
+	if block == nil {
+		// Arrived after being cancelled
+		out := d.fill(nil, address, peer, now)
+		d.mx.Unlock()
+
+		d.send(out)
+		return nil
+	}
+
+	// Duplicates requested in endgame mode are no longer needed
+	var out []*outgoing
+	cancels, _ := d.picker.BlockReceived(address, block)
+	for _, other := range cancels {
+		if otherPeer, exists := d.peers[other]; exists {
+			otherPeer.queue.Cancel(block.Index, block.Offset)
+			out = append(out, &outgoing{address: other, cancel: &pwp.CancelMsg{Index: msg.Index, Offset: msg.Offset, Length: int32(len(msg.Block))}})
+		}
+	}
+
+	sources, exists := d.blocks[block.Index]
+	if !exists {
+		sources = make(map[int]*blockSource)
+		d.blocks[block.Index] = sources
+	}
+	// The assembler keeps the first copy of a block
+	if _, exists := sources[block.Offset]; !exists {
+		sources[block.Offset] = &blockSource{address: address, length: len(msg.Block), digest: sha1.Sum(msg.Block)}
+	}
+
+	data, err := d.assembler.AddBlock(block.Index, block.Offset, msg.Block)
+	if err != nil || data == nil {
+		out = d.fill(out, address, peer, now)
+		d.mx.Unlock()
+
+		d.send(out)
+		return err
+	}
+	delete(d.blocks, block.Index)
+
+	if !d.pieces[block.Index].Verify(data) {
+		banned := d.pieceFailed(block.Index, sources)
+		out = d.fill(out, address, peer, now)
+		onBan := d.onBan
+		d.mx.Unlock()
+
+		d.send(out)
+		for _, address := range banned {
+			onBan(address)
+		}
+		return nil
+	}
+
+	banned := d.pieceVerified(block.Index, data)
+	d.picker.SetHave(block.Index)
+	out = d.fill(out, address, peer, now)
+	onBan := d.onBan
+	onDelivered := d.onDelivered
+	d.mx.Unlock()
+
+	d.send(out)
+	for _, address := range banned {
+		onBan(address)
+	}
+	delivered := make(map[string]int)
+	for _, source := range sources {
+		delivered[source.address] += source.length
+	}
+	for contributor, bytes := range delivered {
+		onDelivered(contributor, int64(bytes))
+	}
+	d.onPiece(block.Index, data)
+	return nil
+}
+
+// Bans a sole sender right away. With several senders the culprits are only known once
+// the piece verifies, so the attempt is kept. Returns the peers to ban. Must be called with the mutex held
+func (d *Downloader) pieceFailed(index int, sources map[int]*blockSource) []string {
+	senders := make(map[string]bool)
+	for _, source := range sources {
+		senders[source.address] = true
+	}
+	logs.Warn("Downloader", "Piece %d failed hash check. Contributors: %d", index, len(senders))
+	d.picker.PieceFailed(index)
+
+	if len(senders) == 1 {
+		for address := range senders {
+			d.strikes[address]++
+			return []string{address}
+		}
+	}
+
+	attempts := append(d.suspects[index], sources)
+	if len(attempts) > _MAX_STRIKES {
+		attempts = attempts[len(attempts)-_MAX_STRIKES:]
+	}
+	d.suspects[index] = attempts
+	return nil
+}
+
+// Gives the senders of blocks of failed attempts that differ from the verified piece a strike.
+// Returns the peers to ban. Must be called with the mutex held
+func (d *Downloader) pieceVerified(index int, data []byte) []string {
+	attempts, exists := d.suspects[index]
+	if !exists {
+		return nil
+	}
+	delete(d.suspects, index)
+
+	culprits := make(map[string]bool)
+	for _, sources := range attempts {
+		for offset, source := range sources {
+			if sha1.Sum(data[offset:offset+source.length]) != source.digest {
+				culprits[source.address] = true
+			}
+		}
+	}
+
+	banned := make([]string, 0)
+	for address := range culprits {
+		logs.Warn("Downloader", "%s sent corrupt data of piece %d", address, index)
+		d.strikes[address]++
+		if d.strikes[address] >= _MAX_STRIKES {
+			banned = append(banned, address)
+		}
+	}
+	return banned
+}
+
+// Number of pieces the peer was found to have sent corrupt data of
+func (d *Downloader) Strikes(address string) int {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return d.strikes[address]
+}
+
+func (d *Downloader) HandleReject(address string, msg *pwp.RejectRequestMsg) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	peer, exists := d.peers[address]
+	if !exists {
+		return
+	}
+	if block := peer.queue.Remove(int(msg.Index), int(msg.Offset)); block != nil {
+		d.picker.Release(address, block)
+	}
+}
+
+// Cancels requests that took too long, so other peers can pick them up
+func (d *Downloader) Tick(now time.Time) {
+	d.mx.Lock()
+	var out []*outgoing
+	for address, peer := range d.peers {
+		for _, block := range peer.queue.Expired(now) {
+			logs.Debug("Downloader", "Request %d/%d to %s timed out", block.Index, block.Offset, address)
+			out = append(out, &outgoing{address: address, cancel: &pwp.CancelMsg{
+				Index:  int32(block.Index),
+				Offset: int32(block.Offset),
+				Length: int32(block.Length),
+			}})
+			d.picker.Release(address, block)
+		}
+	}
+	for address, peer := range d.peers {
+		out = d.fill(out, address, peer, now)
+	}
+	d.mx.Unlock()
+
+	d.send(out)
+}
@@ -0,0 +1,164 @@
+package download
+
+import (
+	"fmt"
+	"gobby/picker"
+	"time"
+)
+
+const (
+	_DEFAULT_REQQ    = 250
+	_MIN_PIPELINE    = 2
+	_INITIAL_RATE    = picker.BlockSize * 2
+	_PIPELINE_TIME   = time.Second * 2
+	_RATE_INTERVAL   = time.Second
+	_REQUEST_TIMEOUT = time.Second * 30
+)
+
+type pendingRequest struct {
+	block  *picker.Block
+	sentAt time.Time
+}
+
+// Blocks requested from a single peer. The pipeline depth follows the peer's measured
+// throughput, so enough requests are outstanding to cover a couple of seconds of transfer
+type RequestQueue struct {
+	maxDepth int
+	pending  []*pendingRequest
+	// Cancelled requests the peer may have answered before receiving the cancel
+	cancelled   map[picker.Block]bool
+	rate        float64
+	sampleStart time.Time
+	sampleBytes int
+}
+
+// reqq as advertised in the peer's extended handshake, 0 if unknown
+func NewRequestQueue(reqq int) *RequestQueue {
+	if reqq <= 0 {
+		reqq = _DEFAULT_REQQ
+	}
+	return &RequestQueue{
+		maxDepth:  reqq,
+		pending:   make([]*pendingRequest, 0),
+		cancelled: make(map[picker.Block]bool),
+		rate:      _INITIAL_RATE,
+	}
+}
+
+// Bytes per second received from the peer
+func (q *RequestQueue) Rate() float64 {
+	return q.rate
+}
+
+func (q *RequestQueue) Depth() int {
+	depth := int(q.rate * _PIPELINE_TIME.Seconds() / picker.BlockSize)
+	if depth < _MIN_PIPELINE {
+		depth = _MIN_PIPELINE
+	}
+	if depth > q.maxDepth {
+		depth = q.maxDepth
+	}
+	return depth
+}
+
+func (q *RequestQueue) Len() int {
+	return len(q.pending)
+}
+
+// Number of requests that can be sent right now
+func (q *RequestQueue) Free() int {
+	free := q.Depth() - len(q.pending)
+	if free < 0 {
+		return 0
+	}
+	return free
+}
+
+func (q *RequestQueue) Add(block *picker.Block, now time.Time) {
+	q.pending = append(q.pending, &pendingRequest{block: block, sentAt: now})
+}
+
+// Matches a received block against the outstanding requests. Blocks of cancelled requests
+// return neither a block nor an error
+func (q *RequestQueue) Received(index, offset, length int, now time.Time) (*picker.Block, error) {
+	for i, req := range q.pending {
+		if req.block.Index != index || req.block.Offset != offset {
+			continue
+		}
+		if req.block.Length != length {
+			return nil, fmt.Errorf("Wrong size of block %d/%d. Expected %d. Got: %d", index, offset, req.block.Length, length)
+		}
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		q.sample(length, now)
+		return req.block, nil
+	}
+
+	block := picker.Block{Index: index, Offset: offset, Length: length}
+	if q.cancelled[block] {
+		delete(q.cancelled, block)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Unsolicited block %d/%d", index, offset)
+}
+
+func (q *RequestQueue) Remove(index, offset int) *picker.Block {
+	for i, req := range q.pending {
+		if req.block.Index == index && req.block.Offset == offset {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return req.block
+		}
+	}
+	return nil
+}
+
+func (q *RequestQueue) Cancel(index, offset int) *picker.Block {
+	block := q.Remove(index, offset)
+	if block != nil {
+		q.cancelled[*block] = true
+	}
+	return block
+}
+
+// Cancels and returns requests that have been outstanding for too long
+func (q *RequestQueue) Expired(now time.Time) []*picker.Block {
+	expired := make([]*picker.Block, 0)
+	remaining := make([]*pendingRequest, 0, len(q.pending))
+	for _, req := range q.pending {
+		if now.Sub(req.sentAt) >= _REQUEST_TIMEOUT {
+			expired = append(expired, req.block)
+			q.cancelled[*req.block] = true
+		} else {
+			remaining = append(remaining, req)
+		}
+	}
+	q.pending = remaining
+	return expired
+}
+
+// Removes and returns all outstanding requests
+func (q *RequestQueue) Clear() []*picker.Block {
+	blocks := make([]*picker.Block, 0, len(q.pending))
+	for _, req := range q.pending {
+		blocks = append(blocks, req.block)
+	}
+	q.pending = make([]*pendingRequest, 0)
+	q.cancelled = make(map[picker.Block]bool)
+	return blocks
+}
+
+// Exponentially weighted average over one second samples
+func (q *RequestQueue) sample(bytes int, now time.Time) {
+	if q.sampleStart.IsZero() {
+		q.sampleStart = now
+	}
+	q.sampleBytes += bytes
+
+	elapsed := now.Sub(q.sampleStart)
+	if elapsed < _RATE_INTERVAL {
+		return
+	}
+	current := float64(q.sampleBytes) / elapsed.Seconds()
+	q.rate = q.rate*0.7 + current*0.3
+	q.sampleStart = now
+	q.sampleBytes = 0
+}
@@ -0,0 +1,134 @@
+package download
+
+import (
+	"fmt"
+	"gobby"
+	"gobby/picker"
+	"sync"
+)
+
+// Storages that can leave files out, e.g. storage.FileStorage
+type FileSkipper interface {
+	SetFileSkipped(index int, skipped bool) error
+}
+
+// Translates file priorities into piece priorities for the picker, also while downloading.
+// Skipped files are left out of the storage. Files can only be skipped if it supports that
+type FileSelector struct {
+	picker      *picker.Picker
+	skipper     FileSkipper
+	files       []*gobby.File
+	pieceLength int
+
+	mx         sync.Mutex
+	priorities []picker.Priority
+}
+
+// All files start with normal priority. The skipper is nil for storages that can't skip files,
+// e.g. memory mapped ones
+func NewFileSelector(p *picker.Picker, skipper FileSkipper, files []*gobby.File, pieceLength int) *FileSelector {
+	priorities := make([]picker.Priority, len(files))
+	for i := range priorities {
+		priorities[i] = picker.PriorityNormal
+	}
+
+	return &FileSelector{
+		picker:      p,
+		skipper:     skipper,
+		files:       files,
+		pieceLength: pieceLength,
+		priorities:  priorities,
+	}
+}
+
+func (s *FileSelector) FilePriority(index int) (picker.Priority, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if index < 0 || index >= len(s.files) {
+		return picker.PrioritySkip, fmt.Errorf("Invalid file index: %d", index)
+	}
+	return s.priorities[index], nil
+}
+
+func (s *FileSelector) SetFilePriority(index int, priority picker.Priority) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if index < 0 || index >= len(s.files) {
+		return fmt.Errorf("Invalid file index: %d", index)
+	}
+	priorities := append([]picker.Priority(nil), s.priorities...)
+	priorities[index] = priority
+	return s.apply(priorities)
+}
+
+func (s *FileSelector) SetFilePriorities(priorities []picker.Priority) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if len(priorities) != len(s.files) {
+		return fmt.Errorf("Expected %d priorities. Got: %d", len(s.files), len(priorities))
+	}
+	return s.apply(priorities)
+}
+
+// Must be called with the mutex held
+func (s *FileSelector) apply(priorities []picker.Priority) error {
+	for _, priority := range priorities {
+		if priority < picker.PrioritySkip || priority > picker.PriorityHigh {
+			return fmt.Errorf("Invalid priority: %d", priority)
+		}
+		if priority == picker.PrioritySkip && s.skipper == nil {
+			return fmt.Errorf("Storage can't skip files")
+		}
+	}
+
+	// The storage goes first, so blocks of pieces that become wanted are written to the right place
+	var err error
+	for i, priority := range priorities {
+		skipped := priority == picker.PrioritySkip
+		if skipped != (s.priorities[i] == picker.PrioritySkip) {
+			err = s.skipper.SetFileSkipped(i, skipped)
+			if err != nil {
+				err = fmt.Errorf("Failed to change file %d: %s", i, err)
+				break
+			}
+		}
+		s.priorities[i] = priority
+	}
+
+	// After a failure, the picker still follows the files changed so far
+	for index, priority := range PiecePriorities(s.files, s.pieceLength, s.priorities) {
+		if s.picker.Priority(index) != priority {
+			s.picker.SetPriority(index, priority)
+		}
+	}
+	return err
+}
+
+// A piece gets the highest priority of the files it overlaps,
+// so pieces straddling a skipped and a wanted file are still downloaded
+func PiecePriorities(files []*gobby.File, pieceLength int, priorities []picker.Priority) []picker.Priority {
+	totalLength := int64(0)
+	for _, file := range files {
+		totalLength += int64(file.Length)
+	}
+	pieceCount := int((totalLength + int64(pieceLength) - 1) / int64(pieceLength))
+
+	pieces := make([]picker.Priority, pieceCount)
+	offset := int64(0)
+	for i, file := range files {
+		if file.Length > 0 {
+			first := offset / int64(pieceLength)
+			last := (offset + int64(file.Length) - 1) / int64(pieceLength)
+			for index := first; index <= last; index++ {
+				if priorities[i] > pieces[index] {
+					pieces[index] = priorities[i]
+				}
+			}
+		}
+		offset += int64(file.Length)
+	}
+	return pieces
+}
@@ -0,0 +1,154 @@
+package ipfilter
+
+import (
+	"fmt"
+	"gobby/logs"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	_RELOAD_INTERVAL = time.Second * 30
+)
+
+// Decides which peers may be connected to. IPs in the blocklist are refused for all torrents.
+// Torrents with an allowlist only accept IPs in it, e.g. to restrict them to a corporate network
+type Filter struct {
+	mx         sync.RWMutex
+	blocklist  *RangeSet
+	allowlists map[string]*RangeSet
+	blocked    int64
+	path       string
+	modified   time.Time
+	stopOnce   sync.Once
+	stopCh     chan struct{}
+}
+
+func NewFilter() *Filter {
+	return &Filter{
+		blocklist:  NewRangeSet(),
+		allowlists: make(map[string]*RangeSet),
+		stopCh:     make(chan struct{}),
+	}
+}
+
+func (f *Filter) SetBlocklist(blocklist *RangeSet) {
+	f.mx.Lock()
+	f.blocklist = blocklist
+	f.mx.Unlock()
+}
+
+// Loads the blocklist from a file. Watch reloads it when the file changes
+func (f *Filter) LoadFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open filter list: %s", err)
+	}
+	blocklist, err := ParseFile(path)
+	if err != nil {
+		return err
+	}
+
+	f.mx.Lock()
+	f.blocklist = blocklist
+	f.path = path
+	f.modified = info.ModTime()
+	f.mx.Unlock()
+	logs.Info("IPFilter", "Loaded %d blocked ranges from %s", blocklist.Len(), path)
+	return nil
+}
+
+// Nil removes the allowlist
+func (f *Filter) SetAllowlist(infoHash []byte, allowlist *RangeSet) {
+	f.mx.Lock()
+	if allowlist == nil {
+		delete(f.allowlists, string(infoHash))
+	} else {
+		f.allowlists[string(infoHash)] = allowlist
+	}
+	f.mx.Unlock()
+}
+
+// Whether the IP may connect for the torrent. A nil info hash only consults the blocklist,
+// e.g. for incoming connections before the handshake. Refusals are counted
+func (f *Filter) Allowed(ip net.IP, infoHash []byte) bool {
+	f.mx.RLock()
+	allowed := !f.blocklist.Contains(ip)
+	if allowed && infoHash != nil {
+		if allowlist, exists := f.allowlists[string(infoHash)]; exists {
+			allowed = allowlist.Contains(ip)
+		}
+	}
+	f.mx.RUnlock()
+
+	if !allowed {
+		atomic.AddInt64(&f.blocked, 1)
+	}
+	return allowed
+}
+
+// Like Allowed, for host:port addresses. Addresses without an IP are refused
+func (f *Filter) AllowedAddress(address string, infoHash []byte) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		atomic.AddInt64(&f.blocked, 1)
+		return false
+	}
+	return f.Allowed(ip, infoHash)
+}
+
+// Number of refused connection attempts
+func (f *Filter) Blocked() int64 {
+	return atomic.LoadInt64(&f.blocked)
+}
+
+// Reloads the file given to LoadFile whenever its modification time changes
+func (f *Filter) Watch() {
+	ticker := time.NewTicker(_RELOAD_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.reload()
+		case <-f.stopCh:
+			return
+		}
+	}
+}
+
+func (f *Filter) reload() {
+	f.mx.RLock()
+	path, modified := f.path, f.modified
+	f.mx.RUnlock()
+	if path == "" {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		logs.Warn("IPFilter", "Failed to check %s: %s", path, err)
+		return
+	}
+	if info.ModTime().Equal(modified) {
+		return
+	}
+
+	err = f.LoadFile(path)
+	if err != nil {
+		logs.Warn("IPFilter", "Failed to reload %s. Keeping previous list: %s", path, err)
+	}
+}
+
+func (f *Filter) Stop() {
+	f.stopOnce.Do(func() {
+		close(f.stopCh)
+	})
+}
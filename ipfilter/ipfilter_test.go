@@ -0,0 +1,174 @@
+package ipfilter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const _TEST_LIST = `# Mixed formats
+000.000.000.000 - 000.255.255.255 , 000 , Bogon
+001.002.004.000 - 001.002.004.255 , 200 , Allowed by level
+Some Org, Inc: with colons:3.3.3.0-3.3.3.255
+10.0.0.0/8
+192.0.2.7
+2001:db8::/32
+2001:db9::1-2001:db9::ff
+// Garbage
+not an ip
+5.5.5.5 - 4.4.4.4 , 000 , Reversed
+`
+
+func TestParse(t *testing.T) {
+	set, err := Parse(strings.NewReader(_TEST_LIST))
+	if err != nil {
+		t.Fatalf("Failed to parse list: %s", err)
+	}
+
+	cases := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"0.0.0.0", true},
+		{"0.255.255.255", true},
+		{"1.0.0.0", false},
+		{"1.2.4.10", false},
+		{"3.3.3.0", true},
+		{"3.3.3.255", true},
+		{"3.3.4.0", false},
+		{"10.200.1.1", true},
+		{"11.0.0.0", false},
+		{"192.0.2.7", true},
+		{"192.0.2.8", false},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::80", true},
+		{"2001:db9::100", false},
+		{"5.0.0.0", false},
+	}
+	for _, c := range cases {
+		if set.Contains(net.ParseIP(c.ip)) != c.blocked {
+			t.Fatalf("Expected %s blocked: %v", c.ip, c.blocked)
+		}
+	}
+	if set.Len() != 6 {
+		t.Fatalf("Expected 6 ranges. Got: %d", set.Len())
+	}
+}
+
+func TestRangeSetMerge(t *testing.T) {
+	set := NewRangeSet()
+	set.AddRange(net.IPv4(1, 0, 0, 10), net.IPv4(1, 0, 0, 20))
+	set.AddRange(net.IPv4(1, 0, 0, 30), net.IPv4(1, 0, 0, 40))
+	set.AddRange(net.IPv4(1, 0, 0, 50), net.IPv4(1, 0, 0, 60))
+	if set.Len() != 3 {
+		t.Fatalf("Expected 3 ranges. Got: %d", set.Len())
+	}
+
+	// Overlaps the first two
+	set.AddRange(net.IPv4(1, 0, 0, 15), net.IPv4(1, 0, 0, 35))
+	// Borders the last one
+	set.AddRange(net.IPv4(1, 0, 0, 61), net.IPv4(1, 0, 0, 70))
+	if set.Len() != 2 {
+		t.Fatalf("Expected 2 ranges. Got: %d", set.Len())
+	}
+	for _, ip := range []net.IP{net.IPv4(1, 0, 0, 10), net.IPv4(1, 0, 0, 25), net.IPv4(1, 0, 0, 40), net.IPv4(1, 0, 0, 70)} {
+		if !set.Contains(ip) {
+			t.Fatalf("Expected %s to be contained", ip)
+		}
+	}
+	for _, ip := range []net.IP{net.IPv4(1, 0, 0, 9), net.IPv4(1, 0, 0, 45), net.IPv4(1, 0, 0, 71)} {
+		if set.Contains(ip) {
+			t.Fatalf("Expected %s not to be contained", ip)
+		}
+	}
+
+	// Covers everything
+	set.AddRange(net.IPv4(1, 0, 0, 0), net.IPv4(1, 0, 0, 255))
+	if set.Len() != 1 {
+		t.Fatalf("Expected 1 range. Got: %d", set.Len())
+	}
+}
+
+func TestRangeSetInvalid(t *testing.T) {
+	set := NewRangeSet()
+	if set.AddRange(net.IPv4(1, 0, 0, 2), net.IPv4(1, 0, 0, 1)) == nil {
+		t.Fatalf("Expected reversed range to fail")
+	}
+	if set.AddRange(net.IPv4(1, 0, 0, 1), net.ParseIP("2001:db8::1")) == nil {
+		t.Fatalf("Expected mixed range to fail")
+	}
+	if set.Contains(nil) {
+		t.Fatalf("Expected nil IP not to be contained")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	infoHash := []byte("01234567890123456789")
+	blocklist, _ := Parse(strings.NewReader("10.1.0.0/16"))
+	allowlist, _ := Parse(strings.NewReader("10.0.0.0/8"))
+
+	filter := NewFilter()
+	filter.SetBlocklist(blocklist)
+	filter.SetAllowlist(infoHash, allowlist)
+
+	if !filter.AllowedAddress("192.0.2.1:6881", nil) {
+		t.Fatalf("Expected IP to be allowed without torrent")
+	}
+	if filter.AllowedAddress("192.0.2.1:6881", infoHash) {
+		t.Fatalf("Expected IP outside allowlist to be refused")
+	}
+	if !filter.AllowedAddress("10.2.0.1:6881", infoHash) {
+		t.Fatalf("Expected IP in allowlist to be allowed")
+	}
+	if filter.AllowedAddress("10.1.0.1:6881", infoHash) {
+		t.Fatalf("Expected blocklist to take precedence")
+	}
+	if !filter.AllowedAddress("192.0.2.1:6881", []byte("other torrent")) {
+		t.Fatalf("Expected torrent without allowlist to allow IP")
+	}
+	if filter.Blocked() != 2 {
+		t.Fatalf("Expected 2 blocked attempts. Got: %d", filter.Blocked())
+	}
+
+	filter.SetAllowlist(infoHash, nil)
+	if !filter.AllowedAddress("192.0.2.1:6881", infoHash) {
+		t.Fatalf("Expected IP to be allowed after removing allowlist")
+	}
+}
+
+func TestFilterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.p2p")
+	err := os.WriteFile(path, []byte("Test:1.1.1.0-1.1.1.255\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write list: %s", err)
+	}
+
+	filter := NewFilter()
+	err = filter.LoadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load list: %s", err)
+	}
+	if filter.Allowed(net.IPv4(1, 1, 1, 1), nil) {
+		t.Fatalf("Expected IP to be blocked")
+	}
+
+	// Unchanged file is not reloaded
+	filter.reload()
+
+	os.WriteFile(path, []byte("Test:2.2.2.0-2.2.2.255\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	filter.reload()
+	if !filter.Allowed(net.IPv4(1, 1, 1, 1), nil) || filter.Allowed(net.IPv4(2, 2, 2, 2), nil) {
+		t.Fatalf("Expected reloaded list to be used")
+	}
+
+	// A broken file keeps the previous list
+	os.Remove(path)
+	filter.reload()
+	if filter.Allowed(net.IPv4(2, 2, 2, 2), nil) {
+		t.Fatalf("Expected previous list to be kept")
+	}
+}
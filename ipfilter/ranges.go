@@ -0,0 +1,243 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"gobby/logs"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// eMule DAT entries with a higher access level are allowed
+	_MAX_BLOCKED_LEVEL = 127
+)
+
+type ipRange struct {
+	start [16]byte
+	end   [16]byte
+}
+
+// Sorted, non-overlapping IP ranges. IPv4 addresses are stored IPv4-mapped
+type RangeSet struct {
+	ranges []ipRange
+}
+
+func NewRangeSet() *RangeSet {
+	return &RangeSet{ranges: make([]ipRange, 0)}
+}
+
+func (s *RangeSet) Len() int {
+	return len(s.ranges)
+}
+
+func (s *RangeSet) Contains(ip net.IP) bool {
+	key, ok := toKey(ip)
+	if !ok {
+		return false
+	}
+
+	// First range ending at or after the IP
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return bytes.Compare(s.ranges[i].end[:], key[:]) >= 0
+	})
+	return i < len(s.ranges) && bytes.Compare(s.ranges[i].start[:], key[:]) <= 0
+}
+
+// Adds an inclusive range. Both ends must be of the same family
+func (s *RangeSet) AddRange(start, end net.IP) error {
+	startKey, ok := toKey(start)
+	if !ok {
+		return fmt.Errorf("Invalid IP: %s", start)
+	}
+	endKey, ok := toKey(end)
+	if !ok {
+		return fmt.Errorf("Invalid IP: %s", end)
+	}
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return fmt.Errorf("Mixed address families in range %s - %s", start, end)
+	}
+	if bytes.Compare(startKey[:], endKey[:]) > 0 {
+		return fmt.Errorf("Range start %s after end %s", start, end)
+	}
+
+	s.insert(ipRange{startKey, endKey})
+	return nil
+}
+
+func (s *RangeSet) AddCIDR(network *net.IPNet) error {
+	start := network.IP.Mask(network.Mask)
+	if start == nil {
+		return fmt.Errorf("Invalid network: %s", network)
+	}
+	end := make(net.IP, len(start))
+	for i := range start {
+		end[i] = start[i] | ^network.Mask[i]
+	}
+	return s.AddRange(start, end)
+}
+
+// Merges the range with the ones it overlaps or borders
+func (s *RangeSet) insert(r ipRange) {
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return bytes.Compare(s.ranges[i].end[:], r.start[:]) >= 0 || adjacent(s.ranges[i].end, r.start)
+	})
+	j := i
+	for j < len(s.ranges) && (bytes.Compare(s.ranges[j].start[:], r.end[:]) <= 0 || adjacent(r.end, s.ranges[j].start)) {
+		if bytes.Compare(s.ranges[j].start[:], r.start[:]) < 0 {
+			r.start = s.ranges[j].start
+		}
+		if bytes.Compare(s.ranges[j].end[:], r.end[:]) > 0 {
+			r.end = s.ranges[j].end
+		}
+		j++
+	}
+
+	merged := append(make([]ipRange, 0, len(s.ranges)-(j-i)+1), s.ranges[:i]...)
+	merged = append(merged, r)
+	s.ranges = append(merged, s.ranges[j:]...)
+}
+
+// Whether b directly follows a
+func adjacent(a, b [16]byte) bool {
+	for i := 15; i >= 0; i-- {
+		a[i]++
+		if a[i] != 0 {
+			break
+		}
+	}
+	return a == b
+}
+
+func toKey(ip net.IP) (key [16]byte, ok bool) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return key, false
+	}
+	copy(key[:], ip16)
+	return key, true
+}
+
+func ParseFile(path string) (*RangeSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open filter list: %s", err)
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+// Reads eMule DAT, PeerGuardian P2P and CIDR lists, also mixed in a single file.
+// Invalid lines are skipped, as published lists commonly contain a few
+func Parse(reader io.Reader) (*RangeSet, error) {
+	set := NewRangeSet()
+	scanner := bufio.NewScanner(reader)
+	invalid := 0
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		err := parseLine(set, line)
+		if err != nil {
+			invalid++
+			logs.Debug("IPFilter", "Skipping line %d: %s", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read filter list: %s", err)
+	}
+
+	if invalid > 0 {
+		logs.Warn("IPFilter", "Skipped %d invalid lines", invalid)
+	}
+	return set, nil
+}
+
+func parseLine(set *RangeSet, line string) error {
+	// CIDR, or a single IP
+	if parseIP(line) != nil || strings.Contains(line, "/") && !strings.Contains(line, "-") {
+		return parseCIDR(set, line)
+	}
+
+	// eMule DAT: "start - end , level , description"
+	if strings.Contains(line, ",") {
+		fields := strings.SplitN(line, ",", 3)
+		if len(fields) >= 2 {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err == nil {
+				if level > _MAX_BLOCKED_LEVEL {
+					return nil
+				}
+				return parseRange(set, fields[0])
+			}
+		}
+	}
+
+	// P2P: "description:start-end". The description may contain colons itself
+	if separator := strings.LastIndex(line, ":"); separator >= 0 && strings.Count(line[separator:], ".") >= 3 {
+		return parseRange(set, line[separator+1:])
+	}
+
+	// IPv6 ranges have no description
+	return parseRange(set, line)
+}
+
+func parseCIDR(set *RangeSet, value string) error {
+	if !strings.Contains(value, "/") {
+		ip := parseIP(value)
+		if ip == nil {
+			return fmt.Errorf("Invalid IP: %s", value)
+		}
+		return set.AddRange(ip, ip)
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return fmt.Errorf("Invalid CIDR: %s", value)
+	}
+	return set.AddCIDR(network)
+}
+
+func parseRange(set *RangeSet, value string) error {
+	ends := strings.SplitN(value, "-", 2)
+	if len(ends) != 2 {
+		return fmt.Errorf("Invalid range: %s", value)
+	}
+	start := parseIP(strings.TrimSpace(ends[0]))
+	end := parseIP(strings.TrimSpace(ends[1]))
+	if start == nil || end == nil {
+		return fmt.Errorf("Invalid range: %s", value)
+	}
+	return set.AddRange(start, end)
+}
+
+// Also accepts zero padded IPv4 addresses like 001.002.003.004, as used by DAT lists
+func parseIP(value string) net.IP {
+	if ip := net.ParseIP(value); ip != nil {
+		return ip
+	}
+
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, part := range parts {
+		octet, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil
+		}
+		ip[i] = byte(octet)
+	}
+	return ip
+}
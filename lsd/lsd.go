@@ -0,0 +1,295 @@
+package lsd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gobby/logs"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_MULTICAST_ADDRESS = "239.192.152.143:6771"
+	_ANNOUNCE_INTERVAL = time.Minute * 5
+	_MIN_SEND_INTERVAL = time.Minute
+	_CHECK_INTERVAL    = time.Second * 5
+	_MAX_DATAGRAM_SIZE = 1400
+)
+
+type Registry interface {
+	PublicInfoHashes() [][]byte
+}
+
+type Peer struct {
+	InfoHash []byte
+	Address  *net.TCPAddr
+}
+
+// Local Service Discovery (BEP 14)
+type LocalDiscovery struct {
+	port      int
+	cookie    string
+	registry  Registry
+	group     *net.UDPAddr
+	announced map[string]time.Time
+	lastSent  time.Time
+
+	mx       sync.Mutex
+	socket   *net.UDPConn
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func NewLocalDiscovery(port int, registry Registry) (*LocalDiscovery, error) {
+	group, err := net.ResolveUDPAddr("udp4", _MULTICAST_ADDRESS)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve multicast address: %s", err)
+	}
+
+	cookie := make([]byte, 4)
+	_, err = rand.Read(cookie)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate cookie: %s", err)
+	}
+
+	discovery := &LocalDiscovery{
+		port:      port,
+		cookie:    hex.EncodeToString(cookie),
+		registry:  registry,
+		group:     group,
+		announced: make(map[string]time.Time),
+		stopCh:    make(chan struct{}),
+	}
+	return discovery, nil
+}
+
+func (d *LocalDiscovery) Stop() {
+	d.stopOnce.Do(func() {
+		d.mx.Lock()
+		close(d.stopCh)
+		if d.socket != nil {
+			d.socket.Close()
+		}
+		d.mx.Unlock()
+	})
+}
+
+// Blocks until stopped. Discovered peers of registered public torrents are passed
+// to addCandidate, e.g. ConnectionManager.AddCandidate
+func (d *LocalDiscovery) Run(addCandidate func(infoHash []byte, address *net.TCPAddr, supportsUTP bool)) error {
+	socket, err := net.ListenMulticastUDP("udp4", nil, d.group)
+	if err != nil {
+		return fmt.Errorf("Failed to join multicast group: %s", err)
+	}
+	// Stop may have been called before the socket existed
+	d.mx.Lock()
+	select {
+	case <-d.stopCh:
+		d.mx.Unlock()
+		socket.Close()
+		return nil
+	default:
+	}
+	d.socket = socket
+	d.mx.Unlock()
+
+	sender, err := net.DialUDP("udp4", nil, d.group)
+	if err != nil {
+		socket.Close()
+		return fmt.Errorf("Failed to open multicast sending socket: %s", err)
+	}
+	defer sender.Close()
+
+	go d.receiving(socket, addCandidate)
+
+	ticker := time.NewTicker(_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	d.announceDue(sender, time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			d.announceDue(sender, now)
+		case <-d.stopCh:
+			logs.Info("LSD", "Stopping local service discovery")
+			return nil
+		}
+	}
+}
+
+// Info hashes stay due until all of their datagrams were sent
+func (d *LocalDiscovery) announceDue(sender io.Writer, now time.Time) {
+	infoHashes := d.dueInfoHashes(now)
+	if len(infoHashes) == 0 {
+		return
+	}
+
+	for _, datagram := range encodeAnnounces(d.port, d.cookie, infoHashes) {
+		_, err := sender.Write(datagram)
+		if err != nil {
+			logs.Warn("LSD", "Failed to send announce: %s", err)
+			return
+		}
+	}
+	for _, infoHash := range infoHashes {
+		d.announced[string(infoHash)] = now
+	}
+	logs.Debug("LSD", "Announced %d info hashes", len(infoHashes))
+}
+
+// Returns info hashes that need announcing. At most one batch of announces is
+// attempted per _MIN_SEND_INTERVAL, and each torrent is announced once per _ANNOUNCE_INTERVAL
+func (d *LocalDiscovery) dueInfoHashes(now time.Time) [][]byte {
+	if !d.lastSent.IsZero() && now.Sub(d.lastSent) < _MIN_SEND_INTERVAL {
+		return nil
+	}
+
+	registered := make(map[string]bool)
+	due := make([][]byte, 0)
+	for _, infoHash := range d.registry.PublicInfoHashes() {
+		registered[string(infoHash)] = true
+		last, exists := d.announced[string(infoHash)]
+		if !exists || now.Sub(last) >= _ANNOUNCE_INTERVAL {
+			due = append(due, infoHash)
+		}
+	}
+
+	for infoHash := range d.announced {
+		if !registered[infoHash] {
+			delete(d.announced, infoHash)
+		}
+	}
+
+	if len(due) == 0 {
+		return nil
+	}
+	d.lastSent = now
+	return due
+}
+
+func (d *LocalDiscovery) receiving(socket *net.UDPConn, addCandidate func([]byte, *net.TCPAddr, bool)) {
+	data := make([]byte, _MAX_DATAGRAM_SIZE)
+
+	for {
+		rc, source, err := socket.ReadFromUDP(data)
+		if err != nil {
+			select {
+			case <-d.stopCh:
+			default:
+				logs.Warn("LSD", "Failed to read announce: %s", err)
+			}
+			return
+		}
+
+		for _, peer := range d.discovered(data[:rc], source) {
+			addCandidate(peer.InfoHash, peer.Address, false)
+		}
+	}
+}
+
+// Peers of registered public torrents in an announce
+func (d *LocalDiscovery) discovered(data []byte, source *net.UDPAddr) []*Peer {
+	port, infoHashes, cookie, err := parseAnnounce(data)
+	if err != nil {
+		logs.Debug("LSD", "Invalid announce from %s: %s", source.String(), err)
+		return nil
+	}
+	if cookie == d.cookie {
+		return nil
+	}
+
+	public := make(map[string]bool)
+	for _, infoHash := range d.registry.PublicInfoHashes() {
+		public[string(infoHash)] = true
+	}
+
+	peers := make([]*Peer, 0, len(infoHashes))
+	address := &net.TCPAddr{IP: source.IP, Port: port}
+	for _, infoHash := range infoHashes {
+		if public[string(infoHash)] {
+			peers = append(peers, &Peer{InfoHash: infoHash, Address: address})
+		}
+	}
+	return peers
+}
+
+func encodeAnnounces(port int, cookie string, infoHashes [][]byte) [][]byte {
+	header := "BT-SEARCH * HTTP/1.1\r\n" +
+		"Host: " + _MULTICAST_ADDRESS + "\r\n" +
+		"Port: " + strconv.Itoa(port) + "\r\n"
+	trailer := "cookie: " + cookie + "\r\n\r\n\r\n"
+
+	datagrams := make([][]byte, 0)
+	buf := bytes.NewBufferString(header)
+	count := 0
+	for _, infoHash := range infoHashes {
+		line := "Infohash: " + hex.EncodeToString(infoHash) + "\r\n"
+		if count > 0 && buf.Len()+len(line)+len(trailer) > _MAX_DATAGRAM_SIZE {
+			buf.WriteString(trailer)
+			datagrams = append(datagrams, buf.Bytes())
+			buf = bytes.NewBufferString(header)
+			count = 0
+		}
+		buf.WriteString(line)
+		count++
+	}
+	buf.WriteString(trailer)
+	datagrams = append(datagrams, buf.Bytes())
+
+	return datagrams
+}
+
+func parseAnnounce(data []byte) (int, [][]byte, string, error) {
+	lines := strings.Split(string(data), "\r\n")
+	if lines[0] != "BT-SEARCH * HTTP/1.1" {
+		return 0, nil, "", fmt.Errorf("Invalid request line: %s", lines[0])
+	}
+
+	var port int
+	var cookie string
+	infoHashes := make([][]byte, 0)
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			return 0, nil, "", fmt.Errorf("Invalid header: %s", line)
+		}
+		value := strings.TrimSpace(split[1])
+
+		switch strings.ToLower(strings.TrimSpace(split[0])) {
+		case "port":
+			parsedPort, err := strconv.Atoi(value)
+			if err != nil || parsedPort <= 0 || parsedPort > 65535 {
+				return 0, nil, "", fmt.Errorf("Invalid port: %s", value)
+			}
+			port = parsedPort
+		case "infohash":
+			infoHash, err := hex.DecodeString(value)
+			if err != nil || len(infoHash) != 20 {
+				return 0, nil, "", fmt.Errorf("Invalid info hash: %s", value)
+			}
+			infoHashes = append(infoHashes, infoHash)
+		case "cookie":
+			cookie = value
+		}
+	}
+
+	if port == 0 {
+		return 0, nil, "", errors.New("Missing port")
+	}
+	if len(infoHashes) == 0 {
+		return 0, nil, "", errors.New("Missing info hash")
+	}
+
+	return port, infoHashes, cookie, nil
+}
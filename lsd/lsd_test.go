@@ -0,0 +1,187 @@
+package lsd
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type mockRegistry struct {
+	infoHashes [][]byte
+}
+
+func (r *mockRegistry) PublicInfoHashes() [][]byte {
+	return r.infoHashes
+}
+
+func TestEncodingParsingAnnounce(t *testing.T) {
+	infoHashes := [][]byte{
+		[]byte("11111111111111111111"),
+		[]byte("22222222222222222222"),
+	}
+
+	datagrams := encodeAnnounces(6881, "abcd", infoHashes)
+	if len(datagrams) != 1 {
+		t.Fatalf("Expected 1 datagram. Got: %d", len(datagrams))
+	}
+
+	port, parsedInfoHashes, cookie, err := parseAnnounce(datagrams[0])
+	if err != nil {
+		t.Fatalf("Failed to parse announce: %s", err)
+	}
+	if port != 6881 {
+		t.Fatalf("Expected port 6881. Got: %d", port)
+	}
+	if cookie != "abcd" {
+		t.Fatalf("Expected cookie abcd. Got: %s", cookie)
+	}
+	if len(parsedInfoHashes) != 2 {
+		t.Fatalf("Expected 2 info hashes. Got: %d", len(parsedInfoHashes))
+	}
+	for i, infoHash := range parsedInfoHashes {
+		if !bytes.Equal(infoHash, infoHashes[i]) {
+			t.Fatalf("Expected info hash %v. Got: %v", infoHashes[i], infoHash)
+		}
+	}
+}
+
+func TestEncodingSplitsDatagrams(t *testing.T) {
+	infoHashes := make([][]byte, 100)
+	for i := range infoHashes {
+		infoHashes[i] = bytes.Repeat([]byte{byte(i)}, 20)
+	}
+
+	datagrams := encodeAnnounces(6881, "abcd", infoHashes)
+	if len(datagrams) < 2 {
+		t.Fatalf("Expected multiple datagrams. Got: %d", len(datagrams))
+	}
+
+	total := 0
+	for _, datagram := range datagrams {
+		if len(datagram) > _MAX_DATAGRAM_SIZE {
+			t.Fatalf("Datagram too long: %d", len(datagram))
+		}
+		_, parsedInfoHashes, _, err := parseAnnounce(datagram)
+		if err != nil {
+			t.Fatalf("Failed to parse announce: %s", err)
+		}
+		total += len(parsedInfoHashes)
+	}
+	if total != len(infoHashes) {
+		t.Fatalf("Expected %d info hashes. Got: %d", len(infoHashes), total)
+	}
+}
+
+func TestParsingInvalidAnnounce(t *testing.T) {
+	inputs := []string{
+		"GET / HTTP/1.1\r\nPort: 6881\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nInfohash: 3131313131313131313131313131313131313131\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 3131\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: 3131313131313131313131313131313131313131\r\n\r\n",
+	}
+
+	for _, input := range inputs {
+		_, _, _, err := parseAnnounce([]byte(input))
+		if err == nil {
+			t.Fatalf("Expected error for input: %q", input)
+		}
+	}
+}
+
+type mockSender struct {
+	sent int
+	fail bool
+}
+
+func (s *mockSender) Write(data []byte) (int, error) {
+	if s.fail {
+		return 0, errors.New("Network unreachable")
+	}
+	s.sent++
+	return len(data), nil
+}
+
+func TestAnnounceRateLimiting(t *testing.T) {
+	registry := &mockRegistry{[][]byte{[]byte("11111111111111111111")}}
+	discovery, err := NewLocalDiscovery(6881, registry)
+	if err != nil {
+		t.Fatalf("Failed to create local discovery: %s", err)
+	}
+	sender := &mockSender{}
+
+	now := time.Now()
+	discovery.announceDue(sender, now)
+	if sender.sent != 1 {
+		t.Fatalf("Expected 1 announce. Got: %d", sender.sent)
+	}
+
+	registry.infoHashes = append(registry.infoHashes, []byte("22222222222222222222"))
+	if due := discovery.dueInfoHashes(now.Add(time.Second * 10)); len(due) != 0 {
+		t.Fatalf("Expected no due info hashes within send interval. Got: %d", len(due))
+	}
+
+	due := discovery.dueInfoHashes(now.Add(_MIN_SEND_INTERVAL))
+	if len(due) != 1 || string(due[0]) != "22222222222222222222" {
+		t.Fatalf("Expected only the new info hash to be due. Got: %v", due)
+	}
+
+	// Failed announces stay due
+	sender.fail = true
+	discovery.announceDue(sender, now.Add(_MIN_SEND_INTERVAL*2))
+	sender.fail = false
+	discovery.announceDue(sender, now.Add(_MIN_SEND_INTERVAL*3))
+	if sender.sent != 2 {
+		t.Fatalf("Expected the failed announce to be retried. Got: %d sent", sender.sent)
+	}
+
+	due = discovery.dueInfoHashes(now.Add(_ANNOUNCE_INTERVAL))
+	if len(due) != 1 || string(due[0]) != "11111111111111111111" {
+		t.Fatalf("Expected only the old info hash to be due. Got: %v", due)
+	}
+}
+
+func TestDiscoveredPeers(t *testing.T) {
+	public := []byte("11111111111111111111")
+	d, err := NewLocalDiscovery(6881, &mockRegistry{infoHashes: [][]byte{public}})
+	if err != nil {
+		t.Fatalf("Failed to create discovery: %s", err)
+	}
+	source := &net.UDPAddr{IP: net.ParseIP("192.168.1.5"), Port: 6771}
+
+	datagram := encodeAnnounces(51413, "abcd", [][]byte{public, []byte("22222222222222222222")})[0]
+	peers := d.discovered(datagram, source)
+	if len(peers) != 1 || !bytes.Equal(peers[0].InfoHash, public) || peers[0].Address.String() != "192.168.1.5:51413" {
+		t.Fatalf("Expected only the public torrent's peer. Got: %v", peers)
+	}
+
+	own := encodeAnnounces(6881, d.cookie, [][]byte{public})[0]
+	if peers := d.discovered(own, source); len(peers) != 0 {
+		t.Fatalf("Expected own announces to be ignored. Got: %v", peers)
+	}
+}
+
+func TestStopBeforeRun(t *testing.T) {
+	d, err := NewLocalDiscovery(6881, &mockRegistry{})
+	if err != nil {
+		t.Fatalf("Failed to create discovery: %s", err)
+	}
+	d.Stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- d.Run(func([]byte, *net.TCPAddr, bool) {})
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Skipf("Multicast unavailable: %s", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Expected Run to return after Stop")
+	}
+	if d.socket != nil {
+		t.Fatalf("Expected socket to be closed without being kept")
+	}
+}
@@ -0,0 +1,458 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"gobby"
+	"gobby/logs"
+	"gobby/pwp"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ExtensionName          = "ut_metadata"
+	_PIECE_SIZE            = 16 * 1024
+	_MAX_METADATA_SIZE     = 8 * 1024 * 1024
+	_MAX_REQUESTS_PER_PEER = 2
+	_REQUEST_TIMEOUT       = time.Second * 30
+	_TICK_INTERVAL         = time.Second * 5
+)
+
+type peerState struct {
+	remoteID byte
+	send     func(pwp.Message)
+	// Metadata size from the peer's extended handshake, 0 if unknown
+	size int
+	// False once the peer rejected, timed out or sent bad data
+	usable      bool
+	outstanding int
+}
+
+type pendingRequest struct {
+	peer   string
+	sentAt time.Time
+}
+
+type outgoing struct {
+	send func(pwp.Message)
+	msg  pwp.Message
+}
+
+// Metadata exchange (BEP 9) state of a single torrent.
+// Fetches the info dictionary from peers until it is known, and serves it afterwards.
+// The metadata size reported by peers is only trusted once the metadata matches the info hash
+type Exchange struct {
+	infoHash []byte
+	mx       sync.Mutex
+	metafile *gobby.Metafile
+	// Size being fetched, 0 until a peer reported one
+	size     int
+	pieces   [][]byte
+	sources  []string
+	requests map[int]*pendingRequest
+	peers    map[string]*peerState
+	doneCh   chan *gobby.Metafile
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func NewExchange(infoHash []byte) *Exchange {
+	return &Exchange{
+		infoHash: infoHash,
+		requests: make(map[int]*pendingRequest),
+		peers:    make(map[string]*peerState),
+		doneCh:   make(chan *gobby.Metafile, 1),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Only serves metadata of an already known torrent
+func NewExchangeFromMetafile(metafile *gobby.Metafile) *Exchange {
+	exchange := NewExchange(metafile.InfoHash)
+	exchange.metafile = metafile
+	exchange.size = len(metafile.Info)
+	exchange.doneCh <- metafile
+	return exchange
+}
+
+// Receives the metafile once the metadata is assembled and verified against the info hash
+func (e *Exchange) Done() <-chan *gobby.Metafile {
+	return e.doneCh
+}
+
+// For the metadata_size field of the extended handshake. 0 while unknown
+func (e *Exchange) MetadataSize() int {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if e.metafile == nil {
+		return 0
+	}
+	return e.size
+}
+
+// Blocks until stopped, periodically expiring requests to peers that don't respond
+func (e *Exchange) Run() {
+	ticker := time.NewTicker(_TICK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			e.Tick(now)
+		case <-e.stopCh:
+			return
+		}
+	}
+}
+
+func (e *Exchange) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.stopCh)
+	})
+}
+
+// Requests that timed out are sent to other peers
+func (e *Exchange) Tick(now time.Time) {
+	e.mx.Lock()
+	toSend := e.scheduleRequests(now)
+	e.mx.Unlock()
+
+	sendAll(toSend)
+}
+
+func (e *Exchange) PeerDisconnected(address *net.TCPAddr) {
+	e.mx.Lock()
+	key := address.String()
+	delete(e.peers, key)
+	e.releaseRequests(key)
+	toSend := e.scheduleRequests(time.Now())
+	e.mx.Unlock()
+
+	sendAll(toSend)
+}
+
+func (e *Exchange) Name() string {
+	return ExtensionName
+}
+
+// Advertises the metadata size once the metadata is known, so peers can fetch it from us
+func (e *Exchange) ExtendHandshake(handshake *pwp.ExtendedHandshake) {
+	if size := e.MetadataSize(); size > 0 {
+		handshake.MetadataSize = size
+	}
+}
+
+func (e *Exchange) NewExtension(conn *pwp.PeerConnection, send func(pwp.Message)) pwp.ExtensionHandler {
+	return &extension{
+		exchange: e,
+		key:      conn.Address.String(),
+		send:     send,
+	}
+}
+
+func (e *Exchange) peerNegotiated(key string, remoteID byte, metadataSize int, send func(pwp.Message)) {
+	e.mx.Lock()
+	if remoteID == 0 {
+		delete(e.peers, key)
+		e.releaseRequests(key)
+		toSend := e.scheduleRequests(time.Now())
+		e.mx.Unlock()
+
+		sendAll(toSend)
+		return
+	}
+
+	peer, exists := e.peers[key]
+	if !exists {
+		peer = &peerState{usable: true}
+		e.peers[key] = peer
+	}
+	peer.remoteID = remoteID
+	peer.send = send
+	peer.size = 0
+	if metadataSize > 0 && metadataSize <= _MAX_METADATA_SIZE {
+		peer.size = metadataSize
+	}
+	if e.metafile == nil && e.size > 0 && peer.size != e.size {
+		logs.Debug("Metadata", "Peer %s reports metadata size %d, expected %d", key, metadataSize, e.size)
+	}
+
+	toSend := e.scheduleRequests(time.Now())
+	e.mx.Unlock()
+
+	sendAll(toSend)
+}
+
+func (e *Exchange) handleMessage(key string, payload []byte) error {
+	msg, err := decodeMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	e.mx.Lock()
+	peer, exists := e.peers[key]
+	if !exists {
+		e.mx.Unlock()
+		return errors.New("Metadata message from peer without ut_metadata support")
+	}
+
+	var toSend []*outgoing
+	switch msg.msgType {
+	case _MSG_REQUEST:
+		toSend = []*outgoing{e.serve(peer, msg.piece)}
+	case _MSG_DATA:
+		err = e.receivePiece(key, peer, msg)
+		if err == nil {
+			toSend = e.scheduleRequests(time.Now())
+		}
+	case _MSG_REJECT:
+		if request, requested := e.requests[msg.piece]; requested && request.peer == key {
+			delete(e.requests, msg.piece)
+			peer.outstanding--
+		}
+		// Peers rejecting requests are most likely not going to serve us later either
+		peer.usable = false
+		toSend = e.scheduleRequests(time.Now())
+	default:
+		// BEP 9: unknown message types must be ignored
+		logs.Debug("Metadata", "Ignoring metadata message of unknown type %d from %s", msg.msgType, key)
+	}
+	e.mx.Unlock()
+
+	sendAll(toSend)
+	return err
+}
+
+func (e *Exchange) serve(peer *peerState, piece int) *outgoing {
+	response := &message{
+		msgType: _MSG_REJECT,
+		piece:   piece,
+	}
+
+	if e.metafile != nil && piece*_PIECE_SIZE < e.size {
+		end := (piece + 1) * _PIECE_SIZE
+		if end > e.size {
+			end = e.size
+		}
+		response.msgType = _MSG_DATA
+		response.totalSize = e.size
+		response.data = e.metafile.Info[piece*_PIECE_SIZE : end]
+	}
+
+	return newOutgoing(peer, response)
+}
+
+func (e *Exchange) receivePiece(key string, peer *peerState, msg *message) error {
+	request, requested := e.requests[msg.piece]
+	if !requested || request.peer != key {
+		return fmt.Errorf("Unsolicited metadata piece %d", msg.piece)
+	}
+	delete(e.requests, msg.piece)
+	peer.outstanding--
+
+	if msg.totalSize != e.size {
+		peer.usable = false
+		return fmt.Errorf("Metadata size missmatch: %d and %d", msg.totalSize, e.size)
+	}
+	if len(msg.data) != e.pieceLength(msg.piece) {
+		peer.usable = false
+		return fmt.Errorf("Invalid metadata piece %d length: %d", msg.piece, len(msg.data))
+	}
+
+	data := make([]byte, len(msg.data))
+	copy(data, msg.data)
+	e.pieces[msg.piece] = data
+	e.sources[msg.piece] = key
+
+	for _, piece := range e.pieces {
+		if piece == nil {
+			return nil
+		}
+	}
+
+	encodedInfo := bytes.Join(e.pieces, nil)
+	infoHash := sha1.Sum(encodedInfo)
+	if !bytes.Equal(infoHash[:], e.infoHash) {
+		logs.Warn("Metadata", "Assembled metadata does not match info hash. Starting over")
+		e.discardPieces()
+		return nil
+	}
+
+	metafile, err := gobby.DecodeInfo(encodedInfo)
+	if err != nil {
+		logs.Warn("Metadata", "Assembled metadata is invalid: %s", err)
+		e.discardPieces()
+		return nil
+	}
+
+	logs.Info("Metadata", "Fetched metadata of %d bytes", e.size)
+	e.metafile = metafile
+	e.pieces = nil
+	e.sources = nil
+	e.doneCh <- metafile
+	return nil
+}
+
+// Assigns missing pieces to usable peers. Must be called with the mutex held
+func (e *Exchange) scheduleRequests(now time.Time) []*outgoing {
+	if e.metafile != nil {
+		return nil
+	}
+
+	for piece, request := range e.requests {
+		if now.Sub(request.sentAt) >= _REQUEST_TIMEOUT {
+			if peer, exists := e.peers[request.peer]; exists {
+				peer.outstanding--
+				// Would be asked again otherwise
+				peer.usable = false
+			}
+			delete(e.requests, piece)
+		}
+	}
+	e.selectSize()
+	if e.pieces == nil {
+		return nil
+	}
+
+	toSend := make([]*outgoing, 0)
+	for piece, data := range e.pieces {
+		if data != nil {
+			continue
+		}
+		if _, requested := e.requests[piece]; requested {
+			continue
+		}
+
+		for key, peer := range e.peers {
+			if !e.canRequest(peer) || peer.outstanding >= _MAX_REQUESTS_PER_PEER {
+				continue
+			}
+
+			peer.outstanding++
+			e.requests[piece] = &pendingRequest{
+				peer:   key,
+				sentAt: now,
+			}
+			toSend = append(toSend, newOutgoing(peer, &message{msgType: _MSG_REQUEST, piece: piece}))
+			break
+		}
+	}
+
+	return toSend
+}
+
+func (e *Exchange) canRequest(peer *peerState) bool {
+	return peer.usable && e.size > 0 && peer.size == e.size
+}
+
+// Once no usable peer reports the size being fetched, e.g. because it was bogus, the pieces
+// are discarded and the size reported by most other usable peers is fetched instead.
+// Must be called with the mutex held
+func (e *Exchange) selectSize() {
+	counts := make(map[int]int)
+	for _, peer := range e.peers {
+		if e.canRequest(peer) {
+			return
+		}
+		if peer.usable && peer.size > 0 {
+			counts[peer.size]++
+		}
+	}
+
+	size := 0
+	for candidate, count := range counts {
+		if size == 0 || count > counts[size] || (count == counts[size] && candidate < size) {
+			size = candidate
+		}
+	}
+	// Without an alternative, pieces are kept for peers with the current size connecting later
+	if size == 0 || size == e.size {
+		return
+	}
+
+	for piece := range e.requests {
+		e.releaseRequest(piece)
+	}
+	e.size = size
+	e.pieces, e.sources = nil, nil
+	if size > 0 {
+		e.pieces = make([][]byte, (size+_PIECE_SIZE-1)/_PIECE_SIZE)
+		e.sources = make([]string, len(e.pieces))
+	}
+}
+
+// There is no way of telling which piece was bad, so every contributing peer is distrusted.
+// Must be called with the mutex held
+func (e *Exchange) discardPieces() {
+	for _, key := range e.sources {
+		if peer, exists := e.peers[key]; exists {
+			peer.usable = false
+		}
+	}
+	e.pieces = make([][]byte, len(e.pieces))
+	e.sources = make([]string, len(e.pieces))
+}
+
+// Must be called with the mutex held
+func (e *Exchange) releaseRequests(key string) {
+	for piece, request := range e.requests {
+		if request.peer == key {
+			e.releaseRequest(piece)
+		}
+	}
+}
+
+// Must be called with the mutex held
+func (e *Exchange) releaseRequest(piece int) {
+	if peer, exists := e.peers[e.requests[piece].peer]; exists {
+		peer.outstanding--
+	}
+	delete(e.requests, piece)
+}
+
+func (e *Exchange) pieceLength(piece int) int {
+	if piece == len(e.pieces)-1 {
+		return e.size - piece*_PIECE_SIZE
+	}
+	return _PIECE_SIZE
+}
+
+func newOutgoing(peer *peerState, msg *message) *outgoing {
+	payload, err := msg.encode()
+	if err != nil {
+		logs.Error("Metadata", "Failed to encode metadata message: %s", err)
+		return nil
+	}
+
+	return &outgoing{
+		send: peer.send,
+		msg:  &pwp.ExtendedMsg{ID: peer.remoteID, Payload: payload},
+	}
+}
+
+func sendAll(toSend []*outgoing) {
+	for _, o := range toSend {
+		if o != nil {
+			o.send(o.msg)
+		}
+	}
+}
+
+type extension struct {
+	exchange *Exchange
+	key      string
+	send     func(pwp.Message)
+}
+
+func (e *extension) Negotiated(localID, remoteID byte, handshake *pwp.ExtendedHandshake) {
+	e.exchange.peerNegotiated(e.key, remoteID, handshake.MetadataSize, e.send)
+}
+
+func (e *extension) HandleMessage(payload []byte) error {
+	return e.exchange.handleMessage(e.key, payload)
+}
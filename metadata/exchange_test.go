@@ -0,0 +1,202 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"gobby"
+	"gobby/pwp"
+	"net"
+	"testing"
+	"time"
+)
+
+func createMetafile(pieceCount int) *gobby.Metafile {
+	hashes := bytes.Repeat([]byte("11111111111111111111"), pieceCount)
+	info := fmt.Sprintf("d6:lengthi%de4:name8:test.txt12:piece lengthi50e6:pieces%d:%se", pieceCount*50, len(hashes), hashes)
+	metafile, err := gobby.DecodeInfo([]byte(info))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create metafile: %s", err))
+	}
+	return metafile
+}
+
+// Connects extensions of two exchanges directly, as if over a single connection
+func connect(a, b *Exchange) (pwp.ExtensionHandler, pwp.ExtensionHandler) {
+	return connectAt(a, b, "10.0.0.1", "10.0.0.2")
+}
+
+func connectAt(a, b *Exchange, ipA, ipB string) (pwp.ExtensionHandler, pwp.ExtensionHandler) {
+	var extA, extB pwp.ExtensionHandler
+	addrA := &net.TCPAddr{IP: net.ParseIP(ipA), Port: 6881}
+	addrB := &net.TCPAddr{IP: net.ParseIP(ipB), Port: 6881}
+
+	extA = a.NewExtension(&pwp.PeerConnection{Address: addrB}, func(msg pwp.Message) {
+		extB.HandleMessage(msg.(*pwp.ExtendedMsg).Payload)
+	})
+	extB = b.NewExtension(&pwp.PeerConnection{Address: addrA}, func(msg pwp.Message) {
+		extA.HandleMessage(msg.(*pwp.ExtendedMsg).Payload)
+	})
+	return extA, extB
+}
+
+func TestMessageEncodingDecoding(t *testing.T) {
+	msg := &message{msgType: _MSG_DATA, piece: 2, totalSize: 40000, data: []byte("piece data")}
+	payload, err := msg.encode()
+	if err != nil {
+		t.Fatalf("Failed to encode message: %s", err)
+	}
+
+	decoded, err := decodeMessage(payload)
+	if err != nil {
+		t.Fatalf("Failed to decode message: %s", err)
+	}
+	if decoded.msgType != _MSG_DATA || decoded.piece != 2 || decoded.totalSize != 40000 {
+		t.Fatalf("Wrong message: %v", decoded)
+	}
+	if string(decoded.data) != "piece data" {
+		t.Fatalf("Wrong data: %s", decoded.data)
+	}
+
+	_, err = decodeMessage([]byte("d8:msg_typei0e5:piecei0eejunk"))
+	if err == nil {
+		t.Fatalf("Expected error for trailing data in request")
+	}
+
+	decoded, err = decodeMessage([]byte("d8:msg_typei7e5:piecei-1eejunk"))
+	if err != nil || decoded.msgType != 7 {
+		t.Fatalf("Expected unknown message type to decode. Got: %v, %v", decoded, err)
+	}
+}
+
+func TestFetchingMetadata(t *testing.T) {
+	metafile := createMetafile(2000)
+	server := NewExchangeFromMetafile(metafile)
+	client := NewExchange(metafile.InfoHash)
+	if server.MetadataSize() <= _PIECE_SIZE*2 {
+		t.Fatalf("Expected metadata spanning multiple pieces. Size: %d", server.MetadataSize())
+	}
+
+	clientExt, serverExt := connect(client, server)
+	serverExt.Negotiated(1, 2, &pwp.ExtendedHandshake{})
+	clientExt.Negotiated(2, 1, &pwp.ExtendedHandshake{MetadataSize: server.MetadataSize()})
+
+	select {
+	case fetched := <-client.Done():
+		if !bytes.Equal(fetched.InfoHash, metafile.InfoHash) {
+			t.Fatalf("Info hash missmatch: %v and %v", fetched.InfoHash, metafile.InfoHash)
+		}
+		if len(fetched.Pieces) != 2000 {
+			t.Fatalf("Expected 2000 pieces. Got: %d", len(fetched.Pieces))
+		}
+	default:
+		t.Fatalf("Metadata not fetched")
+	}
+
+	if client.MetadataSize() != server.MetadataSize() {
+		t.Fatalf("Expected client to serve metadata after fetching")
+	}
+}
+
+func TestFetchingRejected(t *testing.T) {
+	metafile := createMetafile(10)
+	server := NewExchange(metafile.InfoHash)
+	client := NewExchange(metafile.InfoHash)
+
+	clientExt, serverExt := connect(client, server)
+	serverExt.Negotiated(1, 2, &pwp.ExtendedHandshake{})
+	clientExt.Negotiated(2, 1, &pwp.ExtendedHandshake{MetadataSize: len(metafile.Info)})
+
+	select {
+	case <-client.Done():
+		t.Fatalf("Unexpected metadata")
+	default:
+	}
+
+	if len(client.requests) != 0 {
+		t.Fatalf("Expected no outstanding requests after reject. Got: %d", len(client.requests))
+	}
+	if client.peers["10.0.0.2:6881"].usable {
+		t.Fatalf("Expected rejecting peer to be unusable")
+	}
+
+	// Unknown message types are dropped without disconnecting
+	if err := serverExt.HandleMessage([]byte("d8:msg_typei7e5:piecei0ee")); err != nil {
+		t.Fatalf("Expected unknown message type to be ignored. Got: %s", err)
+	}
+}
+
+func TestFetchingWrongMetadata(t *testing.T) {
+	server := NewExchangeFromMetafile(createMetafile(10))
+	wrongHash := sha1.Sum([]byte("wrong"))
+	client := NewExchange(wrongHash[:])
+
+	clientExt, serverExt := connect(client, server)
+	serverExt.Negotiated(1, 2, &pwp.ExtendedHandshake{})
+	clientExt.Negotiated(2, 1, &pwp.ExtendedHandshake{MetadataSize: server.MetadataSize()})
+
+	select {
+	case <-client.Done():
+		t.Fatalf("Unexpected metadata with mismatching info hash")
+	default:
+	}
+	if client.peers["10.0.0.2:6881"].usable {
+		t.Fatalf("Expected peer serving wrong metadata to be unusable")
+	}
+}
+
+func TestFetchingTimeout(t *testing.T) {
+	metafile := createMetafile(10)
+	server := NewExchangeFromMetafile(metafile)
+	client := NewExchange(metafile.InfoHash)
+
+	silent := client.NewExtension(&pwp.PeerConnection{Address: &net.TCPAddr{IP: net.ParseIP("10.0.0.9"), Port: 6881}}, func(pwp.Message) {})
+	silent.Negotiated(2, 1, &pwp.ExtendedHandshake{MetadataSize: server.MetadataSize()})
+	clientExt, serverExt := connect(client, server)
+	serverExt.Negotiated(1, 2, &pwp.ExtendedHandshake{})
+	clientExt.Negotiated(2, 1, &pwp.ExtendedHandshake{MetadataSize: server.MetadataSize()})
+
+	select {
+	case <-client.Done():
+		t.Fatalf("Expected the only piece to be requested from the silent peer")
+	default:
+	}
+
+	client.Tick(time.Now().Add(_REQUEST_TIMEOUT))
+	select {
+	case <-client.Done():
+	default:
+		t.Fatalf("Expected metadata from the other peer after the timeout")
+	}
+	if client.peers["10.0.0.9:6881"].usable {
+		t.Fatalf("Expected silent peer to be unusable")
+	}
+}
+
+func TestFetchingBogusSize(t *testing.T) {
+	metafile := createMetafile(10)
+	// Serves other metadata, so its size is wrong for the info hash
+	bogus := NewExchangeFromMetafile(createMetafile(20))
+	honest := NewExchangeFromMetafile(metafile)
+	client := NewExchange(metafile.InfoHash)
+
+	clientExt, bogusExt := connectAt(client, bogus, "10.0.0.1", "10.0.0.9")
+	bogusExt.Negotiated(1, 2, &pwp.ExtendedHandshake{})
+	clientExt2, honestExt := connectAt(client, honest, "10.0.0.1", "10.0.0.2")
+	honestExt.Negotiated(1, 2, &pwp.ExtendedHandshake{})
+	clientExt.Negotiated(2, 1, &pwp.ExtendedHandshake{MetadataSize: bogus.MetadataSize()})
+	// The honest peer disagrees with the size reported first, which turned out bogus
+	clientExt2.Negotiated(2, 1, &pwp.ExtendedHandshake{MetadataSize: honest.MetadataSize()})
+
+	select {
+	case fetched := <-client.Done():
+		if !bytes.Equal(fetched.InfoHash, metafile.InfoHash) {
+			t.Fatalf("Info hash missmatch: %v and %v", fetched.InfoHash, metafile.InfoHash)
+		}
+	default:
+		t.Fatalf("Expected metadata from the honest peer after the bogus size failed")
+	}
+	if client.peers["10.0.0.9:6881"].usable {
+		t.Fatalf("Expected peer with the bogus size to be unusable")
+	}
+}
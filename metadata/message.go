@@ -0,0 +1,77 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"gobby/bencoding"
+)
+
+const (
+	_MSG_REQUEST = 0
+	_MSG_DATA    = 1
+	_MSG_REJECT  = 2
+)
+
+type message struct {
+	msgType   int
+	piece     int
+	totalSize int
+	data      []byte
+}
+
+func (m *message) encode() ([]byte, error) {
+	dict := map[string]interface{}{
+		"msg_type": m.msgType,
+		"piece":    m.piece,
+	}
+	if m.msgType == _MSG_DATA {
+		dict["total_size"] = m.totalSize
+	}
+
+	encoded, err := bencoding.Encode(dict)
+	if err != nil {
+		return nil, err
+	}
+	return append(encoded, m.data...), nil
+}
+
+func decodeMessage(payload []byte) (*message, error) {
+	_dict, data, err := bencoding.DecodePartial(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode metadata message: %s", err)
+	}
+	dict, ok := _dict.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Invalid metadata message")
+	}
+
+	msgType, ok := dict["msg_type"].(int)
+	if !ok {
+		return nil, errors.New("Invalid metadata message field: msg_type")
+	}
+	// Unknown types are ignored by the exchange, so their other fields aren't checked
+	if msgType < _MSG_REQUEST || msgType > _MSG_REJECT {
+		return &message{msgType: msgType}, nil
+	}
+	piece, ok := dict["piece"].(int)
+	if !ok || piece < 0 {
+		return nil, errors.New("Invalid metadata message field: piece")
+	}
+
+	msg := &message{
+		msgType: msgType,
+		piece:   piece,
+	}
+	if msgType == _MSG_DATA {
+		totalSize, ok := dict["total_size"].(int)
+		if !ok || totalSize <= 0 {
+			return nil, errors.New("Invalid metadata message field: total_size")
+		}
+		msg.totalSize = totalSize
+		msg.data = data
+	} else if len(data) > 0 {
+		return nil, fmt.Errorf("Unexpected %d trailing bytes in metadata message", len(data))
+	}
+
+	return msg, nil
+}
@@ -12,6 +12,8 @@ import (
 type Metafile struct {
 	AnnounceURL string
 	InfoHash    []byte
+	Info        []byte
+	Private     bool
 	Pieces      []*Piece
 	Files       []*File
 }
@@ -39,6 +41,33 @@ func DecodeMetafile(encoded []byte) (*Metafile, error) {
 	if !exists {
 		return nil, errors.New("Missing required field: info")
 	}
+	if _, ok := _info.(map[string]interface{}); !ok {
+		return nil, errors.New("Invalid field: info")
+	}
+
+	// Info hash has to be calculated over the original encoding of the info dictionary
+	encodedInfoIndex := bytes.Index(encoded, []byte("4:info"))
+	infoAndRest := encoded[encodedInfoIndex+6:]
+	_, leftover, err := bencoding.DecodePartial(infoAndRest)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to locate info dictionary: %s", err)
+	}
+	encodedInfo := infoAndRest[:len(infoAndRest)-len(leftover)]
+
+	metafile, err := DecodeInfo(encodedInfo)
+	if err != nil {
+		return nil, err
+	}
+	metafile.AnnounceURL = string(url)
+	return metafile, nil
+}
+
+// Creates a metafile without an announce URL from a bare info dictionary, e.g. one obtained from peers
+func DecodeInfo(encodedInfo []byte) (*Metafile, error) {
+	_info, err := bencoding.Decode(encodedInfo)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode info content: %s", err)
+	}
 	info, ok := _info.(map[string]interface{})
 	if !ok {
 		return nil, errors.New("Invalid field: info")
@@ -52,25 +81,38 @@ func DecodeMetafile(encoded []byte) (*Metafile, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(pieces) == 0 {
+		return nil, errors.New("Invalid field: pieces")
+	}
+
+	private := false
+	_private, exists := info["private"]
+	if exists {
+		privateFlag, ok := _private.(int)
+		if !ok {
+			return nil, errors.New("Invalid field: private")
+		}
+		private = privateFlag == 1
+	}
 
 	totalFileLength := 0
 	for _, file := range files {
 		totalFileLength += file.Length
 	}
-	pieces[len(pieces)-1].Length = totalFileLength % pieces[len(pieces)-1].Length
+	if lastPieceLength := totalFileLength % pieces[len(pieces)-1].Length; lastPieceLength != 0 {
+		pieces[len(pieces)-1].Length = lastPieceLength
+	}
 
-	encodedInfo, _ := bencoding.Encode(info)
-	encodedInfoIndex := bytes.Index(encoded, []byte("4:info"))
-	actualEncodedInfo := encoded[encodedInfoIndex+6 : encodedInfoIndex+6+len(encodedInfo)]
 	hasher := sha1.New()
-	hasher.Write(actualEncodedInfo)
+	hasher.Write(encodedInfo)
 	infoHash := hasher.Sum(nil)
 
 	metafile := &Metafile{
-		AnnounceURL: string(url),
-		Pieces:      pieces,
-		Files:       files,
-		InfoHash:    infoHash,
+		Pieces:   pieces,
+		Files:    files,
+		InfoHash: infoHash,
+		Info:     encodedInfo,
+		Private:  private,
 	}
 	return metafile, nil
 }
@@ -168,6 +210,15 @@ type Piece struct {
 	Data   []byte
 }
 
+// Checks data against the piece's SHA-1. Only v1 hashes are parsed, so there are no merkle trees to check
+func (p *Piece) Verify(data []byte) bool {
+	if len(data) != p.Length {
+		return false
+	}
+	hash := sha1.Sum(data)
+	return bytes.Equal(hash[:], p.Hash)
+}
+
 func ParsePieces(info map[string]interface{}) ([]*Piece, error) {
 	_pieceLength, exists := info["piece length"]
 	if !exists {
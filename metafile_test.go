@@ -2,6 +2,7 @@ package gobby
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"testing"
 )
 
@@ -58,3 +59,59 @@ func TestMetafile(t *testing.T) {
 	}
 
 }
+
+func TestMetafilePrivate(t *testing.T) {
+	piecesInput := "6:pieces20:1111111111111111111112:piece lengthi50e"
+	fileInput := "4:name8:test.txt6:lengthi40e7:privatei1e"
+	input := "d8:announce12:www.test.com4:infod" + piecesInput + fileInput + "ee"
+
+	metafile, err := DecodeMetafile([]byte(input))
+	if err != nil {
+		t.Fatalf("Error while decoding metafile: %s", err)
+	}
+
+	if !metafile.Private {
+		t.Fatalf("Expected private metafile")
+	}
+}
+
+func TestDecodeInfo(t *testing.T) {
+	info := "d6:lengthi99e4:name8:test.txt12:piece lengthi50e6:pieces40:1111111111111111111122222222222222222222e"
+
+	metafile, err := DecodeInfo([]byte(info))
+	if err != nil {
+		t.Fatalf("Error while decoding info: %s", err)
+	}
+
+	expectedInfoHash := sha1.Sum([]byte(info))
+	if !bytes.Equal(metafile.InfoHash, expectedInfoHash[:]) {
+		t.Fatalf("Expected info hash %v. Got: %v", expectedInfoHash, metafile.InfoHash)
+	}
+	if !bytes.Equal(metafile.Info, []byte(info)) {
+		t.Fatalf("Expected raw info to be kept")
+	}
+
+	wrapped, err := DecodeMetafile([]byte("d8:announce12:www.test.com4:info" + info + "e"))
+	if err != nil {
+		t.Fatalf("Error while decoding metafile: %s", err)
+	}
+	if !bytes.Equal(wrapped.InfoHash, metafile.InfoHash) {
+		t.Fatalf("Info hash missmatch between metafile and info: %v and %v", wrapped.InfoHash, metafile.InfoHash)
+	}
+}
+
+func TestPieceVerify(t *testing.T) {
+	data := []byte("spam and eggs")
+	hash := sha1.Sum(data)
+	piece := &Piece{Index: 0, Length: len(data), Hash: hash[:]}
+
+	if !piece.Verify(data) {
+		t.Fatalf("Expected valid piece data to verify")
+	}
+	if piece.Verify([]byte("spam and ham!")) {
+		t.Fatalf("Expected corrupt piece data to fail verification")
+	}
+	if piece.Verify(data[:5]) {
+		t.Fatalf("Expected short piece data to fail verification")
+	}
+}
@@ -0,0 +1,53 @@
+package mse
+
+import (
+	"bufio"
+	"crypto/rc4"
+	"net"
+	"sync"
+)
+
+// Connection carrying the payload stream after the MSE handshake.
+// Plaintext connections have nil ciphers
+type cryptoConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	pending []byte
+	decrypt *rc4.Cipher
+	encrypt *rc4.Cipher
+	writeMx sync.Mutex
+}
+
+// Reports whether the connection returned by the handshake is RC4 encrypted
+func Encrypted(conn net.Conn) bool {
+	wrapped, ok := conn.(*cryptoConn)
+	return ok && wrapped.encrypt != nil
+}
+
+func (c *cryptoConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	n, err := c.reader.Read(p)
+	if c.decrypt != nil && n > 0 {
+		c.decrypt.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *cryptoConn) Write(p []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(p)
+	}
+
+	// The keystream position has to match the order of bytes on the wire,
+	// and the caller's buffer must not be modified
+	c.writeMx.Lock()
+	defer c.writeMx.Unlock()
+	encrypted := make([]byte, len(p))
+	c.encrypt.XORKeyStream(encrypted, p)
+	return c.Conn.Write(encrypted)
+}
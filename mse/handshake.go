@@ -0,0 +1,319 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+type Policy int
+
+const (
+	// Plaintext only. Incoming encrypted connections are refused
+	PolicyDisabled Policy = iota
+	// Encrypted where possible, plaintext accepted
+	PolicyPreferred
+	// RC4 encrypted only
+	PolicyForced
+)
+
+type CryptoMethod uint32
+
+const (
+	CryptoPlaintext CryptoMethod = 0x01
+	CryptoRC4       CryptoMethod = 0x02
+)
+
+const (
+	_MAX_PAD_LENGTH    = 512
+	_HANDSHAKE_TIMEOUT = time.Second * 30
+	_PLAINTEXT_HEADER  = "\x13BitTorrent protocol"
+)
+
+var verificationConstant = make([]byte, 8)
+
+// Performs the initiating side of the handshake. The returned connection carries the payload
+// stream, which is either RC4 encrypted or plaintext depending on what the remote side selected.
+// Connections are returned untouched with PolicyDisabled
+func Initiate(conn net.Conn, infoHash []byte, policy Policy) (net.Conn, error) {
+	if policy == PolicyDisabled {
+		return conn, nil
+	}
+
+	provide := CryptoRC4
+	if policy == PolicyPreferred {
+		provide |= CryptoPlaintext
+	}
+
+	conn.SetDeadline(time.Now().Add(_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	keys, err := generateKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate keys: %s", err)
+	}
+
+	// 1. A->B: Ya, PadA
+	_, err = conn.Write(append(keys.public, randomPad()...))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to send public key: %s", err)
+	}
+
+	// 2. B->A: Yb, PadB
+	reader := bufio.NewReader(conn)
+	remotePublic := make([]byte, _KEY_LENGTH)
+	_, err = io.ReadFull(reader, remotePublic)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive public key: %s", err)
+	}
+	if !validPublicKey(remotePublic) {
+		return nil, errors.New("Invalid public key")
+	}
+	secret := keys.sharedSecret(remotePublic)
+	encrypt := newCipher("keyA", secret, infoHash)
+	decrypt := newCipher("keyB", secret, infoHash)
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	buf := new(bytes.Buffer)
+	buf.Write(hash([]byte("req1"), secret))
+	buf.Write(xor(hash([]byte("req2"), infoHash), hash([]byte("req3"), secret)))
+	plain := new(bytes.Buffer)
+	plain.Write(verificationConstant)
+	binary.Write(plain, binary.BigEndian, uint32(provide))
+	binary.Write(plain, binary.BigEndian, uint16(0))
+	binary.Write(plain, binary.BigEndian, uint16(0))
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+	buf.Write(encrypted)
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to send crypto provide: %s", err)
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	encryptedVC := make([]byte, len(verificationConstant))
+	decrypt.XORKeyStream(encryptedVC, verificationConstant)
+	err = synchronize(reader, encryptedVC, _MAX_PAD_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 6)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive crypto select: %s", err)
+	}
+	decrypt.XORKeyStream(header, header)
+	selected := CryptoMethod(binary.BigEndian.Uint32(header[:4]))
+	if (selected != CryptoRC4 && selected != CryptoPlaintext) || selected&provide == 0 {
+		return nil, fmt.Errorf("Invalid crypto select: %d", selected)
+	}
+	err = skipPad(reader, decrypt, int(binary.BigEndian.Uint16(header[4:])))
+	if err != nil {
+		return nil, err
+	}
+
+	return wrap(conn, reader, selected, decrypt, encrypt), nil
+}
+
+// Performs the receiving side of the handshake, after the remote public key was detected.
+// skeys are the info hashes that may be requested
+func Receive(conn net.Conn, skeys [][]byte, policy Policy) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	return receive(conn, bufio.NewReader(conn), skeys, policy)
+}
+
+// Accepts an incoming connection, detecting whether it is encrypted or plaintext
+// and enforcing the policy. The returned connection starts with the BitTorrent handshake
+func Accept(conn net.Conn, skeys [][]byte, policy Policy) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	start, err := reader.Peek(len(_PLAINTEXT_HEADER))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive connection header: %s", err)
+	}
+
+	if string(start) == _PLAINTEXT_HEADER {
+		if policy == PolicyForced {
+			return nil, errors.New("Plaintext connection refused by policy")
+		}
+		return wrap(conn, reader, CryptoPlaintext, nil, nil), nil
+	}
+
+	if policy == PolicyDisabled {
+		return nil, errors.New("Encrypted connection refused by policy")
+	}
+	return receive(conn, reader, skeys, policy)
+}
+
+func receive(conn net.Conn, reader *bufio.Reader, skeys [][]byte, policy Policy) (net.Conn, error) {
+	// 1. A->B: Ya, PadA
+	remotePublic := make([]byte, _KEY_LENGTH)
+	_, err := io.ReadFull(reader, remotePublic)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive public key: %s", err)
+	}
+	if !validPublicKey(remotePublic) {
+		return nil, errors.New("Invalid public key")
+	}
+
+	keys, err := generateKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate keys: %s", err)
+	}
+	secret := keys.sharedSecret(remotePublic)
+
+	// 2. B->A: Yb, PadB
+	_, err = conn.Write(append(keys.public, randomPad()...))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to send public key: %s", err)
+	}
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	err = synchronize(reader, hash([]byte("req1"), secret), _MAX_PAD_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	skeyHash := make([]byte, 20)
+	_, err = io.ReadFull(reader, skeyHash)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive torrent identification: %s", err)
+	}
+	req3 := hash([]byte("req3"), secret)
+	var infoHash []byte
+	for _, skey := range skeys {
+		if bytes.Equal(xor(hash([]byte("req2"), skey), req3), skeyHash) {
+			infoHash = skey
+			break
+		}
+	}
+	if infoHash == nil {
+		return nil, errors.New("Unknown torrent requested")
+	}
+
+	decrypt := newCipher("keyA", secret, infoHash)
+	encrypt := newCipher("keyB", secret, infoHash)
+
+	header := make([]byte, 14)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive crypto provide: %s", err)
+	}
+	decrypt.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], verificationConstant) {
+		return nil, errors.New("Invalid verification constant")
+	}
+	provided := CryptoMethod(binary.BigEndian.Uint32(header[8:12]))
+	err = skipPad(reader, decrypt, int(binary.BigEndian.Uint16(header[12:14])))
+	if err != nil {
+		return nil, err
+	}
+
+	iaLengthData := make([]byte, 2)
+	_, err = io.ReadFull(reader, iaLengthData)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive initial payload length: %s", err)
+	}
+	decrypt.XORKeyStream(iaLengthData, iaLengthData)
+	initialPayload := make([]byte, binary.BigEndian.Uint16(iaLengthData))
+	_, err = io.ReadFull(reader, initialPayload)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive initial payload: %s", err)
+	}
+	decrypt.XORKeyStream(initialPayload, initialPayload)
+
+	var selected CryptoMethod
+	if provided&CryptoRC4 != 0 {
+		selected = CryptoRC4
+	} else if provided&CryptoPlaintext != 0 && policy != PolicyForced {
+		selected = CryptoPlaintext
+	} else {
+		return nil, fmt.Errorf("No acceptable crypto method provided: %d", provided)
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	plain := new(bytes.Buffer)
+	plain.Write(verificationConstant)
+	binary.Write(plain, binary.BigEndian, uint32(selected))
+	binary.Write(plain, binary.BigEndian, uint16(0))
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+	_, err = conn.Write(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to send crypto select: %s", err)
+	}
+
+	wrapped := wrap(conn, reader, selected, decrypt, encrypt)
+	wrapped.pending = initialPayload
+	return wrapped, nil
+}
+
+func wrap(conn net.Conn, reader *bufio.Reader, selected CryptoMethod, decrypt, encrypt *rc4.Cipher) *cryptoConn {
+	wrapped := &cryptoConn{
+		Conn:   conn,
+		reader: reader,
+	}
+	if selected == CryptoRC4 {
+		wrapped.decrypt = decrypt
+		wrapped.encrypt = encrypt
+	}
+	return wrapped
+}
+
+// Reads until the marker is found, allowing up to maxSkip bytes of padding before it
+func synchronize(reader *bufio.Reader, marker []byte, maxSkip int) error {
+	window := make([]byte, 0, maxSkip+len(marker))
+	for len(window) < cap(window) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return fmt.Errorf("Failed to synchronize: %s", err)
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return errors.New("Failed to synchronize: marker not found")
+}
+
+func skipPad(reader *bufio.Reader, decrypt *rc4.Cipher, length int) error {
+	if length > _MAX_PAD_LENGTH {
+		return fmt.Errorf("Pad too long: %d", length)
+	}
+
+	pad := make([]byte, length)
+	_, err := io.ReadFull(reader, pad)
+	if err != nil {
+		return fmt.Errorf("Failed to receive pad: %s", err)
+	}
+	decrypt.XORKeyStream(pad, pad)
+	return nil
+}
+
+func randomPad() []byte {
+	lengthData := make([]byte, 2)
+	rand.Read(lengthData)
+	pad := make([]byte, int(binary.BigEndian.Uint16(lengthData))%(_MAX_PAD_LENGTH+1))
+	rand.Read(pad)
+	return pad
+}
+
+func xor(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
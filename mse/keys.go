@@ -0,0 +1,78 @@
+package mse
+
+import (
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"math/big"
+)
+
+const (
+	_KEY_LENGTH     = 96
+	_PRIVATE_LENGTH = 20
+	_RC4_DISCARD    = 1024
+)
+
+var (
+	prime     *big.Int
+	generator = big.NewInt(2)
+)
+
+func init() {
+	prime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+}
+
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func generateKeyPair() (*keyPair, error) {
+	privateBytes := make([]byte, _PRIVATE_LENGTH)
+	_, err := rand.Read(privateBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private := new(big.Int).SetBytes(privateBytes)
+	public := new(big.Int).Exp(generator, private, prime)
+	pair := &keyPair{
+		private: private,
+		public:  padKey(public.Bytes()),
+	}
+	return pair, nil
+}
+
+func (k *keyPair) sharedSecret(remotePublic []byte) []byte {
+	remote := new(big.Int).SetBytes(remotePublic)
+	secret := new(big.Int).Exp(remote, k.private, prime)
+	return padKey(secret.Bytes())
+}
+
+// Keys outside of 1 < Y < P-1 would make the shared secret predictable
+func validPublicKey(key []byte) bool {
+	y := new(big.Int).SetBytes(key)
+	return y.Cmp(big.NewInt(1)) > 0 && y.Cmp(new(big.Int).Sub(prime, big.NewInt(1))) < 0
+}
+
+func padKey(key []byte) []byte {
+	padded := make([]byte, _KEY_LENGTH)
+	copy(padded[_KEY_LENGTH-len(key):], key)
+	return padded
+}
+
+func hash(parts ...[]byte) []byte {
+	hasher := sha1.New()
+	for _, part := range parts {
+		hasher.Write(part)
+	}
+	return hasher.Sum(nil)
+}
+
+// RC4 keyed with HASH(name, S, SKEY), with the first 1024 bytes of keystream discarded
+func newCipher(name string, secret, skey []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(hash([]byte(name), secret, skey))
+	discard := make([]byte, _RC4_DISCARD)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
@@ -0,0 +1,197 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+)
+
+type outcome struct {
+	conn net.Conn
+	err  error
+}
+
+func tcpPair() (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer listener.Close()
+
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		acceptedCh <- conn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	return conn, <-acceptedCh
+}
+
+func connect(infoHash []byte, skeys [][]byte, initiatorPolicy, receiverPolicy Policy) (outcome, outcome) {
+	initiatorConn, receiverConn := tcpPair()
+
+	receiverCh := make(chan outcome, 1)
+	go func() {
+		conn, err := Accept(receiverConn, skeys, receiverPolicy)
+		if err != nil {
+			receiverConn.Close()
+		}
+		receiverCh <- outcome{conn, err}
+	}()
+
+	conn, err := Initiate(initiatorConn, infoHash, initiatorPolicy)
+	if err != nil {
+		initiatorConn.Close()
+	}
+	return outcome{conn, err}, <-receiverCh
+}
+
+func exchange(t *testing.T, a, b net.Conn) {
+	messages := [][]byte{[]byte("\x13BitTorrent protocol handshake"), bytes.Repeat([]byte{7}, 100000)}
+	for _, pair := range [][2]net.Conn{{a, b}, {b, a}} {
+		for _, msg := range messages {
+			go pair[0].Write(msg)
+			received := make([]byte, len(msg))
+			_, err := io.ReadFull(pair[1], received)
+			if err != nil {
+				t.Fatalf("Failed to read: %s", err)
+			}
+			if !bytes.Equal(received, msg) {
+				t.Fatalf("Received data missmatch")
+			}
+		}
+	}
+}
+
+func isEncrypted(conn net.Conn) bool {
+	return Encrypted(conn)
+}
+
+func TestEncryptedConnection(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	skeys := [][]byte{bytes.Repeat([]byte{0xbb}, 20), infoHash}
+
+	for _, policy := range []Policy{PolicyPreferred, PolicyForced} {
+		initiator, receiver := connect(infoHash, skeys, policy, PolicyPreferred)
+		if initiator.err != nil {
+			t.Fatalf("Initiator failed: %s", initiator.err)
+		}
+		if receiver.err != nil {
+			t.Fatalf("Receiver failed: %s", receiver.err)
+		}
+		if !isEncrypted(initiator.conn) || !isEncrypted(receiver.conn) {
+			t.Fatalf("Expected RC4 to be selected")
+		}
+
+		exchange(t, initiator.conn, receiver.conn)
+		initiator.conn.Close()
+		receiver.conn.Close()
+	}
+}
+
+func TestEncryptedWire(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	initiatorConn, receiverConn := tcpPair()
+	defer initiatorConn.Close()
+	defer receiverConn.Close()
+
+	go func() {
+		conn, err := Initiate(initiatorConn, infoHash, PolicyForced)
+		if err == nil {
+			conn.Write([]byte(_PLAINTEXT_HEADER))
+		}
+	}()
+
+	// Raw bytes on the wire must not contain the plaintext
+	conn, err := Receive(receiverConn, [][]byte{infoHash}, PolicyForced)
+	if err != nil {
+		t.Fatalf("Receiver failed: %s", err)
+	}
+	wrapped := conn.(*cryptoConn)
+	raw := make([]byte, len(_PLAINTEXT_HEADER))
+	_, err = io.ReadFull(wrapped.reader, raw)
+	if err != nil {
+		t.Fatalf("Failed to read: %s", err)
+	}
+	if string(raw) == _PLAINTEXT_HEADER {
+		t.Fatalf("Payload sent in plaintext")
+	}
+}
+
+func TestPlaintextConnection(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	initiatorConn, receiverConn := tcpPair()
+	defer initiatorConn.Close()
+	defer receiverConn.Close()
+
+	conn, err := Initiate(initiatorConn, infoHash, PolicyDisabled)
+	if err != nil || conn != initiatorConn {
+		t.Fatalf("Expected connection to be untouched with encryption disabled")
+	}
+	go conn.Write([]byte(_PLAINTEXT_HEADER))
+
+	accepted, err := Accept(receiverConn, [][]byte{infoHash}, PolicyPreferred)
+	if err != nil {
+		t.Fatalf("Receiver failed: %s", err)
+	}
+	if isEncrypted(accepted) {
+		t.Fatalf("Expected plaintext connection")
+	}
+
+	received := make([]byte, len(_PLAINTEXT_HEADER))
+	_, err = io.ReadFull(accepted, received)
+	if err != nil || string(received) != _PLAINTEXT_HEADER {
+		t.Fatalf("Expected plaintext header to be preserved. Got: %q, %v", received, err)
+	}
+}
+
+func TestPolicyRefusals(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+
+	initiatorConn, receiverConn := tcpPair()
+	go initiatorConn.Write([]byte(_PLAINTEXT_HEADER))
+	_, err := Accept(receiverConn, [][]byte{infoHash}, PolicyForced)
+	if err == nil {
+		t.Fatalf("Expected plaintext connection to be refused")
+	}
+	initiatorConn.Close()
+	receiverConn.Close()
+
+	initiator, receiver := connect(infoHash, [][]byte{infoHash}, PolicyPreferred, PolicyDisabled)
+	if initiator.err == nil || receiver.err == nil {
+		t.Fatalf("Expected encrypted connection to be refused")
+	}
+
+	initiator, receiver = connect(infoHash, [][]byte{bytes.Repeat([]byte{0xbb}, 20)}, PolicyPreferred, PolicyPreferred)
+	if initiator.err == nil || receiver.err == nil {
+		t.Fatalf("Expected unknown torrent to be refused")
+	}
+}
+
+func TestInvalidPublicKey(t *testing.T) {
+	one := padKey([]byte{1})
+	pMinusOne := padKey(new(big.Int).Sub(prime, big.NewInt(1)).Bytes())
+	for _, key := range [][]byte{make([]byte, _KEY_LENGTH), one, pMinusOne, padKey(prime.Bytes())} {
+		if validPublicKey(key) {
+			t.Fatalf("Expected key to be invalid: %x", key)
+		}
+	}
+
+	initiatorConn, receiverConn := tcpPair()
+	defer initiatorConn.Close()
+	defer receiverConn.Close()
+	go func() {
+		io.ReadFull(receiverConn, make([]byte, _KEY_LENGTH))
+		receiverConn.Write(one)
+	}()
+	_, err := Initiate(initiatorConn, bytes.Repeat([]byte{0xaa}, 20), PolicyPreferred)
+	if err == nil {
+		t.Fatalf("Expected invalid public key to be refused")
+	}
+}
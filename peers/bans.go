@@ -0,0 +1,56 @@
+package peers
+
+import (
+	"net"
+	"sync"
+)
+
+// IPs banned for the rest of the session, e.g. for sending corrupt data
+type BanList struct {
+	mx  sync.Mutex
+	ips map[string]bool
+}
+
+func NewBanList() *BanList {
+	return &BanList{
+		ips: make(map[string]bool),
+	}
+}
+
+func (b *BanList) Ban(ip net.IP) {
+	b.mx.Lock()
+	b.ips[ip.String()] = true
+	b.mx.Unlock()
+}
+
+// Bans the IP of a host:port address
+func (b *BanList) BanAddress(address string) {
+	if ip := addressIP(address); ip != nil {
+		b.Ban(ip)
+	}
+}
+
+func (b *BanList) Banned(ip net.IP) bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.ips[ip.String()]
+}
+
+func (b *BanList) BannedAddress(address string) bool {
+	ip := addressIP(address)
+	return ip != nil && b.Banned(ip)
+}
+
+func (b *BanList) Count() int {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return len(b.ips)
+}
+
+func addressIP(address string) net.IP {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -1,33 +1,140 @@
 package peers
 
 import (
+	"errors"
 	"gobby/logs"
 	"gobby/pwp"
+	"gobby/ratelimit"
+	"io"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 const (
-	_MAX_MESSAGE_SIZE = 1024 * 100
-	_MAX_BUFFER_SIZE  = _MAX_MESSAGE_SIZE * 2
+	_KEEP_ALIVE_INTERVAL  = time.Minute * 2
+	_DEFAULT_IDLE_TIMEOUT = time.Minute * 3
+	_SNUB_TIMEOUT         = time.Minute
+	_MAX_QUEUED_MESSAGES  = 128
+	_DRAIN_TIMEOUT        = time.Second * 5
 )
 
-// TODO - improve error handling
+var (
+	errChannelStopped = errors.New("Channel stopped")
+	errChannelClosed  = errors.New("Channel closed")
+	errPeerClosed     = errors.New("Connection closed by peer")
+)
+
+type ChannelStats struct {
+	BytesSent        int64
+	BytesReceived    int64
+	MessagesSent     int64
+	MessagesReceived int64
+	LastSent         time.Time
+	LastReceived     time.Time
+	LastBlock        time.Time
+	QueuedMessages   int
+	QueuedBytes      int64
+	// The peer unchoked us, but hasn't answered our requests for a while
+	Snubbed bool
+}
+
+// Counts raw traffic, including protocol overhead
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// Passes vectored writes on to the wrapped connection
+func (c *countingConn) WriteBuffers(buffers net.Buffers) (int64, error) {
+	n, err := pwp.WriteBuffers(c.Conn, buffers)
+	atomic.AddInt64(&c.written, n)
+	return n, err
+}
+
 type peerChannel struct {
-	socket     net.Conn
-	buffer     []byte
-	outgoingCh chan pwp.Message
-	stopCh     chan struct{}
+	socket            *countingConn
+	maxMessageLength  int
+	idleTimeout       time.Duration
+	keepAliveInterval time.Duration
+	uploadLimiters    []*ratelimit.Limiter
+	downloadLimiters  []*ratelimit.Limiter
+	excludeOverhead   bool
+	stopCh            chan struct{}
+	stopOnce          sync.Once
+	err               error
+
+	// Outgoing messages. Senders wait on the condition while the queue is full
+	mx          sync.Mutex
+	notFull     *sync.Cond
+	queue       []pwp.Message
+	queuedBytes int64
+	queuedCh    chan struct{}
+	draining    bool
+	closed      bool
+
+	statsMx          sync.Mutex
+	messagesSent     int64
+	messagesReceived int64
+	lastSent         time.Time
+	lastReceived     time.Time
+	lastBlock        time.Time
+	unchoked         bool
+	unchokedAt       time.Time
+	// First request sent since the last received block
+	awaitingSince time.Time
 }
 
 func newPeerChannel(socket net.Conn) *peerChannel {
-	return &peerChannel{
-		socket:     socket,
-		buffer:     make([]byte, 0, _MAX_BUFFER_SIZE),
-		outgoingCh: make(chan pwp.Message, 10),
-		stopCh:     make(chan struct{}, 0),
+	now := time.Now()
+	c := &peerChannel{
+		socket:            &countingConn{Conn: socket},
+		maxMessageLength:  pwp.DefaultMaxMessageLength,
+		idleTimeout:       _DEFAULT_IDLE_TIMEOUT,
+		keepAliveInterval: _KEEP_ALIVE_INTERVAL,
+		stopCh:            make(chan struct{}, 0),
+		queue:             make([]pwp.Message, 0),
+		queuedCh:          make(chan struct{}, 1),
+		lastSent:          now,
+		lastReceived:      now,
 	}
+	c.notFull = sync.NewCond(&c.mx)
+	return c
+}
+
+// Bitfields of torrents with many pieces, or unusually large piece requests, may need a higher limit.
+// Must be called before Start
+func (c *peerChannel) SetMaxMessageLength(maxMessageLength int) {
+	c.maxMessageLength = maxMessageLength
+}
+
+// Peers silent for longer are disconnected. Must be called before Start
+func (c *peerChannel) SetIdleTimeout(timeout time.Duration) {
+	c.idleTimeout = timeout
+}
+
+// Limiters are typically shared, e.g. client wide, per torrent and per peer.
+// Without overhead, only piece payloads count towards the limits. Must be called before Start
+func (c *peerChannel) SetRateLimiters(upload, download []*ratelimit.Limiter, excludeOverhead bool) {
+	c.uploadLimiters = upload
+	c.downloadLimiters = download
+	c.excludeOverhead = excludeOverhead
 }
 
 func (c *peerChannel) Start(incoming chan<- pwp.Message) {
@@ -35,88 +142,306 @@ func (c *peerChannel) Start(incoming chan<- pwp.Message) {
 	go c.receiving(incoming)
 }
 
+// Closes the connection immediately, discarding queued messages
 func (c *peerChannel) Stop() {
-	close(c.stopCh)
-	c.socket.Close()
+	c.terminate(errChannelStopped)
+}
+
+// Sends the queued messages before closing the connection. Gives up after a timeout
+func (c *peerChannel) Close() {
+	c.mx.Lock()
+	c.draining = true
+	c.mx.Unlock()
+	c.signal()
+
+	select {
+	case <-c.stopCh:
+	case <-time.After(_DRAIN_TIMEOUT):
+		c.Stop()
+	}
+}
+
+func (c *peerChannel) terminate(err error) {
+	c.stopOnce.Do(func() {
+		c.mx.Lock()
+		c.err = err
+		c.closed = true
+		c.queue = nil
+		c.queuedBytes = 0
+		c.notFull.Broadcast()
+		c.mx.Unlock()
+
+		close(c.stopCh)
+		c.socket.Close()
+	})
+}
+
+// Closed once the channel is terminated, for whatever reason
+func (c *peerChannel) Done() <-chan struct{} {
+	return c.stopCh
+}
+
+// The reason the channel terminated, nil while it's still open
+func (c *peerChannel) Err() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.err
 }
 
+// Queues the message, waiting while the queue is full. Messages sent to a closed channel are dropped
 func (c *peerChannel) Send(message pwp.Message) {
-	c.outgoingCh <- message
+	c.mx.Lock()
+	for len(c.queue) >= _MAX_QUEUED_MESSAGES && !c.closed && !c.draining {
+		c.notFull.Wait()
+	}
+	c.enqueue(message)
+	c.mx.Unlock()
+	c.signal()
+}
+
+// Queues the message unless the queue is full or the channel closed
+func (c *peerChannel) TrySend(message pwp.Message) bool {
+	c.mx.Lock()
+	if len(c.queue) >= _MAX_QUEUED_MESSAGES {
+		c.mx.Unlock()
+		return false
+	}
+	queued := c.enqueue(message)
+	c.mx.Unlock()
+	c.signal()
+	return queued
+}
+
+// Must be called with the mutex held
+func (c *peerChannel) enqueue(message pwp.Message) bool {
+	if c.closed || c.draining {
+		return false
+	}
+	c.queue = append(c.queue, message)
+	c.queuedBytes += messageLength(message)
+	return true
+}
+
+func (c *peerChannel) dequeue() (message pwp.Message, draining bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if len(c.queue) == 0 {
+		return nil, c.draining
+	}
+	message = c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+	c.queuedBytes -= messageLength(message)
+	c.notFull.Signal()
+	return message, false
+}
+
+func (c *peerChannel) signal() {
+	select {
+	case c.queuedCh <- struct{}{}:
+	default:
+	}
+}
+
+// Removes a queued piece the peer is no longer interested in. Returns false if it was already sent
+func (c *peerChannel) Cancel(index, offset, length int32) bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	for i, message := range c.queue {
+		piece, ok := message.(*pwp.PieceMsg)
+		if ok && piece.Index == index && piece.Offset == offset && int32(len(piece.Block)) == length {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			c.queuedBytes -= messageLength(piece)
+			c.notFull.Signal()
+			return true
+		}
+	}
+	return false
+}
+
+func (c *peerChannel) QueueLength() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return len(c.queue)
+}
+
+func (c *peerChannel) Stats() *ChannelStats {
+	c.mx.Lock()
+	queuedMessages, queuedBytes := len(c.queue), c.queuedBytes
+	c.mx.Unlock()
+
+	c.statsMx.Lock()
+	defer c.statsMx.Unlock()
+
+	return &ChannelStats{
+		QueuedMessages:   queuedMessages,
+		QueuedBytes:      queuedBytes,
+		BytesSent:        atomic.LoadInt64(&c.socket.written),
+		BytesReceived:    atomic.LoadInt64(&c.socket.read),
+		MessagesSent:     c.messagesSent,
+		MessagesReceived: c.messagesReceived,
+		LastSent:         c.lastSent,
+		LastReceived:     c.lastReceived,
+		LastBlock:        c.lastBlock,
+		Snubbed:          c.snubbed(time.Now()),
+	}
+}
+
+// Must be called with the stats mutex held
+func (c *peerChannel) snubbed(now time.Time) bool {
+	if !c.unchoked || c.awaitingSince.IsZero() {
+		return false
+	}
+	since := c.awaitingSince
+	if c.unchokedAt.After(since) {
+		since = c.unchokedAt
+	}
+	return now.Sub(since) >= _SNUB_TIMEOUT
+}
+
+func (c *peerChannel) sent(message pwp.Message) {
+	c.statsMx.Lock()
+	c.messagesSent++
+	c.lastSent = time.Now()
+	if _, ok := message.(*pwp.RequestMsg); ok && c.awaitingSince.IsZero() {
+		c.awaitingSince = c.lastSent
+	}
+	c.statsMx.Unlock()
+}
+
+func (c *peerChannel) received(message pwp.Message) {
+	c.statsMx.Lock()
+	c.messagesReceived++
+	c.lastReceived = time.Now()
+	switch message.(type) {
+	case *pwp.PieceMsg:
+		c.lastBlock = c.lastReceived
+		c.awaitingSince = time.Time{}
+	case *pwp.UnchokeMsg:
+		if !c.unchoked {
+			c.unchoked = true
+			c.unchokedAt = c.lastReceived
+		}
+	case *pwp.ChokeMsg:
+		c.unchoked = false
+		c.awaitingSince = time.Time{}
+	}
+	c.statsMx.Unlock()
 }
 
 func (c *peerChannel) sending() {
+	writer := pwp.NewWriter(c.socket)
+	keepAlive := time.NewTimer(c.keepAliveInterval)
+	defer keepAlive.Stop()
+
 	for {
-		select {
-		case msg := <-c.outgoingCh:
-			data := msg.Encode()
-			totalwc := 0
-			for totalwc < len(data) {
-				wc, err := c.socket.Write(data[totalwc:])
-				if err != nil {
-					select {
-					case <-c.stopCh:
-						return
-					default:
-						logs.Warn("PeerChannel", "Failed to write to socket: %s", err)
-						c.socket.Close()
-						return
-					}
-				}
-				totalwc += wc
+		msg, draining := c.dequeue()
+		if msg == nil {
+			if draining {
+				c.terminate(errChannelClosed)
+				return
+			}
+			select {
+			case <-c.queuedCh:
+				continue
+			case <-keepAlive.C:
+				msg = &pwp.KeepAliveMsg{}
+			case <-c.stopCh:
+				return
+			}
+		}
+
+		if !ratelimit.Wait(c.limitedLength(msg), c.stopCh, c.uploadLimiters...) {
+			return
+		}
+		err := writer.WriteMessage(msg)
+		if err != nil {
+			select {
+			case <-c.stopCh:
+			default:
+				logs.Warn("PeerChannel", "Failed to write to socket: %s", err)
+				c.terminate(err)
 			}
-		case <-c.stopCh:
 			return
 		}
+		c.sent(msg)
+
+		if !keepAlive.Stop() {
+			select {
+			case <-keepAlive.C:
+			default:
+			}
+		}
+		keepAlive.Reset(c.keepAliveInterval)
 	}
 }
 
+// The only place closing incoming
 func (c *peerChannel) receiving(incoming chan<- pwp.Message) {
-	var toRead int
-	data := make([]byte, _MAX_MESSAGE_SIZE)
+	defer close(incoming)
+	reader := pwp.NewReader(c.socket, c.maxMessageLength)
 
 	for {
-		leftInBuffer := _MAX_BUFFER_SIZE - len(c.buffer)
-		if leftInBuffer < len(data) {
-			toRead = leftInBuffer
-		} else {
-			toRead = len(data)
-		}
-
-		rc, err := c.socket.Read(data[:toRead])
+		c.socket.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		message, err := reader.ReadMessage()
 		if err != nil {
-			if opErr, ok := err.(*net.OpError); ok {
-				if syscallErr, ok := opErr.Err.(*os.SyscallError); ok {
-					if syscallErr.Err == syscall.ECONNRESET {
-						logs.Debug("PeerChannel", "Remote peer closed connection")
-						close(incoming)
-						return
-					}
-				}
-			}
-
 			select {
 			case <-c.stopCh:
 				return
 			default:
-				logs.Warn("PeerChannel", "Failed to read data: %s", err)
-				close(incoming)
-				return
 			}
+
+			if err == io.EOF || isConnReset(err) {
+				logs.Debug("PeerChannel", "Remote peer closed connection")
+				c.terminate(errPeerClosed)
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				logs.Debug("PeerChannel", "Peer %s idle for %s", c.socket.RemoteAddr().String(), c.idleTimeout)
+				c.terminate(err)
+			} else {
+				logs.Warn("PeerChannel", "Failed to read message from %s: %s", c.socket.RemoteAddr().String(), err)
+				c.terminate(err)
+			}
+			return
 		}
 
-		c.buffer = append(c.buffer, data[:rc]...)
-		messages, leftover, err := pwp.DecodeMessages(c.buffer)
-		if err != nil {
-			logs.Warn("PeerChannel", "Failed to decode messages from %s: %s. Buffer length: %d", c.socket.RemoteAddr().String(), err, len(c.buffer))
-			c.Stop()
-			close(incoming)
+		c.received(message)
+		// Not reading on keeps the remaining data in the kernel buffers, which slows the peer down
+		if !ratelimit.Wait(c.limitedLength(message), c.stopCh, c.downloadLimiters...) {
 			return
 		}
+		select {
+		case incoming <- message:
+		case <-c.stopCh:
+			return
+		}
+	}
+}
 
-		copy(c.buffer, leftover)
-		c.buffer = c.buffer[:len(leftover)]
-		for _, message := range messages {
-			incoming <- message
+func isConnReset(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if syscallErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return syscallErr.Err == syscall.ECONNRESET
 		}
 	}
+	return false
+}
+
+func (c *peerChannel) limitedLength(message pwp.Message) int {
+	if !c.excludeOverhead {
+		return int(messageLength(message))
+	}
+	if piece, ok := message.(*pwp.PieceMsg); ok {
+		return len(piece.Block)
+	}
+	return 0
+}
+
+// Encoded length of the message, without encoding large pieces
+func messageLength(message pwp.Message) int64 {
+	if piece, ok := message.(*pwp.PieceMsg); ok {
+		return int64(13 + len(piece.Block))
+	}
+	return int64(len(message.Encode()))
 }
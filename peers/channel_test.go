@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"gobby/pwp"
+	"gobby/ratelimit"
 	"io"
 	"net"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -196,3 +198,354 @@ func TestChannel(t *testing.T) {
 		t.Fatalf("Channel received length: %d. Mock peer supposed to send length: %d", len(receivedBytes), len(mockPeerToSendBytes))
 	}
 }
+
+func TestChannelLargeMessages(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	channel := newPeerChannel(local)
+	messagesCh := make(chan pwp.Message, 10)
+	channel.Start(messagesCh)
+	defer channel.Stop()
+
+	bitfield := &pwp.BitfieldMsg{Bitfield: bytes.Repeat([]byte{0xff}, 300000)}
+	piece := &pwp.PieceMsg{Index: 1, Offset: 0, Block: make([]byte, 128*1024)}
+	go func() {
+		remote.Write(bitfield.Encode())
+		remote.Write(piece.Encode())
+	}()
+
+	for _, expected := range []pwp.Message{bitfield, piece} {
+		select {
+		case msg := <-messagesCh:
+			if !bytes.Equal(msg.Encode(), expected.Encode()) {
+				t.Fatalf("Received message missmatch")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for message")
+		}
+	}
+}
+
+func TestChannelKeepAlive(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	channel := newPeerChannel(local)
+	channel.keepAliveInterval = time.Millisecond * 20
+	channel.Start(make(chan pwp.Message, 10))
+	defer channel.Stop()
+
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 4)
+	_, err := io.ReadFull(remote, buffer)
+	if err != nil {
+		t.Fatalf("Expected keep-alive. Got: %s", err)
+	}
+	if !bytes.Equal(buffer, (&pwp.KeepAliveMsg{}).Encode()) {
+		t.Fatalf("Expected keep-alive. Got: %v", buffer)
+	}
+}
+
+func TestChannelIdleTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	channel := newPeerChannel(local)
+	channel.SetIdleTimeout(time.Millisecond * 20)
+	messagesCh := make(chan pwp.Message, 10)
+	channel.Start(messagesCh)
+	defer channel.Stop()
+
+	select {
+	case _, ok := <-messagesCh:
+		if ok {
+			t.Fatalf("Expected channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Idle peer was not disconnected")
+	}
+}
+
+func TestChannelStats(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+
+	channel := newPeerChannel(local)
+	messagesCh := make(chan pwp.Message, 10)
+	channel.Start(messagesCh)
+	defer channel.Stop()
+
+	have := &pwp.HaveMsg{Index: 1}
+	remote.Write(have.Encode())
+	<-messagesCh
+	channel.Send(&pwp.InterestedMsg{})
+	channel.Send(&pwp.RequestMsg{Index: 1, Offset: 0, Length: 16384})
+
+	deadline := time.Now().Add(time.Second)
+	var stats *ChannelStats
+	for time.Now().Before(deadline) {
+		stats = channel.Stats()
+		if stats.MessagesSent == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats.MessagesSent != 2 || stats.BytesSent != 5+17 {
+		t.Fatalf("Expected 2 messages and 22 bytes sent. Got: %d, %d", stats.MessagesSent, stats.BytesSent)
+	}
+	if stats.MessagesReceived != 1 || stats.BytesReceived != int64(len(have.Encode())) {
+		t.Fatalf("Expected 1 message and %d bytes received. Got: %d, %d", len(have.Encode()), stats.MessagesReceived, stats.BytesReceived)
+	}
+}
+
+func TestChannelSnubbed(t *testing.T) {
+	channel := newPeerChannel(&net.TCPConn{})
+	now := time.Now()
+
+	channel.received(&pwp.UnchokeMsg{})
+	channel.sent(&pwp.RequestMsg{Index: 0, Offset: 0, Length: 16384})
+	if channel.snubbed(now.Add(_SNUB_TIMEOUT / 2)) {
+		t.Fatalf("Expected peer not to be snubbed yet")
+	}
+	if !channel.snubbed(now.Add(_SNUB_TIMEOUT * 2)) {
+		t.Fatalf("Expected peer to be snubbed")
+	}
+
+	channel.received(&pwp.PieceMsg{Index: 0, Offset: 0, Block: make([]byte, 16384)})
+	if channel.snubbed(now.Add(_SNUB_TIMEOUT * 2)) {
+		t.Fatalf("Expected peer not to be snubbed after receiving a block")
+	}
+
+	channel.sent(&pwp.RequestMsg{Index: 0, Offset: 16384, Length: 16384})
+	channel.received(&pwp.ChokeMsg{})
+	if channel.snubbed(now.Add(_SNUB_TIMEOUT * 2)) {
+		t.Fatalf("Expected choking peer not to be snubbed")
+	}
+}
+
+func TestChannelBackpressure(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	// Nothing reads the remote end, so the writer blocks on the first message
+	channel := newPeerChannel(local)
+	channel.Start(make(chan pwp.Message, 10))
+	channel.Send(&pwp.UnchokeMsg{})
+	for channel.QueueLength() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	queued := 0
+	for channel.TrySend(&pwp.HaveMsg{Index: int32(queued)}) {
+		queued++
+		if queued > _MAX_QUEUED_MESSAGES+1 {
+			t.Fatalf("Expected queue to be bounded")
+		}
+	}
+	if channel.QueueLength() != _MAX_QUEUED_MESSAGES {
+		t.Fatalf("Expected %d queued messages. Got: %d", _MAX_QUEUED_MESSAGES, channel.QueueLength())
+	}
+	stats := channel.Stats()
+	if stats.QueuedBytes != int64(_MAX_QUEUED_MESSAGES*9) {
+		t.Fatalf("Expected %d queued bytes. Got: %d", _MAX_QUEUED_MESSAGES*9, stats.QueuedBytes)
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		channel.Send(&pwp.InterestedMsg{})
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatalf("Expected Send to block while the queue is full")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	channel.Stop()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Stop to release blocked senders")
+	}
+	if channel.QueueLength() != 0 {
+		t.Fatalf("Expected queue to be discarded. Got: %d", channel.QueueLength())
+	}
+	if channel.TrySend(&pwp.InterestedMsg{}) {
+		t.Fatalf("Expected TrySend to fail on a stopped channel")
+	}
+	if channel.Err() != errChannelStopped {
+		t.Fatalf("Expected %s. Got: %v", errChannelStopped, channel.Err())
+	}
+}
+
+func TestChannelCancelQueuedPiece(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	channel := newPeerChannel(local)
+	channel.Start(make(chan pwp.Message, 10))
+	defer channel.Stop()
+
+	// The first message is picked up by the writer, which blocks
+	channel.Send(&pwp.UnchokeMsg{})
+	for channel.QueueLength() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	channel.Send(&pwp.PieceMsg{Index: 1, Offset: 0, Block: make([]byte, 16384)})
+	channel.Send(&pwp.PieceMsg{Index: 1, Offset: 16384, Block: make([]byte, 16384)})
+
+	if channel.Cancel(1, 0, 100) {
+		t.Fatalf("Expected cancel with wrong length to be ignored")
+	}
+	if !channel.Cancel(1, 0, 16384) {
+		t.Fatalf("Expected queued piece to be cancelled")
+	}
+	if channel.Cancel(1, 0, 16384) {
+		t.Fatalf("Expected piece to be cancelled only once")
+	}
+	if channel.QueueLength() != 1 {
+		t.Fatalf("Expected 1 queued message. Got: %d", channel.QueueLength())
+	}
+}
+
+func TestChannelCloseDrains(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	channel := newPeerChannel(local)
+	channel.Start(make(chan pwp.Message, 10))
+
+	expected := make([]byte, 0)
+	for i := 0; i < 20; i++ {
+		msg := &pwp.HaveMsg{Index: int32(i)}
+		channel.Send(msg)
+		expected = append(expected, msg.Encode()...)
+	}
+
+	receivedCh := make(chan []byte)
+	go func() {
+		received, _ := io.ReadAll(remote)
+		receivedCh <- received
+	}()
+	channel.Close()
+
+	select {
+	case received := <-receivedCh:
+		if !bytes.Equal(received, expected) {
+			t.Fatalf("Expected queued messages to be sent before closing. Got %d bytes", len(received))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for connection to close")
+	}
+	if channel.Err() != errChannelClosed {
+		t.Fatalf("Expected %s. Got: %v", errChannelClosed, channel.Err())
+	}
+}
+
+func TestChannelDoneOnPeerClose(t *testing.T) {
+	local, remote := net.Pipe()
+
+	channel := newPeerChannel(local)
+	messagesCh := make(chan pwp.Message, 10)
+	channel.Start(messagesCh)
+	defer channel.Stop()
+
+	if channel.Err() != nil {
+		t.Fatalf("Expected no error on an open channel. Got: %s", channel.Err())
+	}
+	remote.Close()
+
+	select {
+	case <-channel.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Expected channel to terminate")
+	}
+	if channel.Err() != errPeerClosed {
+		t.Fatalf("Expected %s. Got: %v", errPeerClosed, channel.Err())
+	}
+	if _, ok := <-messagesCh; ok {
+		t.Fatalf("Expected incoming messages to be closed")
+	}
+	// Stopping a terminated channel keeps the original error
+	channel.Stop()
+	if channel.Err() != errPeerClosed {
+		t.Fatalf("Expected %s. Got: %v", errPeerClosed, channel.Err())
+	}
+}
+
+func TestChannelRateLimit(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+
+	// The full burst of 256KiB passes, the remaining 64KiB take 250ms
+	limiter := ratelimit.NewLimiter(256 * 1024)
+	channel := newPeerChannel(local)
+	channel.SetRateLimiters([]*ratelimit.Limiter{nil, limiter}, nil, true)
+	channel.Start(make(chan pwp.Message, 10))
+	defer channel.Stop()
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		channel.Send(&pwp.PieceMsg{Index: 0, Offset: int32(i * 16384), Block: make([]byte, 16384)})
+	}
+	for channel.Stats().MessagesSent != 20 {
+		if time.Since(start) > time.Second*2 {
+			t.Fatalf("Timed out waiting for messages to be sent")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*200 {
+		t.Fatalf("Expected sending to be limited. Took: %s", elapsed)
+	}
+}
+
+func TestChannelLimitedLength(t *testing.T) {
+	channel := newPeerChannel(&net.TCPConn{})
+	piece := &pwp.PieceMsg{Index: 0, Offset: 0, Block: make([]byte, 16384)}
+
+	if length := channel.limitedLength(piece); length != 16384+13 {
+		t.Fatalf("Expected %d. Got: %d", 16384+13, length)
+	}
+	if length := channel.limitedLength(&pwp.HaveMsg{Index: 1}); length != 9 {
+		t.Fatalf("Expected 9. Got: %d", length)
+	}
+
+	channel.SetRateLimiters(nil, nil, true)
+	if length := channel.limitedLength(piece); length != 16384 {
+		t.Fatalf("Expected 16384. Got: %d", length)
+	}
+	if length := channel.limitedLength(&pwp.HaveMsg{Index: 1}); length != 0 {
+		t.Fatalf("Expected overhead to be excluded. Got: %d", length)
+	}
+}
+
+func TestCountingConnWriteBuffers(t *testing.T) {
+	local, remote := connPair(t)
+	defer remote.Close()
+	conn := &countingConn{Conn: local}
+	defer conn.Close()
+
+	var writer io.Writer = conn
+	if _, ok := writer.(pwp.BuffersWriter); !ok {
+		t.Fatalf("Expected counting conn to pass vectored writes on")
+	}
+	msg := &pwp.PieceMsg{Index: 1, Offset: 0, Block: bytes.Repeat([]byte{7}, 1024)}
+	err := pwp.NewWriter(conn).WriteMessage(msg)
+	if err != nil {
+		t.Fatalf("Failed to write message: %s", err)
+	}
+
+	expected := msg.Encode()
+	received := make([]byte, len(expected))
+	remote.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, err = io.ReadFull(remote, received)
+	if err != nil || !bytes.Equal(received, expected) {
+		t.Fatalf("Expected the encoded message. Got: %v", err)
+	}
+	if atomic.LoadInt64(&conn.written) != int64(len(expected)) {
+		t.Fatalf("Expected %d bytes counted. Got: %d", len(expected), conn.written)
+	}
+}
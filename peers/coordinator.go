@@ -0,0 +1,691 @@
+package peers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gobby/bitfield"
+	"gobby/logs"
+	"gobby/mse"
+	"gobby/pwp"
+	"gobby/ratelimit"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	_DEFAULT_MAX_PEERS = 50
+	_EVENT_BUFFER_SIZE = 256
+)
+
+type EventType int
+
+const (
+	EventConnected EventType = iota
+	EventDisconnected
+	EventChoked
+	EventUnchoked
+	EventInterested
+	EventNotInterested
+	// The peer's bitfield changed, Index is set for single pieces and -1 for whole bitfields
+	EventHave
+	// Any message the coordinator doesn't handle itself, e.g. pieces and requests. Extended messages go to the extensions
+	EventMessage
+)
+
+type PeerEvent struct {
+	Type    EventType
+	Address string
+	PeerID  []byte
+	Index   int32
+	Message pwp.Message
+	Err     error
+}
+
+// An extension protocol (BEP 10) shared by all connections of a torrent, e.g. ut_metadata or ut_pex
+type Extension interface {
+	Name() string
+	// Handles the extension on a single connection. send queues a message to the peer
+	NewExtension(conn *pwp.PeerConnection, send func(pwp.Message)) pwp.ExtensionHandler
+	PeerDisconnected(address *net.TCPAddr)
+}
+
+// Extensions that add fields to the extended handshake, e.g. ut_metadata's metadata_size
+type HandshakeExtender interface {
+	ExtendHandshake(handshake *pwp.ExtendedHandshake)
+}
+
+// Snapshot of a connected peer's state
+type PeerState struct {
+	Address        string
+	PeerID         []byte
+	Capabilities   pwp.Reserved
+	ConnectedAt    time.Time
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+	Bitfield       *bitfield.Bitfield
+	Stats          *ChannelStats
+}
+
+type peer struct {
+	address      string
+	peerID       []byte
+	capabilities pwp.Reserved
+	connectedAt  time.Time
+	channel      *peerChannel
+	session      *peerSession
+	// Nil if the peer doesn't support the extension protocol
+	extensions     *pwp.ExtensionRegistry
+	remoteAddress  *net.TCPAddr
+	incoming       chan pwp.Message
+	doneCh         chan struct{}
+	amInterested   bool
+	peerInterested bool
+	bitfield       *bitfield.Bitfield
+	uploadLimit    *ratelimit.Limiter
+	downloadLimit  *ratelimit.Limiter
+}
+
+// Owns all peer connections of a single torrent
+type PeerCoordinator struct {
+	infoHash   []byte
+	peerID     []byte
+	pieceCount int
+
+	mx       sync.Mutex
+	maxPeers int
+	peers    map[string]*peer
+	have     *bitfield.Bitfield
+	stopped  bool
+
+	// Global limiters are shared by all torrents, if any
+	globalUpload     *ratelimit.Limiter
+	globalDownload   *ratelimit.Limiter
+	uploadLimit      *ratelimit.Limiter
+	downloadLimit    *ratelimit.Limiter
+	peerUploadRate   int64
+	peerDownloadRate int64
+	excludeOverhead  bool
+
+	extensions        []Extension
+	extendedHandshake *pwp.ExtendedHandshake
+
+	eventMx  sync.RWMutex
+	eventCh  chan *PeerEvent
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func NewPeerCoordinator(infoHash, peerID []byte, pieceCount int) *PeerCoordinator {
+	return &PeerCoordinator{
+		infoHash:      infoHash,
+		peerID:        peerID,
+		pieceCount:    pieceCount,
+		maxPeers:      _DEFAULT_MAX_PEERS,
+		peers:         make(map[string]*peer),
+		have:          bitfield.New(pieceCount),
+		uploadLimit:   ratelimit.NewLimiter(0),
+		downloadLimit: ratelimit.NewLimiter(0),
+		eventCh:       make(chan *PeerEvent, _EVENT_BUFFER_SIZE),
+		stopCh:        make(chan struct{}),
+	}
+}
+
+// Peer lifecycle and message events. Has to be consumed, otherwise peers stall. Closed after Stop
+func (c *PeerCoordinator) Events() <-chan *PeerEvent {
+	return c.eventCh
+}
+
+func (c *PeerCoordinator) SetMaxPeers(maxPeers int) {
+	c.mx.Lock()
+	c.maxPeers = maxPeers
+	c.mx.Unlock()
+}
+
+// Client wide limiters. Apply to peers added afterwards
+func (c *PeerCoordinator) SetGlobalLimiters(upload, download *ratelimit.Limiter) {
+	c.mx.Lock()
+	c.globalUpload, c.globalDownload = upload, download
+	c.mx.Unlock()
+}
+
+// Rates in bytes per second for the whole torrent, 0 meaning unlimited
+func (c *PeerCoordinator) SetRateLimit(upload, download int64) {
+	c.uploadLimit.SetRate(upload)
+	c.downloadLimit.SetRate(download)
+}
+
+// Rates in bytes per second for each peer, 0 meaning unlimited
+func (c *PeerCoordinator) SetPeerRateLimit(upload, download int64) {
+	c.mx.Lock()
+	c.peerUploadRate, c.peerDownloadRate = upload, download
+	peers := c.peerList()
+	c.mx.Unlock()
+
+	for _, p := range peers {
+		p.uploadLimit.SetRate(upload)
+		p.downloadLimit.SetRate(download)
+	}
+}
+
+// Whether only piece payloads count towards the limits. Applies to peers added afterwards
+func (c *PeerCoordinator) SetExcludeOverhead(exclude bool) {
+	c.mx.Lock()
+	c.excludeOverhead = exclude
+	c.mx.Unlock()
+}
+
+// Applies to peers added afterwards
+func (c *PeerCoordinator) AddExtension(extension Extension) {
+	c.mx.Lock()
+	c.extensions = append(c.extensions, extension)
+	c.mx.Unlock()
+}
+
+// Fields sent in every extended handshake, e.g. the client version and listen port
+func (c *PeerCoordinator) SetExtendedHandshake(handshake *pwp.ExtendedHandshake) {
+	c.mx.Lock()
+	c.extendedHandshake = handshake
+	c.mx.Unlock()
+}
+
+func (c *PeerCoordinator) CanAcceptMore() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return !c.stopped && len(c.peers) < c.maxPeers
+}
+
+func (c *PeerCoordinator) PeerCount() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return len(c.peers)
+}
+
+func (c *PeerCoordinator) HandleIncomingConnection(conn net.Conn, handshake *pwp.HandshakeResult) {
+	err := c.AddConnection(conn, handshake)
+	if err != nil {
+		logs.Debug("PeerCoordinator", "Dropping incoming connection from %s: %s", conn.RemoteAddr().String(), err)
+	}
+}
+
+// Takes over a connection with a completed handshake. The connection is closed if it can't be used
+func (c *PeerCoordinator) AddConnection(conn net.Conn, handshake *pwp.HandshakeResult) error {
+	if !bytes.Equal(handshake.InfoHash, c.infoHash) {
+		conn.Close()
+		return errors.New("Info hash missmatch")
+	}
+
+	address := conn.RemoteAddr().String()
+	p := &peer{
+		address:      address,
+		peerID:       handshake.PeerID,
+		capabilities: handshake.Capabilities,
+		connectedAt:  time.Now(),
+		channel:      newPeerChannel(conn),
+		incoming:     make(chan pwp.Message, 10),
+		doneCh:       make(chan struct{}),
+		bitfield:     bitfield.New(c.pieceCount),
+	}
+
+	fast := handshake.Capabilities.Has(pwp.FastExtension)
+	remoteAddress := tcpAddress(conn.RemoteAddr())
+	var allowedFast []int32
+	if remoteAddress != nil {
+		allowedFast = pwp.AllowedFastSet(_ALLOWED_FAST_SET_SIZE, c.pieceCount, c.infoHash, remoteAddress.IP)
+	}
+	p.session = newPeerSession(p.channel.Send, fast, allowedFast, c.pieceCount)
+
+	c.mx.Lock()
+	if c.stopped {
+		c.mx.Unlock()
+		conn.Close()
+		return errors.New("Coordinator stopped")
+	}
+	if len(c.peers) >= c.maxPeers {
+		c.mx.Unlock()
+		conn.Close()
+		return errors.New("Too many peers")
+	}
+	if _, exists := c.peers[address]; exists {
+		c.mx.Unlock()
+		conn.Close()
+		return fmt.Errorf("Already connected to %s", address)
+	}
+	for _, other := range c.peers {
+		if bytes.Equal(other.peerID, p.peerID) {
+			c.mx.Unlock()
+			conn.Close()
+			return fmt.Errorf("Already connected to peer ID %x", p.peerID)
+		}
+	}
+	c.peers[address] = p
+	have := c.have.Copy()
+	var extendedHandshake *pwp.ExtendedHandshake
+	if handshake.Capabilities.Has(pwp.ExtensionProtocol) && remoteAddress != nil {
+		extendedHandshake = c.registerExtensions(p, &pwp.PeerConnection{
+			Address:   remoteAddress,
+			Outgoing:  handshake.Initiator,
+			Encrypted: mse.Encrypted(conn),
+			UTP:       isUTP(conn),
+			Seed:      func() bool { return c.peerSeed(p) },
+		})
+	}
+	p.uploadLimit = ratelimit.NewLimiter(c.peerUploadRate)
+	p.downloadLimit = ratelimit.NewLimiter(c.peerDownloadRate)
+	p.channel.SetRateLimiters(
+		[]*ratelimit.Limiter{c.globalUpload, c.uploadLimit, p.uploadLimit},
+		[]*ratelimit.Limiter{c.globalDownload, c.downloadLimit, p.downloadLimit},
+		c.excludeOverhead,
+	)
+	c.mx.Unlock()
+
+	p.channel.Start(p.incoming)
+	// Without the fast extension, having no pieces is announced by not sending a bitfield
+	if fast || !have.Empty() {
+		p.channel.Send(have.Message(fast))
+	}
+	p.session.SendAllowedFast()
+	if extendedHandshake != nil {
+		err := c.sendExtendedHandshake(p, extendedHandshake)
+		if err != nil {
+			logs.Warn("PeerCoordinator", "Failed to send extended handshake to %s: %s", address, err)
+		}
+	}
+
+	c.emit(&PeerEvent{Type: EventConnected, Address: address, PeerID: p.peerID, Index: -1})
+	go c.handlingPeer(p)
+
+	logs.Debug("PeerCoordinator", "Added peer %s", address)
+	return nil
+}
+
+// Returns the extended handshake to send. Must be called with the mutex held
+func (c *PeerCoordinator) registerExtensions(p *peer, conn *pwp.PeerConnection) *pwp.ExtendedHandshake {
+	p.extensions = pwp.NewExtensionRegistry()
+	p.remoteAddress = conn.Address
+	for _, extension := range c.extensions {
+		p.extensions.Register(extension.Name(), extension.NewExtension(conn, p.channel.Send))
+	}
+
+	handshake := p.extensions.Handshake(c.extendedHandshake)
+	handshake.YourIP = conn.Address.IP
+	for _, extension := range c.extensions {
+		if extender, ok := extension.(HandshakeExtender); ok {
+			extender.ExtendHandshake(handshake)
+		}
+	}
+	return handshake
+}
+
+func (c *PeerCoordinator) sendExtendedHandshake(p *peer, handshake *pwp.ExtendedHandshake) error {
+	payload, err := handshake.Encode()
+	if err != nil {
+		return err
+	}
+	p.channel.Send(&pwp.ExtendedMsg{ID: pwp.ExtendedHandshakeID, Payload: payload})
+	return nil
+}
+
+func (c *PeerCoordinator) handlingPeer(p *peer) {
+	for {
+		select {
+		case message, ok := <-p.incoming:
+			if !ok {
+				c.removePeer(p, p.channel.Err())
+				return
+			}
+			err := c.handleMessage(p, message)
+			if err != nil {
+				logs.Warn("PeerCoordinator", "Protocol violation by %s: %s", p.address, err)
+				c.removePeer(p, err)
+				return
+			}
+		case <-p.doneCh:
+			return
+		}
+	}
+}
+
+func (c *PeerCoordinator) handleMessage(p *peer, message pwp.Message) error {
+	err := p.session.HandleMessage(message)
+	if err != nil {
+		return err
+	}
+
+	event := &PeerEvent{Address: p.address, PeerID: p.peerID, Index: -1}
+	switch msg := message.(type) {
+	case *pwp.KeepAliveMsg:
+		return nil
+	case *pwp.ChokeMsg:
+		event.Type = EventChoked
+	case *pwp.UnchokeMsg:
+		event.Type = EventUnchoked
+	case *pwp.InterestedMsg:
+		c.mx.Lock()
+		p.peerInterested = true
+		c.mx.Unlock()
+		event.Type = EventInterested
+	case *pwp.UninterestedMsg:
+		c.mx.Lock()
+		p.peerInterested = false
+		c.mx.Unlock()
+		event.Type = EventNotInterested
+	case *pwp.HaveMsg:
+		if msg.Index < 0 || int(msg.Index) >= c.pieceCount {
+			return fmt.Errorf("Have for invalid piece %d", msg.Index)
+		}
+		c.mx.Lock()
+		p.bitfield.Set(int(msg.Index))
+		c.mx.Unlock()
+		event.Type = EventHave
+		event.Index = msg.Index
+	case *pwp.BitfieldMsg, *pwp.HaveAllMsg, *pwp.HaveNoneMsg:
+		received, err := bitfield.FromMessage(message, c.pieceCount)
+		if err != nil {
+			return err
+		}
+		c.mx.Lock()
+		p.bitfield = received
+		c.mx.Unlock()
+		event.Type = EventHave
+	case *pwp.ExtendedMsg:
+		if p.extensions == nil {
+			return errors.New("Extended message without the extension protocol")
+		}
+		return p.extensions.HandleMessage(msg)
+	case *pwp.CancelMsg:
+		// Pending requests are handled by the session, answered ones may still be queued
+		if p.channel.Cancel(msg.Index, msg.Offset, msg.Length) {
+			p.session.Reject(&pwp.RequestMsg{Index: msg.Index, Offset: msg.Offset, Length: msg.Length})
+		}
+		event.Type = EventMessage
+		event.Message = message
+	default:
+		event.Type = EventMessage
+		event.Message = message
+	}
+
+	c.emit(event)
+	return nil
+}
+
+func (c *PeerCoordinator) emit(event *PeerEvent) {
+	c.eventMx.RLock()
+	defer c.eventMx.RUnlock()
+
+	select {
+	case <-c.stopCh:
+		return
+	default:
+	}
+	select {
+	case c.eventCh <- event:
+	case <-c.stopCh:
+	}
+}
+
+func (c *PeerCoordinator) removePeer(p *peer, reason error) {
+	c.mx.Lock()
+	if c.peers[p.address] != p {
+		c.mx.Unlock()
+		return
+	}
+	delete(c.peers, p.address)
+	c.mx.Unlock()
+
+	close(p.doneCh)
+	p.channel.Stop()
+	c.extensionsDisconnected(p)
+	logs.Debug("PeerCoordinator", "Removed peer %s: %s", p.address, reason)
+	c.emit(&PeerEvent{Type: EventDisconnected, Address: p.address, PeerID: p.peerID, Index: -1, Err: reason})
+}
+
+func (c *PeerCoordinator) extensionsDisconnected(p *peer) {
+	if p.extensions == nil {
+		return
+	}
+
+	c.mx.Lock()
+	extensions := c.extensions
+	c.mx.Unlock()
+	for _, extension := range extensions {
+		extension.PeerDisconnected(p.remoteAddress)
+	}
+}
+
+// Peers are identified by TCP addresses, also when connected over uTP. Nil for other addresses
+func (c *PeerCoordinator) peerSeed(p *peer) bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return p.bitfield.Full()
+}
+
+// uTP connections, also when wrapped by MSE, have UDP addresses
+func isUTP(conn net.Conn) bool {
+	_, ok := conn.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
+func tcpAddress(address net.Addr) *net.TCPAddr {
+	switch remote := address.(type) {
+	case *net.TCPAddr:
+		return remote
+	case *net.UDPAddr:
+		return &net.TCPAddr{IP: remote.IP, Port: remote.Port, Zone: remote.Zone}
+	}
+	return nil
+}
+
+func (c *PeerCoordinator) getPeer(address string) (*peer, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	p, exists := c.peers[address]
+	if !exists {
+		return nil, fmt.Errorf("Not connected to %s", address)
+	}
+	return p, nil
+}
+
+func (c *PeerCoordinator) Disconnect(address string) {
+	p, err := c.getPeer(address)
+	if err != nil {
+		return
+	}
+	c.removePeer(p, errors.New("Disconnected locally"))
+}
+
+func (c *PeerCoordinator) Choke(address string) error {
+	p, err := c.getPeer(address)
+	if err != nil {
+		return err
+	}
+	p.session.Choke()
+	return nil
+}
+
+func (c *PeerCoordinator) Unchoke(address string) error {
+	p, err := c.getPeer(address)
+	if err != nil {
+		return err
+	}
+	p.session.Unchoke()
+	return nil
+}
+
+func (c *PeerCoordinator) SetInterested(address string, interested bool) error {
+	p, err := c.getPeer(address)
+	if err != nil {
+		return err
+	}
+
+	c.mx.Lock()
+	changed := p.amInterested != interested
+	p.amInterested = interested
+	c.mx.Unlock()
+
+	if changed {
+		if interested {
+			p.channel.Send(&pwp.InterestedMsg{})
+		} else {
+			p.channel.Send(&pwp.UninterestedMsg{})
+		}
+	}
+	return nil
+}
+
+func (c *PeerCoordinator) Request(address string, msg *pwp.RequestMsg) error {
+	p, err := c.getPeer(address)
+	if err != nil {
+		return err
+	}
+	return p.session.Request(msg)
+}
+
+func (c *PeerCoordinator) Cancel(address string, msg *pwp.CancelMsg) error {
+	p, err := c.getPeer(address)
+	if err != nil {
+		return err
+	}
+	p.session.Cancel(msg)
+	return nil
+}
+
+// Answers the peer's oldest pending request. Returns nil when there is none
+func (c *PeerCoordinator) NextRequest(address string) (*pwp.RequestMsg, error) {
+	p, err := c.getPeer(address)
+	if err != nil {
+		return nil, err
+	}
+	return p.session.NextRequest(), nil
+}
+
+func (c *PeerCoordinator) SendPiece(address string, msg *pwp.PieceMsg) error {
+	p, err := c.getPeer(address)
+	if err != nil {
+		return err
+	}
+	p.session.SendPiece(msg)
+	return nil
+}
+
+func (c *PeerCoordinator) Reject(address string, msg *pwp.RequestMsg) error {
+	p, err := c.getPeer(address)
+	if err != nil {
+		return err
+	}
+	p.session.Reject(msg)
+	return nil
+}
+
+// Sends an arbitrary message, e.g. an extended one, to the peer
+func (c *PeerCoordinator) Send(address string, msg pwp.Message) error {
+	p, err := c.getPeer(address)
+	if err != nil {
+		return err
+	}
+	p.channel.Send(msg)
+	return nil
+}
+
+// Marks a piece as available and announces it to all peers
+func (c *PeerCoordinator) Have(index int) {
+	c.mx.Lock()
+	if index < 0 || index >= c.pieceCount || c.have.Has(index) {
+		c.mx.Unlock()
+		return
+	}
+	c.have.Set(index)
+	peers := c.peerList()
+	c.mx.Unlock()
+
+	for _, p := range peers {
+		p.channel.Send(&pwp.HaveMsg{Index: int32(index)})
+	}
+}
+
+func (c *PeerCoordinator) Peers() []*PeerState {
+	c.mx.Lock()
+	peers := c.peerList()
+	c.mx.Unlock()
+
+	states := make([]*PeerState, 0, len(peers))
+	for _, p := range peers {
+		states = append(states, c.state(p))
+	}
+	return states
+}
+
+func (c *PeerCoordinator) Peer(address string) (*PeerState, error) {
+	p, err := c.getPeer(address)
+	if err != nil {
+		return nil, err
+	}
+	return c.state(p), nil
+}
+
+func (c *PeerCoordinator) state(p *peer) *PeerState {
+	amChoking, peerChoking := p.session.ChokeState()
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return &PeerState{
+		Address:        p.address,
+		PeerID:         p.peerID,
+		Capabilities:   p.capabilities,
+		ConnectedAt:    p.connectedAt,
+		AmChoking:      amChoking,
+		AmInterested:   p.amInterested,
+		PeerChoking:    peerChoking,
+		PeerInterested: p.peerInterested,
+		Bitfield:       p.bitfield.Copy(),
+		Stats:          p.channel.Stats(),
+	}
+}
+
+// Addresses of the connected peers
+func (c *PeerCoordinator) addresses() map[string]bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	addresses := make(map[string]bool, len(c.peers))
+	for address := range c.peers {
+		addresses[address] = true
+	}
+	return addresses
+}
+
+// Must be called with the mutex held
+func (c *PeerCoordinator) peerList() []*peer {
+	peers := make([]*peer, 0, len(c.peers))
+	for _, p := range c.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Disconnects all peers and closes the event stream
+func (c *PeerCoordinator) Stop() {
+	c.stopOnce.Do(func() {
+		c.mx.Lock()
+		c.stopped = true
+		peers := c.peerList()
+		c.peers = make(map[string]*peer)
+		c.mx.Unlock()
+
+		close(c.stopCh)
+		for _, p := range peers {
+			close(p.doneCh)
+			p.channel.Stop()
+			c.extensionsDisconnected(p)
+		}
+
+		// Pending emits return once stopCh is closed
+		c.eventMx.Lock()
+		close(c.eventCh)
+		c.eventMx.Unlock()
+	})
+}
@@ -0,0 +1,357 @@
+package peers
+
+import (
+	"bytes"
+	"fmt"
+	"gobby/metadata"
+	"gobby/pwp"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	_TEST_INFO_HASH = []byte("aaaaaaaaaaaaaaaaaaaa")
+	_TEST_PEER_ID   = []byte("-GB0001-000000000000")
+)
+
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		acceptedCh <- conn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	return conn, <-acceptedCh
+}
+
+func testHandshake(peerID string, fast bool) *pwp.HandshakeResult {
+	var capabilities pwp.Reserved
+	if fast {
+		capabilities.Set(pwp.FastExtension)
+	}
+	return &pwp.HandshakeResult{
+		InfoHash:     _TEST_INFO_HASH,
+		PeerID:       []byte(peerID),
+		Reserved:     capabilities,
+		Capabilities: capabilities,
+	}
+}
+
+func nextEvent(t *testing.T, c *PeerCoordinator, expected EventType) *PeerEvent {
+	select {
+	case event := <-c.Events():
+		if event.Type != expected {
+			t.Fatalf("Expected event %d. Got: %d", expected, event.Type)
+		}
+		return event
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Timed out waiting for event %d", expected)
+	}
+	return nil
+}
+
+func TestCoordinatorPeerLifecycle(t *testing.T) {
+	c := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer c.Stop()
+
+	local, remote := connPair(t)
+	err := c.AddConnection(local, testHandshake("-XX0001-111111111111", false))
+	if err != nil {
+		t.Fatalf("Failed to add connection: %s", err)
+	}
+	event := nextEvent(t, c, EventConnected)
+	address := event.Address
+
+	writer := pwp.NewWriter(remote)
+	writer.WriteMessage(&pwp.BitfieldMsg{Bitfield: []byte{0xa0, 0x40}})
+	writer.WriteMessage(&pwp.UnchokeMsg{})
+	writer.WriteMessage(&pwp.InterestedMsg{})
+	writer.WriteMessage(&pwp.HaveMsg{Index: 1})
+
+	nextEvent(t, c, EventHave)
+	nextEvent(t, c, EventUnchoked)
+	nextEvent(t, c, EventInterested)
+	event = nextEvent(t, c, EventHave)
+	if event.Index != 1 {
+		t.Fatalf("Expected have for piece 1. Got: %d", event.Index)
+	}
+
+	state, err := c.Peer(address)
+	if err != nil {
+		t.Fatalf("Failed to get peer state: %s", err)
+	}
+	if !bytes.Equal(state.Bitfield.Bytes(), []byte{0xe0, 0x40}) {
+		t.Fatalf("Expected bitfield e040. Got: %x", state.Bitfield.Bytes())
+	}
+	if state.PeerChoking || !state.PeerInterested || !state.AmChoking || state.AmInterested {
+		t.Fatalf("Unexpected choke/interest state: %+v", state)
+	}
+
+	remote.Close()
+	nextEvent(t, c, EventDisconnected)
+	if c.PeerCount() != 0 {
+		t.Fatalf("Expected no peers. Got: %d", c.PeerCount())
+	}
+}
+
+func TestCoordinatorLimits(t *testing.T) {
+	c := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer c.Stop()
+	c.SetMaxPeers(1)
+
+	local, remote := connPair(t)
+	defer remote.Close()
+	err := c.AddConnection(local, testHandshake("-XX0001-111111111111", false))
+	if err != nil {
+		t.Fatalf("Failed to add connection: %s", err)
+	}
+	if c.CanAcceptMore() {
+		t.Fatalf("Expected coordinator to be full")
+	}
+
+	local2, remote2 := connPair(t)
+	defer remote2.Close()
+	err = c.AddConnection(local2, testHandshake("-XX0001-222222222222", false))
+	if err == nil {
+		t.Fatalf("Expected connection over limit to be refused")
+	}
+
+	c.SetMaxPeers(2)
+	local3, remote3 := connPair(t)
+	defer remote3.Close()
+	err = c.AddConnection(local3, testHandshake("-XX0001-111111111111", false))
+	if err == nil {
+		t.Fatalf("Expected duplicate peer ID to be refused")
+	}
+}
+
+func TestCoordinatorProtocolViolation(t *testing.T) {
+	c := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer c.Stop()
+
+	local, remote := connPair(t)
+	defer remote.Close()
+	err := c.AddConnection(local, testHandshake("-XX0001-111111111111", false))
+	if err != nil {
+		t.Fatalf("Failed to add connection: %s", err)
+	}
+	nextEvent(t, c, EventConnected)
+
+	pwp.NewWriter(remote).WriteMessage(&pwp.BitfieldMsg{Bitfield: []byte{0xff}})
+	event := nextEvent(t, c, EventDisconnected)
+	if event.Err == nil {
+		t.Fatalf("Expected disconnect reason")
+	}
+}
+
+func TestCoordinatorSpareBits(t *testing.T) {
+	c := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer c.Stop()
+
+	local, remote := connPair(t)
+	defer remote.Close()
+	err := c.AddConnection(local, testHandshake("-XX0001-111111111111", false))
+	if err != nil {
+		t.Fatalf("Failed to add connection: %s", err)
+	}
+	nextEvent(t, c, EventConnected)
+
+	pwp.NewWriter(remote).WriteMessage(&pwp.BitfieldMsg{Bitfield: []byte{0xff, 0xe0}})
+	nextEvent(t, c, EventDisconnected)
+}
+
+func TestCoordinatorBitfieldAndHave(t *testing.T) {
+	c := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer c.Stop()
+	c.Have(0)
+
+	local, remote := connPair(t)
+	defer remote.Close()
+	err := c.AddConnection(local, testHandshake("-XX0001-111111111111", true))
+	if err != nil {
+		t.Fatalf("Failed to add connection: %s", err)
+	}
+	c.Have(9)
+
+	reader := pwp.NewReader(remote, pwp.DefaultMaxMessageLength)
+	remote.SetReadDeadline(time.Now().Add(time.Second * 2))
+	message, err := reader.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read message: %s", err)
+	}
+	bitfield, ok := message.(*pwp.BitfieldMsg)
+	if !ok || !bytes.Equal(bitfield.Bitfield, []byte{0x80, 0x00}) {
+		t.Fatalf("Expected bitfield 8000. Got: %+v", message)
+	}
+
+	// The allowed fast set precedes later haves
+	for {
+		message, err = reader.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read message: %s", err)
+		}
+		if _, ok := message.(*pwp.AllowedFastMsg); !ok {
+			break
+		}
+	}
+	have, ok := message.(*pwp.HaveMsg)
+	if !ok || have.Index != 9 {
+		t.Fatalf("Expected have for piece 9. Got: %+v", message)
+	}
+}
+
+func TestCoordinatorHaveAllAndNone(t *testing.T) {
+	c := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer c.Stop()
+
+	for i, message := range []pwp.Message{&pwp.HaveAllMsg{}, &pwp.HaveNoneMsg{}} {
+		local, remote := connPair(t)
+		defer remote.Close()
+		err := c.AddConnection(local, testHandshake(fmt.Sprintf("-XX0001-11111111111%d", i), true))
+		if err != nil {
+			t.Fatalf("Failed to add connection: %s", err)
+		}
+		nextEvent(t, c, EventConnected)
+
+		pwp.NewWriter(remote).WriteMessage(message)
+		event := nextEvent(t, c, EventHave)
+		state, err := c.Peer(event.Address)
+		if err != nil {
+			t.Fatalf("Failed to get peer: %s", err)
+		}
+		_, all := message.(*pwp.HaveAllMsg)
+		if state.Bitfield.Full() != all || state.Bitfield.Empty() == all {
+			t.Fatalf("Expected bitfield to match %T. Got: %v", message, state.Bitfield.Bytes())
+		}
+	}
+}
+
+func TestCoordinatorStop(t *testing.T) {
+	c := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+
+	local, remote := connPair(t)
+	defer remote.Close()
+	err := c.AddConnection(local, testHandshake("-XX0001-111111111111", false))
+	if err != nil {
+		t.Fatalf("Failed to add connection: %s", err)
+	}
+	c.Stop()
+
+	for range c.Events() {
+	}
+	if c.CanAcceptMore() {
+		t.Fatalf("Expected stopped coordinator to refuse peers")
+	}
+}
+
+type mockExtension struct {
+	mx           sync.Mutex
+	conn         *pwp.PeerConnection
+	remoteID     byte
+	payloads     [][]byte
+	disconnected []string
+}
+
+func (e *mockExtension) Name() string {
+	return "mock"
+}
+
+func (e *mockExtension) NewExtension(conn *pwp.PeerConnection, send func(pwp.Message)) pwp.ExtensionHandler {
+	e.mx.Lock()
+	e.conn = conn
+	e.mx.Unlock()
+	return e
+}
+
+func (e *mockExtension) PeerDisconnected(address *net.TCPAddr) {
+	e.mx.Lock()
+	e.disconnected = append(e.disconnected, address.String())
+	e.mx.Unlock()
+}
+
+func (e *mockExtension) Negotiated(localID, remoteID byte, handshake *pwp.ExtendedHandshake) {
+	e.mx.Lock()
+	e.remoteID = remoteID
+	e.mx.Unlock()
+}
+
+func (e *mockExtension) HandleMessage(payload []byte) error {
+	e.mx.Lock()
+	e.payloads = append(e.payloads, payload)
+	e.mx.Unlock()
+	return nil
+}
+
+var _ Extension = metadata.NewExchange(_TEST_INFO_HASH)
+
+func TestCoordinatorExtensions(t *testing.T) {
+	c := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer c.Stop()
+	extension := &mockExtension{}
+	c.AddExtension(extension)
+	c.SetExtendedHandshake(&pwp.ExtendedHandshake{V: "gobby"})
+
+	local, remote := connPair(t)
+	handshake := testHandshake("-XX0001-111111111111", false)
+	handshake.Capabilities.Set(pwp.ExtensionProtocol)
+	err := c.AddConnection(local, handshake)
+	if err != nil {
+		t.Fatalf("Failed to add connection: %s", err)
+	}
+	nextEvent(t, c, EventConnected)
+
+	reader := pwp.NewReader(remote, pwp.DefaultMaxMessageLength)
+	remote.SetReadDeadline(time.Now().Add(time.Second * 2))
+	message, err := reader.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read message: %s", err)
+	}
+	extended, ok := message.(*pwp.ExtendedMsg)
+	if !ok || extended.ID != pwp.ExtendedHandshakeID {
+		t.Fatalf("Expected extended handshake. Got: %+v", message)
+	}
+	received, err := pwp.DecodeExtendedHandshake(extended.Payload)
+	if err != nil || received.M["mock"] != 1 || received.V != "gobby" || !received.YourIP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("Expected handshake advertising the extension. Got: %+v, %v", received, err)
+	}
+
+	payload, _ := (&pwp.ExtendedHandshake{M: map[string]byte{"mock": 3}}).Encode()
+	writer := pwp.NewWriter(remote)
+	writer.WriteMessage(&pwp.ExtendedMsg{ID: pwp.ExtendedHandshakeID, Payload: payload})
+	writer.WriteMessage(&pwp.ExtendedMsg{ID: 1, Payload: []byte("hello")})
+	writer.WriteMessage(&pwp.BitfieldMsg{Bitfield: []byte{0xff, 0xc0}})
+	// Synchronizes with the coordinator, which handles messages in order
+	writer.WriteMessage(&pwp.InterestedMsg{})
+	nextEvent(t, c, EventHave)
+	nextEvent(t, c, EventInterested)
+
+	extension.mx.Lock()
+	if extension.remoteID != 3 || len(extension.payloads) != 1 || string(extension.payloads[0]) != "hello" {
+		t.Fatalf("Expected extension to be negotiated and receive its message. Got: %d, %q", extension.remoteID, extension.payloads)
+	}
+	conn := extension.conn
+	extension.mx.Unlock()
+	if conn.Outgoing || conn.Encrypted || conn.UTP || !conn.Seed() {
+		t.Fatalf("Expected incoming plaintext TCP connection to a seed. Got: %+v", conn)
+	}
+
+	remote.Close()
+	nextEvent(t, c, EventDisconnected)
+	extension.mx.Lock()
+	defer extension.mx.Unlock()
+	if len(extension.disconnected) != 1 {
+		t.Fatalf("Expected extension to be notified of the disconnect")
+	}
+}
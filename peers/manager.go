@@ -0,0 +1,402 @@
+package peers
+
+import (
+	"errors"
+	"fmt"
+	"gobby/ipfilter"
+	"gobby/logs"
+	"gobby/mse"
+	"gobby/pwp"
+	"gobby/utp"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	_DEFAULT_TORRENT_TARGET   = 30
+	_DEFAULT_GLOBAL_TARGET    = 200
+	_DEFAULT_CONCURRENT_DIALS = 10
+	_DIAL_TIMEOUT             = time.Second * 10
+	_SCHEDULE_INTERVAL        = time.Second
+	_BASE_BACKOFF             = time.Second * 30
+	_MAX_BACKOFF              = time.Hour
+	_MAX_FAILURES             = 8
+	_MAX_CANDIDATES           = 1000
+	// Connections count as failed attempts until they lasted this long
+	_MIN_CONNECTION_TIME = time.Minute
+)
+
+type candidate struct {
+	address     string
+	utp         bool
+	failures    int
+	nextAttempt time.Time
+	// Bytes received from the peer on earlier connections
+	delivered int64
+	dialing   bool
+	// Of a connection that hasn't lasted _MIN_CONNECTION_TIME yet
+	connectedAt time.Time
+}
+
+type managedTorrent struct {
+	infoHash    []byte
+	coordinator *PeerCoordinator
+	target      int
+	dialing     int
+	candidates  map[string]*candidate
+}
+
+// Dials candidate peers of all torrents, keeping each at its target number of connections
+type ConnectionManager struct {
+	peerID     []byte
+	reserved   pwp.Reserved
+	encryption mse.Policy
+	utpSocket  *utp.Socket
+	bans       *BanList
+	filter     *ipfilter.Filter
+
+	mx           sync.Mutex
+	torrents     map[string]*managedTorrent
+	globalTarget int
+	maxDials     int
+	dialing      int
+	stopOnce     sync.Once
+	stopCh       chan struct{}
+}
+
+func NewConnectionManager(peerID []byte, reserved pwp.Reserved) *ConnectionManager {
+	// Extensions are negotiated by the coordinators, like for incoming connections
+	reserved.Set(pwp.ExtensionProtocol)
+	reserved.Set(pwp.FastExtension)
+	return &ConnectionManager{
+		peerID:       peerID,
+		reserved:     reserved,
+		encryption:   mse.PolicyPreferred,
+		bans:         NewBanList(),
+		filter:       ipfilter.NewFilter(),
+		torrents:     make(map[string]*managedTorrent),
+		globalTarget: _DEFAULT_GLOBAL_TARGET,
+		maxDials:     _DEFAULT_CONCURRENT_DIALS,
+		stopCh:       make(chan struct{}),
+	}
+}
+
+// Must be called before Run
+func (m *ConnectionManager) SetEncryptionPolicy(policy mse.Policy) {
+	m.encryption = policy
+}
+
+// Must be called before Run
+func (m *ConnectionManager) SetBanList(bans *BanList) {
+	m.bans = bans
+}
+
+// Must be called before Run
+func (m *ConnectionManager) SetIPFilter(filter *ipfilter.Filter) {
+	m.filter = filter
+}
+
+// Enables dialing peers over uTP. Must be called before Run
+func (m *ConnectionManager) SetUTPSocket(socket *utp.Socket) {
+	m.utpSocket = socket
+}
+
+func (m *ConnectionManager) SetGlobalTarget(target int) {
+	m.mx.Lock()
+	m.globalTarget = target
+	m.mx.Unlock()
+}
+
+func (m *ConnectionManager) SetMaxConcurrentDials(maxDials int) {
+	m.mx.Lock()
+	m.maxDials = maxDials
+	m.mx.Unlock()
+}
+
+func (m *ConnectionManager) AddTorrent(infoHash []byte, coordinator *PeerCoordinator) {
+	m.mx.Lock()
+	m.torrents[string(infoHash)] = &managedTorrent{
+		infoHash:    infoHash,
+		coordinator: coordinator,
+		target:      _DEFAULT_TORRENT_TARGET,
+		candidates:  make(map[string]*candidate),
+	}
+	m.mx.Unlock()
+}
+
+func (m *ConnectionManager) RemoveTorrent(infoHash []byte) {
+	m.mx.Lock()
+	delete(m.torrents, string(infoHash))
+	m.mx.Unlock()
+}
+
+func (m *ConnectionManager) SetTorrentTarget(infoHash []byte, target int) {
+	m.mx.Lock()
+	if torrent, exists := m.torrents[string(infoHash)]; exists {
+		torrent.target = target
+	}
+	m.mx.Unlock()
+}
+
+// Adds a peer address learned from any source, e.g. trackers, LSD or PEX.
+// Known candidates keep their history
+func (m *ConnectionManager) AddCandidate(infoHash []byte, address *net.TCPAddr, supportsUTP bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	torrent, exists := m.torrents[string(infoHash)]
+	if !exists {
+		return
+	}
+	key := address.String()
+	if c, exists := torrent.candidates[key]; exists {
+		c.utp = c.utp || supportsUTP
+		return
+	}
+	if len(torrent.candidates) >= _MAX_CANDIDATES {
+		return
+	}
+	torrent.candidates[key] = &candidate{address: key, utp: supportsUTP}
+}
+
+// Adds candidates of the torrent, e.g. for peer exchange or local service discovery
+func (m *ConnectionManager) CandidateHandler(infoHash []byte) func(address *net.TCPAddr, supportsUTP bool) {
+	return func(address *net.TCPAddr, supportsUTP bool) {
+		m.AddCandidate(infoHash, address, supportsUTP)
+	}
+}
+
+// Forgets a peer that others reported as gone, e.g. through PEX. Peers being dialed
+// or that delivered data before are kept
+func (m *ConnectionManager) RemoveCandidate(infoHash []byte, address *net.TCPAddr) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	torrent, exists := m.torrents[string(infoHash)]
+	if !exists {
+		return
+	}
+	if c, exists := torrent.candidates[address.String()]; exists && !c.dialing && c.delivered == 0 {
+		delete(torrent.candidates, c.address)
+	}
+}
+
+// Removes candidates of the torrent, e.g. for peer exchange
+func (m *ConnectionManager) CandidateRemover(infoHash []byte) func(address *net.TCPAddr) {
+	return func(address *net.TCPAddr) {
+		m.RemoveCandidate(infoHash, address)
+	}
+}
+
+// Remembers how much a peer delivered, so it is preferred when reconnecting
+func (m *ConnectionManager) RecordDelivered(infoHash []byte, address string, bytes int64) {
+	m.mx.Lock()
+	if torrent, exists := m.torrents[string(infoHash)]; exists {
+		if c, exists := torrent.candidates[address]; exists {
+			c.delivered += bytes
+		}
+	}
+	m.mx.Unlock()
+}
+
+func (m *ConnectionManager) Run() {
+	ticker := time.NewTicker(_SCHEDULE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.schedule(now)
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+func (m *ConnectionManager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopCh)
+	})
+}
+
+func (m *ConnectionManager) schedule(now time.Time) {
+	m.mx.Lock()
+	torrents := make([]*managedTorrent, 0, len(m.torrents))
+	for _, torrent := range m.torrents {
+		torrents = append(torrents, torrent)
+	}
+	m.mx.Unlock()
+
+	// The coordinators are asked without the mutex held, as they take their own locks
+	peers := make([]map[string]bool, len(torrents))
+	canAccept := make([]bool, len(torrents))
+	connected := 0
+	for i, torrent := range torrents {
+		peers[i] = torrent.coordinator.addresses()
+		canAccept[i] = torrent.coordinator.CanAcceptMore()
+		connected += len(peers[i])
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for i, torrent := range torrents {
+		if m.torrents[string(torrent.infoHash)] != torrent {
+			continue
+		}
+		torrent.settle(peers[i], now)
+		for _, c := range torrent.dialOrder(now) {
+			if m.dialing >= m.maxDials || connected+m.dialing >= m.globalTarget {
+				return
+			}
+			if len(peers[i])+torrent.dialing >= torrent.target || !canAccept[i] {
+				break
+			}
+			if peers[i][c.address] {
+				continue
+			}
+			if m.bans.BannedAddress(c.address) || !m.filter.AllowedAddress(c.address, torrent.infoHash) {
+				delete(torrent.candidates, c.address)
+				continue
+			}
+
+			c.dialing = true
+			torrent.dialing++
+			m.dialing++
+			go m.connectTo(torrent, c, c.utp)
+		}
+	}
+}
+
+// Forgives the failures of candidates whose connections lasted. Must be called with the mutex held
+func (t *managedTorrent) settle(connected map[string]bool, now time.Time) {
+	for _, c := range t.candidates {
+		if c.connectedAt.IsZero() {
+			continue
+		}
+		if !connected[c.address] {
+			// Disconnected too early, the backoff set when connecting applies
+			c.connectedAt = time.Time{}
+		} else if now.Sub(c.connectedAt) >= _MIN_CONNECTION_TIME {
+			c.failures = 0
+			c.nextAttempt = time.Time{}
+			c.connectedAt = time.Time{}
+		}
+	}
+}
+
+// Candidates that may be dialed now, the ones that delivered most and failed least first.
+// Must be called with the mutex held
+func (t *managedTorrent) dialOrder(now time.Time) []*candidate {
+	candidates := make([]*candidate, 0)
+	for _, c := range t.candidates {
+		if !c.dialing && !now.Before(c.nextAttempt) {
+			candidates = append(candidates, c)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].delivered != candidates[j].delivered {
+			return candidates[i].delivered > candidates[j].delivered
+		}
+		return candidates[i].failures < candidates[j].failures
+	})
+	return candidates
+}
+
+func (m *ConnectionManager) connectTo(torrent *managedTorrent, c *candidate, useUTP bool) {
+	err := m.connect(torrent, c.address, useUTP)
+	now := time.Now()
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	c.dialing = false
+	torrent.dialing--
+	m.dialing--
+
+	// Connections count as failures until they lasted, so peers that drop them right away back off
+	c.failures++
+	if err == nil {
+		c.connectedAt = now
+	} else {
+		logs.Debug("ConnectionManager", "Failed to connect to %s: %s", c.address, err)
+	}
+	if err != nil && c.failures >= _MAX_FAILURES {
+		delete(torrent.candidates, c.address)
+		return
+	}
+	c.nextAttempt = now.Add(backoff(c.failures))
+}
+
+func backoff(failures int) time.Duration {
+	delay := _BASE_BACKOFF
+	for i := 1; i < failures && delay < _MAX_BACKOFF; i++ {
+		delay *= 2
+	}
+	if delay > _MAX_BACKOFF {
+		delay = _MAX_BACKOFF
+	}
+	return delay
+}
+
+func (m *ConnectionManager) connect(torrent *managedTorrent, address string, useUTP bool) error {
+	socket, err := m.dial(address, useUTP)
+	if err != nil {
+		return err
+	}
+	conn, err := m.establish(socket, torrent.infoHash, m.encryption)
+	if err != nil && m.encryption == mse.PolicyPreferred {
+		// The peer is reachable but may not support encryption at all
+		conn, err = m.dial(address, useUTP)
+	}
+	if err != nil {
+		return err
+	}
+
+	opts := &pwp.HandshakeOptions{
+		Reserved:  m.reserved,
+		Initiator: true,
+	}
+	handshake, err := pwp.Handshake(conn, torrent.infoHash, m.peerID, opts)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Failed handshake: %s", err)
+	}
+
+	return torrent.coordinator.AddConnection(conn, handshake)
+}
+
+// Closes the socket if the encryption handshake fails
+func (m *ConnectionManager) establish(socket net.Conn, infoHash []byte, policy mse.Policy) (net.Conn, error) {
+	socket.SetDeadline(time.Now().Add(_DIAL_TIMEOUT))
+	conn, err := mse.Initiate(socket, infoHash, policy)
+	if err != nil {
+		socket.Close()
+		return nil, fmt.Errorf("Failed to establish encryption: %s", err)
+	}
+	socket.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Tries uTP first for peers known to support it, falling back to TCP
+func (m *ConnectionManager) dial(address string, useUTP bool) (net.Conn, error) {
+	if useUTP && m.utpSocket != nil {
+		conn, err := m.utpSocket.DialTimeout(address, _DIAL_TIMEOUT)
+		if err == nil {
+			return conn, nil
+		}
+		logs.Debug("ConnectionManager", "Failed to dial %s over uTP: %s", address, err)
+	}
+
+	select {
+	case <-m.stopCh:
+		return nil, errors.New("Connection manager stopped")
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", address, _DIAL_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to dial: %s", err)
+	}
+	return conn, nil
+}
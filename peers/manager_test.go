@@ -0,0 +1,328 @@
+package peers
+
+import (
+	"gobby/ipfilter"
+	"gobby/mse"
+	"gobby/pex"
+	"gobby/pwp"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	expected := map[int]time.Duration{
+		1:  _BASE_BACKOFF,
+		2:  _BASE_BACKOFF * 2,
+		3:  _BASE_BACKOFF * 4,
+		20: _MAX_BACKOFF,
+	}
+
+	for failures, delay := range expected {
+		if backoff(failures) != delay {
+			t.Fatalf("Expected %s after %d failures. Got: %s", delay, failures, backoff(failures))
+		}
+	}
+}
+
+func TestDialOrder(t *testing.T) {
+	now := time.Now()
+	torrent := &managedTorrent{
+		candidates: map[string]*candidate{
+			"a": &candidate{address: "a", failures: 2},
+			"b": &candidate{address: "b", delivered: 1000},
+			"c": &candidate{address: "c"},
+			"d": &candidate{address: "d", nextAttempt: now.Add(time.Minute)},
+			"e": &candidate{address: "e", dialing: true},
+		},
+	}
+
+	order := torrent.dialOrder(now)
+	if len(order) != 3 {
+		t.Fatalf("Expected 3 candidates. Got: %d", len(order))
+	}
+	for i, address := range []string{"b", "c", "a"} {
+		if order[i].address != address {
+			t.Fatalf("Expected %s at position %d. Got: %s", address, i, order[i].address)
+		}
+	}
+}
+
+func waitDials(t *testing.T, m *ConnectionManager) {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		m.mx.Lock()
+		dialing := m.dialing
+		m.mx.Unlock()
+		if dialing == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("Timed out waiting for dials")
+}
+
+func TestConnectionManagerConnects(t *testing.T) {
+	remoteCoordinator := NewPeerCoordinator(_TEST_INFO_HASH, []byte("-XX0001-111111111111"), 10)
+	defer remoteCoordinator.Stop()
+	server := NewPeerServer([]byte("-XX0001-111111111111"), "0")
+	server.Register(_TEST_INFO_HASH, false, remoteCoordinator)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go server.ServeListener(listener)
+	defer server.Stop()
+
+	coordinator := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer coordinator.Stop()
+	m := NewConnectionManager(_TEST_PEER_ID, pwp.Reserved{})
+	m.AddTorrent(_TEST_INFO_HASH, coordinator)
+	m.AddCandidate(_TEST_INFO_HASH, listener.Addr().(*net.TCPAddr), false)
+
+	m.schedule(time.Now())
+	event := nextEvent(t, coordinator, EventConnected)
+	if string(event.PeerID) != "-XX0001-111111111111" {
+		t.Fatalf("Expected remote peer ID. Got: %s", event.PeerID)
+	}
+	waitDials(t, m)
+
+	// Already connected
+	m.schedule(time.Now())
+	m.mx.Lock()
+	dialing := m.dialing
+	m.mx.Unlock()
+	if dialing != 0 {
+		t.Fatalf("Expected no dials to connected peers. Got: %d", dialing)
+	}
+
+	// Forgiven once the connection lasted
+	m.schedule(time.Now().Add(_MIN_CONNECTION_TIME))
+	m.mx.Lock()
+	c := m.torrents[string(_TEST_INFO_HASH)].candidates[listener.Addr().String()]
+	failures := c.failures
+	m.mx.Unlock()
+	if failures != 0 {
+		t.Fatalf("Expected failures to be reset for a lasting connection. Got: %d", failures)
+	}
+}
+
+func TestConnectionManagerShortConnectionBacksOff(t *testing.T) {
+	remoteCoordinator := NewPeerCoordinator(_TEST_INFO_HASH, []byte("-XX0001-111111111111"), 10)
+	defer remoteCoordinator.Stop()
+	server := NewPeerServer([]byte("-XX0001-111111111111"), "0")
+	server.Register(_TEST_INFO_HASH, false, remoteCoordinator)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go server.ServeListener(listener)
+	defer server.Stop()
+
+	coordinator := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer coordinator.Stop()
+	m := NewConnectionManager(_TEST_PEER_ID, pwp.Reserved{})
+	m.AddTorrent(_TEST_INFO_HASH, coordinator)
+	m.AddCandidate(_TEST_INFO_HASH, listener.Addr().(*net.TCPAddr), false)
+
+	now := time.Now()
+	m.schedule(now)
+	event := nextEvent(t, coordinator, EventConnected)
+	waitDials(t, m)
+	coordinator.Disconnect(event.Address)
+	for {
+		select {
+		case event = <-coordinator.Events():
+		case <-time.After(time.Second * 2):
+			t.Fatalf("Timed out waiting for disconnect")
+		}
+		if event.Type == EventDisconnected {
+			break
+		}
+	}
+
+	m.schedule(now.Add(_SCHEDULE_INTERVAL))
+	m.mx.Lock()
+	c := m.torrents[string(_TEST_INFO_HASH)].candidates[listener.Addr().String()]
+	dialing, failures, nextAttempt := c.dialing, c.failures, c.nextAttempt
+	m.mx.Unlock()
+	if dialing || failures != 1 || nextAttempt.Before(now.Add(_BASE_BACKOFF)) {
+		t.Fatalf("Expected dropped connection to back off. Got: %v, %d, %s", dialing, failures, nextAttempt)
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestConnectionManagerPlaintextFallback(t *testing.T) {
+	remoteCoordinator := NewPeerCoordinator(_TEST_INFO_HASH, []byte("-XX0001-111111111111"), 10)
+	defer remoteCoordinator.Stop()
+	server := NewPeerServer([]byte("-XX0001-111111111111"), "0")
+	server.SetEncryptionPolicy(mse.PolicyDisabled)
+	server.Register(_TEST_INFO_HASH, false, remoteCoordinator)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	counting := &countingListener{Listener: listener}
+	go server.ServeListener(counting)
+	defer server.Stop()
+
+	coordinator := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer coordinator.Stop()
+	m := NewConnectionManager(_TEST_PEER_ID, pwp.Reserved{})
+	m.AddTorrent(_TEST_INFO_HASH, coordinator)
+
+	err = m.connect(m.torrents[string(_TEST_INFO_HASH)], listener.Addr().String(), false)
+	if err != nil {
+		t.Fatalf("Expected plaintext fallback to connect. Got: %s", err)
+	}
+	if accepted := atomic.LoadInt32(&counting.accepted); accepted != 2 {
+		t.Fatalf("Expected 2 connections. Got: %d", accepted)
+	}
+}
+
+func TestConnectionManagerBackoff(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	address := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	coordinator := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer coordinator.Stop()
+	m := NewConnectionManager(_TEST_PEER_ID, pwp.Reserved{})
+	m.AddTorrent(_TEST_INFO_HASH, coordinator)
+	m.AddCandidate(_TEST_INFO_HASH, address, false)
+
+	now := time.Now()
+	m.schedule(now)
+	waitDials(t, m)
+
+	m.mx.Lock()
+	c := m.torrents[string(_TEST_INFO_HASH)].candidates[address.String()]
+	failures, nextAttempt := c.failures, c.nextAttempt
+	m.mx.Unlock()
+	if failures != 1 {
+		t.Fatalf("Expected 1 failure. Got: %d", failures)
+	}
+	if nextAttempt.Before(now.Add(_BASE_BACKOFF)) {
+		t.Fatalf("Expected next attempt after backoff. Got: %s", nextAttempt)
+	}
+}
+
+func TestConnectionManagerTargets(t *testing.T) {
+	coordinator := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer coordinator.Stop()
+	m := NewConnectionManager(_TEST_PEER_ID, pwp.Reserved{})
+	m.AddTorrent(_TEST_INFO_HASH, coordinator)
+	m.SetTorrentTarget(_TEST_INFO_HASH, 2)
+	m.SetMaxConcurrentDials(1)
+	for port := 1; port <= 3; port++ {
+		m.AddCandidate(_TEST_INFO_HASH, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}, false)
+	}
+
+	m.schedule(time.Now())
+	m.mx.Lock()
+	dialing := m.dialing
+	m.mx.Unlock()
+	if dialing != 1 {
+		t.Fatalf("Expected a single concurrent dial. Got: %d", dialing)
+	}
+	m.Stop()
+}
+
+func TestConnectionManagerSkipsBanned(t *testing.T) {
+	coordinator := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer coordinator.Stop()
+	bans := NewBanList()
+	m := NewConnectionManager(_TEST_PEER_ID, pwp.Reserved{})
+	m.SetBanList(bans)
+	m.AddTorrent(_TEST_INFO_HASH, coordinator)
+
+	address := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}
+	bans.BanAddress(address.String())
+	if !bans.Banned(address.IP) || bans.Count() != 1 {
+		t.Fatalf("Expected %s to be banned", address.IP)
+	}
+	m.AddCandidate(_TEST_INFO_HASH, address, false)
+
+	m.schedule(time.Now())
+	m.mx.Lock()
+	dialing := m.dialing
+	candidates := len(m.torrents[string(_TEST_INFO_HASH)].candidates)
+	m.mx.Unlock()
+	if dialing != 0 || candidates != 0 {
+		t.Fatalf("Expected banned candidate to be dropped. Dialing: %d. Candidates: %d", dialing, candidates)
+	}
+}
+
+func TestConnectionManagerSkipsFiltered(t *testing.T) {
+	coordinator := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer coordinator.Stop()
+	allowlist := ipfilter.NewRangeSet()
+	allowlist.AddRange(net.IPv4(10, 0, 0, 0), net.IPv4(10, 255, 255, 255))
+	filter := ipfilter.NewFilter()
+	filter.SetAllowlist(_TEST_INFO_HASH, allowlist)
+	m := NewConnectionManager(_TEST_PEER_ID, pwp.Reserved{})
+	m.SetIPFilter(filter)
+	m.AddTorrent(_TEST_INFO_HASH, coordinator)
+
+	m.AddCandidate(_TEST_INFO_HASH, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}, false)
+	m.schedule(time.Now())
+	m.mx.Lock()
+	candidates := len(m.torrents[string(_TEST_INFO_HASH)].candidates)
+	m.mx.Unlock()
+	if candidates != 0 || filter.Blocked() != 1 {
+		t.Fatalf("Expected candidate outside the allowlist to be dropped. Candidates: %d. Blocked: %d", candidates, filter.Blocked())
+	}
+}
+
+func TestConnectionManagerPEXCandidates(t *testing.T) {
+	coordinator := NewPeerCoordinator(_TEST_INFO_HASH, _TEST_PEER_ID, 10)
+	defer coordinator.Stop()
+	m := NewConnectionManager(_TEST_PEER_ID, pwp.Reserved{})
+	m.AddTorrent(_TEST_INFO_HASH, coordinator)
+
+	exchange := pex.NewExchange(false)
+	exchange.SetCandidateHandlers(m.CandidateHandler(_TEST_INFO_HASH), m.CandidateRemover(_TEST_INFO_HASH))
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51413}
+	extension := exchange.NewExtension(&pwp.PeerConnection{Address: remote}, func(pwp.Message) {})
+	extension.Negotiated(1, 2, &pwp.ExtendedHandshake{Port: 6881})
+	gone := &net.TCPAddr{IP: net.ParseIP("10.0.0.6"), Port: 6881}
+	m.AddCandidate(_TEST_INFO_HASH, gone, false)
+
+	msg := &pex.Message{
+		Added: []*pex.Peer{
+			&pex.Peer{Address: &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 6881}, Flags: pex.FlagUTP},
+		},
+		Dropped: []*net.TCPAddr{gone},
+	}
+	payload, _ := msg.Encode()
+	err := extension.HandleMessage(payload)
+	if err != nil {
+		t.Fatalf("Failed to handle message: %s", err)
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	c, exists := m.torrents[string(_TEST_INFO_HASH)].candidates["10.0.0.5:6881"]
+	if !exists || !c.utp {
+		t.Fatalf("Expected peer learned through PEX to become a uTP candidate")
+	}
+	if _, exists := m.torrents[string(_TEST_INFO_HASH)].candidates[gone.String()]; exists {
+		t.Fatalf("Expected dropped peer to be removed from the candidates")
+	}
+}
@@ -2,7 +2,9 @@ package peers
 
 import (
 	"fmt"
+	"gobby/ipfilter"
 	"gobby/logs"
+	"gobby/mse"
 	"gobby/pwp"
 	"net"
 	"sync"
@@ -10,31 +12,86 @@ import (
 
 type PeerServer struct {
 	peerID         []byte
+	reserved       pwp.Reserved
+	encryption     mse.Policy
 	port           string
-	socket         net.Listener
+	listenersMx    sync.Mutex
+	listeners      []net.Listener
 	closed         bool
 	coordinatorsMx sync.Mutex
 	coordinators   map[string]*PeerCoordinator
+	private        map[string]bool
+	bans           *BanList
+	filter         *ipfilter.Filter
 }
 
 func NewPeerServer(peerID []byte, port string) *PeerServer {
+	var reserved pwp.Reserved
+	reserved.Set(pwp.ExtensionProtocol)
+	reserved.Set(pwp.FastExtension)
+
 	return &PeerServer{
 		peerID:       peerID,
+		reserved:     reserved,
+		encryption:   mse.PolicyPreferred,
 		port:         port,
 		coordinators: make(map[string]*PeerCoordinator),
+		private:      make(map[string]bool),
+		bans:         NewBanList(),
+		filter:       ipfilter.NewFilter(),
 	}
 }
 
-func (s *PeerServer) Register(infoHash []byte, coordinator *PeerCoordinator) {
+// Must be called before Serve
+func (s *PeerServer) SetBanList(bans *BanList) {
+	s.bans = bans
+}
+
+// Must be called before Serve
+func (s *PeerServer) SetIPFilter(filter *ipfilter.Filter) {
+	s.filter = filter
+}
+
+// Must be called before Serve
+func (s *PeerServer) SetEncryptionPolicy(policy mse.Policy) {
+	s.encryption = policy
+}
+
+func (s *PeerServer) Register(infoHash []byte, private bool, coordinator *PeerCoordinator) {
 	s.coordinatorsMx.Lock()
 	s.coordinators[string(infoHash)] = coordinator
+	s.private[string(infoHash)] = private
 	s.coordinatorsMx.Unlock()
 }
 
 func (s *PeerServer) Deregister(infoHash []byte) {
 	s.coordinatorsMx.Lock()
 	delete(s.coordinators, string(infoHash))
+	delete(s.private, string(infoHash))
+	s.coordinatorsMx.Unlock()
+}
+
+// Info hashes of registered torrents that may be announced outside of their trackers
+func (s *PeerServer) PublicInfoHashes() [][]byte {
+	s.coordinatorsMx.Lock()
+	infoHashes := make([][]byte, 0, len(s.coordinators))
+	for infoHash := range s.coordinators {
+		if !s.private[infoHash] {
+			infoHashes = append(infoHashes, []byte(infoHash))
+		}
+	}
+	s.coordinatorsMx.Unlock()
+	return infoHashes
+}
+
+func (s *PeerServer) infoHashes() [][]byte {
+	s.coordinatorsMx.Lock()
+	infoHashes := make([][]byte, 0, len(s.coordinators))
+	for infoHash := range s.coordinators {
+		infoHashes = append(infoHashes, []byte(infoHash))
+	}
 	s.coordinatorsMx.Unlock()
+	return infoHashes
 }
 
 func (s *PeerServer) getCoordinator(infoHash []byte) *PeerCoordinator {
@@ -45,10 +102,20 @@ func (s *PeerServer) getCoordinator(infoHash []byte) *PeerCoordinator {
 }
 
 func (s *PeerServer) Stop() {
-	if !s.closed && s.socket != nil {
+	s.listenersMx.Lock()
+	if !s.closed {
 		s.closed = true
-		s.socket.Close()
+		for _, listener := range s.listeners {
+			listener.Close()
+		}
 	}
+	s.listenersMx.Unlock()
+}
+
+func (s *PeerServer) isClosed() bool {
+	s.listenersMx.Lock()
+	defer s.listenersMx.Unlock()
+	return s.closed
 }
 
 func (s *PeerServer) Serve() error {
@@ -58,15 +125,29 @@ func (s *PeerServer) Serve() error {
 		return fmt.Errorf("Failed to open server socket. Error: %s", err)
 	}
 
-	s.socket = socket
+	return s.ServeListener(socket)
+}
+
+// Accepts peers from any listener, e.g. a uTP socket. May be called for several listeners concurrently
+func (s *PeerServer) ServeListener(listener net.Listener) error {
+	s.listenersMx.Lock()
+	if s.closed {
+		s.listenersMx.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listeners = append(s.listeners, listener)
+	s.listenersMx.Unlock()
+
+	address := listener.Addr().String()
 	for {
-		clientSocket, err := s.socket.Accept()
+		clientSocket, err := listener.Accept()
 		if err != nil {
-			if s.closed {
-				logs.Info("PeerServer", "Terminating server on port %s", s.port)
+			if s.isClosed() {
+				logs.Info("PeerServer", "Terminating server on %s", address)
 				return nil
 			} else {
-				return fmt.Errorf("Error while accepting connections on port %s: %s", s.port, err)
+				return fmt.Errorf("Error while accepting connections on %s: %s", address, err)
 			}
 		}
 
@@ -76,49 +157,54 @@ func (s *PeerServer) Serve() error {
 
 func (s *PeerServer) handleIncomingPeer(socket net.Conn) {
 	peerAddress := socket.RemoteAddr().String()
-	logs.Debug("PeerServer", "Incoming connection at port %s from %s", s.port, peerAddress)
+	logs.Debug("PeerServer", "Incoming connection at %s from %s", socket.LocalAddr().String(), peerAddress)
 
-	peerHandshakeData := make([]byte, 0, 68)
-	readCount, err := socket.Read(peerHandshakeData)
-	if err != nil {
-		logs.Warn("PeerServer", "Error while receiving handshake from %s", peerAddress)
+	if s.bans.BannedAddress(peerAddress) {
+		logs.Debug("PeerServer", "Refusing connection from banned %s", peerAddress)
 		socket.Close()
 		return
 	}
-	if readCount != 68 {
-		logs.Warn("PeerServer", "Read only %d bytes of handshake data from %s", readCount, peerAddress)
+	if !s.filter.AllowedAddress(peerAddress, nil) {
+		logs.Debug("PeerServer", "Refusing connection from filtered %s", peerAddress)
 		socket.Close()
 		return
 	}
 
-	infoHash, peerID, err := pwp.ParseHandshake(peerHandshakeData)
+	conn, err := mse.Accept(socket, s.infoHashes(), s.encryption)
 	if err != nil {
-		logs.Warn("PeerServer", "Invalid handshake from %s: %s", peerAddress, err)
+		logs.Warn("PeerServer", "Failed to establish connection with %s: %s", peerAddress, err)
 		socket.Close()
 		return
 	}
 
-	coordinator := s.getCoordinator(infoHash)
-	if coordinator == nil {
-		logs.Warn("PeerServer", "Nonexistant info hash from %s", peerAddress)
-		socket.Close()
-		return
-	}
-
-	if !coordinator.CanAcceptMore() {
-		logs.Debug("PeerServer", "Refusing connection from %s. Cannot accept more", peerAddress)
-		socket.Close()
-		return
+	var coordinator *PeerCoordinator
+	opts := &pwp.HandshakeOptions{
+		Reserved: s.reserved,
+		Lookup: func(infoHash []byte) bool {
+			coordinator = s.getCoordinator(infoHash)
+			if coordinator == nil {
+				logs.Warn("PeerServer", "Nonexistant info hash from %s", peerAddress)
+				return false
+			}
+			if !s.filter.AllowedAddress(peerAddress, infoHash) {
+				logs.Debug("PeerServer", "Refusing connection from %s. Not allowed for torrent", peerAddress)
+				return false
+			}
+			if !coordinator.CanAcceptMore() {
+				logs.Debug("PeerServer", "Refusing connection from %s. Cannot accept more", peerAddress)
+				return false
+			}
+			return true
+		},
 	}
 
-	responseHandshake := pwp.EncodeHandshake(infoHash, s.peerID)
-	_, err = socket.Write(responseHandshake)
+	handshake, err := pwp.Handshake(conn, nil, s.peerID, opts)
 	if err != nil {
-		logs.Warn("PeerServer", "Failed to send response handshake to %s: %s", peerAddress, err)
+		logs.Warn("PeerServer", "Failed handshake with %s: %s", peerAddress, err)
 		socket.Close()
 		return
 	}
 
 	logs.Debug("PeerServer", "Exchanged handshake with %s. Handing off to coordinator", peerAddress)
-	coordinator.HandleIncomingConnection(socket, peerID)
+	coordinator.HandleIncomingConnection(conn, handshake)
 }
@@ -0,0 +1,319 @@
+package peers
+
+import (
+	"errors"
+	"fmt"
+	"gobby/pwp"
+	"sync"
+)
+
+const (
+	_ALLOWED_FAST_SET_SIZE = 10
+	// Cancelled requests whose late pieces are still accepted without the fast extension
+	_MAX_CANCELLED_REQUESTS = 256
+)
+
+type blockRequest struct {
+	index  int32
+	offset int32
+	length int32
+}
+
+// Protocol state of a single peer connection. Enforces the request/choke semantics,
+// including those of the fast extension (BEP 6) when both sides support it
+type peerSession struct {
+	send       func(pwp.Message)
+	fast       bool
+	pieceCount int
+
+	// Held while sending messages queued under mx, so they go out in the order of the state changes
+	sendMx          sync.Mutex
+	mx              sync.Mutex
+	receivedFirst   bool
+	amChoking       bool
+	peerChoking     bool
+	allowedFast     map[int32]bool
+	peerAllowedFast map[int32]bool
+	suggested       []int32
+	pending         []blockRequest
+	requested       map[blockRequest]bool
+	cancelled       map[blockRequest]bool
+}
+
+func newPeerSession(send func(pwp.Message), fast bool, allowedFast []int32, pieceCount int) *peerSession {
+	session := &peerSession{
+		send:            send,
+		fast:            fast,
+		pieceCount:      pieceCount,
+		amChoking:       true,
+		peerChoking:     true,
+		allowedFast:     make(map[int32]bool),
+		peerAllowedFast: make(map[int32]bool),
+		suggested:       make([]int32, 0),
+		pending:         make([]blockRequest, 0),
+		requested:       make(map[blockRequest]bool),
+		cancelled:       make(map[blockRequest]bool),
+	}
+	if fast {
+		for _, index := range allowedFast {
+			session.allowedFast[index] = true
+		}
+	}
+	return session
+}
+
+// Announces the allowed fast set. Intended to be called once, right after the bitfield
+func (s *peerSession) SendAllowedFast() {
+	if !s.fast {
+		return
+	}
+
+	s.mx.Lock()
+	indexes := make([]int32, 0, len(s.allowedFast))
+	for index := range s.allowedFast {
+		indexes = append(indexes, index)
+	}
+	s.mx.Unlock()
+
+	for _, index := range indexes {
+		s.send(&pwp.AllowedFastMsg{Index: index})
+	}
+}
+
+// Sends the messages after releasing the mutex, which must be held. Blocking sends, e.g. while
+// the peer's queue is full, thus don't hold up incoming messages
+func (s *peerSession) unlockAndSend(messages []pwp.Message) {
+	if len(messages) == 0 {
+		s.mx.Unlock()
+		return
+	}
+
+	s.sendMx.Lock()
+	s.mx.Unlock()
+	for _, message := range messages {
+		s.send(message)
+	}
+	s.sendMx.Unlock()
+}
+
+func (s *peerSession) Choke() {
+	s.mx.Lock()
+	if s.amChoking {
+		s.mx.Unlock()
+		return
+	}
+	s.amChoking = true
+	messages := []pwp.Message{&pwp.ChokeMsg{}}
+
+	// Without the fast extension choking implicitly discards pending requests.
+	// With it, each has to be rejected explicitly unless it's allowed fast
+	remaining := make([]blockRequest, 0)
+	for _, req := range s.pending {
+		if !s.fast {
+			continue
+		}
+		if s.allowedFast[req.index] {
+			remaining = append(remaining, req)
+		} else {
+			messages = append(messages, &pwp.RejectRequestMsg{Index: req.index, Offset: req.offset, Length: req.length})
+		}
+	}
+	s.pending = remaining
+	s.unlockAndSend(messages)
+}
+
+func (s *peerSession) Unchoke() {
+	s.mx.Lock()
+	var messages []pwp.Message
+	if s.amChoking {
+		s.amChoking = false
+		messages = append(messages, &pwp.UnchokeMsg{})
+	}
+	s.unlockAndSend(messages)
+}
+
+func (s *peerSession) Request(msg *pwp.RequestMsg) error {
+	s.mx.Lock()
+	if s.peerChoking && !s.peerAllowedFast[msg.Index] {
+		s.mx.Unlock()
+		return fmt.Errorf("Cannot request piece %d while choked", msg.Index)
+	}
+
+	s.requested[blockRequest{msg.Index, msg.Offset, msg.Length}] = true
+	s.unlockAndSend([]pwp.Message{msg})
+	return nil
+}
+
+func (s *peerSession) Cancel(msg *pwp.CancelMsg) {
+	s.mx.Lock()
+	req := blockRequest{msg.Index, msg.Offset, msg.Length}
+	// With the fast extension the peer still answers with a piece or a reject, so the request
+	// stays registered. Without it the piece may have been sent before the cancel arrived,
+	// but there is no answer otherwise, so only a limited number of late pieces is accepted
+	var messages []pwp.Message
+	if s.requested[req] {
+		messages = append(messages, msg)
+		if !s.fast {
+			delete(s.requested, req)
+			if len(s.cancelled) >= _MAX_CANCELLED_REQUESTS {
+				s.cancelled = make(map[blockRequest]bool)
+			}
+			s.cancelled[req] = true
+		}
+	}
+	s.unlockAndSend(messages)
+}
+
+// Pops the oldest pending request of the peer. The caller has to answer it with either SendPiece or Reject
+func (s *peerSession) NextRequest() *pwp.RequestMsg {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if len(s.pending) == 0 {
+		return nil
+	}
+	req := s.pending[0]
+	s.pending = s.pending[1:]
+	return &pwp.RequestMsg{Index: req.index, Offset: req.offset, Length: req.length}
+}
+
+func (s *peerSession) SendPiece(msg *pwp.PieceMsg) {
+	s.send(msg)
+}
+
+func (s *peerSession) Reject(msg *pwp.RequestMsg) {
+	if s.fast {
+		s.send(&pwp.RejectRequestMsg{Index: msg.Index, Offset: msg.Offset, Length: msg.Length})
+	}
+}
+
+func (s *peerSession) ChokeState() (amChoking, peerChoking bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.amChoking, s.peerChoking
+}
+
+// Pieces the peer suggested since the last call
+func (s *peerSession) Suggested() []int32 {
+	s.mx.Lock()
+	suggested := s.suggested
+	s.suggested = make([]int32, 0)
+	s.mx.Unlock()
+	return suggested
+}
+
+// Updates session state with a message received from the peer.
+// Returns an error on protocol violations, after which the connection should be dropped
+func (s *peerSession) HandleMessage(message pwp.Message) error {
+	s.mx.Lock()
+	var messages []pwp.Message
+	err := s.handleMessage(message, &messages)
+	s.unlockAndSend(messages)
+	return err
+}
+
+// Appends messages to send in response. Must be called with the mutex held
+func (s *peerSession) handleMessage(message pwp.Message, messages *[]pwp.Message) error {
+	// Extension protocol messages, e.g. the extended handshake, may precede the bitfield
+	first := !s.receivedFirst
+	switch message.(type) {
+	case *pwp.KeepAliveMsg, *pwp.ExtendedMsg:
+	default:
+		s.receivedFirst = true
+	}
+
+	switch msg := message.(type) {
+	case *pwp.ChokeMsg:
+		s.peerChoking = true
+		if !s.fast {
+			s.requested = make(map[blockRequest]bool)
+			s.cancelled = make(map[blockRequest]bool)
+		}
+
+	case *pwp.UnchokeMsg:
+		s.peerChoking = false
+
+	case *pwp.BitfieldMsg:
+		if !first {
+			return errors.New("Bitfield is only allowed as the first message")
+		}
+
+	case *pwp.RequestMsg:
+		if !s.validIndex(msg.Index) {
+			return fmt.Errorf("Request for invalid piece %d", msg.Index)
+		}
+		req := blockRequest{msg.Index, msg.Offset, msg.Length}
+		if s.amChoking && !s.allowedFast[msg.Index] {
+			if s.fast {
+				*messages = append(*messages, &pwp.RejectRequestMsg{Index: msg.Index, Offset: msg.Offset, Length: msg.Length})
+			}
+			return nil
+		}
+		s.pending = append(s.pending, req)
+
+	case *pwp.CancelMsg:
+		req := blockRequest{msg.Index, msg.Offset, msg.Length}
+		for i, pending := range s.pending {
+			if pending == req {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				if s.fast {
+					*messages = append(*messages, &pwp.RejectRequestMsg{Index: msg.Index, Offset: msg.Offset, Length: msg.Length})
+				}
+				break
+			}
+		}
+
+	case *pwp.PieceMsg:
+		req := blockRequest{msg.Index, msg.Offset, int32(len(msg.Block))}
+		if s.cancelled[req] {
+			delete(s.cancelled, req)
+			break
+		}
+		if !s.requested[req] {
+			return fmt.Errorf("Unrequested block %d/%d of length %d", msg.Index, msg.Offset, len(msg.Block))
+		}
+		delete(s.requested, req)
+
+	case *pwp.HaveAllMsg, *pwp.HaveNoneMsg:
+		if !s.fast {
+			return errors.New("Fast extension message without fast extension support")
+		}
+		if !first {
+			return errors.New("Have all/none is only allowed as the first message")
+		}
+
+	case *pwp.SuggestPieceMsg:
+		if !s.fast {
+			return errors.New("Fast extension message without fast extension support")
+		}
+		if !s.validIndex(msg.Index) {
+			return fmt.Errorf("Suggestion of invalid piece %d", msg.Index)
+		}
+		s.suggested = append(s.suggested, msg.Index)
+
+	case *pwp.RejectRequestMsg:
+		if !s.fast {
+			return errors.New("Fast extension message without fast extension support")
+		}
+		req := blockRequest{msg.Index, msg.Offset, msg.Length}
+		if !s.requested[req] {
+			return fmt.Errorf("Reject for unrequested block %d/%d", msg.Index, msg.Offset)
+		}
+		delete(s.requested, req)
+
+	case *pwp.AllowedFastMsg:
+		if !s.fast {
+			return errors.New("Fast extension message without fast extension support")
+		}
+		if !s.validIndex(msg.Index) {
+			return fmt.Errorf("Allowed fast for invalid piece %d", msg.Index)
+		}
+		s.peerAllowedFast[msg.Index] = true
+	}
+
+	return nil
+}
+
+func (s *peerSession) validIndex(index int32) bool {
+	return index >= 0 && int(index) < s.pieceCount
+}
@@ -0,0 +1,205 @@
+package peers
+
+import (
+	"gobby/pwp"
+	"testing"
+)
+
+type sentMessages struct {
+	messages []pwp.Message
+}
+
+func (s *sentMessages) send(msg pwp.Message) {
+	s.messages = append(s.messages, msg)
+}
+
+func (s *sentMessages) rejects() int {
+	count := 0
+	for _, msg := range s.messages {
+		if _, ok := msg.(*pwp.RejectRequestMsg); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSessionFastRejectsWhileChoking(t *testing.T) {
+	sent := &sentMessages{}
+	session := newPeerSession(sent.send, true, []int32{5}, 10)
+
+	if err := session.HandleMessage(&pwp.RequestMsg{Index: 1, Offset: 0, Length: 16384}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sent.rejects() != 1 {
+		t.Fatalf("Expected request to be rejected while choking. Sent: %v", sent.messages)
+	}
+
+	if err := session.HandleMessage(&pwp.RequestMsg{Index: 5, Offset: 0, Length: 16384}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	req := session.NextRequest()
+	if req == nil || req.Index != 5 {
+		t.Fatalf("Expected allowed fast request to be pending. Got: %v", req)
+	}
+}
+
+func TestSessionFastChokeRejectsPending(t *testing.T) {
+	sent := &sentMessages{}
+	session := newPeerSession(sent.send, true, []int32{5}, 10)
+	session.Unchoke()
+
+	session.HandleMessage(&pwp.RequestMsg{Index: 1, Offset: 0, Length: 16384})
+	session.HandleMessage(&pwp.RequestMsg{Index: 5, Offset: 0, Length: 16384})
+	session.HandleMessage(&pwp.RequestMsg{Index: 2, Offset: 0, Length: 16384})
+	session.Choke()
+
+	if sent.rejects() != 2 {
+		t.Fatalf("Expected 2 rejects on choke. Got: %d", sent.rejects())
+	}
+	req := session.NextRequest()
+	if req == nil || req.Index != 5 {
+		t.Fatalf("Expected allowed fast request to survive choke. Got: %v", req)
+	}
+	if session.NextRequest() != nil {
+		t.Fatalf("Expected no other pending requests")
+	}
+}
+
+func TestSessionFastCancelRejects(t *testing.T) {
+	sent := &sentMessages{}
+	session := newPeerSession(sent.send, true, nil, 10)
+	session.Unchoke()
+
+	session.HandleMessage(&pwp.RequestMsg{Index: 1, Offset: 0, Length: 16384})
+	session.HandleMessage(&pwp.CancelMsg{Index: 1, Offset: 0, Length: 16384})
+	if sent.rejects() != 1 {
+		t.Fatalf("Expected cancelled request to be rejected. Got: %d", sent.rejects())
+	}
+	if session.NextRequest() != nil {
+		t.Fatalf("Expected no pending requests")
+	}
+}
+
+func TestSessionRequestingWhileChoked(t *testing.T) {
+	sent := &sentMessages{}
+	session := newPeerSession(sent.send, true, nil, 10)
+
+	if err := session.Request(&pwp.RequestMsg{Index: 3, Offset: 0, Length: 16384}); err == nil {
+		t.Fatalf("Expected error when requesting while choked")
+	}
+
+	session.HandleMessage(&pwp.AllowedFastMsg{Index: 3})
+	if err := session.Request(&pwp.RequestMsg{Index: 3, Offset: 0, Length: 16384}); err != nil {
+		t.Fatalf("Expected allowed fast request while choked. Got: %s", err)
+	}
+
+	// Choke doesn't discard requests with fast extension, they are rejected explicitly
+	session.HandleMessage(&pwp.ChokeMsg{})
+	if err := session.HandleMessage(&pwp.RejectRequestMsg{Index: 3, Offset: 0, Length: 16384}); err != nil {
+		t.Fatalf("Unexpected error for reject of pending request: %s", err)
+	}
+	if err := session.HandleMessage(&pwp.RejectRequestMsg{Index: 3, Offset: 0, Length: 16384}); err == nil {
+		t.Fatalf("Expected error for reject of unrequested block")
+	}
+}
+
+func TestSessionWithoutFast(t *testing.T) {
+	sent := &sentMessages{}
+	session := newPeerSession(sent.send, false, []int32{5}, 10)
+
+	session.HandleMessage(&pwp.RequestMsg{Index: 5, Offset: 0, Length: 16384})
+	if sent.rejects() != 0 || session.NextRequest() != nil {
+		t.Fatalf("Expected request to be silently dropped while choking")
+	}
+
+	if err := session.HandleMessage(&pwp.HaveAllMsg{}); err == nil {
+		t.Fatalf("Expected error for fast message without fast extension")
+	}
+
+	session.HandleMessage(&pwp.UnchokeMsg{})
+	session.Request(&pwp.RequestMsg{Index: 1, Offset: 0, Length: 10})
+	session.HandleMessage(&pwp.ChokeMsg{})
+	if err := session.HandleMessage(&pwp.PieceMsg{Index: 1, Offset: 0, Block: make([]byte, 10)}); err == nil {
+		t.Fatalf("Expected choke to discard outstanding requests")
+	}
+}
+
+func TestSessionHaveAllOnlyFirst(t *testing.T) {
+	session := newPeerSession((&sentMessages{}).send, true, nil, 10)
+	session.HandleMessage(&pwp.KeepAliveMsg{})
+	if err := session.HandleMessage(&pwp.HaveAllMsg{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := session.HandleMessage(&pwp.HaveNoneMsg{}); err == nil {
+		t.Fatalf("Expected error for have none after first message")
+	}
+}
+
+func TestSessionInvalidIndexes(t *testing.T) {
+	session := newPeerSession((&sentMessages{}).send, true, nil, 10)
+	messages := []pwp.Message{
+		&pwp.RequestMsg{Index: 10, Offset: 0, Length: 16384},
+		&pwp.RequestMsg{Index: -1, Offset: 0, Length: 16384},
+		&pwp.AllowedFastMsg{Index: 10},
+		&pwp.SuggestPieceMsg{Index: 10},
+	}
+	for _, msg := range messages {
+		if err := session.HandleMessage(msg); err == nil {
+			t.Fatalf("Expected error for invalid index. Message: %v", msg)
+		}
+	}
+	if suggested := session.Suggested(); len(suggested) != 0 {
+		t.Fatalf("Expected invalid suggestion to be dropped. Got: %v", suggested)
+	}
+}
+
+func TestSessionSendsWithoutLock(t *testing.T) {
+	var session *peerSession
+	count := 0
+	session = newPeerSession(func(pwp.Message) {
+		// Would deadlock if sends were made with the mutex held
+		session.ChokeState()
+		count++
+	}, true, nil, 10)
+
+	session.Unchoke()
+	session.HandleMessage(&pwp.UnchokeMsg{})
+	session.Request(&pwp.RequestMsg{Index: 1, Offset: 0, Length: 16384})
+	session.Cancel(&pwp.CancelMsg{Index: 1, Offset: 0, Length: 16384})
+	session.HandleMessage(&pwp.RequestMsg{Index: 2, Offset: 0, Length: 16384})
+	session.Choke()
+	if count != 5 {
+		t.Fatalf("Expected 5 messages sent. Got: %d", count)
+	}
+}
+
+func TestSessionExtendedBeforeBitfield(t *testing.T) {
+	session := newPeerSession((&sentMessages{}).send, true, nil, 10)
+	if err := session.HandleMessage(&pwp.ExtendedMsg{ID: pwp.ExtendedHandshakeID}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := session.HandleMessage(&pwp.HaveNoneMsg{}); err != nil {
+		t.Fatalf("Expected have none after the extended handshake. Got: %s", err)
+	}
+	if err := session.HandleMessage(&pwp.BitfieldMsg{Bitfield: []byte{0, 0}}); err == nil {
+		t.Fatalf("Expected error for bitfield after have none")
+	}
+}
+
+func TestSessionCancelWithoutFast(t *testing.T) {
+	session := newPeerSession((&sentMessages{}).send, false, nil, 10)
+	session.HandleMessage(&pwp.UnchokeMsg{})
+	session.Request(&pwp.RequestMsg{Index: 1, Offset: 0, Length: 10})
+	session.Cancel(&pwp.CancelMsg{Index: 1, Offset: 0, Length: 10})
+	if len(session.requested) != 0 {
+		t.Fatalf("Expected cancelled request to be forgotten. Got: %v", session.requested)
+	}
+
+	// Sent before the cancel arrived
+	if err := session.HandleMessage(&pwp.PieceMsg{Index: 1, Offset: 0, Block: make([]byte, 10)}); err != nil {
+		t.Fatalf("Expected late piece to be accepted. Got: %s", err)
+	}
+	if err := session.HandleMessage(&pwp.PieceMsg{Index: 1, Offset: 0, Block: make([]byte, 10)}); err == nil {
+		t.Fatalf("Expected error for a second piece of the cancelled request")
+	}
+}
@@ -0,0 +1,257 @@
+package pex
+
+import (
+	"errors"
+	"gobby/logs"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	_PEX_INTERVAL          = time.Minute
+	_MIN_RECEIVE_INTERVAL  = time.Second * 45
+	_MAX_PEERS_PER_MESSAGE = 50
+)
+
+type Sender interface {
+	Send(payload []byte)
+}
+
+type connectedPeer struct {
+	peer *Peer
+	// Nil if unknown
+	seed func() bool
+}
+
+type remotePeer struct {
+	sender       Sender
+	sent         map[string]*net.TCPAddr
+	lastSent     time.Time
+	lastReceived time.Time
+}
+
+// Peer exchange (BEP 11) state of a single torrent. Inert for private torrents
+type Exchange struct {
+	private         bool
+	addCandidate    func(address *net.TCPAddr, supportsUTP bool)
+	removeCandidate func(address *net.TCPAddr)
+	mx              sync.Mutex
+	connected       map[string]*connectedPeer
+	remotes         map[string]*remotePeer
+	stopOnce        sync.Once
+	stopCh          chan struct{}
+}
+
+func NewExchange(private bool) *Exchange {
+	return &Exchange{
+		private:   private,
+		connected: make(map[string]*connectedPeer),
+		remotes:   make(map[string]*remotePeer),
+		stopCh:    make(chan struct{}),
+	}
+}
+
+// Peers learned from others are passed to addCandidate, e.g. ConnectionManager.AddCandidate,
+// peers others dropped to removeCandidate. Must be called before peers connect
+func (e *Exchange) SetCandidateHandlers(addCandidate func(address *net.TCPAddr, supportsUTP bool), removeCandidate func(address *net.TCPAddr)) {
+	e.addCandidate = addCandidate
+	e.removeCandidate = removeCandidate
+}
+
+func (e *Exchange) PeerConnected(peer *Peer) {
+	e.peerConnected(peer.Address.String(), peer, nil)
+}
+
+// The key is the connection's address, which differs from the listen address for incoming connections.
+// seed is asked whether to flag the peer as a seed when it is advertised, and may be nil
+func (e *Exchange) peerConnected(key string, peer *Peer, seed func() bool) {
+	if e.private {
+		return
+	}
+
+	e.mx.Lock()
+	e.connected[key] = &connectedPeer{peer: peer, seed: seed}
+	e.mx.Unlock()
+}
+
+func (e *Exchange) PeerDisconnected(address *net.TCPAddr) {
+	if e.private {
+		return
+	}
+
+	e.mx.Lock()
+	delete(e.connected, address.String())
+	delete(e.remotes, address.String())
+	e.mx.Unlock()
+}
+
+// Called once the remote peer is known to support ut_pex
+func (e *Exchange) Subscribe(address *net.TCPAddr, sender Sender) {
+	if e.private {
+		return
+	}
+
+	e.mx.Lock()
+	if remote, exists := e.remotes[address.String()]; exists {
+		remote.sender = sender
+	} else {
+		e.remotes[address.String()] = &remotePeer{
+			sender: sender,
+			sent:   make(map[string]*net.TCPAddr),
+		}
+	}
+	e.mx.Unlock()
+}
+
+// Returns newly learned peers, to be added to the candidate pool, and peers the remote peer
+// is no longer connected to
+func (e *Exchange) HandleMessage(address *net.TCPAddr, payload []byte) ([]*Peer, []*net.TCPAddr, error) {
+	if e.private {
+		return nil, nil, errors.New("PEX is disabled for private torrents")
+	}
+
+	now := time.Now()
+	e.mx.Lock()
+	remote, exists := e.remotes[address.String()]
+	if exists {
+		if !remote.lastReceived.IsZero() && now.Sub(remote.lastReceived) < _MIN_RECEIVE_INTERVAL {
+			e.mx.Unlock()
+			return nil, nil, errors.New("PEX messages received too frequently")
+		}
+		remote.lastReceived = now
+	}
+	e.mx.Unlock()
+
+	msg, err := DecodeMessage(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	added, dropped := msg.Added, msg.Dropped
+	if len(added) > _MAX_PEERS_PER_MESSAGE {
+		added = added[:_MAX_PEERS_PER_MESSAGE]
+	}
+	if len(dropped) > _MAX_PEERS_PER_MESSAGE {
+		dropped = dropped[:_MAX_PEERS_PER_MESSAGE]
+	}
+
+	candidates := make([]*Peer, 0, len(added))
+	e.mx.Lock()
+	for _, peer := range added {
+		if _, connected := e.connected[peer.Address.String()]; !connected {
+			candidates = append(candidates, peer)
+		}
+	}
+	e.mx.Unlock()
+
+	return candidates, dropped, nil
+}
+
+func (e *Exchange) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.stopCh)
+	})
+}
+
+// Blocks until stopped, periodically sending connected peer updates to subscribed peers
+func (e *Exchange) Run() {
+	if e.private {
+		return
+	}
+
+	ticker := time.NewTicker(_PEX_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			e.sendUpdates(now)
+		case <-e.stopCh:
+			return
+		}
+	}
+}
+
+func (e *Exchange) sendUpdates(now time.Time) {
+	senders := make([]Sender, 0)
+	messages := make([]*Message, 0)
+
+	// Seed states are queried without the mutex held, as they come from the peer coordinator
+	e.mx.Lock()
+	queries := make(map[string]func() bool)
+	for address, connected := range e.connected {
+		if connected.seed != nil {
+			queries[address] = connected.seed
+		}
+	}
+	e.mx.Unlock()
+	seeds := make(map[string]bool)
+	for address, seed := range queries {
+		seeds[address] = seed()
+	}
+
+	e.mx.Lock()
+	for address, remote := range e.remotes {
+		msg := e.prepareMessage(address, now, seeds)
+		if msg != nil {
+			senders = append(senders, remote.sender)
+			messages = append(messages, msg)
+		}
+	}
+	e.mx.Unlock()
+
+	for i, msg := range messages {
+		payload, err := msg.Encode()
+		if err != nil {
+			logs.Warn("PEX", "Failed to encode message: %s", err)
+			continue
+		}
+		senders[i].Send(payload)
+	}
+}
+
+// Computes the delta between what was sent to the remote peer and what is connected now.
+// Returns nil if there is nothing to send or the remote peer was updated too recently.
+// Must be called with the mutex held
+func (e *Exchange) prepareMessage(address string, now time.Time, seeds map[string]bool) *Message {
+	remote := e.remotes[address]
+	if !remote.lastSent.IsZero() && now.Sub(remote.lastSent) < _PEX_INTERVAL {
+		return nil
+	}
+
+	msg := &Message{
+		Added:   make([]*Peer, 0),
+		Dropped: make([]*net.TCPAddr, 0),
+	}
+	for peerAddress, connected := range e.connected {
+		if len(msg.Added) == _MAX_PEERS_PER_MESSAGE {
+			break
+		}
+		if _, sent := remote.sent[peerAddress]; sent || peerAddress == address {
+			continue
+		}
+		peer := &Peer{Address: connected.peer.Address, Flags: connected.peer.Flags}
+		if seeds[peerAddress] {
+			peer.Flags |= FlagSeed
+		}
+		msg.Added = append(msg.Added, peer)
+		remote.sent[peerAddress] = peer.Address
+	}
+	for peerAddress, tcpAddress := range remote.sent {
+		if len(msg.Dropped) == _MAX_PEERS_PER_MESSAGE {
+			break
+		}
+		if _, connected := e.connected[peerAddress]; connected {
+			continue
+		}
+		msg.Dropped = append(msg.Dropped, tcpAddress)
+		delete(remote.sent, peerAddress)
+	}
+
+	if len(msg.Added) == 0 && len(msg.Dropped) == 0 {
+		return nil
+	}
+	remote.lastSent = now
+	return msg
+}
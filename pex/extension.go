@@ -0,0 +1,93 @@
+package pex
+
+import (
+	"gobby/pwp"
+	"net"
+)
+
+const ExtensionName = "ut_pex"
+
+type messageSender struct {
+	remoteID byte
+	send     func(pwp.Message)
+}
+
+func (s *messageSender) Send(payload []byte) {
+	s.send(&pwp.ExtendedMsg{ID: s.remoteID, Payload: payload})
+}
+
+// Connects the exchange to a single peer connection's extension registry
+type extension struct {
+	exchange *Exchange
+	conn     *pwp.PeerConnection
+	address  *net.TCPAddr
+	send     func(pwp.Message)
+}
+
+func (e *Exchange) Name() string {
+	return ExtensionName
+}
+
+func (e *Exchange) NewExtension(conn *pwp.PeerConnection, send func(pwp.Message)) pwp.ExtensionHandler {
+	return &extension{
+		exchange: e,
+		conn:     conn,
+		address:  conn.Address,
+		send:     send,
+	}
+}
+
+// Flags describing the connection to the peer, apart from the seed flag, which may change
+func connectionFlags(conn *pwp.PeerConnection) Flags {
+	var flags Flags
+	if conn.Encrypted {
+		flags |= FlagEncryption
+	}
+	if conn.UTP {
+		flags |= FlagUTP
+	}
+	if conn.Outgoing {
+		flags |= FlagReachable
+	}
+	return flags
+}
+
+func (e *extension) Negotiated(localID, remoteID byte, handshake *pwp.ExtendedHandshake) {
+	// Only the listen port makes the peer reachable for others. Peers we dialed are at it already
+	var listen *net.TCPAddr
+	if e.conn.Outgoing {
+		listen = e.address
+	} else if handshake.Port > 0 {
+		listen = &net.TCPAddr{IP: e.address.IP, Port: handshake.Port, Zone: e.address.Zone}
+	}
+	if listen != nil {
+		e.exchange.peerConnected(e.address.String(), &Peer{Address: listen, Flags: connectionFlags(e.conn)}, e.conn.Seed)
+	}
+
+	if remoteID == 0 {
+		e.exchange.mx.Lock()
+		delete(e.exchange.remotes, e.address.String())
+		e.exchange.mx.Unlock()
+		return
+	}
+	e.exchange.Subscribe(e.address, &messageSender{remoteID: remoteID, send: e.send})
+}
+
+func (e *extension) HandleMessage(payload []byte) error {
+	candidates, dropped, err := e.exchange.HandleMessage(e.address, payload)
+	if err != nil {
+		return err
+	}
+
+	if e.exchange.addCandidate != nil {
+		for _, candidate := range candidates {
+			e.exchange.addCandidate(candidate.Address, candidate.Flags&FlagUTP != 0)
+		}
+	}
+	if e.exchange.removeCandidate != nil {
+		for _, address := range dropped {
+			e.exchange.removeCandidate(address)
+		}
+	}
+	return nil
+}
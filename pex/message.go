@@ -0,0 +1,143 @@
+package pex
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gobby/bencoding"
+	"net"
+)
+
+type Flags byte
+
+const (
+	FlagEncryption Flags = 0x01
+	FlagSeed       Flags = 0x02
+	FlagUTP        Flags = 0x04
+	FlagHolepunch  Flags = 0x08
+	FlagReachable  Flags = 0x10
+)
+
+type Peer struct {
+	Address *net.TCPAddr
+	Flags   Flags
+}
+
+type Message struct {
+	Added   []*Peer
+	Dropped []*net.TCPAddr
+}
+
+func (m *Message) Encode() ([]byte, error) {
+	added, addedFlags := make([]byte, 0), make([]byte, 0)
+	added6, added6Flags := make([]byte, 0), make([]byte, 0)
+	for _, peer := range m.Added {
+		if ip := peer.Address.IP.To4(); ip != nil {
+			added = appendCompact(added, ip, peer.Address.Port)
+			addedFlags = append(addedFlags, byte(peer.Flags))
+		} else {
+			added6 = appendCompact(added6, peer.Address.IP.To16(), peer.Address.Port)
+			added6Flags = append(added6Flags, byte(peer.Flags))
+		}
+	}
+
+	dropped, dropped6 := make([]byte, 0), make([]byte, 0)
+	for _, address := range m.Dropped {
+		if ip := address.IP.To4(); ip != nil {
+			dropped = appendCompact(dropped, ip, address.Port)
+		} else {
+			dropped6 = appendCompact(dropped6, address.IP.To16(), address.Port)
+		}
+	}
+
+	return bencoding.Encode(map[string]interface{}{
+		"added":    added,
+		"added.f":  addedFlags,
+		"added6":   added6,
+		"added6.f": added6Flags,
+		"dropped":  dropped,
+		"dropped6": dropped6,
+	})
+}
+
+func DecodeMessage(payload []byte) (*Message, error) {
+	_decoded, err := bencoding.Decode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode PEX message: %s", err)
+	}
+	decoded, ok := _decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Invalid PEX message")
+	}
+
+	added, err := parsePeers(decoded, "added", "added.f", net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	added6, err := parsePeers(decoded, "added6", "added6.f", net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+	dropped, err := parsePeers(decoded, "dropped", "", net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	dropped6, err := parsePeers(decoded, "dropped6", "", net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{
+		Added:   append(added, added6...),
+		Dropped: make([]*net.TCPAddr, 0, len(dropped)+len(dropped6)),
+	}
+	for _, peer := range append(dropped, dropped6...) {
+		msg.Dropped = append(msg.Dropped, peer.Address)
+	}
+	return msg, nil
+}
+
+func appendCompact(data []byte, ip net.IP, port int) []byte {
+	data = append(data, ip...)
+	return append(data, byte(port>>8), byte(port))
+}
+
+func parsePeers(decoded map[string]interface{}, key, flagsKey string, ipLength int) ([]*Peer, error) {
+	_compact, exists := decoded[key]
+	if !exists {
+		return nil, nil
+	}
+	compact, ok := _compact.([]byte)
+	if !ok || len(compact)%(ipLength+2) != 0 {
+		return nil, fmt.Errorf("Invalid PEX field: %s", key)
+	}
+	count := len(compact) / (ipLength + 2)
+
+	var flags []byte
+	if flagsKey != "" {
+		if _flags, exists := decoded[flagsKey]; exists {
+			flags, ok = _flags.([]byte)
+			if !ok || len(flags) != count {
+				return nil, fmt.Errorf("Invalid PEX field: %s", flagsKey)
+			}
+		}
+	}
+
+	peers := make([]*Peer, count)
+	for i := 0; i < count; i++ {
+		entry := compact[i*(ipLength+2) : (i+1)*(ipLength+2)]
+		ip := make(net.IP, ipLength)
+		copy(ip, entry[:ipLength])
+		peers[i] = &Peer{
+			Address: &net.TCPAddr{
+				IP:   ip,
+				Port: int(binary.BigEndian.Uint16(entry[ipLength:])),
+			},
+		}
+		if flags != nil {
+			peers[i].Flags = Flags(flags[i])
+		}
+	}
+
+	return peers, nil
+}
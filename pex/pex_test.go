@@ -0,0 +1,216 @@
+package pex
+
+import (
+	"gobby/pwp"
+	"net"
+	"testing"
+	"time"
+)
+
+type mockSender struct {
+	payloads [][]byte
+}
+
+func (s *mockSender) Send(payload []byte) {
+	s.payloads = append(s.payloads, payload)
+}
+
+func tcpAddr(ip string, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestEncodingDecodingMessage(t *testing.T) {
+	msg := &Message{
+		Added: []*Peer{
+			&Peer{Address: tcpAddr("10.0.0.1", 6881), Flags: FlagSeed | FlagUTP},
+			&Peer{Address: tcpAddr("2001:db8::1", 51413), Flags: FlagEncryption},
+		},
+		Dropped: []*net.TCPAddr{
+			tcpAddr("10.0.0.2", 6882),
+			tcpAddr("2001:db8::2", 6883),
+		},
+	}
+
+	payload, err := msg.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode message: %s", err)
+	}
+	decoded, err := DecodeMessage(payload)
+	if err != nil {
+		t.Fatalf("Failed to decode message: %s", err)
+	}
+
+	if len(decoded.Added) != 2 {
+		t.Fatalf("Expected 2 added peers. Got: %d", len(decoded.Added))
+	}
+	for i, peer := range decoded.Added {
+		expected := msg.Added[i]
+		if !peer.Address.IP.Equal(expected.Address.IP) || peer.Address.Port != expected.Address.Port {
+			t.Fatalf("Expected address %s. Got: %s", expected.Address, peer.Address)
+		}
+		if peer.Flags != expected.Flags {
+			t.Fatalf("Expected flags %d. Got: %d", expected.Flags, peer.Flags)
+		}
+	}
+
+	if len(decoded.Dropped) != 2 {
+		t.Fatalf("Expected 2 dropped peers. Got: %d", len(decoded.Dropped))
+	}
+	for i, address := range decoded.Dropped {
+		if address.String() != msg.Dropped[i].String() {
+			t.Fatalf("Expected address %s. Got: %s", msg.Dropped[i], address)
+		}
+	}
+}
+
+func TestDecodingInvalidMessage(t *testing.T) {
+	inputs := []string{
+		"le",
+		"d5:added5:12345e",
+		"d5:added6:1234567:added.f2:12e",
+	}
+
+	for _, input := range inputs {
+		_, err := DecodeMessage([]byte(input))
+		if err == nil {
+			t.Fatalf("Expected error for input: %q", input)
+		}
+	}
+}
+
+func TestExchangeDeltas(t *testing.T) {
+	exchange := NewExchange(false)
+	remote := tcpAddr("10.0.0.1", 6881)
+	exchange.PeerConnected(&Peer{Address: remote})
+	exchange.PeerConnected(&Peer{Address: tcpAddr("10.0.0.2", 6881)})
+	exchange.PeerConnected(&Peer{Address: tcpAddr("10.0.0.3", 6881)})
+
+	sender := &mockSender{}
+	exchange.Subscribe(remote, sender)
+
+	now := time.Now()
+	exchange.sendUpdates(now)
+	if len(sender.payloads) != 1 {
+		t.Fatalf("Expected 1 message. Got: %d", len(sender.payloads))
+	}
+	msg, _ := DecodeMessage(sender.payloads[0])
+	if len(msg.Added) != 2 || len(msg.Dropped) != 0 {
+		t.Fatalf("Expected 2 added and 0 dropped. Got: %d and %d", len(msg.Added), len(msg.Dropped))
+	}
+
+	exchange.PeerDisconnected(tcpAddr("10.0.0.2", 6881))
+	exchange.sendUpdates(now.Add(time.Second))
+	if len(sender.payloads) != 1 {
+		t.Fatalf("Expected no message within interval. Got: %d", len(sender.payloads))
+	}
+
+	exchange.sendUpdates(now.Add(_PEX_INTERVAL))
+	if len(sender.payloads) != 2 {
+		t.Fatalf("Expected 2 messages. Got: %d", len(sender.payloads))
+	}
+	msg, _ = DecodeMessage(sender.payloads[1])
+	if len(msg.Added) != 0 || len(msg.Dropped) != 1 {
+		t.Fatalf("Expected 0 added and 1 dropped. Got: %d and %d", len(msg.Added), len(msg.Dropped))
+	}
+	if msg.Dropped[0].String() != "10.0.0.2:6881" {
+		t.Fatalf("Wrong dropped peer: %s", msg.Dropped[0])
+	}
+
+	exchange.sendUpdates(now.Add(_PEX_INTERVAL * 2))
+	if len(sender.payloads) != 2 {
+		t.Fatalf("Expected no message without changes. Got: %d", len(sender.payloads))
+	}
+}
+
+func TestExchangeHandleMessage(t *testing.T) {
+	exchange := NewExchange(false)
+	remote := tcpAddr("10.0.0.1", 6881)
+	exchange.PeerConnected(&Peer{Address: remote})
+	exchange.Subscribe(remote, &mockSender{})
+
+	msg := &Message{
+		Added: []*Peer{
+			&Peer{Address: remote},
+			&Peer{Address: tcpAddr("10.0.0.5", 6881)},
+		},
+	}
+	payload, _ := msg.Encode()
+
+	candidates, _, err := exchange.HandleMessage(remote, payload)
+	if err != nil {
+		t.Fatalf("Failed to handle message: %s", err)
+	}
+	if len(candidates) != 1 || candidates[0].Address.String() != "10.0.0.5:6881" {
+		t.Fatalf("Expected only the unconnected peer as candidate. Got: %v", candidates)
+	}
+
+	_, _, err = exchange.HandleMessage(remote, payload)
+	if err == nil {
+		t.Fatalf("Expected error for too frequent messages")
+	}
+}
+
+func TestExchangePrivate(t *testing.T) {
+	exchange := NewExchange(true)
+	remote := tcpAddr("10.0.0.1", 6881)
+	exchange.PeerConnected(&Peer{Address: remote})
+	exchange.PeerConnected(&Peer{Address: tcpAddr("10.0.0.2", 6881)})
+	sender := &mockSender{}
+	exchange.Subscribe(remote, sender)
+
+	exchange.sendUpdates(time.Now())
+	if len(sender.payloads) != 0 {
+		t.Fatalf("Expected no messages for private torrent. Got: %d", len(sender.payloads))
+	}
+
+	payload, _ := (&Message{}).Encode()
+	if _, _, err := exchange.HandleMessage(remote, payload); err == nil {
+		t.Fatalf("Expected error for private torrent")
+	}
+}
+
+func TestExtensionAdvertisesConnections(t *testing.T) {
+	exchange := NewExchange(false)
+	sent := make([]pwp.Message, 0)
+	subscriber := exchange.NewExtension(&pwp.PeerConnection{Address: tcpAddr("10.0.0.1", 50000)}, func(msg pwp.Message) {
+		sent = append(sent, msg)
+	})
+	subscriber.Negotiated(1, 2, &pwp.ExtendedHandshake{})
+
+	seed := false
+	outgoing := exchange.NewExtension(&pwp.PeerConnection{
+		Address:   tcpAddr("10.0.0.2", 6881),
+		Outgoing:  true,
+		Encrypted: true,
+		UTP:       true,
+		Seed:      func() bool { return seed },
+	}, func(pwp.Message) {})
+	outgoing.Negotiated(1, 2, &pwp.ExtendedHandshake{})
+	incoming := exchange.NewExtension(&pwp.PeerConnection{Address: tcpAddr("10.0.0.3", 50001)}, func(pwp.Message) {})
+	incoming.Negotiated(1, 2, &pwp.ExtendedHandshake{Port: 6882})
+	unreachable := exchange.NewExtension(&pwp.PeerConnection{Address: tcpAddr("10.0.0.4", 50002)}, func(pwp.Message) {})
+	unreachable.Negotiated(1, 2, &pwp.ExtendedHandshake{})
+
+	seed = true
+	exchange.sendUpdates(time.Now())
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 message. Got: %d", len(sent))
+	}
+	msg, err := DecodeMessage(sent[0].(*pwp.ExtendedMsg).Payload)
+	if err != nil {
+		t.Fatalf("Failed to decode message: %s", err)
+	}
+	flags := make(map[string]Flags)
+	for _, peer := range msg.Added {
+		flags[peer.Address.String()] = peer.Flags
+	}
+	if len(flags) != 2 {
+		t.Fatalf("Expected the outgoing peer and the incoming peer's listen address. Got: %v", flags)
+	}
+	if flags["10.0.0.2:6881"] != FlagEncryption|FlagSeed|FlagUTP|FlagReachable {
+		t.Fatalf("Expected flags of the outgoing connection. Got: %x", flags["10.0.0.2:6881"])
+	}
+	if f, exists := flags["10.0.0.3:6882"]; !exists || f != 0 {
+		t.Fatalf("Expected incoming peer's listen address without flags. Got: %v", flags)
+	}
+}
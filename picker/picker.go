@@ -0,0 +1,488 @@
+package picker
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	BlockSize = 16 * 1024
+
+	_RANDOM_FIRST_PIECES = 4
+)
+
+type Priority int
+
+const (
+	PrioritySkip   Priority = 0
+	PriorityLow    Priority = 1
+	PriorityNormal Priority = 4
+	PriorityHigh   Priority = 7
+)
+
+type Block struct {
+	Index  int
+	Offset int
+	Length int
+}
+
+type blockState struct {
+	received   bool
+	requesters []string
+}
+
+type pieceState struct {
+	availability int
+	priority     Priority
+	have         bool
+	// Allocated once the piece is started
+	blocks []*blockState
+}
+
+// Decides which blocks to request from which peer: random pieces first, then rarest first
+// within the highest priority, finishing started pieces before new ones. Once every wanted
+// block has been requested, endgame mode requests the remaining blocks from all peers
+type Picker struct {
+	pieceLength     int
+	lastPieceLength int
+
+	mx        sync.Mutex
+	random    *rand.Rand
+	pieces    []*pieceState
+	peers     map[string][]bool
+	started   map[int]bool
+	completed int
+	endgame   bool
+}
+
+func NewPicker(pieceCount, pieceLength, lastPieceLength int) *Picker {
+	pieces := make([]*pieceState, pieceCount)
+	for i := range pieces {
+		pieces[i] = &pieceState{priority: PriorityNormal}
+	}
+
+	return &Picker{
+		pieceLength:     pieceLength,
+		lastPieceLength: lastPieceLength,
+		random:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		pieces:          pieces,
+		peers:           make(map[string][]bool),
+		started:         make(map[int]bool),
+	}
+}
+
+// Out of range indexes are ignored, like by bitfield.Bitfield
+func (p *Picker) SetHave(index int) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if !p.valid(index) {
+		return
+	}
+	piece := p.pieces[index]
+	if piece.have {
+		return
+	}
+	piece.have = true
+	piece.blocks = nil
+	delete(p.started, index)
+	p.completed++
+}
+
+func (p *Picker) Have(index int) bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.valid(index) && p.pieces[index].have
+}
+
+func (p *Picker) Completed() int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.completed
+}
+
+func (p *Picker) SetPriority(index int, priority Priority) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if !p.valid(index) {
+		return
+	}
+	// Received blocks of skipped pieces are kept in case the priority is raised again
+	p.pieces[index].priority = priority
+	p.endgame = false
+}
+
+func (p *Picker) Priority(index int) Priority {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if !p.valid(index) {
+		return PrioritySkip
+	}
+	return p.pieces[index].priority
+}
+
+func (p *Picker) Endgame() bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.endgame
+}
+
+func (p *Picker) PeerHave(peer string, index int) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if !p.valid(index) {
+		return
+	}
+	has := p.peerPieces(peer)
+	if !has[index] {
+		has[index] = true
+		p.pieces[index].availability++
+	}
+}
+
+// Bits beyond the piece count are ignored
+func (p *Picker) PeerBitfield(peer string, bitfield []byte) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	has := p.peerPieces(peer)
+	for index := range p.pieces {
+		if index/8 >= len(bitfield) {
+			break
+		}
+		if bitfield[index/8]&(0x80>>uint(index%8)) != 0 && !has[index] {
+			has[index] = true
+			p.pieces[index].availability++
+		}
+	}
+}
+
+func (p *Picker) PeerHaveAll(peer string) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	has := p.peerPieces(peer)
+	for index, piece := range p.pieces {
+		if !has[index] {
+			has[index] = true
+			piece.availability++
+		}
+	}
+}
+
+// Forgets the peer's pieces and releases all of its requests
+func (p *Picker) PeerLeft(peer string) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	has, exists := p.peers[peer]
+	if !exists {
+		return
+	}
+	for index, piece := range p.pieces {
+		if has[index] {
+			piece.availability--
+		}
+		for _, block := range piece.blocks {
+			block.requesters = without(block.requesters, peer)
+		}
+	}
+	delete(p.peers, peer)
+	p.endgame = false
+}
+
+// Whether the peer has any piece we still want
+func (p *Picker) Interesting(peer string) bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	has, exists := p.peers[peer]
+	if !exists {
+		return false
+	}
+	for index, piece := range p.pieces {
+		if has[index] && p.wanted(piece) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Picker) Availability(index int) int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if !p.valid(index) {
+		return 0
+	}
+	return p.pieces[index].availability
+}
+
+// Must be called with the mutex held
+func (p *Picker) valid(index int) bool {
+	return index >= 0 && index < len(p.pieces)
+}
+
+// Must be called with the mutex held
+func (p *Picker) peerPieces(peer string) []bool {
+	has, exists := p.peers[peer]
+	if !exists {
+		has = make([]bool, len(p.pieces))
+		p.peers[peer] = has
+	}
+	return has
+}
+
+func (p *Picker) wanted(piece *pieceState) bool {
+	return !piece.have && piece.priority != PrioritySkip
+}
+
+func (p *Picker) pieceSize(index int) int {
+	if index == len(p.pieces)-1 {
+		return p.lastPieceLength
+	}
+	return p.pieceLength
+}
+
+func (p *Picker) blockLength(index, block int) int {
+	remaining := p.pieceSize(index) - block*BlockSize
+	if remaining > BlockSize {
+		return BlockSize
+	}
+	return remaining
+}
+
+// Picks up to count blocks to request from the peer and marks them as requested by it
+func (p *Picker) Pick(peer string, count int) []*Block {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	has := p.peers[peer]
+	if has == nil {
+		return nil
+	}
+
+	blocks := make([]*Block, 0, count)
+	blocks = p.pickStarted(peer, has, blocks, count)
+	for len(blocks) < count {
+		index := p.pickNew(has)
+		if index < 0 {
+			break
+		}
+		p.start(index)
+		blocks = p.pickFrom(index, peer, blocks, count, false)
+	}
+
+	if len(blocks) == 0 && !p.endgame {
+		p.endgame = p.allRequested()
+	}
+	if p.endgame && len(blocks) < count {
+		for _, index := range p.startedIndexes(has) {
+			blocks = p.pickFrom(index, peer, blocks, count, true)
+			if len(blocks) == count {
+				break
+			}
+		}
+	}
+	return blocks
+}
+
+func (p *Picker) pickStarted(peer string, has []bool, blocks []*Block, count int) []*Block {
+	for _, index := range p.startedIndexes(has) {
+		if len(blocks) == count {
+			break
+		}
+		blocks = p.pickFrom(index, peer, blocks, count, false)
+	}
+	return blocks
+}
+
+// Wanted started pieces the peer has, highest priority first
+func (p *Picker) startedIndexes(has []bool) []int {
+	indexes := make([]int, 0, len(p.started))
+	for index := range p.started {
+		if has[index] && p.wanted(p.pieces[index]) {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		a, b := p.pieces[indexes[i]], p.pieces[indexes[j]]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		return indexes[i] < indexes[j]
+	})
+	return indexes
+}
+
+// Appends blocks of the piece that are neither received nor requested. In endgame
+// mode blocks requested from other peers are picked as well
+func (p *Picker) pickFrom(index int, peer string, blocks []*Block, count int, duplicate bool) []*Block {
+	for i, block := range p.pieces[index].blocks {
+		if len(blocks) == count {
+			break
+		}
+		if block.received || contains(block.requesters, peer) {
+			continue
+		}
+		if len(block.requesters) > 0 && !duplicate {
+			continue
+		}
+		block.requesters = append(block.requesters, peer)
+		blocks = append(blocks, &Block{Index: index, Offset: i * BlockSize, Length: p.blockLength(index, i)})
+	}
+	return blocks
+}
+
+// Chooses a piece to start among those the peer has. Returns -1 if there is none
+func (p *Picker) pickNew(has []bool) int {
+	best := -1
+	ties := 0
+	randomFirst := p.completed < _RANDOM_FIRST_PIECES
+
+	for index, piece := range p.pieces {
+		if !has[index] || !p.wanted(piece) || piece.blocks != nil {
+			continue
+		}
+
+		if best >= 0 {
+			order := p.compare(piece, p.pieces[best], randomFirst)
+			if order < 0 {
+				continue
+			}
+			if order > 0 {
+				ties = 0
+			}
+		}
+
+		// Reservoir sampling breaks ties uniformly
+		ties++
+		if p.random.Intn(ties) == 0 {
+			best = index
+		}
+	}
+	return best
+}
+
+// Positive if a is preferable to b, zero on a tie
+func (p *Picker) compare(a, b *pieceState, randomFirst bool) int {
+	if a.priority != b.priority {
+		return int(a.priority - b.priority)
+	}
+	if randomFirst {
+		return 0
+	}
+	return b.availability - a.availability
+}
+
+func (p *Picker) start(index int) {
+	length := p.pieceSize(index)
+	blocks := make([]*blockState, (length+BlockSize-1)/BlockSize)
+	for i := range blocks {
+		blocks[i] = &blockState{requesters: make([]string, 0, 1)}
+	}
+	p.pieces[index].blocks = blocks
+	p.started[index] = true
+}
+
+// Must be called with the mutex held
+func (p *Picker) allRequested() bool {
+	for _, piece := range p.pieces {
+		if !p.wanted(piece) {
+			continue
+		}
+		if piece.blocks == nil {
+			return false
+		}
+		for _, block := range piece.blocks {
+			if !block.received && len(block.requesters) == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Marks a block as received from the peer. Returns the other peers it was requested from,
+// which should be sent a CancelMsg, and whether all blocks of the piece have been received
+func (p *Picker) BlockReceived(peer string, b *Block) ([]string, bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if !p.valid(b.Index) || b.Offset < 0 {
+		return nil, false
+	}
+	piece := p.pieces[b.Index]
+	i := b.Offset / BlockSize
+	if piece.blocks == nil || i >= len(piece.blocks) {
+		return nil, false
+	}
+
+	block := piece.blocks[i]
+	cancels := without(block.requesters, peer)
+	block.received = true
+	block.requesters = block.requesters[:0]
+
+	for _, block := range piece.blocks {
+		if !block.received {
+			return cancels, false
+		}
+	}
+	return cancels, true
+}
+
+// Makes a block requested from the peer available again, e.g. after a reject or a timeout
+func (p *Picker) Release(peer string, b *Block) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if !p.valid(b.Index) || b.Offset < 0 {
+		return
+	}
+	piece := p.pieces[b.Index]
+	i := b.Offset / BlockSize
+	if piece.blocks == nil || i >= len(piece.blocks) {
+		return
+	}
+	piece.blocks[i].requesters = without(piece.blocks[i].requesters, peer)
+	p.endgame = false
+}
+
+// Resets a piece whose data turned out to be invalid so it gets downloaded again
+func (p *Picker) PieceFailed(index int) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if !p.valid(index) {
+		return
+	}
+	piece := p.pieces[index]
+	if piece.have {
+		return
+	}
+	piece.blocks = nil
+	delete(p.started, index)
+	p.endgame = false
+}
+
+func contains(peers []string, peer string) bool {
+	for _, other := range peers {
+		if other == peer {
+			return true
+		}
+	}
+	return false
+}
+
+func without(peers []string, peer string) []string {
+	result := make([]string, 0, len(peers))
+	for _, other := range peers {
+		if other != peer {
+			result = append(result, other)
+		}
+	}
+	return result
+}
@@ -0,0 +1,206 @@
+package picker
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func newTestPicker(pieceCount, pieceLength, lastPieceLength int) *Picker {
+	p := NewPicker(pieceCount, pieceLength, lastPieceLength)
+	p.random = rand.New(rand.NewSource(1))
+	return p
+}
+
+func TestPickRarestFirst(t *testing.T) {
+	p := newTestPicker(8, BlockSize, BlockSize)
+	for index := 0; index < _RANDOM_FIRST_PIECES; index++ {
+		p.SetHave(index)
+	}
+
+	p.PeerHaveAll("a")
+	p.PeerHaveAll("b")
+	p.PeerHave("c", 4)
+	p.PeerBitfield("c", []byte{0x04})
+	p.PeerBitfield("d", []byte{0x04})
+
+	// Availability of pieces 4 to 7 is 3, 4, 2 and 2
+	blocks := p.Pick("a", 4)
+	if len(blocks) != 4 {
+		t.Fatalf("Expected 4 blocks. Got: %d", len(blocks))
+	}
+	if blocks[0].Index+blocks[1].Index != 13 || blocks[2].Index != 4 || blocks[3].Index != 5 {
+		t.Fatalf("Expected pieces 6 and 7, then 4 and 5. Got: %d %d %d %d",
+			blocks[0].Index, blocks[1].Index, blocks[2].Index, blocks[3].Index)
+	}
+}
+
+func TestPickRandomFirst(t *testing.T) {
+	picked := make(map[int]bool)
+	for seed := int64(0); seed < 20; seed++ {
+		p := NewPicker(10, BlockSize, BlockSize)
+		p.random = rand.New(rand.NewSource(seed))
+		p.PeerHaveAll("a")
+		p.PeerHave("b", 0)
+
+		blocks := p.Pick("a", 1)
+		picked[blocks[0].Index] = true
+	}
+
+	// Piece 0 is the rarest, but random selection also starts others
+	if len(picked) < 2 {
+		t.Fatalf("Expected random first pieces. Got: %v", picked)
+	}
+}
+
+func TestPickPriorities(t *testing.T) {
+	p := newTestPicker(4, BlockSize, BlockSize)
+	p.PeerHaveAll("a")
+	p.SetPriority(0, PrioritySkip)
+	p.SetPriority(2, PriorityHigh)
+	p.SetPriority(3, PriorityLow)
+
+	blocks := p.Pick("a", 4)
+	expected := []int{2, 1, 3}
+	if len(blocks) != len(expected) {
+		t.Fatalf("Expected %d blocks. Got: %d", len(expected), len(blocks))
+	}
+	for i, block := range blocks {
+		if block.Index != expected[i] {
+			t.Fatalf("Expected piece %d at position %d. Got: %d", expected[i], i, block.Index)
+		}
+	}
+}
+
+func TestPickFinishesStartedPieces(t *testing.T) {
+	p := newTestPicker(4, BlockSize*4, BlockSize*2+100)
+	p.PeerHaveAll("a")
+	p.PeerHaveAll("b")
+
+	first := p.Pick("a", 1)
+	second := p.Pick("b", 3)
+	for _, block := range second {
+		if block.Index != first[0].Index {
+			t.Fatalf("Expected blocks of started piece %d. Got: %+v", first[0].Index, block)
+		}
+	}
+
+	p.SetHave(0)
+	p.SetHave(1)
+	p.SetHave(2)
+	blocks := p.Pick("a", 10)
+	if len(blocks) != 3 {
+		t.Fatalf("Expected 3 blocks of the last piece. Got: %d", len(blocks))
+	}
+	if blocks[2].Offset != BlockSize*2 || blocks[2].Length != 100 {
+		t.Fatalf("Expected short last block. Got: %+v", blocks[2])
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	p := newTestPicker(2, BlockSize*2, BlockSize)
+	p.PeerHaveAll("a")
+	p.PeerHaveAll("b")
+
+	blocks := p.Pick("a", 10)
+	if len(blocks) != 3 {
+		t.Fatalf("Expected 3 blocks. Got: %d", len(blocks))
+	}
+	if p.Endgame() {
+		t.Fatalf("Expected no endgame before all blocks are requested")
+	}
+
+	duplicates := p.Pick("b", 10)
+	if !p.Endgame() {
+		t.Fatalf("Expected endgame")
+	}
+	if len(duplicates) != 3 {
+		t.Fatalf("Expected 3 duplicate blocks. Got: %d", len(duplicates))
+	}
+	if more := p.Pick("b", 10); len(more) != 0 {
+		t.Fatalf("Expected no blocks requested twice from the same peer. Got: %d", len(more))
+	}
+
+	cancels, complete := p.BlockReceived("a", duplicates[0])
+	if len(cancels) != 1 || cancels[0] != "b" {
+		t.Fatalf("Expected cancel to b. Got: %v", cancels)
+	}
+	if complete != (duplicates[0].Index == 1) {
+		t.Fatalf("Unexpected completion of piece %d", duplicates[0].Index)
+	}
+}
+
+func TestPeerLeftReleasesRequests(t *testing.T) {
+	p := newTestPicker(1, BlockSize, BlockSize)
+	p.PeerHaveAll("a")
+	p.PeerHaveAll("b")
+
+	if blocks := p.Pick("a", 1); len(blocks) != 1 {
+		t.Fatalf("Expected 1 block. Got: %d", len(blocks))
+	}
+	p.PeerLeft("a")
+	if p.Availability(0) != 1 {
+		t.Fatalf("Expected availability 1. Got: %d", p.Availability(0))
+	}
+	if p.Endgame() {
+		t.Fatalf("Expected endgame to end once requests are released")
+	}
+
+	blocks := p.Pick("b", 1)
+	if len(blocks) != 1 {
+		t.Fatalf("Expected released block. Got: %d", len(blocks))
+	}
+	_, complete := p.BlockReceived("b", blocks[0])
+	if !complete {
+		t.Fatalf("Expected piece to be complete")
+	}
+}
+
+func TestPieceFailed(t *testing.T) {
+	p := newTestPicker(1, BlockSize, BlockSize)
+	p.PeerHaveAll("a")
+
+	blocks := p.Pick("a", 1)
+	p.BlockReceived("a", blocks[0])
+	p.PieceFailed(0)
+
+	blocks = p.Pick("a", 1)
+	if len(blocks) != 1 || blocks[0].Index != 0 {
+		t.Fatalf("Expected failed piece to be picked again. Got: %+v", blocks)
+	}
+}
+
+func TestInteresting(t *testing.T) {
+	p := newTestPicker(3, BlockSize, BlockSize)
+	p.PeerHave("a", 1)
+	if !p.Interesting("a") {
+		t.Fatalf("Expected peer to be interesting")
+	}
+
+	p.SetHave(1)
+	if p.Interesting("a") {
+		t.Fatalf("Expected peer without wanted pieces to be uninteresting")
+	}
+	if p.Interesting("unknown") {
+		t.Fatalf("Expected unknown peer to be uninteresting")
+	}
+}
+
+func TestOutOfRangeIndexes(t *testing.T) {
+	p := newTestPicker(2, BlockSize, BlockSize)
+	for _, index := range []int{-1, 2} {
+		p.SetHave(index)
+		p.SetPriority(index, PriorityHigh)
+		p.PeerHave("a", index)
+		p.PieceFailed(index)
+		p.Release("a", &Block{Index: index})
+		if cancels, done := p.BlockReceived("a", &Block{Index: index}); cancels != nil || done {
+			t.Fatalf("Expected block of piece %d to be ignored", index)
+		}
+		if p.Have(index) || p.Priority(index) != PrioritySkip || p.Availability(index) != 0 {
+			t.Fatalf("Expected piece %d to be ignored", index)
+		}
+	}
+	if p.Completed() != 0 || p.Interesting("a") {
+		t.Fatalf("Expected out of range indexes to change nothing")
+	}
+}
@@ -0,0 +1,250 @@
+package pwp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gobby/bencoding"
+	"net"
+	"sync"
+)
+
+const (
+	ExtendedHandshakeID byte = 0
+)
+
+// Extension protocol message (BEP 10)
+type ExtendedMsg struct {
+	ID      byte
+	Payload []byte
+}
+
+func (m *ExtendedMsg) Encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, int32(len(m.Payload)+2))
+	buf.WriteByte(20)
+	buf.WriteByte(m.ID)
+	buf.Write(m.Payload)
+	return buf.Bytes()
+}
+
+type ExtendedHandshake struct {
+	M            map[string]byte
+	V            string
+	Port         int
+	Reqq         int
+	YourIP       net.IP
+	MetadataSize int
+}
+
+func (h *ExtendedHandshake) Encode() ([]byte, error) {
+	m := make(map[string]interface{})
+	for name, id := range h.M {
+		m[name] = int(id)
+	}
+
+	handshake := map[string]interface{}{
+		"m": m,
+	}
+	if h.V != "" {
+		handshake["v"] = h.V
+	}
+	if h.Port > 0 {
+		handshake["p"] = h.Port
+	}
+	if h.Reqq > 0 {
+		handshake["reqq"] = h.Reqq
+	}
+	if h.YourIP != nil {
+		if ip := h.YourIP.To4(); ip != nil {
+			handshake["yourip"] = []byte(ip)
+		} else {
+			handshake["yourip"] = []byte(h.YourIP.To16())
+		}
+	}
+	if h.MetadataSize > 0 {
+		handshake["metadata_size"] = h.MetadataSize
+	}
+
+	return bencoding.Encode(handshake)
+}
+
+func DecodeExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	_decoded, err := bencoding.Decode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode extended handshake: %s", err)
+	}
+	decoded, ok := _decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Invalid extended handshake")
+	}
+
+	handshake := &ExtendedHandshake{
+		M: make(map[string]byte),
+	}
+
+	if _m, exists := decoded["m"]; exists {
+		m, ok := _m.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Invalid extended handshake field: m")
+		}
+		for name, _id := range m {
+			id, ok := _id.(int)
+			if !ok || id < 0 || id > 255 {
+				return nil, fmt.Errorf("Invalid extended handshake ID for %s", name)
+			}
+			handshake.M[name] = byte(id)
+		}
+	}
+
+	if v, ok := decoded["v"].([]byte); ok {
+		handshake.V = string(v)
+	}
+	if port, ok := decoded["p"].(int); ok && port > 0 && port <= 65535 {
+		handshake.Port = port
+	}
+	if reqq, ok := decoded["reqq"].(int); ok && reqq > 0 {
+		handshake.Reqq = reqq
+	}
+	if yourIP, ok := decoded["yourip"].([]byte); ok && (len(yourIP) == net.IPv4len || len(yourIP) == net.IPv6len) {
+		handshake.YourIP = net.IP(yourIP)
+	}
+	if metadataSize, ok := decoded["metadata_size"].(int); ok && metadataSize > 0 {
+		handshake.MetadataSize = metadataSize
+	}
+
+	return handshake, nil
+}
+
+// The connection an extension handler is created for
+type PeerConnection struct {
+	Address *net.TCPAddr
+	// Set if we dialed the peer, in which case Address is also its listen address
+	Outgoing  bool
+	Encrypted bool
+	UTP       bool
+	// Reports whether the peer currently has all pieces
+	Seed func() bool
+}
+
+type ExtensionHandler interface {
+	// Called on every extended handshake received. remoteID is 0 if the remote peer doesn't support the extension
+	Negotiated(localID, remoteID byte, handshake *ExtendedHandshake)
+	HandleMessage(payload []byte) error
+}
+
+// Extensions supported on a single connection, and their IDs negotiated with the remote peer
+type ExtensionRegistry struct {
+	mx              sync.Mutex
+	names           []string
+	handlers        map[string]ExtensionHandler
+	remoteIDs       map[string]byte
+	remoteHandshake *ExtendedHandshake
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		names:     make([]string, 0),
+		handlers:  make(map[string]ExtensionHandler),
+		remoteIDs: make(map[string]byte),
+	}
+}
+
+// Returns the local ID assigned to the extension
+func (r *ExtensionRegistry) Register(name string, handler ExtensionHandler) byte {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	for i, registered := range r.names {
+		if registered == name {
+			r.handlers[name] = handler
+			return byte(i + 1)
+		}
+	}
+
+	r.names = append(r.names, name)
+	r.handlers[name] = handler
+	return byte(len(r.names))
+}
+
+// Extended handshake advertising all registered extensions. Other fields are taken from base
+func (r *ExtensionRegistry) Handshake(base *ExtendedHandshake) *ExtendedHandshake {
+	handshake := &ExtendedHandshake{}
+	if base != nil {
+		*handshake = *base
+	}
+
+	r.mx.Lock()
+	handshake.M = make(map[string]byte, len(r.names))
+	for i, name := range r.names {
+		handshake.M[name] = byte(i + 1)
+	}
+	r.mx.Unlock()
+
+	return handshake
+}
+
+func (r *ExtensionRegistry) RemoteID(name string) byte {
+	r.mx.Lock()
+	id := r.remoteIDs[name]
+	r.mx.Unlock()
+	return id
+}
+
+// Nil until the remote peer sent its extended handshake
+func (r *ExtensionRegistry) RemoteHandshake() *ExtendedHandshake {
+	r.mx.Lock()
+	handshake := r.remoteHandshake
+	r.mx.Unlock()
+	return handshake
+}
+
+func (r *ExtensionRegistry) HandleMessage(msg *ExtendedMsg) error {
+	if msg.ID == ExtendedHandshakeID {
+		return r.handleHandshake(msg.Payload)
+	}
+
+	r.mx.Lock()
+	if int(msg.ID) > len(r.names) {
+		r.mx.Unlock()
+		return fmt.Errorf("Unknown extended message ID: %d", msg.ID)
+	}
+	handler := r.handlers[r.names[msg.ID-1]]
+	r.mx.Unlock()
+
+	return handler.HandleMessage(msg.Payload)
+}
+
+func (r *ExtensionRegistry) handleHandshake(payload []byte) error {
+	handshake, err := DecodeExtendedHandshake(payload)
+	if err != nil {
+		return err
+	}
+
+	r.mx.Lock()
+	// Subsequent handshakes only update the IDs they mention. ID 0 disables an extension
+	for name, id := range handshake.M {
+		if id == 0 {
+			delete(r.remoteIDs, name)
+		} else {
+			r.remoteIDs[name] = id
+		}
+	}
+	r.remoteHandshake = handshake
+
+	negotiated := make([]func(), 0, len(r.names))
+	for i, name := range r.names {
+		handler := r.handlers[name]
+		localID, remoteID := byte(i+1), r.remoteIDs[name]
+		negotiated = append(negotiated, func() {
+			handler.Negotiated(localID, remoteID, handshake)
+		})
+	}
+	r.mx.Unlock()
+
+	for _, notify := range negotiated {
+		notify()
+	}
+	return nil
+}
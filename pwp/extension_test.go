@@ -0,0 +1,164 @@
+package pwp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+type mockExtension struct {
+	localID  byte
+	remoteID byte
+	payloads [][]byte
+}
+
+func (e *mockExtension) Negotiated(localID, remoteID byte, handshake *ExtendedHandshake) {
+	e.localID = localID
+	e.remoteID = remoteID
+}
+
+func (e *mockExtension) HandleMessage(payload []byte) error {
+	e.payloads = append(e.payloads, payload)
+	return nil
+}
+
+func TestReservedFlags(t *testing.T) {
+	var reserved Reserved
+	reserved.Set(ExtensionProtocol)
+	reserved.Set(FastExtension)
+
+	encoded := EncodeHandshake(reserved, bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 20))
+	parsedReserved, _, _, err := ParseHandshake(encoded)
+	if err != nil {
+		t.Fatalf("Failed to parse handshake: %s", err)
+	}
+
+	if !parsedReserved.Has(ExtensionProtocol) || !parsedReserved.Has(FastExtension) {
+		t.Fatalf("Missing reserved flags: %v", parsedReserved)
+	}
+	if parsedReserved.Has(DHT) {
+		t.Fatalf("Unexpected DHT flag: %v", parsedReserved)
+	}
+}
+
+func TestExtendedMessageEncodingDecoding(t *testing.T) {
+	messages := []Message{
+		&ExtendedMsg{0, []byte("d1:md6:ut_pexi1eee")},
+		&KeepAliveMsg{},
+		&ExtendedMsg{3, []byte{}},
+	}
+
+	data := make([]byte, 0)
+	for _, msg := range messages {
+		data = append(data, msg.Encode()...)
+	}
+
+	decodedMessages, _, err := DecodeMessages(data)
+	if err != nil {
+		t.Fatalf("Failed to decode messages: %s", err)
+	}
+	if len(decodedMessages) != len(messages) {
+		t.Fatalf("Length missmatch. Expected: %d. Got: %d", len(messages), len(decodedMessages))
+	}
+
+	msg0 := decodedMessages[0].(*ExtendedMsg)
+	if msg0.ID != 0 || string(msg0.Payload) != "d1:md6:ut_pexi1eee" {
+		t.Fatalf("Wrong extended message: %v", msg0)
+	}
+	msg2 := decodedMessages[2].(*ExtendedMsg)
+	if msg2.ID != 3 || len(msg2.Payload) != 0 {
+		t.Fatalf("Wrong extended message: %v", msg2)
+	}
+}
+
+func TestExtendedHandshakeEncodingDecoding(t *testing.T) {
+	handshake := &ExtendedHandshake{
+		M:            map[string]byte{"ut_pex": 1, "ut_metadata": 2},
+		V:            "gobby 0.1",
+		Port:         6881,
+		Reqq:         250,
+		YourIP:       net.ParseIP("10.0.0.1"),
+		MetadataSize: 31235,
+	}
+
+	payload, err := handshake.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode handshake: %s", err)
+	}
+	decoded, err := DecodeExtendedHandshake(payload)
+	if err != nil {
+		t.Fatalf("Failed to decode handshake: %s", err)
+	}
+
+	if decoded.M["ut_pex"] != 1 || decoded.M["ut_metadata"] != 2 {
+		t.Fatalf("Wrong extension IDs: %v", decoded.M)
+	}
+	if decoded.V != handshake.V {
+		t.Fatalf("Expected v %s. Got: %s", handshake.V, decoded.V)
+	}
+	if decoded.Port != 6881 {
+		t.Fatalf("Expected port 6881. Got: %d", decoded.Port)
+	}
+	if decoded.Reqq != 250 {
+		t.Fatalf("Expected reqq 250. Got: %d", decoded.Reqq)
+	}
+	if !decoded.YourIP.Equal(handshake.YourIP) {
+		t.Fatalf("Expected yourip %s. Got: %s", handshake.YourIP, decoded.YourIP)
+	}
+	if decoded.MetadataSize != 31235 {
+		t.Fatalf("Expected metadata size 31235. Got: %d", decoded.MetadataSize)
+	}
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	registry := NewExtensionRegistry()
+	pex := &mockExtension{}
+	metadata := &mockExtension{}
+	pexID := registry.Register("ut_pex", pex)
+	metadataID := registry.Register("ut_metadata", metadata)
+
+	handshake := registry.Handshake(&ExtendedHandshake{Reqq: 100})
+	if handshake.M["ut_pex"] != pexID || handshake.M["ut_metadata"] != metadataID {
+		t.Fatalf("Wrong local IDs in handshake: %v", handshake.M)
+	}
+	if handshake.Reqq != 100 {
+		t.Fatalf("Expected reqq 100. Got: %d", handshake.Reqq)
+	}
+
+	remoteHandshake := &ExtendedHandshake{M: map[string]byte{"ut_pex": 7, "lt_donthave": 3}}
+	payload, _ := remoteHandshake.Encode()
+	err := registry.HandleMessage(&ExtendedMsg{ExtendedHandshakeID, payload})
+	if err != nil {
+		t.Fatalf("Failed to handle handshake: %s", err)
+	}
+
+	if pex.localID != pexID || pex.remoteID != 7 {
+		t.Fatalf("Wrong negotiated IDs for ut_pex: %d and %d", pex.localID, pex.remoteID)
+	}
+	if metadata.localID != metadataID || metadata.remoteID != 0 {
+		t.Fatalf("Wrong negotiated IDs for ut_metadata: %d and %d", metadata.localID, metadata.remoteID)
+	}
+	if registry.RemoteID("ut_pex") != 7 {
+		t.Fatalf("Wrong remote ID for ut_pex: %d", registry.RemoteID("ut_pex"))
+	}
+
+	err = registry.HandleMessage(&ExtendedMsg{pexID, []byte("data")})
+	if err != nil {
+		t.Fatalf("Failed to handle message: %s", err)
+	}
+	if len(pex.payloads) != 1 || string(pex.payloads[0]) != "data" {
+		t.Fatalf("Message not dispatched to ut_pex: %v", pex.payloads)
+	}
+
+	err = registry.HandleMessage(&ExtendedMsg{10, []byte("data")})
+	if err == nil {
+		t.Fatalf("Expected error for unknown extension ID")
+	}
+
+	disabling := &ExtendedHandshake{M: map[string]byte{"ut_pex": 0}}
+	payload, _ = disabling.Encode()
+	registry.HandleMessage(&ExtendedMsg{ExtendedHandshakeID, payload})
+	if pex.remoteID != 0 {
+		t.Fatalf("Expected ut_pex to be disabled. Remote ID: %d", pex.remoteID)
+	}
+}
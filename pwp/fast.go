@@ -0,0 +1,89 @@
+package pwp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// Fast extension (BEP 6) messages
+
+type SuggestPieceMsg struct {
+	Index int32
+}
+
+func (m *SuggestPieceMsg) Encode() []byte {
+	buf := bytes.NewBuffer([]byte{0, 0, 0, 5, 13})
+	binary.Write(buf, binary.BigEndian, m.Index)
+	return buf.Bytes()
+}
+
+type HaveAllMsg struct{}
+
+func (m *HaveAllMsg) Encode() []byte {
+	return []byte{0, 0, 0, 1, 14}
+}
+
+type HaveNoneMsg struct{}
+
+func (m *HaveNoneMsg) Encode() []byte {
+	return []byte{0, 0, 0, 1, 15}
+}
+
+type RejectRequestMsg struct {
+	Index  int32
+	Offset int32
+	Length int32
+}
+
+func (m *RejectRequestMsg) Encode() []byte {
+	buf := bytes.NewBuffer([]byte{0, 0, 0, 13, 16})
+	binary.Write(buf, binary.BigEndian, m.Index)
+	binary.Write(buf, binary.BigEndian, m.Offset)
+	binary.Write(buf, binary.BigEndian, m.Length)
+	return buf.Bytes()
+}
+
+type AllowedFastMsg struct {
+	Index int32
+}
+
+func (m *AllowedFastMsg) Encode() []byte {
+	buf := bytes.NewBuffer([]byte{0, 0, 0, 5, 17})
+	binary.Write(buf, binary.BigEndian, m.Index)
+	return buf.Bytes()
+}
+
+// Canonical allowed fast set of size k for a peer, as specified in BEP 6.
+// Only defined for IPv4 peers, nil is returned otherwise
+func AllowedFastSet(k int, pieceCount int, infoHash []byte, ip net.IP) []int32 {
+	ipv4 := ip.To4()
+	if ipv4 == nil || pieceCount <= 0 {
+		return nil
+	}
+	if k > pieceCount {
+		k = pieceCount
+	}
+
+	x := make([]byte, 0, 4+len(infoHash))
+	x = append(x, ipv4[0], ipv4[1], ipv4[2], 0)
+	x = append(x, infoHash...)
+
+	set := make([]int32, 0, k)
+	seen := make(map[int32]bool, k)
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			y := binary.BigEndian.Uint32(x[i*4 : i*4+4])
+			index := int32(y % uint32(pieceCount))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+
+	return set
+}
@@ -0,0 +1,71 @@
+package pwp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestFastMessagesEncodingDecoding(t *testing.T) {
+	messages := []Message{
+		&HaveAllMsg{},
+		&HaveNoneMsg{},
+		&SuggestPieceMsg{42},
+		&RejectRequestMsg{1, 16384, 16384},
+		&AllowedFastMsg{1059},
+	}
+
+	data := make([]byte, 0)
+	for _, msg := range messages {
+		data = append(data, msg.Encode()...)
+	}
+
+	decodedMessages, _, err := DecodeMessages(data)
+	if err != nil {
+		t.Fatalf("Failed to decode messages: %s", err)
+	}
+	if len(decodedMessages) != len(messages) {
+		t.Fatalf("Length missmatch. Expected: %d. Got: %d", len(messages), len(decodedMessages))
+	}
+
+	_ = decodedMessages[0].(*HaveAllMsg)
+	_ = decodedMessages[1].(*HaveNoneMsg)
+	if msg := decodedMessages[2].(*SuggestPieceMsg); msg.Index != 42 {
+		t.Fatalf("Wrong index: %d", msg.Index)
+	}
+	msg3 := decodedMessages[3].(*RejectRequestMsg)
+	if msg3.Index != 1 || msg3.Offset != 16384 || msg3.Length != 16384 {
+		t.Fatalf("Wrong reject request: %v", msg3)
+	}
+	if msg := decodedMessages[4].(*AllowedFastMsg); msg.Index != 1059 {
+		t.Fatalf("Wrong index: %d", msg.Index)
+	}
+}
+
+func TestAllowedFastSet(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	ip := net.ParseIP("80.4.4.200")
+
+	// Reference sets from BEP 6
+	expected7 := []int32{1059, 431, 808, 1217, 287, 376, 1188}
+	expected9 := []int32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+
+	for _, expected := range [][]int32{expected7, expected9} {
+		set := AllowedFastSet(len(expected), 1313, infoHash, ip)
+		if len(set) != len(expected) {
+			t.Fatalf("Expected %d pieces. Got: %d", len(expected), len(set))
+		}
+		for i, index := range set {
+			if index != expected[i] {
+				t.Fatalf("Expected set %v. Got: %v", expected, set)
+			}
+		}
+	}
+
+	if set := AllowedFastSet(10, 3, infoHash, ip); len(set) != 3 {
+		t.Fatalf("Expected set limited to piece count. Got: %v", set)
+	}
+	if set := AllowedFastSet(10, 1313, infoHash, net.ParseIP("2001:db8::1")); set != nil {
+		t.Fatalf("Expected no set for IPv6 peer. Got: %v", set)
+	}
+}
@@ -4,33 +4,169 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"time"
 )
 
-func EncodeHandshake(infoHash, peerID []byte) []byte {
+const (
+	_PROTOCOL_STRING   = "BitTorrent protocol"
+	_HANDSHAKE_LENGTH  = 68
+	_HANDSHAKE_TIMEOUT = time.Second * 10
+)
+
+type Reserved [8]byte
+
+type ReservedFlag struct {
+	index int
+	mask  byte
+}
+
+var (
+	ExtensionProtocol = ReservedFlag{index: 5, mask: 0x10}
+	FastExtension     = ReservedFlag{index: 7, mask: 0x04}
+	DHT               = ReservedFlag{index: 7, mask: 0x01}
+)
+
+func (r Reserved) Has(flag ReservedFlag) bool {
+	return r[flag.index]&flag.mask != 0
+}
+
+func (r *Reserved) Set(flag ReservedFlag) {
+	r[flag.index] |= flag.mask
+}
+
+// Flags set in both
+func (r Reserved) Intersect(other Reserved) Reserved {
+	var result Reserved
+	for i := range r {
+		result[i] = r[i] & other[i]
+	}
+	return result
+}
+
+func EncodeHandshake(reserved Reserved, infoHash, peerID []byte) []byte {
 	buf := new(bytes.Buffer)
 	buf.WriteByte(19)
-	buf.WriteString("BitTorrent Protocol")
-	for i := 0; i < 8; i++ {
-		buf.WriteByte(0)
-	}
+	buf.WriteString(_PROTOCOL_STRING)
+	buf.Write(reserved[:])
 	buf.Write(infoHash)
 	buf.Write(peerID)
 	return buf.Bytes()
 }
 
-func ParseHandshake(encoded []byte) ([]byte, []byte, error) {
-	if len(encoded) != 68 {
-		return nil, nil, fmt.Errorf("Invalid handshake length: %d", len(encoded))
+func ParseHandshake(encoded []byte) (Reserved, []byte, []byte, error) {
+	var reserved Reserved
+	if len(encoded) != _HANDSHAKE_LENGTH {
+		return reserved, nil, nil, fmt.Errorf("Invalid handshake length: %d", len(encoded))
 	}
 
 	if encoded[0] != 19 {
-		return nil, nil, errors.New("Invalid protocol string length byte")
+		return reserved, nil, nil, errors.New("Invalid protocol string length byte")
 	}
 
 	protocolString := string(encoded[1:20])
-	if protocolString != "BitTorrent Protocol" {
-		return nil, nil, fmt.Errorf("Invalid protocol string: %s", protocolString)
+	if protocolString != _PROTOCOL_STRING {
+		return reserved, nil, nil, fmt.Errorf("Invalid protocol string: %s", protocolString)
+	}
+
+	copy(reserved[:], encoded[20:28])
+	return reserved, encoded[28:48], encoded[48:68], nil
+}
+
+type HandshakeOptions struct {
+	Reserved Reserved
+	// Defaults to _HANDSHAKE_TIMEOUT
+	Timeout time.Duration
+	// The initiator sends its handshake right away. The receiver waits for the remote info hash first
+	Initiator bool
+	// Checked against the remote peer ID if set, e.g. when it is known from a tracker
+	ExpectedPeerID []byte
+	// Receiver only. Called with the remote info hash when ourHash is nil, so a single
+	// listener can serve many torrents. Returning false aborts the handshake
+	Lookup func(infoHash []byte) bool
+}
+
+type HandshakeResult struct {
+	InfoHash []byte
+	PeerID   []byte
+	// As sent by the remote peer
+	Reserved Reserved
+	// Supported by both sides
+	Capabilities Reserved
+	// Set if we sent our handshake first, i.e. dialed the peer
+	Initiator bool
+}
+
+func Handshake(conn net.Conn, ourHash, ourID []byte, opts *HandshakeOptions) (*HandshakeResult, error) {
+	if opts == nil {
+		opts = &HandshakeOptions{}
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = _HANDSHAKE_TIMEOUT
+	}
+
+	err := conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set handshake deadline: %s", err)
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	if opts.Initiator {
+		if ourHash == nil {
+			return nil, errors.New("Initiator has to provide an info hash")
+		}
+		_, err = conn.Write(EncodeHandshake(opts.Reserved, ourHash, ourID))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to send handshake: %s", err)
+		}
+	}
+
+	// Everything up to the peer ID, so the receiver can decide whether to respond
+	data := make([]byte, 48)
+	_, err = io.ReadFull(conn, data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive handshake: %s", err)
+	}
+	if data[0] != 19 || string(data[1:20]) != _PROTOCOL_STRING {
+		return nil, fmt.Errorf("Invalid protocol string: %q", data[1:20])
+	}
+
+	result := &HandshakeResult{
+		InfoHash:  make([]byte, 20),
+		PeerID:    make([]byte, 20),
+		Initiator: opts.Initiator,
+	}
+	copy(result.Reserved[:], data[20:28])
+	copy(result.InfoHash, data[28:48])
+	result.Capabilities = opts.Reserved.Intersect(result.Reserved)
+
+	if ourHash != nil {
+		if !bytes.Equal(result.InfoHash, ourHash) {
+			return nil, fmt.Errorf("Info hash missmatch: %x", result.InfoHash)
+		}
+	} else if opts.Lookup == nil || !opts.Lookup(result.InfoHash) {
+		return nil, fmt.Errorf("Unknown info hash: %x", result.InfoHash)
+	}
+
+	if !opts.Initiator {
+		_, err = conn.Write(EncodeHandshake(opts.Reserved, result.InfoHash, ourID))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to send handshake: %s", err)
+		}
+	}
+
+	_, err = io.ReadFull(conn, result.PeerID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive peer ID: %s", err)
+	}
+	if bytes.Equal(result.PeerID, ourID) {
+		return nil, errors.New("Connected to self")
+	}
+	if opts.ExpectedPeerID != nil && !bytes.Equal(result.PeerID, opts.ExpectedPeerID) {
+		return nil, fmt.Errorf("Peer ID missmatch: %x", result.PeerID)
 	}
 
-	return encoded[28:48], encoded[48:68], nil
+	return result, nil
 }
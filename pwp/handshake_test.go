@@ -0,0 +1,146 @@
+package pwp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+type handshakeOutcome struct {
+	result *HandshakeResult
+	err    error
+}
+
+// Unlike net.Pipe, writes are buffered as with real connections
+func tcpPair() (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer listener.Close()
+
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		acceptedCh <- conn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	return conn, <-acceptedCh
+}
+
+func runHandshakes(initiatorID, receiverID []byte, initiatorOpts, receiverOpts *HandshakeOptions) (handshakeOutcome, handshakeOutcome) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	initiatorConn, receiverConn := tcpPair()
+	defer initiatorConn.Close()
+	defer receiverConn.Close()
+
+	receiverCh := make(chan handshakeOutcome, 1)
+	go func() {
+		result, err := Handshake(receiverConn, nil, receiverID, receiverOpts)
+		if err != nil {
+			receiverConn.Close()
+		}
+		receiverCh <- handshakeOutcome{result, err}
+	}()
+
+	initiatorOpts.Initiator = true
+	result, err := Handshake(initiatorConn, infoHash, initiatorID, initiatorOpts)
+	if err != nil {
+		initiatorConn.Close()
+	}
+	return handshakeOutcome{result, err}, <-receiverCh
+}
+
+func TestHandshake(t *testing.T) {
+	initiatorID := bytes.Repeat([]byte{1}, 20)
+	receiverID := bytes.Repeat([]byte{2}, 20)
+
+	var initiatorReserved, receiverReserved Reserved
+	initiatorReserved.Set(ExtensionProtocol)
+	initiatorReserved.Set(FastExtension)
+	receiverReserved.Set(FastExtension)
+
+	lookedUp := make([]byte, 0)
+	initiator, receiver := runHandshakes(initiatorID, receiverID,
+		&HandshakeOptions{Reserved: initiatorReserved, ExpectedPeerID: receiverID},
+		&HandshakeOptions{Reserved: receiverReserved, Lookup: func(infoHash []byte) bool {
+			lookedUp = infoHash
+			return true
+		}},
+	)
+
+	if initiator.err != nil {
+		t.Fatalf("Initiator failed: %s", initiator.err)
+	}
+	if receiver.err != nil {
+		t.Fatalf("Receiver failed: %s", receiver.err)
+	}
+	if !bytes.Equal(lookedUp, bytes.Repeat([]byte{0xaa}, 20)) {
+		t.Fatalf("Wrong info hash looked up: %v", lookedUp)
+	}
+	if !bytes.Equal(initiator.result.PeerID, receiverID) || !bytes.Equal(receiver.result.PeerID, initiatorID) {
+		t.Fatalf("Wrong peer IDs")
+	}
+	for _, result := range []*HandshakeResult{initiator.result, receiver.result} {
+		if !result.Capabilities.Has(FastExtension) || result.Capabilities.Has(ExtensionProtocol) {
+			t.Fatalf("Wrong negotiated capabilities: %v", result.Capabilities)
+		}
+	}
+	if !receiver.result.Reserved.Has(ExtensionProtocol) {
+		t.Fatalf("Expected remote reserved bits of initiator")
+	}
+}
+
+func TestHandshakeUnknownInfoHash(t *testing.T) {
+	_, receiver := runHandshakes(bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 20),
+		&HandshakeOptions{},
+		&HandshakeOptions{Lookup: func(infoHash []byte) bool { return false }},
+	)
+
+	if receiver.err == nil {
+		t.Fatalf("Expected error for unknown info hash")
+	}
+}
+
+func TestHandshakeSelfConnection(t *testing.T) {
+	peerID := bytes.Repeat([]byte{1}, 20)
+	initiator, receiver := runHandshakes(peerID, peerID,
+		&HandshakeOptions{},
+		&HandshakeOptions{Lookup: func(infoHash []byte) bool { return true }},
+	)
+
+	if initiator.err == nil || receiver.err == nil {
+		t.Fatalf("Expected self connection to fail on both sides")
+	}
+}
+
+func TestHandshakePeerIDMissmatch(t *testing.T) {
+	initiator, _ := runHandshakes(bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 20),
+		&HandshakeOptions{ExpectedPeerID: bytes.Repeat([]byte{3}, 20)},
+		&HandshakeOptions{Lookup: func(infoHash []byte) bool { return true }},
+	)
+
+	if initiator.err == nil {
+		t.Fatalf("Expected error for mismatched peer ID")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	start := time.Now()
+	_, err := Handshake(local, nil, bytes.Repeat([]byte{1}, 20), &HandshakeOptions{Timeout: time.Millisecond * 50})
+	if err == nil {
+		t.Fatalf("Expected timeout error")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Handshake did not time out in time")
+	}
+}
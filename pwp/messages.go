@@ -226,6 +226,59 @@ func decodeMessage(data []byte) (Message, error) {
 		}
 		return msg, nil
 
+	case 13:
+		if len(data) != 5 {
+			return nil, fmt.Errorf("Invalid suggest piece message length: %d", len(data))
+		}
+		msg := &SuggestPieceMsg{
+			Index: int32(binary.BigEndian.Uint32(data[1:5])),
+		}
+		return msg, nil
+
+	case 14:
+		if len(data) > 1 {
+			return nil, fmt.Errorf("Invalid have all message length: %d", len(data))
+		}
+		return &HaveAllMsg{}, nil
+
+	case 15:
+		if len(data) > 1 {
+			return nil, fmt.Errorf("Invalid have none message length: %d", len(data))
+		}
+		return &HaveNoneMsg{}, nil
+
+	case 16:
+		if len(data) != 13 {
+			return nil, fmt.Errorf("Invalid reject request message length: %d", len(data))
+		}
+		msg := &RejectRequestMsg{
+			Index:  int32(binary.BigEndian.Uint32(data[1:5])),
+			Offset: int32(binary.BigEndian.Uint32(data[5:9])),
+			Length: int32(binary.BigEndian.Uint32(data[9:13])),
+		}
+		return msg, nil
+
+	case 17:
+		if len(data) != 5 {
+			return nil, fmt.Errorf("Invalid allowed fast message length: %d", len(data))
+		}
+		msg := &AllowedFastMsg{
+			Index: int32(binary.BigEndian.Uint32(data[1:5])),
+		}
+		return msg, nil
+
+	case 20:
+		if len(data) < 2 {
+			return nil, fmt.Errorf("Invalid extended message length: %d", len(data))
+		}
+		payload := make([]byte, len(data)-2)
+		copy(payload, data[2:])
+		msg := &ExtendedMsg{
+			ID:      data[1],
+			Payload: payload,
+		}
+		return msg, nil
+
 	default:
 		return nil, fmt.Errorf("Invalid message ID: %d", data[0])
 	}
@@ -0,0 +1,119 @@
+package pwp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	DefaultMaxMessageLength = 1024 * 1024
+	_POOLED_BLOCK_SIZE      = 16 * 1024
+	_READ_BUFFER_SIZE       = 64 * 1024
+)
+
+var blockPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, _POOLED_BLOCK_SIZE)
+	},
+}
+
+func getBuffer(length int) []byte {
+	if length > _POOLED_BLOCK_SIZE {
+		return make([]byte, length)
+	}
+	return blockPool.Get().([]byte)[:length]
+}
+
+// Returns the block of a PieceMsg obtained from a Reader to the buffer pool.
+// The block must not be used afterwards
+func ReleaseBlock(block []byte) {
+	if cap(block) == _POOLED_BLOCK_SIZE {
+		blockPool.Put(block[:_POOLED_BLOCK_SIZE])
+	}
+}
+
+// Decodes messages one at a time from a stream
+type Reader struct {
+	r                *bufio.Reader
+	maxMessageLength int
+	header           [13]byte
+}
+
+func NewReader(r io.Reader, maxMessageLength int) *Reader {
+	return &Reader{
+		r:                bufio.NewReaderSize(r, _READ_BUFFER_SIZE),
+		maxMessageLength: maxMessageLength,
+	}
+}
+
+// Blocks of returned PieceMsgs are pooled, and should be passed to ReleaseBlock once no longer needed
+func (r *Reader) ReadMessage() (Message, error) {
+	_, err := io.ReadFull(r.r, r.header[:4])
+	if err != nil {
+		return nil, err
+	}
+
+	messageLength := int(binary.BigEndian.Uint32(r.header[:4]))
+	if messageLength == 0 {
+		return &KeepAliveMsg{}, nil
+	}
+	if messageLength > r.maxMessageLength {
+		return nil, fmt.Errorf("Message too long: %d. Max: %d", messageLength, r.maxMessageLength)
+	}
+
+	id, err := r.r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if id == 7 {
+		return r.readPiece(messageLength)
+	}
+
+	data := getBuffer(messageLength)
+	defer ReleaseBlock(data)
+	data[0] = id
+	_, err = io.ReadFull(r.r, data[1:])
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return decodeMessage(data)
+}
+
+// Reads the block directly into a pooled buffer, avoiding copies
+func (r *Reader) readPiece(messageLength int) (Message, error) {
+	if messageLength < 9 {
+		return nil, fmt.Errorf("Invalid piece message length: %d", messageLength)
+	}
+
+	_, err := io.ReadFull(r.r, r.header[4:12])
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	block := getBuffer(messageLength - 9)
+	_, err = io.ReadFull(r.r, block)
+	if err != nil {
+		ReleaseBlock(block)
+		return nil, unexpectedEOF(err)
+	}
+
+	msg := &PieceMsg{
+		Index:  int32(binary.BigEndian.Uint32(r.header[4:8])),
+		Offset: int32(binary.BigEndian.Uint32(r.header[8:12])),
+		Block:  block,
+	}
+	return msg, nil
+}
+
+// EOF in the middle of a message is never clean
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
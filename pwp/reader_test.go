@@ -0,0 +1,81 @@
+package pwp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	messages := []Message{
+		&BitfieldMsg{bytes.Repeat([]byte{0xff}, 200000)},
+		&KeepAliveMsg{},
+		&HaveMsg{500000},
+		&PieceMsg{10, 20, bytes.Repeat([]byte{7}, 16384)},
+		&PieceMsg{11, 0, bytes.Repeat([]byte{8}, 100000)},
+		&ExtendedMsg{1, []byte("payload")},
+		&UninterestedMsg{},
+	}
+
+	data := make([]byte, 0)
+	for _, msg := range messages {
+		data = append(data, msg.Encode()...)
+	}
+
+	reader := NewReader(bytes.NewReader(data), DefaultMaxMessageLength)
+	for i, expected := range messages {
+		msg, err := reader.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read message %d: %s", i, err)
+		}
+		if !bytes.Equal(msg.Encode(), expected.Encode()) {
+			t.Fatalf("Message %d missmatch", i)
+		}
+		if piece, ok := msg.(*PieceMsg); ok {
+			ReleaseBlock(piece.Block)
+		}
+	}
+
+	_, err := reader.ReadMessage()
+	if err != io.EOF {
+		t.Fatalf("Expected EOF. Got: %v", err)
+	}
+}
+
+func TestReaderMaxLength(t *testing.T) {
+	data := (&BitfieldMsg{make([]byte, 1000)}).Encode()
+	reader := NewReader(bytes.NewReader(data), 500)
+
+	_, err := reader.ReadMessage()
+	if err == nil {
+		t.Fatalf("Expected error for message above max length")
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	data := (&PieceMsg{1, 2, make([]byte, 100)}).Encode()
+	reader := NewReader(bytes.NewReader(data[:50]), DefaultMaxMessageLength)
+
+	_, err := reader.ReadMessage()
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected unexpected EOF. Got: %v", err)
+	}
+}
+
+func BenchmarkReaderPieces(b *testing.B) {
+	encoded := (&PieceMsg{1, 0, make([]byte, 16384)}).Encode()
+	data := bytes.Repeat(encoded, 64)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		reader := NewReader(bytes.NewReader(data), DefaultMaxMessageLength)
+		for {
+			msg, err := reader.ReadMessage()
+			if err != nil {
+				break
+			}
+			ReleaseBlock(msg.(*PieceMsg).Block)
+		}
+	}
+}
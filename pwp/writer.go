@@ -0,0 +1,56 @@
+package pwp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// Encodes messages to a stream. Blocks of PieceMsgs are written without being copied
+type Writer struct {
+	w      io.Writer
+	header [13]byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w: w,
+	}
+}
+
+func (w *Writer) WriteMessage(msg Message) error {
+	piece, ok := msg.(*PieceMsg)
+	if !ok {
+		_, err := w.w.Write(msg.Encode())
+		return err
+	}
+
+	binary.BigEndian.PutUint32(w.header[0:4], uint32(len(piece.Block)+9))
+	w.header[4] = 7
+	binary.BigEndian.PutUint32(w.header[5:9], uint32(piece.Index))
+	binary.BigEndian.PutUint32(w.header[9:13], uint32(piece.Offset))
+
+	_, err := WriteBuffers(w.w, net.Buffers{w.header[:], piece.Block})
+	return err
+}
+
+// Implemented by connections wrapping another one, e.g. to count bytes,
+// so vectored writes still reach the socket
+type BuffersWriter interface {
+	WriteBuffers(buffers net.Buffers) (int64, error)
+}
+
+// Uses a single vectored write on a *net.TCPConn. Other writers, e.g. encrypting connections,
+// get the buffers joined into a single write instead of one write per buffer
+func WriteBuffers(w io.Writer, buffers net.Buffers) (int64, error) {
+	switch conn := w.(type) {
+	case BuffersWriter:
+		return conn.WriteBuffers(buffers)
+	case *net.TCPConn:
+		return buffers.WriteTo(conn)
+	}
+
+	n, err := w.Write(bytes.Join(buffers, nil))
+	return int64(n), err
+}
@@ -0,0 +1,58 @@
+package pwp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	messages := []Message{
+		&HaveMsg{1},
+		&PieceMsg{10, 20, bytes.Repeat([]byte{7}, 16384)},
+		&KeepAliveMsg{},
+		&PieceMsg{11, 0, []byte{}},
+		&CancelMsg{1, 2, 3},
+	}
+
+	expected := make([]byte, 0)
+	for _, msg := range messages {
+		expected = append(expected, msg.Encode()...)
+	}
+
+	buf := new(bytes.Buffer)
+	writer := NewWriter(buf)
+	for _, msg := range messages {
+		if err := writer.WriteMessage(msg); err != nil {
+			t.Fatalf("Failed to write message: %s", err)
+		}
+	}
+
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("Written data missmatch. Expected length: %d. Got: %d", len(expected), buf.Len())
+	}
+}
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestWriterSingleWrite(t *testing.T) {
+	w := &countingWriter{}
+	msg := &PieceMsg{1, 0, bytes.Repeat([]byte{7}, 16384)}
+	if err := NewWriter(w).WriteMessage(msg); err != nil {
+		t.Fatalf("Failed to write message: %s", err)
+	}
+
+	if w.writes != 1 {
+		t.Fatalf("Expected header and block in a single write. Got: %d writes", w.writes)
+	}
+	if !bytes.Equal(w.Bytes(), msg.Encode()) {
+		t.Fatalf("Written data missmatch")
+	}
+}
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Allows at least a couple of blocks through at once, even at low rates
+	_MIN_BURST = 64 * 1024
+)
+
+// Token bucket limiting a rate in bytes per second. A single limiter may be shared
+// by many connections, e.g. all peers of a torrent
+type Limiter struct {
+	mx     sync.Mutex
+	rate   int64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// A rate of 0 means unlimited
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{last: time.Now()}
+	l.setRate(rate)
+	l.tokens = l.burst
+	return l
+}
+
+// Can be changed at any time. Waiting callers are not woken up early
+func (l *Limiter) SetRate(rate int64) {
+	l.mx.Lock()
+	l.advance(time.Now())
+	unlimited := l.rate == 0
+	l.setRate(rate)
+	if unlimited || l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.mx.Unlock()
+}
+
+func (l *Limiter) Rate() int64 {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return l.rate
+}
+
+func (l *Limiter) setRate(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	l.burst = float64(rate)
+	if l.burst < _MIN_BURST {
+		l.burst = _MIN_BURST
+	}
+}
+
+func (l *Limiter) advance(now time.Time) {
+	elapsed := now.Sub(l.last)
+	if elapsed <= 0 {
+		return
+	}
+	l.last = now
+	if l.rate == 0 {
+		l.tokens = l.burst
+		return
+	}
+	l.tokens += elapsed.Seconds() * float64(l.rate)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Takes n tokens, going into debt if there aren't enough.
+// Returns how long the caller has to wait for the debt to be paid off
+func (l *Limiter) reserve(n int, now time.Time) time.Duration {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.advance(now)
+	if l.rate == 0 {
+		return 0
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Gives back the tokens of a reservation that wasn't used
+func (l *Limiter) refund(n int) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.rate == 0 {
+		return
+	}
+	l.tokens += float64(n)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Blocks until all limiters allow n more bytes. Nil limiters are ignored.
+// Returns false if cancelled while waiting, in which case the bytes are given back
+func Wait(n int, cancel <-chan struct{}, limiters ...*Limiter) bool {
+	if n <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	var delay time.Duration
+	for _, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		if d := limiter.reserve(n, now); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		for _, limiter := range limiters {
+			if limiter != nil {
+				limiter.refund(n)
+			}
+		}
+		return false
+	}
+}
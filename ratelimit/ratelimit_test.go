@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(100000)
+	l.last = now
+
+	if delay := l.reserve(100000, now); delay != 0 {
+		t.Fatalf("Expected burst to pass. Got delay: %s", delay)
+	}
+	if delay := l.reserve(50000, now); delay != time.Millisecond*500 {
+		t.Fatalf("Expected 500ms delay. Got: %s", delay)
+	}
+	// The debt is paid off after 500ms, the next 500ms refill 50000 tokens
+	if delay := l.reserve(50000, now.Add(time.Second)); delay != 0 {
+		t.Fatalf("Expected no delay. Got: %s", delay)
+	}
+	if delay := l.reserve(10000, now.Add(time.Second)); delay != time.Millisecond*100 {
+		t.Fatalf("Expected 100ms delay. Got: %s", delay)
+	}
+}
+
+func TestLimiterMinimumBurst(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(1000)
+	l.last = now
+
+	if delay := l.reserve(_MIN_BURST, now); delay != 0 {
+		t.Fatalf("Expected minimum burst to pass. Got delay: %s", delay)
+	}
+	if delay := l.reserve(1000, now); delay != time.Second {
+		t.Fatalf("Expected 1s delay. Got: %s", delay)
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(0)
+
+	for i := 0; i < 100; i++ {
+		if delay := l.reserve(1024*1024, now); delay != 0 {
+			t.Fatalf("Expected unlimited limiter not to delay. Got: %s", delay)
+		}
+	}
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(0)
+	l.last = now
+	l.SetRate(100000)
+	l.last = now
+
+	l.reserve(100000, now)
+	if delay := l.reserve(100000, now); delay != time.Second {
+		t.Fatalf("Expected 1s delay. Got: %s", delay)
+	}
+
+	l.SetRate(0)
+	if delay := l.reserve(1024*1024, time.Now()); delay != 0 {
+		t.Fatalf("Expected no delay after removing the limit. Got: %s", delay)
+	}
+	if l.Rate() != 0 {
+		t.Fatalf("Expected rate 0. Got: %d", l.Rate())
+	}
+}
+
+func TestWait(t *testing.T) {
+	global := NewLimiter(0)
+	torrent := NewLimiter(1000)
+	torrent.reserve(_MIN_BURST, time.Now())
+
+	start := time.Now()
+	if !Wait(50, nil, global, nil, torrent) {
+		t.Fatalf("Expected wait to succeed")
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*40 {
+		t.Fatalf("Expected to wait for the slowest limiter. Waited: %s", elapsed)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if Wait(10000, cancel, torrent) {
+		t.Fatalf("Expected cancelled wait to fail")
+	}
+	// The cancelled reservation was given back
+	if delay := torrent.reserve(10000, time.Now()); delay > time.Second*15 {
+		t.Fatalf("Expected cancelled bytes to be refunded. Got delay: %s", delay)
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	officeHours := &Schedule{
+		Days:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Start: time.Hour * 9,
+		End:   time.Hour * 17,
+	}
+	// 2024-01-01 is a Monday
+	monday := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+
+	cases := []struct {
+		schedule *Schedule
+		at       time.Time
+		active   bool
+	}{
+		{officeHours, monday.Add(time.Hour * 8), false},
+		{officeHours, monday.Add(time.Hour * 9), true},
+		{officeHours, monday.Add(time.Hour*16 + time.Minute*59), true},
+		{officeHours, monday.Add(time.Hour * 17), false},
+		{officeHours, monday.AddDate(0, 0, 5).Add(time.Hour * 10), false},
+	}
+
+	nights := &Schedule{Days: []time.Weekday{time.Monday}, Start: time.Hour * 22, End: time.Hour * 6}
+	cases = append(cases, []struct {
+		schedule *Schedule
+		at       time.Time
+		active   bool
+	}{
+		{nights, monday.Add(time.Hour * 23), true},
+		{nights, monday.AddDate(0, 0, 1).Add(time.Hour * 5), true},
+		{nights, monday.Add(time.Hour * 5), false},
+		{nights, monday.AddDate(0, 0, 1).Add(time.Hour * 23), false},
+	}...)
+
+	for i, c := range cases {
+		if c.schedule.Active(c.at) != c.active {
+			t.Fatalf("Case %d: expected active %v at %s", i, c.active, c.at)
+		}
+	}
+}
+
+func TestScheduleDaylightSaving(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Time zone data not available: %s", err)
+	}
+	officeHours := &Schedule{Start: time.Hour * 9, End: time.Hour * 17}
+	// Clocks go from 2:00 to 3:00 on 2024-03-10 and from 2:00 back to 1:00 on 2024-11-03
+	days := []time.Time{
+		time.Date(2024, time.March, 10, 0, 0, 0, 0, location),
+		time.Date(2024, time.November, 3, 0, 0, 0, 0, location),
+	}
+	for _, day := range days {
+		year, month, date := day.Date()
+		if !officeHours.Active(time.Date(year, month, date, 9, 30, 0, 0, location)) {
+			t.Fatalf("Expected active at 9:30 on %s", day)
+		}
+		if officeHours.Active(time.Date(year, month, date, 8, 30, 0, 0, location)) {
+			t.Fatalf("Expected inactive at 8:30 on %s", day)
+		}
+		if officeHours.Active(time.Date(year, month, date, 17, 0, 0, 0, location)) {
+			t.Fatalf("Expected inactive at 17:00 on %s", day)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	upload, download := NewLimiter(0), NewLimiter(0)
+	scheduler := NewScheduler(upload, download)
+	scheduler.SetNormalRates(100000, 500000)
+	scheduler.SetAltRates(10000, 50000)
+
+	monday := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	scheduler.SetSchedule(&Schedule{Start: time.Hour * 9, End: time.Hour * 17})
+
+	scheduler.Apply(monday.Add(time.Hour * 10))
+	if upload.Rate() != 10000 || download.Rate() != 50000 {
+		t.Fatalf("Expected alternative rates. Got: %d, %d", upload.Rate(), download.Rate())
+	}
+	scheduler.Apply(monday.Add(time.Hour * 18))
+	if upload.Rate() != 100000 || download.Rate() != 500000 {
+		t.Fatalf("Expected normal rates. Got: %d, %d", upload.Rate(), download.Rate())
+	}
+
+	scheduler.SetSchedule(nil)
+	scheduler.Apply(monday.Add(time.Hour * 10))
+	if upload.Rate() != 100000 {
+		t.Fatalf("Expected normal rates without schedule. Got: %d", upload.Rate())
+	}
+}
@@ -0,0 +1,148 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	_SCHEDULE_INTERVAL = time.Minute
+)
+
+// Recurring time window, e.g. office hours
+type Schedule struct {
+	// Days the window starts on. Every day if empty
+	Days []time.Weekday
+	// Offsets from local midnight. If End is before Start, the window spans midnight
+	Start time.Duration
+	End   time.Duration
+}
+
+func (s *Schedule) Active(now time.Time) bool {
+	start, end := wallClock(now, s.Start), wallClock(now, s.End)
+
+	if s.Start <= s.End {
+		return !now.Before(start) && now.Before(end) && s.onDay(now.Weekday())
+	}
+	if !now.Before(start) {
+		return s.onDay(now.Weekday())
+	}
+	if now.Before(end) {
+		// Started the day before
+		return s.onDay((now.Weekday() + 6) % 7)
+	}
+	return false
+}
+
+// The time of day on the clock, so days with DST changes keep their windows
+func wallClock(day time.Time, offset time.Duration) time.Time {
+	year, month, date := day.Date()
+	return time.Date(year, month, date, int(offset/time.Hour), int(offset%time.Hour/time.Minute),
+		int(offset%time.Minute/time.Second), int(offset%time.Second), day.Location())
+}
+
+func (s *Schedule) onDay(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Switches a pair of limiters between normal and alternative rates
+type Scheduler struct {
+	upload   *Limiter
+	download *Limiter
+
+	mx             sync.Mutex
+	normalUpload   int64
+	normalDownload int64
+	altUpload      int64
+	altDownload    int64
+	schedule       *Schedule
+	stopOnce       sync.Once
+	stopCh         chan struct{}
+}
+
+// Starts with the current rates of the limiters as the normal ones
+func NewScheduler(upload, download *Limiter) *Scheduler {
+	return &Scheduler{
+		upload:         upload,
+		download:       download,
+		normalUpload:   upload.Rate(),
+		normalDownload: download.Rate(),
+		stopCh:         make(chan struct{}),
+	}
+}
+
+func (s *Scheduler) SetNormalRates(upload, download int64) {
+	s.mx.Lock()
+	s.normalUpload, s.normalDownload = upload, download
+	s.mx.Unlock()
+	s.Apply(time.Now())
+}
+
+func (s *Scheduler) SetAltRates(upload, download int64) {
+	s.mx.Lock()
+	s.altUpload, s.altDownload = upload, download
+	s.mx.Unlock()
+	s.Apply(time.Now())
+}
+
+// Nil disables the alternative rates
+func (s *Scheduler) SetSchedule(schedule *Schedule) {
+	s.mx.Lock()
+	s.schedule = schedule
+	s.mx.Unlock()
+	s.Apply(time.Now())
+}
+
+// Whether the alternative rates are in effect at the given time
+func (s *Scheduler) Alternative(now time.Time) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.schedule != nil && s.schedule.Active(now)
+}
+
+func (s *Scheduler) Apply(now time.Time) {
+	alternative := s.Alternative(now)
+
+	s.mx.Lock()
+	upload, download := s.normalUpload, s.normalDownload
+	if alternative {
+		upload, download = s.altUpload, s.altDownload
+	}
+	s.mx.Unlock()
+
+	if s.upload.Rate() != upload {
+		s.upload.SetRate(upload)
+	}
+	if s.download.Rate() != download {
+		s.download.SetRate(download)
+	}
+}
+
+func (s *Scheduler) Run() {
+	ticker := time.NewTicker(_SCHEDULE_INTERVAL)
+	defer ticker.Stop()
+
+	s.Apply(time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			s.Apply(now)
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+}
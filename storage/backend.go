@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"gobby"
+	"gobby/bitfield"
+	"sync"
+)
+
+const (
+	// Completion is tracked per block of the size requested from peers
+	_BLOCK_SIZE = 16 * 1024
+)
+
+var errClosed = errors.New("Storage closed")
+
+// Piece data of a single torrent. Blocks may be written in any order, by several goroutines at once
+type Storage interface {
+	// Data that was never written reads as zeros on every backend, so only hash checks,
+	// e.g. by Recheck, tell whether a piece is there
+	ReadBlock(index, offset int, data []byte) error
+	WriteBlock(index, offset int, data []byte) error
+	// Pieces that were completely written, or marked complete
+	Completion() *bitfield.Bitfield
+	// Overrides the completion of a piece, e.g. after failed verification or when resuming
+	SetComplete(index int, complete bool)
+	Flush() error
+	Close() error
+}
+
+type Backend int
+
+const (
+	BackendFile Backend = iota
+	BackendMemory
+	BackendMmap
+)
+
+func (b Backend) String() string {
+	switch b {
+	case BackendFile:
+		return "file"
+	case BackendMemory:
+		return "memory"
+	case BackendMmap:
+		return "mmap"
+	default:
+		return fmt.Sprintf("Backend(%d)", int(b))
+	}
+}
+
+// Opens the torrent's storage in the directory with the chosen backend.
+// Memory mapped storage on Linux maps every file in full, so it doesn't implement SkipTracker
+func Open(backend Backend, path string, files []*gobby.File, pieceLength int) (Storage, error) {
+	var storage Storage
+	var err error
+	// Assigned separately, so failures don't return a non-nil interface holding a nil pointer
+	switch backend {
+	case BackendFile:
+		var s *FileStorage
+		s, err = NewFileStorage(path, files, pieceLength)
+		storage = s
+	case BackendMemory:
+		var s *MemoryStorage
+		s, err = NewMemoryStorage(files, pieceLength)
+		storage = s
+	case BackendMmap:
+		var s *MmapStorage
+		s, err = NewMmapStorage(path, files, pieceLength)
+		storage = s
+	default:
+		return nil, fmt.Errorf("Unknown storage backend: %s", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// Tracks which blocks of each piece were written
+type completion struct {
+	layout *layout
+
+	mx       sync.Mutex
+	complete *bitfield.Bitfield
+	partial  map[int]*bitfield.Bitfield
+}
+
+func newCompletion(layout *layout) *completion {
+	return &completion{
+		layout:   layout,
+		complete: bitfield.New(layout.PieceCount()),
+		partial:  make(map[int]*bitfield.Bitfield),
+	}
+}
+
+// Blocks only partially covered by the write don't count
+func (c *completion) written(index, offset, length int) {
+	size := c.layout.pieceSize(index)
+	blockCount := (size + _BLOCK_SIZE - 1) / _BLOCK_SIZE
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.complete.Has(index) {
+		return
+	}
+
+	blocks, exists := c.partial[index]
+	if !exists {
+		blocks = bitfield.New(blockCount)
+		c.partial[index] = blocks
+	}
+	for block := (offset + _BLOCK_SIZE - 1) / _BLOCK_SIZE; block < blockCount; block++ {
+		end := (block + 1) * _BLOCK_SIZE
+		if end > size {
+			end = size
+		}
+		if end > offset+length {
+			break
+		}
+		blocks.Set(block)
+	}
+
+	if blocks.Full() {
+		c.complete.Set(index)
+		delete(c.partial, index)
+	}
+}
+
+func (c *completion) SetComplete(index int, complete bool) {
+	if index < 0 || index >= c.complete.Len() {
+		return
+	}
+
+	c.mx.Lock()
+	if complete {
+		c.complete.Set(index)
+	} else {
+		c.complete.Clear(index)
+	}
+	delete(c.partial, index)
+	c.mx.Unlock()
+}
+
+// Written blocks of incomplete pieces
+func (c *completion) PartialBlocks() map[int]*bitfield.Bitfield {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	partial := make(map[int]*bitfield.Bitfield, len(c.partial))
+	for index, blocks := range c.partial {
+		partial[index] = blocks.Copy()
+	}
+	return partial
+}
+
+func (c *completion) Completion() *bitfield.Bitfield {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.complete.Copy()
+}
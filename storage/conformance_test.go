@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"bytes"
+	"gobby"
+	"os"
+	"sync"
+	"testing"
+)
+
+const _CONFORMANCE_PATH = "/tmp/gobby/conformance_tests/"
+
+// Two blocks per piece. The last piece is a single, short block
+const _CONFORMANCE_PIECE_LENGTH = 2 * _BLOCK_SIZE
+
+var conformanceFiles = []*gobby.File{
+	&gobby.File{Length: 20000, Path: "dir0/file0"},
+	&gobby.File{Length: 0, Path: "dir0/empty"},
+	&gobby.File{Length: 30000, Path: "file1"},
+	&gobby.File{Length: 50000, Path: "dir1/file2"},
+}
+
+type openFunc func(t *testing.T, files []*gobby.File, pieceLength int) Storage
+
+// Every backend has to pass these
+func testConformance(t *testing.T, open openFunc, persistent bool) {
+	os.RemoveAll(_CONFORMANCE_PATH)
+	os.MkdirAll(_CONFORMANCE_PATH, 0700)
+	defer os.RemoveAll(_CONFORMANCE_PATH)
+
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, open, persistent) })
+	t.Run("Completion", func(t *testing.T) { testCompletion(t, open) })
+	t.Run("Bounds", func(t *testing.T) { testBounds(t, open) })
+	t.Run("Unwritten", func(t *testing.T) { testUnwritten(t, open) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, open) })
+	t.Run("Close", func(t *testing.T) { testClose(t, open) })
+}
+
+func conformanceData() []byte {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+// Blocks of all pieces, last block first
+func writeAll(t *testing.T, s Storage, data []byte) {
+	for offset := len(data) - len(data)%_BLOCK_SIZE; offset >= 0; offset -= _BLOCK_SIZE {
+		end := offset + _BLOCK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		if offset == end {
+			continue
+		}
+		err := s.WriteBlock(offset/_CONFORMANCE_PIECE_LENGTH, offset%_CONFORMANCE_PIECE_LENGTH, data[offset:end])
+		if err != nil {
+			t.Fatalf("Failed to write block at %d: %s", offset, err)
+		}
+	}
+}
+
+func checkAll(t *testing.T, s Storage, data []byte) {
+	for index := 0; index*_CONFORMANCE_PIECE_LENGTH < len(data); index++ {
+		start := index * _CONFORMANCE_PIECE_LENGTH
+		end := start + _CONFORMANCE_PIECE_LENGTH
+		if end > len(data) {
+			end = len(data)
+		}
+		piece := make([]byte, end-start)
+		err := s.ReadBlock(index, 0, piece)
+		if err != nil {
+			t.Fatalf("Failed to read piece %d: %s", index, err)
+		}
+		if !bytes.Equal(piece, data[start:end]) {
+			t.Fatalf("Piece %d missmatch", index)
+		}
+	}
+}
+
+func testRoundTrip(t *testing.T, open openFunc, persistent bool) {
+	data := conformanceData()
+	s := open(t, conformanceFiles, _CONFORMANCE_PIECE_LENGTH)
+	writeAll(t, s, data)
+	checkAll(t, s, data)
+
+	// Crosses the boundary of file0, the empty file and file1
+	block := make([]byte, 1000)
+	err := s.ReadBlock(0, 19500, block)
+	if err != nil {
+		t.Fatalf("Failed to read block: %s", err)
+	}
+	if !bytes.Equal(block, data[19500:20500]) {
+		t.Fatalf("Block across files missmatch")
+	}
+
+	err = s.Flush()
+	if err != nil {
+		t.Fatalf("Failed to flush: %s", err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("Failed to close: %s", err)
+	}
+
+	if persistent {
+		s = open(t, conformanceFiles, _CONFORMANCE_PIECE_LENGTH)
+		defer s.Close()
+		checkAll(t, s, data)
+	}
+}
+
+func testCompletion(t *testing.T, open openFunc) {
+	data := conformanceData()
+	s := open(t, conformanceFiles, _CONFORMANCE_PIECE_LENGTH)
+	defer s.Close()
+
+	completion := s.Completion()
+	if completion.Len() != 4 || !completion.Empty() {
+		t.Fatalf("Expected 4 incomplete pieces. Got: %d, %d complete", completion.Len(), completion.Count())
+	}
+
+	s.WriteBlock(0, 0, data[:_BLOCK_SIZE])
+	// Doesn't cover the second block entirely
+	s.WriteBlock(0, _BLOCK_SIZE, data[_BLOCK_SIZE:_BLOCK_SIZE*2-1])
+	if s.Completion().Has(0) {
+		t.Fatalf("Expected piece 0 to be incomplete")
+	}
+	s.WriteBlock(0, _BLOCK_SIZE, data[_BLOCK_SIZE:_BLOCK_SIZE*2])
+	if !s.Completion().Has(0) {
+		t.Fatalf("Expected piece 0 to be complete")
+	}
+
+	lastStart := 3 * _CONFORMANCE_PIECE_LENGTH
+	s.WriteBlock(3, 0, data[lastStart:])
+	if !s.Completion().Has(3) || s.Completion().Count() != 2 {
+		t.Fatalf("Expected pieces 0 and 3 to be complete. Got %d complete", s.Completion().Count())
+	}
+
+	s.SetComplete(0, false)
+	s.SetComplete(1, true)
+	completion = s.Completion()
+	if completion.Has(0) || !completion.Has(1) {
+		t.Fatalf("Expected completion to be overridden")
+	}
+	// Out of range is ignored
+	s.SetComplete(4, true)
+}
+
+func testBounds(t *testing.T, open openFunc) {
+	s := open(t, conformanceFiles, _CONFORMANCE_PIECE_LENGTH)
+	defer s.Close()
+
+	cases := []struct {
+		index  int
+		offset int
+		length int
+	}{
+		{-1, 0, 10},
+		{4, 0, 10},
+		{0, -1, 10},
+		{0, _CONFORMANCE_PIECE_LENGTH - 5, 10},
+		{3, 100000 - 3*_CONFORMANCE_PIECE_LENGTH, 1},
+	}
+	for i, c := range cases {
+		data := make([]byte, c.length)
+		if s.WriteBlock(c.index, c.offset, data) == nil {
+			t.Fatalf("Case %d: expected write out of bounds to fail", i)
+		}
+		if s.ReadBlock(c.index, c.offset, data) == nil {
+			t.Fatalf("Case %d: expected read out of bounds to fail", i)
+		}
+	}
+}
+
+func testUnwritten(t *testing.T, open openFunc) {
+	os.RemoveAll(_CONFORMANCE_PATH)
+	os.MkdirAll(_CONFORMANCE_PATH, 0700)
+	data := conformanceData()
+	s := open(t, conformanceFiles, _CONFORMANCE_PIECE_LENGTH)
+	defer s.Close()
+
+	s.WriteBlock(0, 0, data[:_BLOCK_SIZE])
+	// Partly written, and never written across files
+	cases := []struct {
+		index  int
+		offset int
+		length int
+	}{
+		{0, _BLOCK_SIZE - 10, 20},
+		{1, 0, _CONFORMANCE_PIECE_LENGTH},
+		{3, 0, 100000 - 3*_CONFORMANCE_PIECE_LENGTH},
+	}
+	for i, c := range cases {
+		read := bytes.Repeat([]byte{0xff}, c.length)
+		if err := s.ReadBlock(c.index, c.offset, read); err != nil {
+			t.Fatalf("Case %d: failed to read unwritten data: %s", i, err)
+		}
+		expected := make([]byte, c.length)
+		if c.index == 0 {
+			copy(expected, data[c.offset:_BLOCK_SIZE])
+		}
+		if !bytes.Equal(read, expected) {
+			t.Fatalf("Case %d: expected unwritten data to read as zeros", i)
+		}
+	}
+}
+
+func testConcurrent(t *testing.T, open openFunc) {
+	data := conformanceData()
+	s := open(t, conformanceFiles, _CONFORMANCE_PIECE_LENGTH)
+	defer s.Close()
+
+	wg := sync.WaitGroup{}
+	for offset := 0; offset < len(data); offset += _BLOCK_SIZE {
+		end := offset + _BLOCK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		wg.Add(1)
+		go func(offset, end int) {
+			defer wg.Done()
+			err := s.WriteBlock(offset/_CONFORMANCE_PIECE_LENGTH, offset%_CONFORMANCE_PIECE_LENGTH, data[offset:end])
+			if err != nil {
+				t.Errorf("Failed to write block at %d: %s", offset, err)
+			}
+		}(offset, end)
+	}
+	wg.Wait()
+
+	checkAll(t, s, data)
+	if !s.Completion().Full() {
+		t.Fatalf("Expected all pieces to be complete. Got: %d", s.Completion().Count())
+	}
+}
+
+func testClose(t *testing.T, open openFunc) {
+	s := open(t, conformanceFiles, _CONFORMANCE_PIECE_LENGTH)
+	err := s.Close()
+	if err != nil {
+		t.Fatalf("Failed to close: %s", err)
+	}
+
+	data := make([]byte, 10)
+	if s.WriteBlock(0, 0, data) == nil {
+		t.Fatalf("Expected write after close to fail")
+	}
+	if s.ReadBlock(0, 0, data) == nil {
+		t.Fatalf("Expected read after close to fail")
+	}
+	if s.Flush() == nil {
+		t.Fatalf("Expected flush after close to fail")
+	}
+	if s.Close() != nil {
+		t.Fatalf("Expected closing twice to succeed")
+	}
+}
+
+func openBackend(backend Backend) openFunc {
+	return func(t *testing.T, files []*gobby.File, pieceLength int) Storage {
+		s, err := Open(backend, _CONFORMANCE_PATH, files, pieceLength)
+		if err != nil {
+			t.Fatalf("Failed to open %s storage: %s", backend, err)
+		}
+		return s
+	}
+}
+
+func TestFileStorageConformance(t *testing.T) {
+	testConformance(t, openBackend(BackendFile), true)
+}
+
+func TestMemoryStorageConformance(t *testing.T) {
+	testConformance(t, openBackend(BackendMemory), false)
+}
+
+func TestMmapStorageConformance(t *testing.T) {
+	testConformance(t, openBackend(BackendMmap), true)
+}
@@ -0,0 +1,383 @@
+package storage
+
+import (
+	"fmt"
+	"gobby"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	_MAX_OPEN_FILES = 32
+	// Handle index of the parts file
+	_PARTS_FILE      = -1
+	_PARTS_FILE_NAME = ".parts"
+)
+
+type fileHandle struct {
+	file     *os.File
+	refs     int
+	lastUsed time.Time
+	evicted  bool
+}
+
+// Writes pieces directly into the torrent's files, so partially downloaded files are readable
+// and there is nothing to compose at the end. Handles of recently used files are kept open.
+// Data of skipped files, e.g. of pieces straddling a skipped and a wanted file, goes to a sparse
+// parts file at its offset in the torrent instead, so skipped files are never created
+type FileStorage struct {
+	*layout
+	*completion
+	path      string
+	partsPath string
+
+	// Held for writing while files are skipped or unskipped
+	skipMx  sync.RWMutex
+	skipped []bool
+
+	handlesMx sync.Mutex
+	handles   map[int]*fileHandle
+	maxOpen   int
+	closed    bool
+}
+
+func NewFileStorage(path string, files []*gobby.File, pieceLength int) (*FileStorage, error) {
+	layout, err := newLayout(path, files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	// Empty files are never written to
+	for _, file := range layout.files {
+		if file.length == 0 {
+			err = createFile(file.path)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &FileStorage{
+		layout:     layout,
+		path:       path,
+		partsPath:  filepath.Join(path, _PARTS_FILE_NAME),
+		skipped:    make([]bool, len(layout.files)),
+		completion: newCompletion(layout),
+		handles:    make(map[int]*fileHandle),
+		maxOpen:    _MAX_OPEN_FILES,
+	}, nil
+}
+
+func createFile(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory for %s: %s", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create file %s: %s", path, err)
+	}
+	return f.Close()
+}
+
+func (s *FileStorage) WriteBlock(index, offset int, data []byte) error {
+	streamOffset, err := s.blockOffset(index, offset, len(data))
+	if err != nil {
+		return err
+	}
+	err = s.WriteAt(data, streamOffset)
+	if err != nil {
+		return err
+	}
+	s.completion.written(index, offset, len(data))
+	return nil
+}
+
+func (s *FileStorage) ReadBlock(index, offset int, data []byte) error {
+	streamOffset, err := s.blockOffset(index, offset, len(data))
+	if err != nil {
+		return err
+	}
+	return s.ReadAt(data, streamOffset)
+}
+
+// Must be called before anything is written
+func (s *FileStorage) SetPartsPath(path string) {
+	s.partsPath = path
+}
+
+func (s *FileStorage) PartsPath() string {
+	return s.partsPath
+}
+
+// Writes at an offset into the concatenation of all files
+func (s *FileStorage) WriteAt(data []byte, offset int64) error {
+	spans, err := s.spans(offset, len(data))
+	if err != nil {
+		return err
+	}
+
+	s.skipMx.RLock()
+	defer s.skipMx.RUnlock()
+	for _, span := range spans {
+		target, targetOffset := s.target(span)
+		err = s.writeTo(target, data[span.start:span.end], targetOffset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads at an offset into the concatenation of all files. Data that was never written reads as zeros
+func (s *FileStorage) ReadAt(data []byte, offset int64) error {
+	spans, err := s.spans(offset, len(data))
+	if err != nil {
+		return err
+	}
+
+	s.skipMx.RLock()
+	defer s.skipMx.RUnlock()
+	for _, span := range spans {
+		target, targetOffset := s.target(span)
+		err = s.readFrom(target, data[span.start:span.end], targetOffset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Where the span is stored. Must be called with the skip mutex held
+func (s *FileStorage) target(span *fileSpan) (int, int64) {
+	if s.skipped[span.file] {
+		return _PARTS_FILE, s.files[span.file].offset + span.fileOffset
+	}
+	return span.file, span.fileOffset
+}
+
+func (s *FileStorage) writeTo(index int, data []byte, offset int64) error {
+	handle, err := s.acquire(index, true)
+	if err != nil {
+		return err
+	}
+	_, err = handle.file.WriteAt(data, offset)
+	s.release(handle)
+	if err != nil {
+		return fmt.Errorf("Failed to write to %s: %s", s.handlePath(index), err)
+	}
+	return nil
+}
+
+// Files are not created for reading. Missing files and data past their end read as zeros
+func (s *FileStorage) readFrom(index int, data []byte, offset int64) error {
+	handle, err := s.acquire(index, false)
+	if err != nil {
+		return err
+	}
+	n := 0
+	if handle != nil {
+		n, err = handle.file.ReadAt(data, offset)
+		s.release(handle)
+	}
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("Failed to read from %s: %s", s.handlePath(index), err)
+	}
+	for i := n; i < len(data); i++ {
+		data[i] = 0
+	}
+	return nil
+}
+
+func (s *FileStorage) handlePath(index int) string {
+	if index == _PARTS_FILE {
+		return s.partsPath
+	}
+	return s.files[index].path
+}
+
+// Skipped files aren't created. Their data already written, e.g. of pieces that were started before, is moved
+// between the file and the parts file, so it stays readable. Existing files are left on disk when skipped
+func (s *FileStorage) SetFileSkipped(index int, skipped bool) error {
+	if index < 0 || index >= len(s.files) {
+		return fmt.Errorf("Invalid file index: %d", index)
+	}
+
+	s.skipMx.Lock()
+	defer s.skipMx.Unlock()
+	if s.skipped[index] == skipped {
+		return nil
+	}
+
+	file := s.files[index]
+	from, fromOffset, to, toOffset := index, int64(0), _PARTS_FILE, file.offset
+	if !skipped {
+		from, fromOffset, to, toOffset = _PARTS_FILE, file.offset, index, 0
+	}
+	_, err := os.Stat(s.handlePath(from))
+	if file.length > 0 && err == nil {
+		err = s.moveWritten(file, from, fromOffset, to, toOffset)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.skipped[index] = skipped
+	return nil
+}
+
+// Copies the parts of written pieces that fall into the file. Must be called with the skip mutex held
+func (s *FileStorage) moveWritten(file *fileEntry, from int, fromOffset int64, to int, toOffset int64) error {
+	complete := s.Completion()
+	partial := s.PartialBlocks()
+	pieceLength := int64(s.pieceLength)
+
+	for piece := file.offset / pieceLength; piece <= (file.offset+file.length-1)/pieceLength; piece++ {
+		if !complete.Has(int(piece)) && partial[int(piece)] == nil {
+			continue
+		}
+
+		start, end := piece*pieceLength, (piece+1)*pieceLength
+		if start < file.offset {
+			start = file.offset
+		}
+		if end > file.offset+file.length {
+			end = file.offset + file.length
+		}
+		data := make([]byte, end-start)
+
+		handle, err := s.acquire(from, true)
+		if err != nil {
+			return err
+		}
+		// Unwritten blocks of partial pieces may lie past the end
+		n, err := handle.file.ReadAt(data, start-file.offset+fromOffset)
+		s.release(handle)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Failed to read from %s: %s", s.handlePath(from), err)
+		}
+
+		if n > 0 {
+			err = s.writeTo(to, data[:n], start-file.offset+toOffset)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) Skipped(index int) bool {
+	s.skipMx.RLock()
+	defer s.skipMx.RUnlock()
+	return s.skipped[index]
+}
+
+// Returns nil if the file doesn't exist and mustn't be created
+func (s *FileStorage) acquire(index int, create bool) (*fileHandle, error) {
+	s.handlesMx.Lock()
+	defer s.handlesMx.Unlock()
+
+	if s.closed {
+		return nil, errClosed
+	}
+
+	handle, exists := s.handles[index]
+	if !exists {
+		if len(s.handles) >= s.maxOpen {
+			s.evict()
+		}
+
+		path := s.handlePath(index)
+		flags := os.O_RDWR
+		if create {
+			flags |= os.O_CREATE
+			err := os.MkdirAll(filepath.Dir(path), 0700)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to create directory for %s: %s", path, err)
+			}
+		}
+		f, err := os.OpenFile(path, flags, 0600)
+		if os.IsNotExist(err) && !create {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open %s: %s", path, err)
+		}
+		handle = &fileHandle{file: f}
+		s.handles[index] = handle
+	}
+
+	handle.refs++
+	handle.lastUsed = time.Now()
+	return handle, nil
+}
+
+func (s *FileStorage) release(handle *fileHandle) {
+	s.handlesMx.Lock()
+	handle.refs--
+	if handle.evicted && handle.refs == 0 {
+		handle.file.Close()
+	}
+	s.handlesMx.Unlock()
+}
+
+// Closes the least recently used handle. Must be called with the handles mutex held
+func (s *FileStorage) evict() {
+	// The parts file's index is negative, so it can't double as a sentinel
+	oldest, found := 0, false
+	for index, handle := range s.handles {
+		if !found || handle.lastUsed.Before(s.handles[oldest].lastUsed) {
+			oldest, found = index, true
+		}
+	}
+	if found {
+		s.evictIndex(oldest)
+	}
+}
+
+// Handles in use are closed once released. Must be called with the handles mutex held
+func (s *FileStorage) evictIndex(index int) {
+	handle := s.handles[index]
+	delete(s.handles, index)
+	handle.evicted = true
+	if handle.refs == 0 {
+		handle.file.Close()
+	}
+}
+
+// Syncs all open files to disk
+func (s *FileStorage) Flush() error {
+	s.handlesMx.Lock()
+	defer s.handlesMx.Unlock()
+
+	if s.closed {
+		return errClosed
+	}
+	var firstErr error
+	for index, handle := range s.handles {
+		err := handle.file.Sync()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Failed to sync %s: %s", s.handlePath(index), err)
+		}
+	}
+	return firstErr
+}
+
+func (s *FileStorage) Close() error {
+	err := s.Flush()
+	if err == errClosed {
+		return nil
+	}
+
+	s.handlesMx.Lock()
+	s.closed = true
+	for index := range s.handles {
+		s.evictIndex(index)
+	}
+	s.handlesMx.Unlock()
+	return err
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"fmt"
+	"gobby"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type fileEntry struct {
+	path   string
+	offset int64
+	length int64
+}
+
+// Part of a read or write falling into a single file
+type fileSpan struct {
+	file       int
+	fileOffset int64
+	start      int
+	end        int
+}
+
+// Maps pieces onto the torrent's files, which are treated as one contiguous stream
+type layout struct {
+	files       []*fileEntry
+	pieceLength int
+	totalLength int64
+}
+
+func newLayout(path string, files []*gobby.File, pieceLength int) (*layout, error) {
+	if pieceLength <= 0 {
+		return nil, fmt.Errorf("Invalid piece length: %d", pieceLength)
+	}
+
+	l := &layout{
+		files:       make([]*fileEntry, 0, len(files)),
+		pieceLength: pieceLength,
+	}
+	for _, file := range files {
+		fullPath, err := resolvePath(path, file.Path)
+		if err != nil {
+			return nil, err
+		}
+		l.files = append(l.files, &fileEntry{path: fullPath, offset: l.totalLength, length: int64(file.Length)})
+		l.totalLength += int64(file.Length)
+	}
+	return l, nil
+}
+
+// Joins the torrent's path with the download directory, refusing paths escaping it
+func resolvePath(directory, path string) (string, error) {
+	fullPath := filepath.Join(directory, path)
+	relative, err := filepath.Rel(directory, fullPath)
+	if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid file path: %s", path)
+	}
+	return fullPath, nil
+}
+
+func (l *layout) PieceCount() int {
+	return int((l.totalLength + int64(l.pieceLength) - 1) / int64(l.pieceLength))
+}
+
+func (l *layout) pieceSize(index int) int {
+	remaining := l.totalLength - int64(index)*int64(l.pieceLength)
+	if remaining < int64(l.pieceLength) {
+		return int(remaining)
+	}
+	return l.pieceLength
+}
+
+// Offset of a block in the stream of all files. The block has to lie within the piece
+func (l *layout) blockOffset(index, offset, length int) (int64, error) {
+	if index < 0 || index >= l.PieceCount() {
+		return 0, fmt.Errorf("Invalid piece index: %d", index)
+	}
+	if offset < 0 || length < 0 || offset+length > l.pieceSize(index) {
+		return 0, fmt.Errorf("Block %d+%d out of bounds of piece %d", offset, length, index)
+	}
+	return int64(index)*int64(l.pieceLength) + int64(offset), nil
+}
+
+// Splits a range of the stream into the parts falling into each file
+func (l *layout) spans(offset int64, length int) ([]*fileSpan, error) {
+	if offset < 0 || length < 0 || offset+int64(length) > l.totalLength {
+		return nil, fmt.Errorf("Range %d+%d out of bounds", offset, length)
+	}
+
+	// First file ending after the offset. Empty files are skipped that way
+	i := sort.Search(len(l.files), func(i int) bool {
+		return l.files[i].offset+l.files[i].length > offset
+	})
+
+	spans := make([]*fileSpan, 0, 1)
+	position := 0
+	for position < length {
+		file := l.files[i]
+		fileOffset := offset + int64(position) - file.offset
+		n := length - position
+		if remaining := file.length - fileOffset; int64(n) > remaining {
+			n = int(remaining)
+		}
+		if n > 0 {
+			spans = append(spans, &fileSpan{file: i, fileOffset: fileOffset, start: position, end: position + n})
+		}
+		position += n
+		i++
+	}
+	return spans, nil
+}
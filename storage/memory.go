@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"gobby"
+	"sync"
+)
+
+// Keeps all data in memory, for tests and ephemeral transfers. Pieces are allocated on first write
+type MemoryStorage struct {
+	*layout
+	*completion
+
+	mx     sync.RWMutex
+	pieces map[int][]byte
+	closed bool
+}
+
+func NewMemoryStorage(files []*gobby.File, pieceLength int) (*MemoryStorage, error) {
+	// Paths are only validated, nothing is written to disk
+	layout, err := newLayout(".", files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemoryStorage{
+		layout:     layout,
+		completion: newCompletion(layout),
+		pieces:     make(map[int][]byte),
+	}, nil
+}
+
+func (s *MemoryStorage) WriteBlock(index, offset int, data []byte) error {
+	_, err := s.blockOffset(index, offset, len(data))
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return errClosed
+	}
+	piece, exists := s.pieces[index]
+	if !exists {
+		piece = make([]byte, s.pieceSize(index))
+		s.pieces[index] = piece
+	}
+	copy(piece[offset:], data)
+	s.mx.Unlock()
+
+	s.completion.written(index, offset, len(data))
+	return nil
+}
+
+// Data that was never written reads as zeros
+func (s *MemoryStorage) ReadBlock(index, offset int, data []byte) error {
+	_, err := s.blockOffset(index, offset, len(data))
+	if err != nil {
+		return err
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return errClosed
+	}
+	piece, exists := s.pieces[index]
+	if !exists {
+		for i := range data {
+			data[i] = 0
+		}
+		return nil
+	}
+	copy(data, piece[offset:])
+	return nil
+}
+
+func (s *MemoryStorage) Flush() error {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return errClosed
+	}
+	return nil
+}
+
+// Releases the data
+func (s *MemoryStorage) Close() error {
+	s.mx.Lock()
+	s.closed = true
+	s.pieces = nil
+	s.mx.Unlock()
+	return nil
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"fmt"
+	"gobby"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Maps the torrent's files into memory. Files are extended to their full length up front,
+// sparsely where the file system supports it
+type MmapStorage struct {
+	*layout
+	*completion
+
+	// Held for writing only while unmapping
+	mx       sync.RWMutex
+	handles  []*os.File
+	mappings [][]byte
+	closed   bool
+}
+
+// Linux only. Other platforms fall back to regular file storage
+func NewMmapStorage(path string, files []*gobby.File, pieceLength int) (*MmapStorage, error) {
+	layout, err := newLayout(path, files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MmapStorage{
+		layout:     layout,
+		completion: newCompletion(layout),
+		handles:    make([]*os.File, len(layout.files)),
+		mappings:   make([][]byte, len(layout.files)),
+	}
+	for i, file := range layout.files {
+		err = s.mapFile(i, file)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *MmapStorage) mapFile(i int, file *fileEntry) error {
+	err := os.MkdirAll(filepath.Dir(file.path), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory for %s: %s", file.path, err)
+	}
+	f, err := os.OpenFile(file.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %s", file.path, err)
+	}
+	s.handles[i] = f
+	if file.length == 0 {
+		return nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Failed to stat %s: %s", file.path, err)
+	}
+	if info.Size() < file.length {
+		err = f.Truncate(file.length)
+		if err != nil {
+			return fmt.Errorf("Failed to extend %s: %s", file.path, err)
+		}
+	}
+
+	mapping, err := syscall.Mmap(int(f.Fd()), 0, int(file.length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("Failed to map %s: %s", file.path, err)
+	}
+	s.mappings[i] = mapping
+	return nil
+}
+
+func (s *MmapStorage) WriteBlock(index, offset int, data []byte) error {
+	err := s.copyBlock(index, offset, data, true)
+	if err != nil {
+		return err
+	}
+	s.completion.written(index, offset, len(data))
+	return nil
+}
+
+// Data that was never written reads as zeros
+func (s *MmapStorage) ReadBlock(index, offset int, data []byte) error {
+	return s.copyBlock(index, offset, data, false)
+}
+
+func (s *MmapStorage) copyBlock(index, offset int, data []byte, write bool) error {
+	streamOffset, err := s.blockOffset(index, offset, len(data))
+	if err != nil {
+		return err
+	}
+	spans, err := s.spans(streamOffset, len(data))
+	if err != nil {
+		return err
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return errClosed
+	}
+	for _, span := range spans {
+		mapped := s.mappings[span.file][span.fileOffset:]
+		if write {
+			copy(mapped, data[span.start:span.end])
+		} else {
+			copy(data[span.start:span.end], mapped)
+		}
+	}
+	return nil
+}
+
+// On Linux, syncing the file also writes back the dirty pages of its shared mappings
+func (s *MmapStorage) Flush() error {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return errClosed
+	}
+
+	for i, f := range s.handles {
+		err := f.Sync()
+		if err != nil {
+			return fmt.Errorf("Failed to sync %s: %s", s.files[i].path, err)
+		}
+	}
+	return nil
+}
+
+func (s *MmapStorage) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var firstErr error
+	for i, mapping := range s.mappings {
+		if mapping == nil {
+			continue
+		}
+		err := syscall.Munmap(mapping)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Failed to unmap %s: %s", s.files[i].path, err)
+		}
+	}
+	for _, f := range s.handles {
+		if f == nil {
+			continue
+		}
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.mappings = nil
+	s.handles = nil
+	return firstErr
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"gobby"
+)
+
+// Memory mapped storage is only implemented for Linux
+type MmapStorage struct {
+	*FileStorage
+}
+
+// Falls back to regular file storage on this platform
+func NewMmapStorage(path string, files []*gobby.File, pieceLength int) (*MmapStorage, error) {
+	fs, err := NewFileStorage(path, files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+	return &MmapStorage{fs}, nil
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"errors"
+	"gobby"
+	"gobby/bitfield"
+	"runtime"
+	"sync"
+)
+
+const (
+	_DEFAULT_CONCURRENT_READS = 2
+)
+
+var ErrRecheckCancelled = errors.New("Recheck cancelled")
+
+type RecheckOptions struct {
+	// Pieces to check. All pieces if nil
+	Indices []int
+	// Hashing goroutines. The number of CPUs by default
+	Workers int
+	// Concurrent reads from the storage. Spinning disks prefer few
+	Reads int
+	// Called after each checked piece, one call at a time
+	Progress func(checked, total int)
+	// Stops the recheck once closed
+	Cancel <-chan struct{}
+}
+
+// Hashes the stored pieces against the metafile's hashes, updating the storage's completion.
+// Returns the verified pieces, the downloader's starting point. Pieces that can't be read count as missing
+func Recheck(s Storage, pieces []*gobby.Piece, opts *RecheckOptions) (*bitfield.Bitfield, error) {
+	if opts == nil {
+		opts = &RecheckOptions{}
+	}
+	indices := opts.Indices
+	if indices == nil {
+		indices = make([]int, len(pieces))
+		for i := range indices {
+			indices[i] = i
+		}
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	reads := opts.Reads
+	if reads <= 0 {
+		reads = _DEFAULT_CONCURRENT_READS
+	}
+	maxLength := 0
+	for _, piece := range pieces {
+		if piece.Length > maxLength {
+			maxLength = piece.Length
+		}
+	}
+
+	have := bitfield.New(len(pieces))
+	indexCh := make(chan int)
+	readSlots := make(chan struct{}, reads)
+	var mx sync.Mutex
+	checked := 0
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, maxLength)
+
+			for index := range indexCh {
+				piece := pieces[index]
+				data := buffer[:piece.Length]
+
+				readSlots <- struct{}{}
+				err := s.ReadBlock(index, 0, data)
+				<-readSlots
+				verified := err == nil && piece.Verify(data)
+				s.SetComplete(index, verified)
+
+				mx.Lock()
+				if verified {
+					have.Set(index)
+				}
+				checked++
+				if opts.Progress != nil {
+					opts.Progress(checked, len(indices))
+				}
+				mx.Unlock()
+			}
+		}()
+	}
+
+	cancelled := false
+	for _, index := range indices {
+		select {
+		case indexCh <- index:
+		case <-opts.Cancel:
+			cancelled = true
+		}
+		if cancelled {
+			break
+		}
+	}
+	close(indexCh)
+	wg.Wait()
+
+	if cancelled {
+		return have, ErrRecheckCancelled
+	}
+	return have, nil
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"gobby"
+	"sync"
+	"testing"
+)
+
+func createRecheckStorage(t *testing.T, pieceCount int, corrupt map[int]bool) (Storage, []*gobby.Piece) {
+	pieceLength := _BLOCK_SIZE
+	files := []*gobby.File{&gobby.File{Length: pieceLength * pieceCount, Path: "file"}}
+	s, err := NewMemoryStorage(files, pieceLength)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %s", err)
+	}
+
+	pieces := make([]*gobby.Piece, pieceCount)
+	for i := range pieces {
+		data := make([]byte, pieceLength)
+		for j := range data {
+			data[j] = byte(i + j)
+		}
+		hash := sha1.Sum(data)
+		pieces[i] = &gobby.Piece{Index: i, Length: pieceLength, Hash: hash[:]}
+
+		if corrupt[i] {
+			data[0]++
+		}
+		s.WriteBlock(i, 0, data)
+	}
+	return s, pieces
+}
+
+func TestRecheck(t *testing.T) {
+	corrupt := map[int]bool{3: true, 17: true}
+	s, pieces := createRecheckStorage(t, 20, corrupt)
+
+	var mx sync.Mutex
+	calls, last := 0, 0
+	have, err := Recheck(s, pieces, &RecheckOptions{
+		Workers: 4,
+		Reads:   2,
+		Progress: func(checked, total int) {
+			mx.Lock()
+			calls++
+			if checked != last+1 || total != 20 {
+				t.Errorf("Expected progress %d of 20. Got: %d of %d", last+1, checked, total)
+			}
+			last = checked
+			mx.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to recheck: %s", err)
+	}
+	if calls != 20 {
+		t.Fatalf("Expected 20 progress calls. Got: %d", calls)
+	}
+	for i := range pieces {
+		if have.Has(i) == corrupt[i] {
+			t.Fatalf("Expected piece %d verified: %v", i, !corrupt[i])
+		}
+	}
+	if !s.Completion().Has(0) || s.Completion().Has(3) {
+		t.Fatalf("Expected storage completion to be updated")
+	}
+}
+
+func TestRecheckIndices(t *testing.T) {
+	s, pieces := createRecheckStorage(t, 10, nil)
+
+	have, err := Recheck(s, pieces, &RecheckOptions{Indices: []int{2, 5}})
+	if err != nil {
+		t.Fatalf("Failed to recheck: %s", err)
+	}
+	if have.Count() != 2 || !have.Has(2) || !have.Has(5) {
+		t.Fatalf("Expected only pieces 2 and 5 to be checked. Got: %v", have.Bytes())
+	}
+}
+
+func TestRecheckCancel(t *testing.T) {
+	s, pieces := createRecheckStorage(t, 100, nil)
+	cancel := make(chan struct{})
+	checked := 0
+
+	have, err := Recheck(s, pieces, &RecheckOptions{
+		Workers: 1,
+		Cancel:  cancel,
+		Progress: func(c, total int) {
+			checked = c
+			if c == 5 {
+				close(cancel)
+			}
+		},
+	})
+	if err != ErrRecheckCancelled {
+		t.Fatalf("Expected %s. Got: %v", ErrRecheckCancelled, err)
+	}
+	if checked == 100 || have.Count() != checked {
+		t.Fatalf("Expected recheck to stop early. Checked: %d. Verified: %d", checked, have.Count())
+	}
+}
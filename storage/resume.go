@@ -0,0 +1,396 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gobby"
+	"gobby/bencoding"
+	"gobby/bitfield"
+	"gobby/logs"
+	"gobby/stats"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	_RESUME_INTERVAL = time.Minute * 5
+)
+
+// Implemented by storages that can leave files out, e.g. FileStorage
+type SkipTracker interface {
+	Skipped(index int) bool
+	SetFileSkipped(index int, skipped bool) error
+	// Where data of skipped files is kept
+	PartsPath() string
+}
+
+// Metadata of a file when resume data was saved. Missing files have a size of -1
+type FileState struct {
+	Size int64
+	// Unix nanoseconds
+	ModTime int64
+	// Skipped files are validated by the parts file instead
+	Skipped bool
+}
+
+// Progress of a torrent, saved so a restart doesn't require hashing all data again.
+// Pieces are assembled in memory and only written once verified, so incomplete pieces aren't saved
+type ResumeData struct {
+	InfoHash []byte
+	// Verified pieces
+	Have  *bitfield.Bitfield
+	Files []*FileState
+	// The parts file of storages that skip files, nil otherwise
+	Parts *FileState
+	// Known peers, to be added as candidates again after a restart
+	Peers []string
+	// Totals carried over into the next session
+	Downloaded int64
+	Uploaded   int64
+}
+
+func (r *ResumeData) Encode() ([]byte, error) {
+	files := make([]interface{}, len(r.Files))
+	for i, file := range r.Files {
+		files[i] = encodeFileState(file)
+	}
+	peers := make([]interface{}, len(r.Peers))
+	for i, peer := range r.Peers {
+		peers[i] = peer
+	}
+
+	encoded := map[string]interface{}{
+		"info hash":   r.InfoHash,
+		"piece count": r.Have.Len(),
+		"pieces":      r.Have.Bytes(),
+		"files":       files,
+		"peers":       peers,
+		"downloaded":  int(r.Downloaded),
+		"uploaded":    int(r.Uploaded),
+	}
+	if r.Parts != nil {
+		encoded["parts"] = encodeFileState(r.Parts)
+	}
+	return bencoding.Encode(encoded)
+}
+
+func encodeFileState(file *FileState) map[string]interface{} {
+	skipped := 0
+	if file.Skipped {
+		skipped = 1
+	}
+	return map[string]interface{}{
+		"size":    int(file.Size),
+		"mtime":   int(file.ModTime),
+		"skipped": skipped,
+	}
+}
+
+func decodeFileState(_file interface{}) (*FileState, bool) {
+	file, ok := _file.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	size, ok1 := file["size"].(int)
+	modTime, ok2 := file["mtime"].(int)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	// Absent in resume data saved before files could be skipped
+	skipped, _ := file["skipped"].(int)
+	return &FileState{Size: int64(size), ModTime: int64(modTime), Skipped: skipped == 1}, true
+}
+
+func DecodeResumeData(data []byte) (*ResumeData, error) {
+	_decoded, err := bencoding.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode resume data: %s", err)
+	}
+	decoded, ok := _decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Invalid resume data")
+	}
+
+	infoHash, ok := decoded["info hash"].([]byte)
+	if !ok {
+		return nil, errors.New("Invalid field: info hash")
+	}
+	pieceCount, ok := decoded["piece count"].(int)
+	if !ok {
+		return nil, errors.New("Invalid field: piece count")
+	}
+	pieces, ok := decoded["pieces"].([]byte)
+	if !ok {
+		return nil, errors.New("Invalid field: pieces")
+	}
+	have, err := bitfield.FromBytes(pieces, pieceCount)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid field: pieces: %s", err)
+	}
+	downloaded, _ := decoded["downloaded"].(int)
+	uploaded, _ := decoded["uploaded"].(int)
+
+	r := &ResumeData{
+		InfoHash:   infoHash,
+		Have:       have,
+		Files:      make([]*FileState, 0),
+		Peers:      make([]string, 0),
+		Downloaded: int64(downloaded),
+		Uploaded:   int64(uploaded),
+	}
+
+	files, ok := decoded["files"].([]interface{})
+	if !ok {
+		return nil, errors.New("Invalid field: files")
+	}
+	for _, _file := range files {
+		file, ok := decodeFileState(_file)
+		if !ok {
+			return nil, errors.New("Invalid field: files")
+		}
+		r.Files = append(r.Files, file)
+	}
+	if _parts, exists := decoded["parts"]; exists {
+		r.Parts, ok = decodeFileState(_parts)
+		if !ok {
+			return nil, errors.New("Invalid field: parts")
+		}
+	}
+
+	peers, _ := decoded["peers"].([]interface{})
+	for _, _peer := range peers {
+		if peer, ok := _peer.([]byte); ok {
+			r.Peers = append(r.Peers, string(peer))
+		}
+	}
+
+	return r, nil
+}
+
+func LoadResumeData(path string) (*ResumeData, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read resume data: %s", err)
+	}
+	return DecodeResumeData(data)
+}
+
+// Replaces the file atomically, so a crash while saving keeps the previous resume data
+func SaveResumeData(path string, r *ResumeData) error {
+	data, err := r.Encode()
+	if err != nil {
+		return fmt.Errorf("Failed to encode resume data: %s", err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Failed to create resume data file: %s", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Failed to write resume data: %s", err)
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Failed to replace resume data: %s", err)
+	}
+	return nil
+}
+
+// Snapshot of the verified pieces, skipped files, the files' metadata, the known peers and the transfer totals.
+// The storage is flushed first, so the modification times cover everything written
+func CaptureResumeData(s Storage, have *bitfield.Bitfield, path string, metafile *gobby.Metafile, peers []string, current *stats.CurrentStats) (*ResumeData, error) {
+	layout, err := newLayout(path, metafile.Files, metafile.Pieces[0].Length)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ResumeData{
+		InfoHash:   metafile.InfoHash,
+		Have:       have.Copy(),
+		Files:      make([]*FileState, len(layout.files)),
+		Peers:      append([]string{}, peers...),
+		Downloaded: int64(current.Downloaded),
+		Uploaded:   int64(current.Uploaded),
+	}
+	skips, _ := s.(SkipTracker)
+	for i, file := range layout.files {
+		r.Files[i] = statFile(file.path)
+		r.Files[i].Skipped = skips != nil && skips.Skipped(i)
+	}
+	if skips != nil {
+		r.Parts = statFile(skips.PartsPath())
+	}
+	return r, nil
+}
+
+func statFile(path string) *FileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return &FileState{Size: -1}
+	}
+	return &FileState{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+}
+
+// Restores the progress saved in the resume data into the storage and returns the verified pieces.
+// Resume data is trusted for pieces whose files didn't change since it was saved. Pieces overlapping
+// changed files are hashed instead, pieces overlapping missing files are dropped. Skipped files are
+// skipped in the storage again and checked by the parts file holding their data.
+// Without valid resume data, every piece is hashed
+func Resume(s Storage, r *ResumeData, path string, metafile *gobby.Metafile) (*bitfield.Bitfield, error) {
+	layout, err := newLayout(path, metafile.Files, metafile.Pieces[0].Length)
+	if err != nil {
+		return nil, err
+	}
+	pieceCount := len(metafile.Pieces)
+
+	valid := r != nil && bytes.Equal(r.InfoHash, metafile.InfoHash) &&
+		r.Have.Len() == pieceCount && len(r.Files) == len(layout.files)
+	if r != nil && !valid {
+		logs.Warn("Storage", "Resume data doesn't match torrent %x. Checking all pieces", metafile.InfoHash)
+	}
+
+	skips, _ := s.(SkipTracker)
+	if valid && skips != nil {
+		for i, file := range r.Files {
+			if file.Skipped {
+				err = skips.SetFileSkipped(i, true)
+				if err != nil {
+					return nil, fmt.Errorf("Failed to skip file %d: %s", i, err)
+				}
+			}
+		}
+	}
+
+	missing := make([]bool, len(layout.files))
+	changed := make([]bool, len(layout.files))
+	for i, file := range layout.files {
+		state, saved := statFile(file.path), (*FileState)(nil)
+		if valid {
+			saved = r.Files[i]
+		}
+		if skips != nil && skips.Skipped(i) {
+			state = statFile(skips.PartsPath())
+			if valid {
+				saved = r.Parts
+			}
+		}
+		missing[i] = state.Size == -1
+		changed[i] = saved == nil || state.Size != saved.Size || state.ModTime != saved.ModTime
+	}
+
+	have := bitfield.New(pieceCount)
+	toCheck := make([]int, 0)
+	for index := 0; index < pieceCount; index++ {
+		spans, err := layout.spans(int64(index)*int64(layout.pieceLength), layout.pieceSize(index))
+		if err != nil {
+			return nil, err
+		}
+		pieceMissing, pieceChanged := false, false
+		for _, span := range spans {
+			pieceMissing = pieceMissing || missing[span.file]
+			pieceChanged = pieceChanged || changed[span.file]
+		}
+
+		switch {
+		case pieceMissing:
+			s.SetComplete(index, false)
+		case pieceChanged:
+			toCheck = append(toCheck, index)
+		case r.Have.Has(index):
+			have.Set(index)
+			s.SetComplete(index, true)
+		default:
+			s.SetComplete(index, false)
+		}
+	}
+
+	if len(toCheck) == 0 {
+		return have, nil
+	}
+	logs.Info("Storage", "Hashing %d of %d pieces of %x", len(toCheck), pieceCount, metafile.InfoHash)
+	verified, err := Recheck(s, metafile.Pieces, &RecheckOptions{Indices: toCheck})
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range toCheck {
+		if verified.Has(index) {
+			have.Set(index)
+		}
+	}
+	return have, nil
+}
+
+// Saves resume data periodically and once more when stopped
+type ResumeSaver struct {
+	path    string
+	capture func() (*ResumeData, error)
+
+	mx       sync.Mutex
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func NewResumeSaver(path string, capture func() (*ResumeData, error)) *ResumeSaver {
+	return &ResumeSaver{
+		path:    path,
+		capture: capture,
+		stopCh:  make(chan struct{}),
+	}
+}
+
+func (r *ResumeSaver) Save() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	data, err := r.capture()
+	if err != nil {
+		return fmt.Errorf("Failed to capture resume data: %s", err)
+	}
+	return SaveResumeData(r.path, data)
+}
+
+func (r *ResumeSaver) Run() {
+	ticker := time.NewTicker(_RESUME_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := r.Save()
+			if err != nil {
+				logs.Warn("Storage", "Failed to save resume data to %s: %s", r.path, err)
+			}
+		case <-r.stopCh:
+			return
+		}
+	}
+}
+
+// Saves the final resume data. Intended to be called at shutdown, before the storage is closed
+func (r *ResumeSaver) Stop() error {
+	var err error
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+		err = r.Save()
+	})
+	return err
+}
@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"gobby"
+	"gobby/bitfield"
+	"gobby/stats"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const _RESUME_PATH = "/tmp/gobby/resume_tests/"
+
+// Two files of 1.5 pieces each, so piece 1 straddles both
+func createResumeTorrent(t *testing.T) (*gobby.Metafile, []byte) {
+	os.RemoveAll(_RESUME_PATH)
+	os.MkdirAll(_RESUME_PATH, 0700)
+
+	pieceLength := _BLOCK_SIZE * 2
+	data := make([]byte, pieceLength*3)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	metafile := &gobby.Metafile{
+		InfoHash: []byte("01234567890123456789"),
+		Files: []*gobby.File{
+			&gobby.File{Length: pieceLength * 3 / 2, Path: "file0"},
+			&gobby.File{Length: pieceLength * 3 / 2, Path: "file1"},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		hash := sha1.Sum(data[i*pieceLength : (i+1)*pieceLength])
+		metafile.Pieces = append(metafile.Pieces, &gobby.Piece{Index: i, Length: pieceLength, Hash: hash[:]})
+	}
+	return metafile, data
+}
+
+func openResumeStorage(t *testing.T, metafile *gobby.Metafile) Storage {
+	s, err := Open(BackendFile, _RESUME_PATH, metafile.Files, metafile.Pieces[0].Length)
+	if err != nil {
+		t.Fatalf("Failed to open storage: %s", err)
+	}
+	return s
+}
+
+func writePiece(t *testing.T, s Storage, metafile *gobby.Metafile, data []byte, index int) {
+	length := metafile.Pieces[0].Length
+	err := s.WriteBlock(index, 0, data[index*length:(index+1)*length])
+	if err != nil {
+		t.Fatalf("Failed to write piece %d: %s", index, err)
+	}
+}
+
+func TestResumeDataEncoding(t *testing.T) {
+	have := bitfield.New(10)
+	have.Set(3)
+	have.Set(9)
+	r := &ResumeData{
+		InfoHash:   []byte("01234567890123456789"),
+		Have:       have,
+		Files:      []*FileState{&FileState{Size: 100, ModTime: time.Now().UnixNano()}, &FileState{Size: -1, Skipped: true}},
+		Parts:      &FileState{Size: 50, ModTime: time.Now().UnixNano()},
+		Peers:      []string{"192.0.2.1:6881"},
+		Downloaded: 1 << 40,
+		Uploaded:   12345,
+	}
+
+	encoded, err := r.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode: %s", err)
+	}
+	decoded, err := DecodeResumeData(encoded)
+	if err != nil {
+		t.Fatalf("Failed to decode: %s", err)
+	}
+
+	if string(decoded.InfoHash) != string(r.InfoHash) || !decoded.Have.Has(3) || !decoded.Have.Has(9) || decoded.Have.Count() != 2 {
+		t.Fatalf("Expected info hash and pieces to match")
+	}
+	if len(decoded.Files) != 2 || *decoded.Files[0] != *r.Files[0] || *decoded.Files[1] != *r.Files[1] {
+		t.Fatalf("Expected file states to match")
+	}
+	if decoded.Parts == nil || *decoded.Parts != *r.Parts {
+		t.Fatalf("Expected parts file state to match")
+	}
+	if len(decoded.Peers) != 1 || decoded.Peers[0] != r.Peers[0] || decoded.Downloaded != r.Downloaded || decoded.Uploaded != r.Uploaded {
+		t.Fatalf("Expected peers and stats to match")
+	}
+
+	if _, err := DecodeResumeData([]byte("d4:infoi1ee")); err == nil {
+		t.Fatalf("Expected invalid resume data to fail")
+	}
+}
+
+func TestResumeWithoutResumeData(t *testing.T) {
+	metafile, data := createResumeTorrent(t)
+	s := openResumeStorage(t, metafile)
+	writePiece(t, s, metafile, data, 0)
+	writePiece(t, s, metafile, data, 2)
+	// Corrupt piece
+	s.WriteBlock(1, 0, make([]byte, metafile.Pieces[0].Length))
+	s.Close()
+
+	s = openResumeStorage(t, metafile)
+	defer s.Close()
+	have, err := Resume(s, nil, _RESUME_PATH, metafile)
+	if err != nil {
+		t.Fatalf("Failed to resume: %s", err)
+	}
+	if !have.Has(0) || have.Has(1) || !have.Has(2) {
+		t.Fatalf("Expected pieces 0 and 2 to be verified. Got: %v", have.Bytes())
+	}
+	if completion := s.Completion(); !completion.Has(0) || completion.Has(1) {
+		t.Fatalf("Expected storage completion to match")
+	}
+}
+
+func TestResumeTrustsUnchangedFiles(t *testing.T) {
+	metafile, data := createResumeTorrent(t)
+	s := openResumeStorage(t, metafile)
+	writePiece(t, s, metafile, data, 0)
+	// Half of piece 2, so the second file exists
+	s.WriteBlock(2, 0, data[metafile.Pieces[0].Length*2:metafile.Pieces[0].Length*2+_BLOCK_SIZE])
+
+	have := bitfield.New(3)
+	have.Set(0)
+	peers := []string{"192.0.2.1:6881"}
+	r, err := CaptureResumeData(s, have, _RESUME_PATH, metafile, peers, &stats.CurrentStats{Downloaded: 300, Uploaded: 20})
+	if err != nil {
+		t.Fatalf("Failed to capture resume data: %s", err)
+	}
+	s.Close()
+	if r.Files[0].Size != int64(metafile.Pieces[0].Length) {
+		t.Fatalf("Expected file state to be captured")
+	}
+	if len(r.Peers) != 1 || r.Peers[0] != peers[0] || r.Downloaded != 300 || r.Uploaded != 20 {
+		t.Fatalf("Expected peers and stats to be captured. Got: %v, %d, %d", r.Peers, r.Downloaded, r.Uploaded)
+	}
+
+	// Claimed, but never written. Trusted since the files are unchanged
+	r.Have.Set(1)
+	s = openResumeStorage(t, metafile)
+	resumed, err := Resume(s, r, _RESUME_PATH, metafile)
+	if err != nil {
+		t.Fatalf("Failed to resume: %s", err)
+	}
+	if !resumed.Has(0) || !resumed.Has(1) || resumed.Has(2) {
+		t.Fatalf("Expected resume data to be trusted. Got: %v", resumed.Bytes())
+	}
+	s.Close()
+
+	// Piece 1 straddles both files, so changing the second one only hashes pieces 1 and 2
+	file1 := filepath.Join(_RESUME_PATH, "file1")
+	os.Chtimes(file1, time.Now(), time.Now().Add(time.Hour))
+	s = openResumeStorage(t, metafile)
+	defer s.Close()
+	resumed, err = Resume(s, r, _RESUME_PATH, metafile)
+	if err != nil {
+		t.Fatalf("Failed to resume: %s", err)
+	}
+	if !resumed.Has(0) || resumed.Has(1) || resumed.Has(2) {
+		t.Fatalf("Expected pieces of the changed file to be hashed. Got: %v", resumed.Bytes())
+	}
+}
+
+func TestResumeMissingFile(t *testing.T) {
+	metafile, data := createResumeTorrent(t)
+	s := openResumeStorage(t, metafile)
+	for i := 0; i < 3; i++ {
+		writePiece(t, s, metafile, data, i)
+	}
+	r, _ := CaptureResumeData(s, s.Completion(), _RESUME_PATH, metafile, nil, &stats.CurrentStats{})
+	s.Close()
+
+	os.Remove(filepath.Join(_RESUME_PATH, "file0"))
+	s = openResumeStorage(t, metafile)
+	defer s.Close()
+	have, err := Resume(s, r, _RESUME_PATH, metafile)
+	if err != nil {
+		t.Fatalf("Failed to resume: %s", err)
+	}
+	if have.Has(0) || have.Has(1) || !have.Has(2) {
+		t.Fatalf("Expected only piece 2 to remain. Got: %v", have.Bytes())
+	}
+}
+
+func TestResumeSkippedFile(t *testing.T) {
+	metafile, data := createResumeTorrent(t)
+	s := openResumeStorage(t, metafile)
+	err := s.(SkipTracker).SetFileSkipped(0, true)
+	if err != nil {
+		t.Fatalf("Failed to skip file: %s", err)
+	}
+	// Piece 1 straddles the skipped and the wanted file
+	writePiece(t, s, metafile, data, 1)
+	writePiece(t, s, metafile, data, 2)
+	have := bitfield.New(3)
+	have.Set(1)
+	have.Set(2)
+	r, err := CaptureResumeData(s, have, _RESUME_PATH, metafile, nil, &stats.CurrentStats{})
+	if err != nil {
+		t.Fatalf("Failed to capture resume data: %s", err)
+	}
+	s.Close()
+	if !r.Files[0].Skipped || r.Files[1].Skipped || r.Parts == nil || r.Parts.Size == -1 {
+		t.Fatalf("Expected skipped file and parts file to be captured")
+	}
+
+	s = openResumeStorage(t, metafile)
+	resumed, err := Resume(s, r, _RESUME_PATH, metafile)
+	if err != nil {
+		t.Fatalf("Failed to resume: %s", err)
+	}
+	if resumed.Has(0) || !resumed.Has(1) || !resumed.Has(2) {
+		t.Fatalf("Expected straddling piece to be kept. Got: %v", resumed.Bytes())
+	}
+	if !s.(SkipTracker).Skipped(0) || s.(SkipTracker).Skipped(1) {
+		t.Fatalf("Expected file 0 to be skipped again")
+	}
+	if _, err := os.Stat(filepath.Join(_RESUME_PATH, "file0")); !os.IsNotExist(err) {
+		t.Fatalf("Expected skipped file not to be created. Got: %v", err)
+	}
+	length := metafile.Pieces[0].Length
+	piece := make([]byte, length)
+	err = s.ReadBlock(1, 0, piece)
+	if err != nil || string(piece) != string(data[length:length*2]) {
+		t.Fatalf("Expected straddling piece to be readable. Got: %v", err)
+	}
+	s.Close()
+
+	// Without the parts file, the straddling piece is gone
+	os.Remove(filepath.Join(_RESUME_PATH, _PARTS_FILE_NAME))
+	s = openResumeStorage(t, metafile)
+	defer s.Close()
+	resumed, err = Resume(s, r, _RESUME_PATH, metafile)
+	if err != nil {
+		t.Fatalf("Failed to resume: %s", err)
+	}
+	if resumed.Has(1) || !resumed.Has(2) {
+		t.Fatalf("Expected only piece 2 to remain. Got: %v", resumed.Bytes())
+	}
+}
+
+func TestResumeSaver(t *testing.T) {
+	metafile, _ := createResumeTorrent(t)
+	path := filepath.Join(_RESUME_PATH, "torrent.resume")
+	have := bitfield.New(3)
+	have.Set(2)
+
+	saver := NewResumeSaver(path, func() (*ResumeData, error) {
+		return &ResumeData{InfoHash: metafile.InfoHash, Have: have, Files: []*FileState{}}, nil
+	})
+	go saver.Run()
+	err := saver.Stop()
+	if err != nil {
+		t.Fatalf("Failed to save resume data: %s", err)
+	}
+
+	r, err := LoadResumeData(path)
+	if err != nil {
+		t.Fatalf("Failed to load resume data: %s", err)
+	}
+	if !r.Have.Has(2) || r.Have.Count() != 1 {
+		t.Fatalf("Expected saved pieces to be loaded")
+	}
+	if matches, _ := filepath.Glob(path + ".tmp*"); len(matches) != 0 {
+		t.Fatalf("Expected no temporary files. Got: %v", matches)
+	}
+}
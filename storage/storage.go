@@ -114,8 +114,7 @@ func (dh *DirectoryHandler) retrieveAndSendPiece(index int) {
 }
 
 // Blocking operation, intended to be executed once per download process
-// Assumes clean directory
-// TODO - support continuation between different invocations and preparation if needed
+// Assumes clean directory. FileStorage together with resume data continues across invocations without composing
 func (dh *DirectoryHandler) ComposeFiles(fileInfos []*gobby.File) error {
 	indexes, err := listExistingIndexes(dh.piecesPath)
 	if err != nil {
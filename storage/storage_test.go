@@ -178,3 +178,217 @@ func BenchmarkRetrieve(b *testing.B) {
 		<-resCh
 	}
 }
+
+func createFileStorage(t *testing.T, fileInfos []*gobby.File, pieceLength int) *FileStorage {
+	path := "/tmp/gobby/file_storage_tests/"
+	os.RemoveAll(path)
+	os.MkdirAll(path, 0700)
+	storage, err := NewFileStorage(path, fileInfos, pieceLength)
+	if err != nil {
+		t.Fatalf("Failed to create file storage: %s", err)
+	}
+	return storage
+}
+
+func TestFileStorageLayout(t *testing.T) {
+	fileInfos := []*gobby.File{
+		&gobby.File{Length: 7, Path: "dir0/file0.txt"},
+		&gobby.File{Length: 0, Path: "dir0/empty.txt"},
+		&gobby.File{Length: 5, Path: "/dir0/file1.txt"},
+		&gobby.File{Length: 28, Path: "file2.txt"},
+		&gobby.File{Length: 16, Path: "dir1/file3.txt"},
+	}
+	storage := createFileStorage(t, fileInfos, 10)
+	defer storage.Close()
+
+	if storage.PieceCount() != 6 {
+		t.Fatalf("Expected 6 pieces. Got: %d", storage.PieceCount())
+	}
+	for i := 0; i < 6; i++ {
+		length := 10
+		if i == 5 {
+			length = 6
+		}
+		err := storage.WriteBlock(i, 0, bytes.Repeat([]byte{byte(i)}, length))
+		if err != nil {
+			t.Fatalf("Failed to write piece %d: %s", i, err)
+		}
+	}
+
+	expectedContents := map[string][]byte{
+		"dir0/file0.txt": {0, 0, 0, 0, 0, 0, 0},
+		"dir0/empty.txt": {},
+		"dir0/file1.txt": {0, 0, 0, 1, 1},
+		"file2.txt":      {1, 1, 1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3},
+		"dir1/file3.txt": {4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 5, 5, 5, 5, 5, 5},
+	}
+	for name, expected := range expectedContents {
+		content, err := ioutil.ReadFile(filepath.Join(storage.path, name))
+		if err != nil {
+			t.Fatalf("Failed to read file content. Err: %s", err)
+		}
+		if !bytes.Equal(content, expected) {
+			t.Fatalf("Expected %s content: %v. Got: %v", name, expected, content)
+		}
+	}
+}
+
+func TestFileStoragePartialFiles(t *testing.T) {
+	fileInfos := []*gobby.File{
+		&gobby.File{Length: 15, Path: "file0"},
+		&gobby.File{Length: 15, Path: "file1"},
+	}
+	storage := createFileStorage(t, fileInfos, 10)
+	defer storage.Close()
+
+	err := storage.WriteBlock(0, 0, bytes.Repeat([]byte{1}, 10))
+	if err != nil {
+		t.Fatalf("Failed to write piece: %s", err)
+	}
+	err = storage.Flush()
+	if err != nil {
+		t.Fatalf("Failed to flush: %s", err)
+	}
+
+	// Readable before the download completes
+	content, err := ioutil.ReadFile(filepath.Join(storage.path, "file0"))
+	if err != nil || !bytes.Equal(content, bytes.Repeat([]byte{1}, 10)) {
+		t.Fatalf("Expected partial file content. Got: %v, %v", content, err)
+	}
+	missing := bytes.Repeat([]byte{1}, 10)
+	if err := storage.ReadBlock(2, 0, missing); err != nil || !bytes.Equal(missing, make([]byte, 10)) {
+		t.Fatalf("Expected a missing piece to read as zeros. Got: %v, %v", missing, err)
+	}
+}
+
+func TestFileStorageHandleCache(t *testing.T) {
+	fileInfos := make([]*gobby.File, 10)
+	for i := range fileInfos {
+		fileInfos[i] = &gobby.File{Length: 4, Path: fmt.Sprintf("file%d", i)}
+	}
+	storage := createFileStorage(t, fileInfos, 8)
+	storage.maxOpen = 3
+
+	for i := 0; i < storage.PieceCount(); i++ {
+		err := storage.WriteBlock(i, 0, bytes.Repeat([]byte{byte(i)}, 8))
+		if err != nil {
+			t.Fatalf("Failed to write piece %d: %s", i, err)
+		}
+		if len(storage.handles) > 3 {
+			t.Fatalf("Expected at most 3 open files. Got: %d", len(storage.handles))
+		}
+	}
+	for i := 0; i < storage.PieceCount(); i++ {
+		data := make([]byte, 8)
+		err := storage.ReadBlock(i, 0, data)
+		if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{byte(i)}, 8)) {
+			t.Fatalf("Expected piece %d to be readable. Got: %v, %v", i, data, err)
+		}
+	}
+
+	storage.Close()
+	if len(storage.handles) != 0 {
+		t.Fatalf("Expected all files to be closed. Got: %d", len(storage.handles))
+	}
+}
+
+func TestInvalidPath(t *testing.T) {
+	fileInfos := []*gobby.File{&gobby.File{Length: 4, Path: "../outside"}}
+	for _, backend := range []Backend{BackendFile, BackendMemory, BackendMmap} {
+		if _, err := Open(backend, "/tmp/gobby/file_storage_tests/", fileInfos, 4); err == nil {
+			t.Fatalf("Expected path escaping the directory to fail for %s storage", backend)
+		}
+	}
+}
+
+func TestFileStorageSkippedFiles(t *testing.T) {
+	fileInfos := []*gobby.File{
+		&gobby.File{Length: 15, Path: "file0"},
+		&gobby.File{Length: 15, Path: "file1"},
+	}
+	storage := createFileStorage(t, fileInfos, 10)
+	defer storage.Close()
+
+	err := storage.SetFileSkipped(0, true)
+	if err != nil {
+		t.Fatalf("Failed to skip file: %s", err)
+	}
+	// Piece 1 straddles the skipped and the wanted file
+	data := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	err = storage.WriteBlock(1, 0, data)
+	if err != nil {
+		t.Fatalf("Failed to write piece: %s", err)
+	}
+	storage.SetComplete(1, true)
+
+	if _, err := os.Stat(filepath.Join(storage.path, "file0")); !os.IsNotExist(err) {
+		t.Fatalf("Expected skipped file not to be created. Got: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(storage.path, "file1"))
+	if err != nil || !bytes.Equal(content, data[5:]) {
+		t.Fatalf("Expected wanted part in file1. Got: %v, %v", content, err)
+	}
+	read := make([]byte, 10)
+	err = storage.ReadBlock(1, 0, read)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("Expected straddling piece to be readable. Got: %v, %v", read, err)
+	}
+
+	err = storage.SetFileSkipped(0, false)
+	if err != nil {
+		t.Fatalf("Failed to unskip file: %s", err)
+	}
+	err = storage.Flush()
+	if err != nil {
+		t.Fatalf("Failed to flush: %s", err)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(storage.path, "file0"))
+	if err != nil || !bytes.Equal(content[10:], data[:5]) {
+		t.Fatalf("Expected data moved into file0. Got: %v, %v", content, err)
+	}
+	err = storage.ReadBlock(1, 0, read)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("Expected piece to stay readable. Got: %v, %v", read, err)
+	}
+	if err := storage.SetFileSkipped(2, true); err == nil {
+		t.Fatalf("Expected invalid file index to fail")
+	}
+}
+
+func TestFileStorageHandleCacheWithParts(t *testing.T) {
+	fileInfos := make([]*gobby.File, 6)
+	for i := range fileInfos {
+		fileInfos[i] = &gobby.File{Length: 4, Path: fmt.Sprintf("file%d", i)}
+	}
+	storage := createFileStorage(t, fileInfos, 4)
+	defer storage.Close()
+	storage.maxOpen = 3
+
+	err := storage.SetFileSkipped(0, true)
+	if err != nil {
+		t.Fatalf("Failed to skip file: %s", err)
+	}
+	// The parts file is alternately the least and the most recently used handle.
+	// Repeated, since eviction depends on the map's iteration order
+	for round := 0; round < 20; round++ {
+		for i := 0; i < storage.PieceCount(); i++ {
+			err := storage.WriteBlock(i, 0, bytes.Repeat([]byte{byte(i)}, 4))
+			if err != nil {
+				t.Fatalf("Failed to write piece %d: %s", i, err)
+			}
+			if len(storage.handles) > 3 {
+				t.Fatalf("Expected at most 3 open files. Got: %d", len(storage.handles))
+			}
+		}
+		for i := storage.PieceCount() - 1; i >= 0; i-- {
+			data := make([]byte, 4)
+			err := storage.ReadBlock(i, 0, data)
+			if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{byte(i)}, 4)) {
+				t.Fatalf("Expected piece %d to be readable. Got: %v, %v", i, data, err)
+			}
+			if len(storage.handles) > 3 {
+				t.Fatalf("Expected at most 3 open files. Got: %d", len(storage.handles))
+			}
+		}
+	}
+}
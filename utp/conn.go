@@ -0,0 +1,648 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	_STATE_SYN_SENT = iota
+	_STATE_CONNECTED
+	_STATE_CLOSED
+)
+
+const (
+	// LEDBAT parameters
+	_TARGET_DELAY       = 100000
+	_MAX_CWND_INCREASE  = 3000
+	_MIN_WINDOW         = _MAX_PACKET_SIZE
+	_INITIAL_WINDOW     = _MAX_PACKET_SIZE * 10
+	_MAX_WINDOW         = 1024 * 1024
+	_BASE_DELAY_HISTORY = time.Minute
+
+	_RECV_BUFFER_SIZE    = 1024 * 1024
+	_SEND_BUFFER_SIZE    = 1024 * 1024
+	_MAX_REORDER         = 256
+	_INITIAL_TIMEOUT     = time.Second
+	_MIN_TIMEOUT         = time.Millisecond * 500
+	_MAX_TIMEOUT         = time.Second * 30
+	_MAX_RETRANSMISSIONS = 6
+	_DUPLICATE_ACKS      = 3
+)
+
+var (
+	errReset       = errors.New("uTP connection reset by peer")
+	errTimedOut    = errors.New("uTP connection timed out")
+	errConnClosed  = errors.New("Use of closed uTP connection")
+	errDialTimeout = errors.New("uTP dial timed out")
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+type outgoingPacket struct {
+	p             *packet
+	sentAt        time.Time
+	transmissions int
+	fastResent    bool
+}
+
+type Conn struct {
+	socket *Socket
+	remote *net.UDPAddr
+	recvID uint16
+	sendID uint16
+
+	mx          sync.Mutex
+	cond        *sync.Cond
+	state       int
+	err         error
+	synReceived bool
+	closing     bool
+	finSent     bool
+
+	seqNr     uint16
+	ackNr     uint16
+	replyDiff uint32
+
+	sendBuffer []byte
+	inFlight   []*outgoingPacket
+	curWindow  int
+	maxWindow  float64
+	peerWindow int
+	lastAck    uint16
+	dupAcks    int
+	lastLoss   time.Time
+
+	reorder      map[uint16]*packet
+	reorderBytes int
+	readBuffer   []byte
+	eof          bool
+
+	rtt             time.Duration
+	rttVar          time.Duration
+	rto             time.Duration
+	retransmissions int
+
+	baseDelays  [2]uint32
+	bucketStart time.Time
+	ourDelay    int64
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(socket *Socket, remote *net.UDPAddr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		socket:     socket,
+		remote:     remote,
+		recvID:     recvID,
+		sendID:     sendID,
+		state:      _STATE_SYN_SENT,
+		sendBuffer: make([]byte, 0),
+		inFlight:   make([]*outgoingPacket, 0),
+		maxWindow:  _INITIAL_WINDOW,
+		peerWindow: _RECV_BUFFER_SIZE,
+		reorder:    make(map[uint16]*packet),
+		readBuffer: make([]byte, 0),
+		rto:        _INITIAL_TIMEOUT,
+	}
+	c.cond = sync.NewCond(&c.mx)
+	return c
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mx.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	c.mx.Unlock()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mx.Lock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	c.mx.Unlock()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mx.Lock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	c.mx.Unlock()
+	return nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	for {
+		if c.closing {
+			return 0, errConnClosed
+		}
+		if len(c.readBuffer) > 0 {
+			n := copy(p, c.readBuffer)
+			c.readBuffer = c.readBuffer[n:]
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, &timeoutError{}
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	written := 0
+	for {
+		if c.closing {
+			return written, errConnClosed
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+		if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+			return written, &timeoutError{}
+		}
+
+		space := _SEND_BUFFER_SIZE - len(c.sendBuffer)
+		if space > 0 {
+			n := len(p) - written
+			if n > space {
+				n = space
+			}
+			c.sendBuffer = append(c.sendBuffer, p[written:written+n]...)
+			written += n
+			c.flush(time.Now())
+			if written == len(p) {
+				return written, nil
+			}
+		}
+		c.cond.Wait()
+	}
+}
+
+// Queued data is still delivered, followed by a FIN
+func (c *Conn) Close() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.closing || c.state == _STATE_CLOSED {
+		return nil
+	}
+	c.closing = true
+	if c.state == _STATE_SYN_SENT {
+		c.terminate(errConnClosed)
+	} else {
+		c.flush(time.Now())
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) connect(deadline time.Time) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.seqNr = 1
+	c.queue(_ST_SYN, nil, time.Now())
+
+	for c.state == _STATE_SYN_SENT {
+		if c.err != nil {
+			return c.err
+		}
+		if !time.Now().Before(deadline) {
+			c.terminate(errDialTimeout)
+			return errDialTimeout
+		}
+		c.cond.Wait()
+	}
+	return c.err
+}
+
+func (c *Conn) fail(err error) {
+	c.mx.Lock()
+	c.terminate(err)
+	c.mx.Unlock()
+}
+
+// Must be called with the mutex held
+func (c *Conn) terminate(err error) {
+	if c.state == _STATE_CLOSED {
+		return
+	}
+	c.state = _STATE_CLOSED
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+	go c.socket.remove(c)
+}
+
+func (c *Conn) handleSyn(p *packet, received uint32) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.state == _STATE_CLOSED {
+		return
+	}
+	if !c.synReceived {
+		c.synReceived = true
+		c.state = _STATE_CONNECTED
+		c.seqNr = uint16(rand.Intn(65536))
+		c.ackNr = p.seqNr
+		c.lastAck = c.seqNr - 1
+	}
+	c.replyDiff = received - p.timestamp
+	// Also answers retransmitted SYNs whose ack got lost
+	c.sendState()
+	c.flush(time.Now())
+}
+
+func (c *Conn) handlePacket(p *packet, received uint32) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.state == _STATE_CLOSED {
+		return
+	}
+	if p.packetType == _ST_RESET {
+		c.terminate(errReset)
+		return
+	}
+
+	now := time.Now()
+	c.replyDiff = received - p.timestamp
+	c.peerWindow = int(p.wndSize)
+
+	if c.state == _STATE_SYN_SENT {
+		if p.packetType != _ST_STATE {
+			return
+		}
+		c.state = _STATE_CONNECTED
+		c.ackNr = p.seqNr - 1
+		c.cond.Broadcast()
+	}
+
+	if p.timestampDiff != 0 {
+		c.updateDelay(p.timestampDiff, now)
+	}
+	c.processAck(p, now)
+
+	if p.packetType == _ST_DATA || p.packetType == _ST_FIN {
+		c.receive(p)
+		c.sendState()
+	}
+
+	c.flush(now)
+	if c.closing && c.finSent && len(c.inFlight) == 0 {
+		c.terminate(errConnClosed)
+	}
+}
+
+func (c *Conn) tick(now time.Time) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.state == _STATE_CLOSED {
+		return
+	}
+	// Waiters re-check their deadlines
+	c.cond.Broadcast()
+
+	if len(c.inFlight) > 0 && now.Sub(c.inFlight[0].sentAt) >= c.rto {
+		c.retransmissions++
+		if c.retransmissions > _MAX_RETRANSMISSIONS {
+			c.terminate(errTimedOut)
+			return
+		}
+
+		c.maxWindow = _MIN_WINDOW
+		c.rto *= 2
+		if c.rto > _MAX_TIMEOUT {
+			c.rto = _MAX_TIMEOUT
+		}
+		c.transmit(c.inFlight[0], now)
+	}
+
+	c.flush(now)
+}
+
+// Packetizes buffered data as far as the window allows. Must be called with the mutex held
+func (c *Conn) flush(now time.Time) {
+	if c.state != _STATE_CONNECTED {
+		return
+	}
+
+	window := int(c.maxWindow)
+	if c.peerWindow < window {
+		window = c.peerWindow
+	}
+
+	sent := false
+	for len(c.sendBuffer) > 0 && len(c.inFlight) < _MAX_REORDER {
+		size := len(c.sendBuffer)
+		if size > _MAX_PAYLOAD {
+			size = _MAX_PAYLOAD
+		}
+		// A single packet is always allowed in flight, which also probes closed windows
+		if c.curWindow > 0 && c.curWindow+size > window {
+			break
+		}
+
+		payload := make([]byte, size)
+		copy(payload, c.sendBuffer)
+		c.sendBuffer = c.sendBuffer[size:]
+		c.queue(_ST_DATA, payload, now)
+		sent = true
+	}
+	if sent {
+		c.cond.Broadcast()
+	}
+
+	if c.closing && !c.finSent && len(c.sendBuffer) == 0 {
+		c.finSent = true
+		c.queue(_ST_FIN, nil, now)
+	}
+}
+
+func (c *Conn) queue(packetType byte, payload []byte, now time.Time) {
+	connID := c.sendID
+	if packetType == _ST_SYN {
+		connID = c.recvID
+	}
+
+	o := &outgoingPacket{
+		p: &packet{
+			packetType: packetType,
+			connID:     connID,
+			seqNr:      c.seqNr,
+			payload:    payload,
+		},
+	}
+	c.seqNr++
+	c.inFlight = append(c.inFlight, o)
+	c.curWindow += len(payload)
+	c.transmit(o, now)
+}
+
+func (c *Conn) transmit(o *outgoingPacket, now time.Time) {
+	o.p.ackNr = c.ackNr
+	o.p.timestampDiff = c.replyDiff
+	o.p.wndSize = c.receiveWindow()
+	o.sentAt = now
+	o.transmissions++
+	c.socket.send(o.p, c.remote)
+}
+
+func (c *Conn) sendState() {
+	p := &packet{
+		packetType:    _ST_STATE,
+		connID:        c.sendID,
+		seqNr:         c.seqNr,
+		ackNr:         c.ackNr,
+		timestampDiff: c.replyDiff,
+		wndSize:       c.receiveWindow(),
+		sack:          c.selectiveAck(),
+	}
+	c.socket.send(p, c.remote)
+}
+
+func (c *Conn) receiveWindow() uint32 {
+	free := _RECV_BUFFER_SIZE - len(c.readBuffer) - c.reorderBytes
+	if free < 0 {
+		return 0
+	}
+	return uint32(free)
+}
+
+// Bit i of the mask acknowledges ackNr + 2 + i, least significant bit first
+func (c *Conn) selectiveAck() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+
+	var mask [_MAX_REORDER / 8]byte
+	highest := 0
+	for seq := range c.reorder {
+		index := int(seq - c.ackNr - 2)
+		if index < 0 || index >= len(mask)*8 {
+			continue
+		}
+		mask[index/8] |= 1 << uint(index%8)
+		if index > highest {
+			highest = index
+		}
+	}
+
+	length := (highest/32 + 1) * 4
+	return mask[:length]
+}
+
+func (c *Conn) receive(p *packet) {
+	if !seqLess(c.ackNr, p.seqNr) {
+		return
+	}
+	if p.seqNr-c.ackNr > _MAX_REORDER {
+		return
+	}
+	if _, exists := c.reorder[p.seqNr]; !exists {
+		c.reorder[p.seqNr] = p
+		c.reorderBytes += len(p.payload)
+	}
+
+	delivered := false
+	for {
+		next, exists := c.reorder[c.ackNr+1]
+		if !exists {
+			break
+		}
+		delete(c.reorder, c.ackNr+1)
+		c.reorderBytes -= len(next.payload)
+		c.ackNr++
+
+		if next.packetType == _ST_FIN {
+			c.eof = true
+			c.reorder = make(map[uint16]*packet)
+			c.reorderBytes = 0
+			delivered = true
+			break
+		}
+		c.readBuffer = append(c.readBuffer, next.payload...)
+		delivered = true
+	}
+
+	if delivered {
+		c.cond.Broadcast()
+	}
+}
+
+func (c *Conn) processAck(p *packet, now time.Time) {
+	ackNr, sack := p.ackNr, p.sack
+	ackedBytes := 0
+	progress := false
+
+	for len(c.inFlight) > 0 && !seqLess(ackNr, c.inFlight[0].p.seqNr) {
+		o := c.inFlight[0]
+		c.inFlight = c.inFlight[1:]
+		c.acked(o, now)
+		ackedBytes += len(o.p.payload)
+		progress = true
+	}
+
+	if sack != nil && len(c.inFlight) > 0 {
+		remaining := make([]*outgoingPacket, 0, len(c.inFlight))
+		sackedAfter := 0
+		// Walk backwards, so the number of selectively acked packets after each one is known
+		for i := len(c.inFlight) - 1; i >= 0; i-- {
+			o := c.inFlight[i]
+			index := int(o.p.seqNr - ackNr - 2)
+			if index >= 0 && index < len(sack)*8 && sack[index/8]&(1<<uint(index%8)) != 0 {
+				c.acked(o, now)
+				ackedBytes += len(o.p.payload)
+				sackedAfter++
+				progress = true
+				continue
+			}
+			if sackedAfter >= _DUPLICATE_ACKS && !o.fastResent {
+				o.fastResent = true
+				c.lost(now)
+				c.transmit(o, now)
+			}
+			remaining = append(remaining, o)
+		}
+		for i, j := 0, len(remaining)-1; i < j; i, j = i+1, j-1 {
+			remaining[i], remaining[j] = remaining[j], remaining[i]
+		}
+		c.inFlight = remaining
+	}
+
+	// Data packets repeat the ack while the peer is sending, only bare acks count as duplicates
+	if !progress && p.packetType == _ST_STATE && ackNr == c.lastAck && len(c.inFlight) > 0 {
+		c.dupAcks++
+		if c.dupAcks == _DUPLICATE_ACKS && !c.inFlight[0].fastResent {
+			c.inFlight[0].fastResent = true
+			c.lost(now)
+			c.transmit(c.inFlight[0], now)
+		}
+	} else if progress {
+		c.dupAcks = 0
+	}
+	c.lastAck = ackNr
+
+	if progress {
+		c.retransmissions = 0
+		c.updateTimeout()
+		c.updateWindow(ackedBytes)
+		c.cond.Broadcast()
+	}
+}
+
+func (c *Conn) acked(o *outgoingPacket, now time.Time) {
+	c.curWindow -= len(o.p.payload)
+	// Karn's algorithm, retransmitted packets give ambiguous samples
+	if o.transmissions == 1 {
+		c.sampleRTT(now.Sub(o.sentAt))
+	}
+}
+
+func (c *Conn) sampleRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+		return
+	}
+
+	diff := c.rtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	c.rttVar += (diff - c.rttVar) / 4
+	c.rtt += (sample - c.rtt) / 8
+}
+
+func (c *Conn) updateTimeout() {
+	if c.rtt == 0 {
+		c.rto = _INITIAL_TIMEOUT
+		return
+	}
+	c.rto = c.rtt + c.rttVar*4
+	if c.rto < _MIN_TIMEOUT {
+		c.rto = _MIN_TIMEOUT
+	}
+}
+
+// Halves the window at most once per round trip
+func (c *Conn) lost(now time.Time) {
+	if now.Sub(c.lastLoss) < c.rtt {
+		return
+	}
+	c.lastLoss = now
+	c.maxWindow /= 2
+	if c.maxWindow < _MIN_WINDOW {
+		c.maxWindow = _MIN_WINDOW
+	}
+}
+
+// One way delay samples, relative to the lowest delay seen in the last couple of minutes
+func (c *Conn) updateDelay(sample uint32, now time.Time) {
+	if c.bucketStart.IsZero() || now.Sub(c.bucketStart) >= _BASE_DELAY_HISTORY {
+		c.baseDelays[1] = c.baseDelays[0]
+		c.baseDelays[0] = sample
+		c.bucketStart = now
+	} else if sample < c.baseDelays[0] {
+		c.baseDelays[0] = sample
+	}
+
+	base := c.baseDelays[0]
+	if c.baseDelays[1] != 0 && c.baseDelays[1] < base {
+		base = c.baseDelays[1]
+	}
+	c.ourDelay = int64(sample - base)
+}
+
+// LEDBAT: grows the window while queuing delay is below target, shrinks it above
+func (c *Conn) updateWindow(ackedBytes int) {
+	offTarget := float64(_TARGET_DELAY - c.ourDelay)
+	delayFactor := offTarget / _TARGET_DELAY
+	windowFactor := float64(ackedBytes) / c.maxWindow
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+
+	c.maxWindow += _MAX_CWND_INCREASE * delayFactor * windowFactor
+	if c.maxWindow < _MIN_WINDOW {
+		c.maxWindow = _MIN_WINDOW
+	}
+	if c.maxWindow > _MAX_WINDOW {
+		c.maxWindow = _MAX_WINDOW
+	}
+}
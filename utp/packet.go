@@ -0,0 +1,110 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	_ST_DATA  = 0
+	_ST_FIN   = 1
+	_ST_STATE = 2
+	_ST_RESET = 3
+	_ST_SYN   = 4
+
+	_VERSION         = 1
+	_HEADER_LENGTH   = 20
+	_EXTENSION_SACK  = 1
+	_MAX_PACKET_SIZE = 1400
+	_MAX_PAYLOAD     = _MAX_PACKET_SIZE - _HEADER_LENGTH
+)
+
+type packet struct {
+	packetType    byte
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+	// Selective ack bitmask. Bit i acknowledges ackNr + 2 + i
+	sack    []byte
+	payload []byte
+}
+
+func (p *packet) encode() []byte {
+	length := _HEADER_LENGTH + len(p.payload)
+	if p.sack != nil {
+		length += 2 + len(p.sack)
+	}
+	data := make([]byte, length)
+
+	data[0] = p.packetType<<4 | _VERSION
+	binary.BigEndian.PutUint16(data[2:4], p.connID)
+	binary.BigEndian.PutUint32(data[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(data[8:12], p.timestampDiff)
+	binary.BigEndian.PutUint32(data[12:16], p.wndSize)
+	binary.BigEndian.PutUint16(data[16:18], p.seqNr)
+	binary.BigEndian.PutUint16(data[18:20], p.ackNr)
+
+	offset := _HEADER_LENGTH
+	if p.sack != nil {
+		data[1] = _EXTENSION_SACK
+		data[offset] = 0
+		data[offset+1] = byte(len(p.sack))
+		copy(data[offset+2:], p.sack)
+		offset += 2 + len(p.sack)
+	}
+	copy(data[offset:], p.payload)
+
+	return data
+}
+
+// Whether the datagram looks like uTP, as opposed to e.g. DHT traffic sharing the socket
+func isPacket(data []byte) bool {
+	return len(data) >= _HEADER_LENGTH && data[0]&0x0f == _VERSION && data[0]>>4 <= _ST_SYN
+}
+
+func decodePacket(data []byte) (*packet, error) {
+	if !isPacket(data) {
+		return nil, errors.New("Not a uTP packet")
+	}
+
+	p := &packet{
+		packetType:    data[0] >> 4,
+		connID:        binary.BigEndian.Uint16(data[2:4]),
+		timestamp:     binary.BigEndian.Uint32(data[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(data[8:12]),
+		wndSize:       binary.BigEndian.Uint32(data[12:16]),
+		seqNr:         binary.BigEndian.Uint16(data[16:18]),
+		ackNr:         binary.BigEndian.Uint16(data[18:20]),
+	}
+
+	extension := data[1]
+	offset := _HEADER_LENGTH
+	for extension != 0 {
+		if len(data) < offset+2 {
+			return nil, errors.New("Truncated extension header")
+		}
+		next, length := data[offset], int(data[offset+1])
+		if len(data) < offset+2+length {
+			return nil, fmt.Errorf("Truncated extension %d", extension)
+		}
+		if extension == _EXTENSION_SACK {
+			if length == 0 || length%4 != 0 {
+				return nil, fmt.Errorf("Invalid selective ack length: %d", length)
+			}
+			p.sack = data[offset+2 : offset+2+length]
+		}
+		extension = next
+		offset += 2 + length
+	}
+	p.payload = data[offset:]
+
+	return p, nil
+}
+
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
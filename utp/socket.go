@@ -0,0 +1,262 @@
+package utp
+
+import (
+	"errors"
+	"fmt"
+	"gobby/logs"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	_ACCEPT_BACKLOG = 32
+	_TICK_INTERVAL  = time.Millisecond * 20
+	_DIAL_TIMEOUT   = time.Second * 10
+)
+
+var errClosed = errors.New("Use of closed uTP socket")
+
+// Multiplexes uTP connections (BEP 29) over a single UDP socket.
+// Datagrams that aren't uTP are passed to the handler set by HandleOther, so the socket can be shared with the DHT
+type Socket struct {
+	conn      net.PacketConn
+	mx        sync.Mutex
+	conns     map[string]*Conn
+	other     func(data []byte, from net.Addr)
+	acceptCh  chan *Conn
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	start     time.Time
+}
+
+func Listen(network, address string) (*Socket, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open UDP socket: %s", err)
+	}
+	return NewSocket(conn), nil
+}
+
+func NewSocket(conn net.PacketConn) *Socket {
+	s := &Socket{
+		conn:     conn,
+		conns:    make(map[string]*Conn),
+		acceptCh: make(chan *Conn, _ACCEPT_BACKLOG),
+		closeCh:  make(chan struct{}),
+		start:    time.Now(),
+	}
+	go s.receiving()
+	go s.ticking()
+	return s
+}
+
+func (s *Socket) HandleOther(handler func(data []byte, from net.Addr)) {
+	s.mx.Lock()
+	s.other = handler
+	s.mx.Unlock()
+}
+
+// For other protocols sharing the socket
+func (s *Socket) WriteTo(data []byte, addr net.Addr) (int, error) {
+	return s.conn.WriteTo(data, addr)
+}
+
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.acceptCh:
+		return conn, nil
+	case <-s.closeCh:
+		return nil, errClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Socket) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		s.mx.Lock()
+		for _, conn := range s.conns {
+			conn.fail(errClosed)
+		}
+		s.conns = make(map[string]*Conn)
+		s.mx.Unlock()
+		s.conn.Close()
+	})
+	return nil
+}
+
+func (s *Socket) Dial(address string) (net.Conn, error) {
+	return s.DialTimeout(address, _DIAL_TIMEOUT)
+}
+
+func (s *Socket) DialTimeout(address string, timeout time.Duration) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve %s: %s", address, err)
+	}
+
+	s.mx.Lock()
+	select {
+	case <-s.closeCh:
+		s.mx.Unlock()
+		return nil, errClosed
+	default:
+	}
+	var recvID uint16
+	for {
+		recvID = uint16(rand.Intn(65535))
+		if _, exists := s.conns[connKey(addr, recvID)]; !exists {
+			break
+		}
+	}
+	conn := newConn(s, addr, recvID, recvID+1)
+	s.conns[connKey(addr, recvID)] = conn
+	s.mx.Unlock()
+
+	err = conn.connect(time.Now().Add(timeout))
+	if err != nil {
+		s.remove(conn)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *Socket) remove(conn *Conn) {
+	s.mx.Lock()
+	key := connKey(conn.remote, conn.recvID)
+	if s.conns[key] == conn {
+		delete(s.conns, key)
+	}
+	s.mx.Unlock()
+}
+
+func (s *Socket) send(p *packet, addr net.Addr) {
+	p.timestamp = s.timestamp()
+	_, err := s.conn.WriteTo(p.encode(), addr)
+	if err != nil {
+		select {
+		case <-s.closeCh:
+		default:
+			logs.Debug("uTP", "Failed to send packet to %s: %s", addr.String(), err)
+		}
+	}
+}
+
+func (s *Socket) timestamp() uint32 {
+	return uint32(time.Since(s.start) / time.Microsecond)
+}
+
+func (s *Socket) receiving() {
+	data := make([]byte, 64*1024)
+
+	for {
+		rc, from, err := s.conn.ReadFrom(data)
+		if err != nil {
+			select {
+			case <-s.closeCh:
+			default:
+				logs.Warn("uTP", "Failed to read from socket: %s", err)
+				s.Close()
+			}
+			return
+		}
+		received := s.timestamp()
+
+		if !isPacket(data[:rc]) {
+			s.mx.Lock()
+			other := s.other
+			s.mx.Unlock()
+			if other != nil {
+				datagram := make([]byte, rc)
+				copy(datagram, data[:rc])
+				other(datagram, from)
+			}
+			continue
+		}
+
+		p, err := decodePacket(data[:rc])
+		if err != nil {
+			logs.Debug("uTP", "Invalid packet from %s: %s", from.String(), err)
+			continue
+		}
+		// The payload is retained by the connection
+		p.payload = append([]byte(nil), p.payload...)
+		p.sack = append([]byte(nil), p.sack...)
+		s.dispatch(p, from, received)
+	}
+}
+
+func (s *Socket) dispatch(p *packet, from net.Addr, received uint32) {
+	addr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	s.mx.Lock()
+	if p.packetType == _ST_SYN {
+		key := connKey(addr, p.connID+1)
+		conn, exists := s.conns[key]
+		if !exists {
+			conn = newConn(s, addr, p.connID+1, p.connID)
+			select {
+			case <-s.closeCh:
+				s.mx.Unlock()
+				return
+			default:
+			}
+			if len(s.acceptCh) == cap(s.acceptCh) {
+				s.mx.Unlock()
+				s.send(&packet{packetType: _ST_RESET, connID: p.connID, ackNr: p.seqNr}, addr)
+				return
+			}
+			s.conns[key] = conn
+			s.acceptCh <- conn
+		}
+		s.mx.Unlock()
+		conn.handleSyn(p, received)
+		return
+	}
+
+	conn, exists := s.conns[connKey(addr, p.connID)]
+	s.mx.Unlock()
+	if !exists {
+		if p.packetType != _ST_RESET {
+			s.send(&packet{packetType: _ST_RESET, connID: p.connID, ackNr: p.seqNr}, addr)
+		}
+		return
+	}
+
+	conn.handlePacket(p, received)
+}
+
+func (s *Socket) ticking() {
+	ticker := time.NewTicker(_TICK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mx.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, conn := range s.conns {
+				conns = append(conns, conn)
+			}
+			s.mx.Unlock()
+
+			for _, conn := range conns {
+				conn.tick(now)
+			}
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+func connKey(addr *net.UDPAddr, id uint16) string {
+	return fmt.Sprintf("%s/%d", addr.String(), id)
+}
@@ -0,0 +1,296 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Drops and reorders outgoing datagrams deterministically
+type lossyConn struct {
+	net.PacketConn
+	mx       sync.Mutex
+	random   *rand.Rand
+	loss     float64
+	reorder  float64
+	held     []byte
+	heldAddr net.Addr
+}
+
+func (c *lossyConn) WriteTo(data []byte, addr net.Addr) (int, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.random.Float64() < c.loss {
+		return len(data), nil
+	}
+	if c.held == nil && c.random.Float64() < c.reorder {
+		c.held = append([]byte(nil), data...)
+		c.heldAddr = addr
+		return len(data), nil
+	}
+
+	n, err := c.PacketConn.WriteTo(data, addr)
+	if c.held != nil {
+		c.PacketConn.WriteTo(c.held, c.heldAddr)
+		c.held = nil
+	}
+	return n, err
+}
+
+func newSocket(t *testing.T, loss, reorder float64, seed int64) *Socket {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to open UDP socket: %s", err)
+	}
+	return NewSocket(&lossyConn{
+		PacketConn: conn,
+		random:     rand.New(rand.NewSource(seed)),
+		loss:       loss,
+		reorder:    reorder,
+	})
+}
+
+func transfer(t *testing.T, server, client *Socket, size int) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			t.Errorf("Failed to accept: %s", err)
+			close(acceptedCh)
+			return
+		}
+		acceptedCh <- conn
+	}()
+
+	conn, err := client.Dial(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	go func() {
+		conn.Write(data)
+		conn.Close()
+	}()
+
+	accepted := <-acceptedCh
+	if accepted == nil {
+		t.FailNow()
+	}
+	defer accepted.Close()
+	accepted.SetReadDeadline(time.Now().Add(time.Second * 20))
+
+	received, err := ioutil.ReadAll(accepted)
+	if err != nil {
+		t.Fatalf("Failed to read: %s", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("Data missmatch. Expected %d bytes. Got: %d", len(data), len(received))
+	}
+}
+
+func TestPacketEncodeDecode(t *testing.T) {
+	p := &packet{
+		packetType:    _ST_STATE,
+		connID:        1234,
+		timestamp:     1000,
+		timestampDiff: 20,
+		wndSize:       65536,
+		seqNr:         7,
+		ackNr:         65535,
+		sack:          []byte{0x05, 0, 0, 0x80},
+		payload:       []byte("spam"),
+	}
+
+	data := p.encode()
+	if !isPacket(data) {
+		t.Fatalf("Expected encoded packet to be recognized")
+	}
+	decoded, err := decodePacket(data)
+	if err != nil {
+		t.Fatalf("Failed to decode packet: %s", err)
+	}
+	if decoded.packetType != p.packetType || decoded.connID != p.connID || decoded.timestamp != p.timestamp ||
+		decoded.timestampDiff != p.timestampDiff || decoded.wndSize != p.wndSize ||
+		decoded.seqNr != p.seqNr || decoded.ackNr != p.ackNr {
+		t.Fatalf("Header missmatch. Expected %+v. Got: %+v", p, decoded)
+	}
+	if !bytes.Equal(decoded.sack, p.sack) {
+		t.Fatalf("Expected sack %v. Got: %v", p.sack, decoded.sack)
+	}
+	if !bytes.Equal(decoded.payload, p.payload) {
+		t.Fatalf("Expected payload %s. Got: %s", p.payload, decoded.payload)
+	}
+}
+
+func TestDecodeInvalidPacket(t *testing.T) {
+	inputs := [][]byte{
+		nil,
+		[]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"),
+		append([]byte{0x21, 1}, make([]byte, 18)...),
+		append(append([]byte{0x21, 1}, make([]byte, 18)...), 0, 3, 1, 2, 3),
+	}
+
+	for _, input := range inputs {
+		if _, err := decodePacket(input); err == nil {
+			t.Fatalf("Expected error for input: %v", input)
+		}
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	if !seqLess(1, 2) || seqLess(2, 1) || seqLess(3, 3) {
+		t.Fatalf("Invalid ordering of plain sequence numbers")
+	}
+	if !seqLess(65535, 0) || seqLess(0, 65535) {
+		t.Fatalf("Invalid ordering across wraparound")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	server := newSocket(t, 0, 0, 1)
+	defer server.Close()
+	client := newSocket(t, 0, 0, 2)
+	defer client.Close()
+
+	transfer(t, server, client, 1024*1024)
+}
+
+func TestTransferLossyReordering(t *testing.T) {
+	server := newSocket(t, 0.05, 0.1, 3)
+	defer server.Close()
+	client := newSocket(t, 0.05, 0.1, 4)
+	defer client.Close()
+
+	transfer(t, server, client, 256*1024)
+}
+
+func TestSelectiveAck(t *testing.T) {
+	socket := newSocket(t, 0, 0, 5)
+	defer socket.Close()
+	c := newConn(socket, socket.Addr().(*net.UDPAddr), 1, 2)
+	c.state = _STATE_CONNECTED
+	c.ackNr = 10
+
+	for _, seq := range []uint16{12, 13, 44} {
+		c.receive(&packet{packetType: _ST_DATA, seqNr: seq, payload: []byte{byte(seq)}})
+	}
+	sack := c.selectiveAck()
+	expected := []byte{0x03, 0, 0, 0, 0x01, 0, 0, 0}
+	if !bytes.Equal(sack, expected) {
+		t.Fatalf("Expected sack %v. Got: %v", expected, sack)
+	}
+
+	c.receive(&packet{packetType: _ST_DATA, seqNr: 11, payload: []byte{11}})
+	if c.ackNr != 13 {
+		t.Fatalf("Expected ack 13. Got: %d", c.ackNr)
+	}
+	if !bytes.Equal(c.readBuffer, []byte{11, 12, 13}) {
+		t.Fatalf("Expected in order data. Got: %v", c.readBuffer)
+	}
+}
+
+func TestEOFAfterClose(t *testing.T) {
+	server := newSocket(t, 0, 0, 6)
+	defer server.Close()
+	client := newSocket(t, 0, 0, 7)
+	defer client.Close()
+
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := server.Accept()
+		acceptedCh <- conn
+	}()
+
+	conn, err := client.Dial(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	accepted := <-acceptedCh
+	conn.Close()
+
+	accepted.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = accepted.Read(make([]byte, 10))
+	if err != io.EOF {
+		t.Fatalf("Expected EOF. Got: %v", err)
+	}
+	accepted.Close()
+
+	if _, err := conn.Write([]byte("spam")); err == nil {
+		t.Fatalf("Expected error writing to closed connection")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	server := newSocket(t, 0, 0, 8)
+	defer server.Close()
+	client := newSocket(t, 0, 0, 9)
+	defer client.Close()
+
+	conn, err := client.Dial(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err = conn.Read(make([]byte, 10))
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() {
+		t.Fatalf("Expected timeout error. Got: %v", err)
+	}
+}
+
+func TestDialUnreachable(t *testing.T) {
+	client := newSocket(t, 0, 0, 10)
+	defer client.Close()
+
+	// Every datagram gets lost
+	silent := newSocket(t, 1, 0, 11)
+	defer silent.Close()
+
+	_, err := client.DialTimeout(silent.Addr().String(), time.Millisecond*200)
+	if err == nil {
+		t.Fatalf("Expected dial to fail")
+	}
+}
+
+func TestHandleOther(t *testing.T) {
+	socket := newSocket(t, 0, 0, 12)
+	defer socket.Close()
+
+	receivedCh := make(chan []byte, 1)
+	socket.HandleOther(func(data []byte, from net.Addr) {
+		receivedCh <- data
+	})
+
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to open UDP socket: %s", err)
+	}
+	defer sender.Close()
+
+	message := []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")
+	sender.WriteTo(message, socket.Addr())
+
+	select {
+	case data := <-receivedCh:
+		if !bytes.Equal(data, message) {
+			t.Fatalf("Expected %s. Got: %s", message, data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for datagram")
+	}
+}
+
+func TestSocketIsListener(t *testing.T) {
+	var listener net.Listener = newSocket(t, 0, 0, 13)
+	listener.Close()
+}